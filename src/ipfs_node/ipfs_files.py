@@ -9,7 +9,7 @@ import threading
 from dataclasses import dataclass
 from pathlib import Path
 from typing import Optional, Union, List, Dict, Any, Callable, Tuple, Iterator, Set
-from libkubo import libkubo, c_str, c_bool, from_c_str, ffi
+from libkubo import libkubo, c_str, c_bool, from_c_str, ffi, last_error
 
 from ipfs_tk_generics.files import BaseFiles
 
@@ -61,12 +61,14 @@ class NodeFiles(BaseFiles):
 
     def publish(self, file_path: str, *args, **kwargs) -> str:
         return self._add(file_path)
-    def _add(self, file_path: str, only_hash: bool = False, *args, **kwargs) -> str:
+    def _add(self, file_path: str, only_hash: bool = False, announce: bool = False, *args, **kwargs) -> str:
         """
         Add a file to IPFS.
 
         Args:
             file_path: Path to the file to add.
+            only_hash: Only compute the CID without storing the content.
+            announce: Provide the CID to the DHT immediately after adding.
 
         Returns:
             str: The CID (Content Identifier) of the added file.
@@ -78,10 +80,13 @@ class NodeFiles(BaseFiles):
         file_path_c = c_str(os.path.abspath(file_path).encode('utf-8'))
 
         try:
+            # Discard errors left over from earlier calls
+            last_error()
             cid_ptr = libkubo.AddFile(
-                repo_path, file_path_c, c_bool(only_hash))
+                repo_path, file_path_c, c_bool(only_hash), c_bool(announce))
             if not cid_ptr:
-                raise RuntimeError("Failed to add file to IPFS")
+                raise RuntimeError(
+                    f"Failed to add file to IPFS: {last_error()}")
 
             # Copy the string content before freeing the pointer
             cid = from_c_str(cid_ptr)
@@ -101,7 +106,7 @@ class NodeFiles(BaseFiles):
             # Handle any exceptions during the process
             raise RuntimeError(f"Error adding file to IPFS: {e}")
 
-    def download(self, cid: str, dest_path: str=".", **kwargs) -> bool:
+    def download(self, cid: str, dest_path: str=".", pin: bool = False, verify: bool = False, **kwargs) -> bool:
         """
         Retrieve a file or directory from IPFS by its CID.
 
@@ -112,6 +117,9 @@ class NodeFiles(BaseFiles):
                        - For a directory: The path where the directory and its contents
                          will be placed. All directory contents will be created inside 
                          this path.
+            pin: Pin the content once it has been retrieved.
+            verify: Check the written output against the CID once it is
+                    complete.
 
         Returns:
             bool: True if the content was successfully retrieved, False otherwise.
@@ -122,14 +130,46 @@ class NodeFiles(BaseFiles):
             cid_c = c_str(cid.encode('utf-8'))
             dest_path_c = c_str(os.path.abspath(dest_path).encode('utf-8'))
 
-            result = libkubo.Download(repo_path, cid_c, dest_path_c)
+            result = libkubo.Download(repo_path, cid_c, dest_path_c, c_bool(pin), c_bool(verify))
 
             return result == 0
         except Exception as e:
             # Handle any exceptions during the process
             raise RuntimeError(f"Error retrieving file from IPFS: {e}")
 
-    def pin(self, cid: str, recursive: bool = True) -> bool:
+    def download_to_file(self, cid: str, file) -> bool:
+        """
+        Write the content of a file on IPFS to an open file, pipe or socket.
+
+        Args:
+            cid: The Content Identifier of the file to retrieve.
+            file: A file descriptor, or an object with a fileno() method such
+                  as an open binary file or socket. Content is written at its
+                  current position, and it is left open.
+
+        Returns:
+            bool: True if the content was successfully written, False otherwise.
+        """
+        try:
+            if hasattr(file, "flush"):
+                # Buffered data must come before the content
+                file.flush()
+            fd = file if isinstance(file, int) else file.fileno()
+            if platform.system() == "Windows":
+                import msvcrt
+                fd = msvcrt.get_osfhandle(fd)
+
+            repo_path = c_str(self._repo_path.encode('utf-8'))
+            cid_c = c_str(cid.encode('utf-8'))
+
+            result = libkubo.DownloadToFD(repo_path, cid_c, fd)
+
+            return result == 0
+        except Exception as e:
+            # Handle any exceptions during the process
+            raise RuntimeError(f"Error retrieving file from IPFS: {e}")
+
+    def pin(self, cid: str, recursive: bool = True, name: Optional[str] = None) -> bool:
         """
         Pin a CID to the local IPFS node.
 
@@ -137,6 +177,8 @@ class NodeFiles(BaseFiles):
             cid: The Content Identifier to pin.
             recursive: Whether to recursively pin the object and its references.
                       Currently, only recursive pinning is supported.
+            name: Optional label for the pin, returned by list_pins_info.
+                  Pinning again with a name replaces it, an empty name removes it.
 
         Returns:
             bool: True if the CID was successfully pinned, False otherwise.
@@ -145,7 +187,12 @@ class NodeFiles(BaseFiles):
             repo_path = c_str(self._repo_path.encode('utf-8'))
             cid_c = c_str(cid.encode('utf-8'))
 
-            result = libkubo.PinCID(repo_path, cid_c)
+            if name is None:
+                result = libkubo.PinCID(repo_path, cid_c)
+            else:
+                result = libkubo.PinCIDNamed(
+                    repo_path, cid_c, c_str(name.encode('utf-8'))
+                )
 
             return result == 0
         except Exception as e:
@@ -182,12 +229,25 @@ class NodeFiles(BaseFiles):
         Returns:
             list[str]: A list of pinned CIDs.
         """
+        return [pin["cid"] for pin in self.list_pins_info()]
+
+    def list_pins_info(self) -> list[dict]:
+        """
+        List all pins in the local IPFS node with their names and types.
+
+        Returns:
+            list[dict]: A list of dictionaries with the keys "cid", "name"
+                (empty for unnamed pins) and "type" ("recursive", "direct"
+                or "indirect").
+        """
         try:
             repo_path = c_str(self._repo_path.encode('utf-8'))
 
+            # Discard errors left over from earlier calls
+            last_error()
             pins_json_ptr = libkubo.ListPins(repo_path)
             if not pins_json_ptr:
-                raise RuntimeError("Failed to list pins")
+                raise RuntimeError(f"Failed to list pins: {last_error()}")
 
             # Copy the string content before freeing the pointer
             pins_json = from_c_str(pins_json_ptr)
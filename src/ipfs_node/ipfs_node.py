@@ -24,7 +24,7 @@ class IpfsNode(IpfsClient):
     through the Kubo implementation.
     """
 
-    def __init__(self, repo_path: Optional[str] = None, online: bool = True, enable_pubsub: bool = True):
+    def __init__(self, repo_path: Optional[str] = None, online: bool = True, enable_pubsub: bool = True, repo_profile: str = "", passphrase: Optional[str] = None, blocks_path: Optional[str] = None):
         """
         Initialize an IPFS node with a specific repository path.
 
@@ -33,11 +33,22 @@ class IpfsNode(IpfsClient):
                        repository will be created.
             online: Whether the node should connect to the IPFS network.
             enable_pubsub: Whether to enable pubsub functionality.
+            repo_profile: Comma-separated Kubo config profiles to apply when
+                          creating a new repository, e.g. "badgerds" or
+                          "lowpower". Ignored for existing repositories.
+            passphrase: Encrypt a new repository's datastore with this
+                        passphrase, or unlock an existing encrypted one.
+            blocks_path: Store a new repository's blocks in this directory
+                         instead of inside the repository, e.g. on an SD
+                         card. Can't be combined with passphrase.
         """
         self._temp_dir = None
         self._repo_path = repo_path
         self._online = online
         self._enable_pubsub = enable_pubsub
+        self._repo_profile = repo_profile
+        self._passphrase = passphrase
+        self._blocks_path = blocks_path
         self._peer_id = None  # Will be set when connecting to the network
         # If no repo path is provided, create a temporary directory
         if self._repo_path is None:
@@ -50,6 +61,8 @@ class IpfsNode(IpfsClient):
             self._init_repo()
         else:
             print("Loading existing IPFS repo")
+            if self._passphrase is not None:
+                self._unlock_repo()
         libkubo.RunNode(c_str(self._repo_path.encode('utf-8')))
 
         # Get the node ID if online
@@ -84,13 +97,36 @@ class IpfsNode(IpfsClient):
     def _init_repo(self):
         """Initialize the IPFS repository."""
         repo_path = c_str(self._repo_path.encode('utf-8'))
-        result = libkubo.CreateRepo(repo_path)
+        profile = c_str(self._repo_profile.encode('utf-8'))
+        if self._passphrase is not None:
+            if self._blocks_path is not None:
+                raise ValueError(
+                    "blocks_path can't be combined with passphrase")
+            result = libkubo.CreateEncryptedRepo(
+                repo_path, profile, c_str(self._passphrase.encode('utf-8')))
+        elif self._blocks_path is not None:
+            result = libkubo.CreateRepoWithBlocksPath(
+                repo_path, profile, c_str(self._blocks_path.encode('utf-8')))
+        else:
+            result = libkubo.CreateRepo(repo_path, profile)
 
         if result < 0:
             raise RuntimeError(
                 f"Failed to initialize IPFS repository: {result}")
         # print(f"Initalised repo at: {repo_path}")
 
+    def _unlock_repo(self):
+        """Unlock the encrypted IPFS repository with the passphrase."""
+        repo_path = c_str(self._repo_path.encode('utf-8'))
+        passphrase = c_str(self._passphrase.encode('utf-8'))
+        result = libkubo.UnlockRepo(repo_path, passphrase)
+
+        if result == -3:
+            raise ValueError("Wrong passphrase for the IPFS repository")
+        if result < 0:
+            raise RuntimeError(
+                f"Failed to unlock IPFS repository: {result}")
+
 
 
 
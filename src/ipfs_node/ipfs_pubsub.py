@@ -11,7 +11,7 @@ from dataclasses import dataclass
 from pathlib import Path
 from typing import Optional, Union, List, Dict, Any, Callable, Tuple, Iterator, Set
 import base64
-from base64 import urlsafe_b64decode, urlsafe_b64encode
+from base64 import b64decode, urlsafe_b64encode
 from libkubo import libkubo, c_str, from_c_str, ffi
 
 
@@ -51,8 +51,8 @@ class IPFSMessage:
 
         data = json.loads(json_data)
 
-        # decode data field
-        data_bytes = bytes(urlsafe_b64decode(data.get('data')))
+        # decode data field (standard base64, as encoded by Go's encoding/json)
+        data_bytes = bytes(b64decode(data.get('data') or ""))
 
         # Convert seqno field back to bytes
         seqno = None
@@ -258,6 +258,8 @@ class NodePubsub(BasePubSub):
         topic_c = c_str(topic.encode('utf-8'))
 
         sub_id = libkubo.PubSubSubscribe(repo_path, topic_c)
+        if sub_id == -3:
+            raise RuntimeError("PubSub is not enabled on the running node")
         if sub_id < 0:
             raise RuntimeError(f"Failed to subscribe to topic: {topic}")
 
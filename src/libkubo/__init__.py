@@ -1 +1 @@
-from .libkubo_loader import libkubo, c_str, from_c_str, ffi, c_bool
\ No newline at end of file
+from .libkubo_loader import libkubo, c_str, from_c_str, ffi, c_bool, last_error
\ No newline at end of file
@@ -0,0 +1,699 @@
+package main
+
+// #include <stdint.h>
+// #include <stdlib.h>
+import "C"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	gopath "path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	chunker "github.com/ipfs/boxo/chunker"
+	iface "github.com/ipfs/boxo/coreiface"
+	"github.com/ipfs/boxo/coreiface/options"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/files"
+	dag "github.com/ipfs/boxo/ipld/merkledag"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/balanced"
+	"github.com/ipfs/boxo/ipld/unixfs/importer/helpers"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// AddOptions controls how content is chunked and hashed when it is added.
+// Adding the same content with the same options always yields the same CID:
+// directory entries are added in sorted order and, unless PreserveMode,
+// PreserveMtime or FixedMtime is set, no Unixfs mode/mtime metadata is
+// written, so the CID depends on file contents and names only. With
+// PreserveMtime, it also depends on the modification times in the file
+// system, so the same content added from another copy gets another CID.
+type AddOptions struct {
+	CidVersion   *int   `json:"cidVersion,omitempty"`
+	HashFunction string `json:"hashFunction,omitempty"`
+	Chunker      string `json:"chunker,omitempty"`
+	RawLeaves    *bool  `json:"rawLeaves,omitempty"`
+	Trickle      bool   `json:"trickle,omitempty"`
+	Inline       bool   `json:"inline,omitempty"`
+	Pin          *bool  `json:"pin,omitempty"`
+
+	// OnlyHash computes the CID without storing anything. All other options
+	// still apply, so the result matches a real add with the same options.
+	OnlyHash bool `json:"onlyHash,omitempty"`
+
+	// Ignore lists gitignore-style patterns (e.g. ".git", "node_modules",
+	// "*.o") for directory entries to leave out. Patterns are matched
+	// against entry names at every level of the directory tree.
+	Ignore []string `json:"ignore,omitempty"`
+
+	// Nocopy stores references to the added files instead of copying their
+	// contents into the blockstore, which needs the filestore to be enabled
+	// (see SetFilestoreEnabled). The files must be inside the directory that
+	// contains the repo, and moving, changing or deleting them afterwards
+	// makes their content unretrievable. Implies raw leaves.
+	Nocopy bool `json:"nocopy,omitempty"`
+
+	// Announce provides the root CID to the DHT right after adding, instead
+	// of waiting for the next reprovide cycle
+	Announce bool `json:"announce,omitempty"`
+
+	// Sharding controls HAMT sharding of directories, which splits the
+	// entries of large directories across many nodes: "auto" (the default)
+	// shards directories whose node would exceed ShardingThreshold,
+	// "always" shards every non-empty directory and "never" keeps every
+	// directory in a single node.
+	Sharding string `json:"sharding,omitempty"`
+
+	// ShardingThreshold is the directory node size in bytes above which
+	// "auto" sharding kicks in. 0 keeps the threshold taken from
+	// Internal.UnixFSShardingSizeThreshold (256KiB by default) of the last
+	// node started, as the setting is process-wide. For the same reason,
+	// adds with different sharding settings don't run at the same time.
+	ShardingThreshold int `json:"shardingThreshold,omitempty"`
+
+	// ShardWidth is the fanout of sharded directory nodes, a power of two
+	// from 8 to 1024. 0 means 256.
+	ShardWidth int `json:"shardWidth,omitempty"`
+
+	// PreserveMode stores the permissions of every file and directory in
+	// its Unixfs mode metadata, and PreserveMtime their modification times
+	// in its mtime metadata. FixedMtime, in seconds since the Unix epoch,
+	// stores that time for every entry instead, so the CID doesn't depend on
+	// when the files were written. Files that fit into a single raw leaf are
+	// wrapped into a file node to hold the metadata. Progress events report
+	// the CIDs of entries before their metadata is added.
+	PreserveMode  bool  `json:"preserveMode,omitempty"`
+	PreserveMtime bool  `json:"preserveMtime,omitempty"`
+	FixedMtime    int64 `json:"fixedMtime,omitempty"`
+
+	// events receives the add's events, including progress events, as
+	// *iface.AddEvent. It must be read until the add returns.
+	events chan<- interface{}
+}
+
+// parseAddOptions decodes AddOptions from JSON, treating an empty string as defaults
+func parseAddOptions(optionsJSON string) (AddOptions, error) {
+	var opts AddOptions
+	if optionsJSON == "" {
+		return opts, nil
+	}
+	if err := json.Unmarshal([]byte(optionsJSON), &opts); err != nil {
+		return opts, fmt.Errorf("parsing add options JSON: %w", err)
+	}
+	return opts, nil
+}
+
+// pins reports whether the added content is pinned
+func (o AddOptions) pins() bool {
+	if o.Pin != nil {
+		return *o.Pin && !o.OnlyHash
+	}
+	return !o.OnlyHash
+}
+
+// unixfsOptions converts AddOptions into options for the Unixfs API
+func (o AddOptions) unixfsOptions() ([]options.UnixfsAddOption, error) {
+	opts := []options.UnixfsAddOption{
+		options.Unixfs.Pin(o.pins()),
+		options.Unixfs.HashOnly(o.OnlyHash),
+	}
+
+	if o.CidVersion != nil {
+		opts = append(opts, options.Unixfs.CidVersion(*o.CidVersion))
+	}
+	if o.HashFunction != "" {
+		code, ok := mh.Names[o.HashFunction]
+		if !ok {
+			return nil, fmt.Errorf("unrecognized hash function: %s", o.HashFunction)
+		}
+		opts = append(opts, options.Unixfs.Hash(code))
+	}
+	if o.Chunker != "" {
+		opts = append(opts, options.Unixfs.Chunker(o.Chunker))
+	}
+	if o.RawLeaves != nil {
+		opts = append(opts, options.Unixfs.RawLeaves(*o.RawLeaves))
+	}
+	if o.Trickle {
+		opts = append(opts, options.Unixfs.Layout(options.TrickleLayout))
+	}
+	if o.Inline {
+		opts = append(opts, options.Unixfs.Inline(true))
+	}
+	if o.Nocopy {
+		opts = append(opts, options.Unixfs.Nocopy(true))
+	}
+	if o.events != nil {
+		opts = append(opts, options.Unixfs.Events(o.events), options.Unixfs.Progress(true))
+	}
+
+	return opts, nil
+}
+
+// shardingSettings are the values of the process-wide sharding variables of
+// the Unixfs library, uio.HAMTShardingSize and uio.DefaultShardWidth
+type shardingSettings struct {
+	size  int
+	width int
+}
+
+// The Unixfs library only offers the sharding settings as process-wide
+// variables, so they can't be passed per add. Adds with the same settings
+// run concurrently, while those with other settings wait for them to finish
+// (see acquireSharding). The mutex is only held briefly, never for a whole
+// add, so it can be taken while starting a node. The cond is signalled
+// whenever the last add with the active settings finishes.
+var (
+	shardingMutex  sync.Mutex
+	shardingCond   = sync.NewCond(&shardingMutex)
+	shardingActive shardingSettings
+	shardingUsers  int
+	// shardingDefaultSize is the threshold of adds that don't set one,
+	// which Kubo sets from Internal.UnixFSShardingSizeThreshold of the last
+	// node built
+	shardingDefaultSize = uio.HAMTShardingSize
+)
+
+// applySharding sets the sharding settings of o for the duration of an add,
+// returning a function to call once the add is done
+func (o AddOptions) applySharding() (func(), error) {
+	if o.ShardingThreshold < 0 {
+		return nil, fmt.Errorf("sharding threshold must not be negative")
+	}
+	if o.ShardWidth != 0 && (o.ShardWidth < 8 || o.ShardWidth > 1024 || o.ShardWidth&(o.ShardWidth-1) != 0) {
+		return nil, fmt.Errorf("shard width must be a power of two from 8 to 1024: %d", o.ShardWidth)
+	}
+	switch o.Sharding {
+	case "", "auto", "always", "never":
+	default:
+		return nil, fmt.Errorf("unknown sharding mode: %s", o.Sharding)
+	}
+
+	return acquireSharding(func(defaultSize int) shardingSettings {
+		settings := shardingSettings{size: defaultSize, width: defaultShardWidth}
+		switch {
+		case o.Sharding == "always":
+			// Any entry exceeds this
+			settings.size = 1
+		case o.Sharding == "never":
+			// Disables the switch to a sharded directory
+			settings.size = 0
+		case o.ShardingThreshold > 0:
+			settings.size = o.ShardingThreshold
+		}
+		if o.ShardWidth != 0 {
+			settings.width = o.ShardWidth
+		}
+		return settings
+	}), nil
+}
+
+// defaultShardWidth is the shard width of adds that don't set one
+const defaultShardWidth = 256
+
+// acquireSharding waits until no add with other sharding settings than those
+// resolve returns for the current default threshold is running, applies them
+// and returns a function releasing them
+func acquireSharding(resolve func(defaultSize int) shardingSettings) func() {
+	shardingMutex.Lock()
+	defer shardingMutex.Unlock()
+	settings := resolve(shardingDefaultSize)
+	for shardingUsers > 0 && shardingActive != settings {
+		shardingCond.Wait()
+		// The default may have changed meanwhile
+		settings = resolve(shardingDefaultSize)
+	}
+	if shardingUsers == 0 {
+		shardingActive = settings
+		uio.HAMTShardingSize, uio.DefaultShardWidth = settings.size, settings.width
+	}
+	shardingUsers++
+
+	return func() {
+		shardingMutex.Lock()
+		defer shardingMutex.Unlock()
+		if shardingUsers--; shardingUsers == 0 {
+			shardingCond.Broadcast()
+		}
+	}
+}
+
+// buildWithSharding runs build, which builds a node and so lets Kubo set
+// uio.HAMTShardingSize, taking the value it sets as the new default
+// threshold and restoring the settings of the adds running meanwhile. Adds
+// don't wait for the build, but those running may see Kubo's threshold
+// until it returns.
+func buildWithSharding(build func()) {
+	shardingMutex.Lock()
+	defer shardingMutex.Unlock()
+	build()
+	shardingDefaultSize = uio.HAMTShardingSize
+	if shardingUsers > 0 {
+		uio.HAMTShardingSize = shardingActive.size
+	}
+}
+
+// AddFileAdvanced adds a file or directory to IPFS using the add options
+// given as a JSON object (see AddOptions)
+//
+//export AddFileAdvanced
+func AddFileAdvanced(repoPath, filePath, optionsJSON *C.char) *C.char {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+	file := C.GoString(filePath)
+
+	opts, err := parseAddOptions(C.GoString(optionsJSON))
+	if err != nil {
+		logError("%s", err)
+		return nil
+	}
+	log.Printf("DEBUG: Adding file from path %s with options using repo %s\n", file, path)
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	cid, err := addPath(ctx, api, file, opts)
+	if err != nil {
+		logError("%s", err)
+		return nil
+	}
+	log.Printf("DEBUG: File added with CID: %s\n", cid)
+
+	return C.CString(cid)
+}
+
+// HashBytes computes the CID that adding data as a file would yield, without
+// a repo or node. cidVersion is 0 or 1, or negative for Kubo's default (CIDv0,
+// or CIDv1 for hash functions other than sha2-256); CIDv1 uses raw leaves.
+// hashFn is a multihash name such as "sha2-256" (the default if empty) or
+// "blake2b-256". Content is chunked and laid out as with the default add
+// options, so the CID matches AddFileAdvanced with onlyHash and the same
+// cidVersion and hashFunction. Returns NULL for invalid options.
+//
+//export HashBytes
+func HashBytes(data unsafe.Pointer, dataLen C.int, cidVersion C.int, hashFn *C.char) *C.char {
+	cid, err := hashBytes(C.GoBytes(data, dataLen), int(cidVersion), C.GoString(hashFn))
+	if err != nil {
+		logError("hashing data: %s", err)
+		return nil
+	}
+	return C.CString(cid.String())
+}
+
+// hashBytes builds the Unixfs DAG of data as an add would, discarding the
+// blocks, and returns its root CID
+func hashBytes(data []byte, cidVersion int, hashFn string) (cidlib.Cid, error) {
+	// Resolve the options like an add does, so the defaults stay in sync
+	opts := []options.UnixfsAddOption{options.Unixfs.CidVersion(cidVersion)}
+	if hashFn != "" {
+		code, ok := mh.Names[hashFn]
+		if !ok {
+			return cidlib.Undef, fmt.Errorf("unrecognized hash function: %s", hashFn)
+		}
+		opts = append(opts, options.Unixfs.Hash(code))
+	}
+	settings, prefix, err := options.UnixfsAddOptions(opts...)
+	if err != nil {
+		return cidlib.Undef, err
+	}
+
+	chunks, err := chunker.FromString(bytes.NewReader(data), settings.Chunker)
+	if err != nil {
+		return cidlib.Undef, err
+	}
+	bs := blockstore.NewBlockstore(datastore.NewNullDatastore())
+	params := helpers.DagBuilderParams{
+		Dagserv:    dag.NewDAGService(blockservice.New(bs, offline.Exchange(bs))),
+		RawLeaves:  settings.RawLeaves,
+		Maxlinks:   helpers.DefaultLinksPerBlock,
+		CidBuilder: prefix,
+	}
+	db, err := params.New(chunks)
+	if err != nil {
+		return cidlib.Undef, err
+	}
+	root, err := balanced.Layout(db)
+	if err != nil {
+		return cidlib.Undef, err
+	}
+	return root.Cid(), nil
+}
+
+// ManifestEntry describes a file added as part of a directory
+type ManifestEntry struct {
+	Path string `json:"path"`
+	CID  string `json:"cid"`
+	Size uint64 `json:"size"`
+}
+
+// PublishResult is the outcome of Publish. Provided is false if the content
+// was added but announcing it failed, e.g. because the node is offline; it is
+// then announced with the next reprovide cycle.
+type PublishResult struct {
+	Cid      string `json:"cid"`
+	Provided bool   `json:"provided"`
+}
+
+// Publish adds a file or directory, pins it and announces its root CID to
+// the DHT right away, which is what making content available on IPFS takes.
+// Returns a PublishResult JSON object, or NULL if adding failed.
+//
+//export Publish
+func Publish(repoPath, filePath *C.char) *C.char {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+	file := C.GoString(filePath)
+
+	log.Printf("DEBUG: Publishing file from path %s using repo %s\n", file, path)
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	// Pinned by default
+	cid, err := addPath(ctx, api, file, AddOptions{})
+	if err != nil {
+		logError("%s", err)
+		return nil
+	}
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return nil
+	}
+
+	result := PublishResult{Cid: cid, Provided: true}
+	if err := api.Dht().Provide(ctx, ipath.IpfsPath(decodedCid)); err != nil {
+		log.Printf("ERROR:  announcing %s: %s\n", cid, err)
+		result.Provided = false
+	}
+	log.Printf("DEBUG: Published %s (provided: %t)\n", cid, result.Provided)
+
+	// Convert to JSON
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logError("marshaling publish result to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(resultJSON))
+}
+
+// AddDirManifest adds a directory to IPFS and returns a JSON array of
+// ManifestEntry for every file in it, with paths relative to the directory
+// (using "/" as separator), so that each file can be addressed by its own
+// CID. Adding a single file returns one entry named after the file.
+//
+//export AddDirManifest
+func AddDirManifest(repoPath, dirPath *C.char) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	dir := C.GoString(dirPath)
+
+	log.Printf("DEBUG: Adding directory %s with manifest using repo %s\n", dir, path)
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	cid, err := addPath(ctx, api, dir, AddOptions{})
+	if err != nil {
+		logError("%s", err)
+		return nil
+	}
+	rootCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return nil
+	}
+
+	manifest, err := buildManifest(ctx, api, rootCid, filepath.Base(dir))
+	if err != nil {
+		logError("building manifest: %s", err)
+		return nil
+	}
+
+	// Convert to JSON
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		logError("marshaling manifest to JSON: %s", err)
+		return nil
+	}
+
+	log.Printf("DEBUG: Directory added with CID %s and %d files\n", cid, len(manifest))
+	return C.CString(string(manifestJSON))
+}
+
+// EntrypointResult is the outcome of AddDirWithEntrypoint
+type EntrypointResult struct {
+	Cid  string `json:"cid"`
+	Path string `json:"path"`
+}
+
+// AddDirWithEntrypoint adds a directory like AddFile and returns, alongside
+// its root CID, the /ipfs/<cid>/<entrypoint> path of a file in it, e.g. the
+// index.html of a static site, ready to be opened through a gateway.
+// entrypoint is relative to the directory, using "/" as separator; an empty
+// one yields the path of the directory itself. Returns an EntrypointResult
+// JSON object, or NULL if adding failed or the entrypoint isn't a file in
+// the directory.
+//
+//export AddDirWithEntrypoint
+func AddDirWithEntrypoint(repoPath, dirPath, entrypoint *C.char) *C.char {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+	dir := C.GoString(dirPath)
+	entry := C.GoString(entrypoint)
+
+	log.Printf("DEBUG: Adding directory %s with entrypoint %q using repo %s\n", dir, entry, path)
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	cid, err := addPath(ctx, api, dir, AddOptions{})
+	if err != nil {
+		logError("%s", err)
+		return nil
+	}
+	rootCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return nil
+	}
+
+	entryPath, err := entrypointPath(ctx, api, rootCid, entry)
+	if err != nil {
+		logError("%s", err)
+		return nil
+	}
+
+	// Convert to JSON
+	resultJSON, err := json.Marshal(EntrypointResult{Cid: cid, Path: entryPath})
+	if err != nil {
+		logError("marshaling entrypoint result to JSON: %s", err)
+		return nil
+	}
+
+	log.Printf("DEBUG: Directory added with entrypoint %s\n", entryPath)
+	return C.CString(string(resultJSON))
+}
+
+// entrypointPath returns the /ipfs path of the entrypoint file below the
+// directory at root, checking that it exists
+func entrypointPath(ctx context.Context, api iface.CoreAPI, root cidlib.Cid, entrypoint string) (string, error) {
+	rootPath := ipath.IpfsPath(root)
+	if entrypoint == "" {
+		return rootPath.String(), nil
+	}
+
+	clean := gopath.Clean(entrypoint)
+	if gopath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("entrypoint must be a path inside the directory: %q", entrypoint)
+	}
+	p := ipath.Join(rootPath, strings.Split(clean, "/")...)
+
+	node, err := api.Unixfs().Get(ctx, p)
+	if err != nil {
+		return "", fmt.Errorf("resolving entrypoint %s: %w", clean, err)
+	}
+	defer node.Close()
+	if _, isFile := node.(files.File); !isFile {
+		return "", fmt.Errorf("entrypoint %s is not a file", clean)
+	}
+	return p.String(), nil
+}
+
+// AddDirEvent is reported by AddDirWithEvents for each file and directory
+// added. Name is the entry's path relative to the added directory, using
+// "/" as separator and empty for the directory itself, and Bytes the size of
+// a file's content (0 for directories).
+type AddDirEvent struct {
+	Name  string `json:"name"`
+	CID   string `json:"cid"`
+	Bytes int64  `json:"bytes"`
+}
+
+// AddDirWithEvents adds a directory like AddFile, passing an AddDirEvent
+// JSON object to cb, of type void(char* event), as each file and directory
+// has been added, so the progress of large imports can be shown and a
+// manifest built as it goes. Directories are reported after their entries,
+// the added directory itself last. The callback runs on a thread of the
+// library and must copy the string. The content is pinned once added.
+// Returns the root CID, or NULL on error.
+//
+//export AddDirWithEvents
+func AddDirWithEvents(repoPath, dirPath *C.char, cb C.uintptr_t) *C.char {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+	dir := C.GoString(dirPath)
+
+	log.Printf("DEBUG: Adding directory %s with events using repo %s\n", dir, path)
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	events := make(chan interface{}, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		forwardAddEvents(events, func(event AddDirEvent) {
+			eventJSON, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("ERROR:  marshaling add event to JSON: %s\n", err)
+				return
+			}
+			callStringCallback(cb, string(eventJSON))
+		})
+	}()
+
+	cid, err := addPath(ctx, api, dir, AddOptions{events: events})
+	// The add sends no more events once it has returned
+	close(events)
+	<-done
+	if err != nil {
+		logError("%s", err)
+		return nil
+	}
+
+	log.Printf("DEBUG: Directory added with CID %s\n", cid)
+	return C.CString(cid)
+}
+
+// forwardAddEvents passes an AddDirEvent to report for each file and
+// directory added, until events is closed. The sizes of files are taken
+// from the progress events that precede their completion.
+func forwardAddEvents(events <-chan interface{}, report func(AddDirEvent)) {
+	bytesRead := make(map[string]int64)
+	for e := range events {
+		event, ok := e.(*iface.AddEvent)
+		if !ok {
+			continue
+		}
+		if event.Path == nil {
+			// Progress of a file being read
+			bytesRead[event.Name] = event.Bytes
+			continue
+		}
+		report(AddDirEvent{
+			Name:  event.Name,
+			CID:   event.Path.Cid().String(),
+			Bytes: bytesRead[event.Name],
+		})
+		delete(bytesRead, event.Name)
+	}
+}
+
+// buildManifest lists every file below the Unixfs node at root. If root is
+// itself a file, it is listed under name.
+func buildManifest(ctx context.Context, api iface.CoreAPI, root cidlib.Cid, name string) ([]ManifestEntry, error) {
+	manifest := []ManifestEntry{}
+
+	rootNode, err := api.Unixfs().Get(ctx, ipath.IpfsPath(root))
+	if err != nil {
+		return nil, err
+	}
+	defer rootNode.Close()
+	if _, isDir := rootNode.(files.Directory); !isDir {
+		size, err := rootNode.Size()
+		if err != nil {
+			return nil, err
+		}
+		return append(manifest, ManifestEntry{Path: name, CID: root.String(), Size: uint64(size)}), nil
+	}
+
+	var walk func(c cidlib.Cid, prefix string) error
+	walk = func(c cidlib.Cid, prefix string) error {
+		entries, err := api.Unixfs().Ls(ctx, ipath.IpfsPath(c))
+		if err != nil {
+			return err
+		}
+		for entry := range entries {
+			if entry.Err != nil {
+				return entry.Err
+			}
+			entryPath := gopath.Join(prefix, entry.Name)
+			switch entry.Type {
+			case iface.TFile:
+				manifest = append(manifest, ManifestEntry{
+					Path: entryPath,
+					CID:  entry.Cid.String(),
+					Size: entry.Size,
+				})
+			case iface.TDirectory:
+				if err := walk(entry.Cid, entryPath); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(root, ""); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	dag "github.com/ipfs/boxo/ipld/merkledag"
+	ft "github.com/ipfs/boxo/ipld/unixfs"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	cidlib "github.com/ipfs/go-cid"
+)
+
+func TestOnlyHashMatchesAdd(t *testing.T) {
+	ctx := context.Background()
+
+	srcDir := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Large enough to be split into several chunks with any of the chunkers below
+	big := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	if err := os.WriteFile(filepath.Join(srcDir, "big.bin"), big, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "small.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cidV1 := 1
+	no := false
+	cases := map[string]AddOptions{
+		"defaults":  {},
+		"cidv1":     {CidVersion: &cidV1},
+		"sha2-512":  {CidVersion: &cidV1, HashFunction: "sha2-512"},
+		"chunker":   {Chunker: "size-4096", RawLeaves: &no},
+		"rabin":     {CidVersion: &cidV1, Chunker: "rabin-1024-4096-16384"},
+		"trickle":   {CidVersion: &cidV1, Trickle: true},
+		"inline":    {CidVersion: &cidV1, Inline: true},
+		"unpinned":  {Pin: &no},
+		"announced": {Announce: true},
+		"mode":      {PreserveMode: true},
+		"mtime":     {CidVersion: &cidV1, PreserveMtime: true},
+		"metadata":  {CidVersion: &cidV1, Inline: true, PreserveMode: true, FixedMtime: 1700000000},
+	}
+
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			api := newTestAPI(t)
+
+			hashOpts := opts
+			hashOpts.OnlyHash = true
+			hashCID, err := addPath(ctx, api, srcDir, hashOpts)
+			if err != nil {
+				t.Fatalf("hashing directory: %s", err)
+			}
+
+			// Hashing must not store any blocks
+			if _, err := api.Block().Stat(ctx, ipath.New("/ipfs/"+hashCID)); err == nil {
+				t.Errorf("root block %s stored by a hash-only add", hashCID)
+			}
+
+			addCID, err := addPath(ctx, api, srcDir, opts)
+			if err != nil {
+				t.Fatalf("adding directory: %s", err)
+			}
+			if hashCID != addCID {
+				t.Errorf("hash-only CID %s differs from added CID %s", hashCID, addCID)
+			}
+		})
+	}
+}
+
+func TestHashBytesMatchesAdd(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	contents := map[string][]byte{
+		"empty": {},
+		"small": []byte("hello"),
+		// Several chunks, linked from more than one level of the tree
+		"big": bytes.Repeat([]byte("0123456789abcdef"), 300*1024),
+	}
+	cidV0, cidV1 := 0, 1
+	cases := []struct {
+		cidVersion int
+		hashFn     string
+		opts       AddOptions
+	}{
+		{-1, "", AddOptions{}},
+		{0, "sha2-256", AddOptions{CidVersion: &cidV0}},
+		{1, "", AddOptions{CidVersion: &cidV1}},
+		{-1, "blake2b-256", AddOptions{HashFunction: "blake2b-256"}},
+	}
+
+	for name, content := range contents {
+		file := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(file, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range cases {
+			c.opts.OnlyHash = true
+			want, err := addPath(ctx, api, file, c.opts)
+			if err != nil {
+				t.Fatalf("hashing %s with an add: %s", name, err)
+			}
+			got, err := hashBytes(content, c.cidVersion, c.hashFn)
+			if err != nil {
+				t.Fatalf("hashing %s: %s", name, err)
+			}
+			if got.String() != want {
+				t.Errorf("%s with CID version %d and hash %q: got %s, want %s", name, c.cidVersion, c.hashFn, got, want)
+			}
+		}
+	}
+
+	if _, err := hashBytes(nil, 0, "blake2b-256"); err == nil {
+		t.Error("hashing with CIDv0 and blake2b-256 succeeded")
+	}
+}
+
+func TestAddDirEvents(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	srcDir := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "sub", "b.bin"), bytes.Repeat([]byte("b"), 300*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan interface{})
+	var reported []AddDirEvent
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		forwardAddEvents(events, func(event AddDirEvent) {
+			reported = append(reported, event)
+		})
+	}()
+	cid, err := addPath(ctx, api, srcDir, AddOptions{events: events})
+	close(events)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byName := make(map[string]AddDirEvent)
+	for _, event := range reported {
+		byName[event.Name] = event
+	}
+	want := map[string]int64{"a.txt": 5, "sub/b.bin": 300 * 1024, "sub": 0, "": 0}
+	for name, size := range want {
+		event, ok := byName[name]
+		if !ok {
+			t.Fatalf("no event for %s in %+v", name, reported)
+		}
+		if event.Bytes != size {
+			t.Errorf("%s: bytes = %d, want %d", name, event.Bytes, size)
+		}
+	}
+	if last := reported[len(reported)-1]; last.Name != "" || last.CID != cid {
+		t.Fatalf("last event = %+v, want the root %s", last, cid)
+	}
+}
+
+func TestEntrypointPath(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	srcDir := filepath.Join(t.TempDir(), "site")
+	if err := os.MkdirAll(filepath.Join(srcDir, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"index.html", "docs/intro.html"} {
+		if err := os.WriteFile(filepath.Join(srcDir, name), []byte("<h1>"+name+"</h1>"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := addPath(ctx, api, srcDir, AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCid, err := cidlib.Decode(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for entrypoint, want := range map[string]string{
+		"":                  "/ipfs/" + root,
+		"index.html":        "/ipfs/" + root + "/index.html",
+		"./docs/intro.html": "/ipfs/" + root + "/docs/intro.html",
+	} {
+		got, err := entrypointPath(ctx, api, rootCid, entrypoint)
+		if err != nil || got != want {
+			t.Errorf("entrypoint %q: got %q (%v), want %q", entrypoint, got, err, want)
+		}
+	}
+
+	for _, entrypoint := range []string{"missing.html", "docs", "../index.html", "/index.html"} {
+		if got, err := entrypointPath(ctx, api, rootCid, entrypoint); err == nil {
+			t.Errorf("entrypoint %q: expected an error, got %q", entrypoint, got)
+		}
+	}
+}
+
+func TestMaxAddSize(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(dir, name), make([]byte, 600), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	maxAddSize.Store(1000)
+	defer maxAddSize.Store(0)
+
+	if _, err := addPath(ctx, api, filepath.Join(dir, "a"), AddOptions{}); err != nil {
+		t.Fatalf("adding file within the limit: %s", err)
+	}
+	if _, err := addPath(ctx, api, dir, AddOptions{}); !errors.Is(err, errAddTooLarge) {
+		t.Fatalf("expected errAddTooLarge for directory, got %v", err)
+	}
+	// Hashing stores nothing, so it isn't limited
+	if _, err := addPath(ctx, api, dir, AddOptions{OnlyHash: true}); err != nil {
+		t.Fatalf("hashing directory: %s", err)
+	}
+}
+
+func TestAddWithMetadata(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	srcDir := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(srcDir, "sub", "run.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "a.txt"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cidV1 := 1
+	opts := AddOptions{CidVersion: &cidV1, PreserveMode: true, FixedMtime: 1700000000}
+	first, err := addPath(ctx, api, srcDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := addPath(ctx, api, srcDir, AddOptions{CidVersion: &cidV1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == plain {
+		t.Fatal("metadata didn't change the CID")
+	}
+
+	// A fixed mtime makes the CID independent of the files' times
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(script, later, later); err != nil {
+		t.Fatal(err)
+	}
+	second, err := addPath(ctx, api, srcDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Errorf("CID changed with the mtime: %s, then %s", first, second)
+	}
+
+	// The metadata is stored on the pinned DAG
+	if _, pinned, err := api.Pin().IsPinned(ctx, ipath.New("/ipfs/"+first)); err != nil || !pinned {
+		t.Fatalf("%s not pinned (%v)", first, err)
+	}
+	nd, err := api.ResolveNode(ctx, ipath.New("/ipfs/"+first+"/sub/run.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	protoNode, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		t.Fatalf("single-chunk file stored as %T, not wrapped into a file node", nd)
+	}
+	if mode, ok := unixfsMode(protoNode.Data()); !ok || mode != 0750 {
+		t.Errorf("mode = %o (%v), want 750", mode, ok)
+	}
+	if _, err := ft.FSNodeFromBytes(protoNode.Data()); err != nil {
+		t.Errorf("file node with metadata doesn't decode: %s", err)
+	}
+}
+
+func TestApplySharding(t *testing.T) {
+	releaseDefault, err := AddOptions{}.applySharding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Adds with the same settings share them
+	releaseOther, err := AddOptions{}.applySharding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseOther()
+
+	// Building a node doesn't wait for running adds, nor change their settings
+	built := make(chan struct{})
+	go func() {
+		buildWithSharding(func() { uio.HAMTShardingSize = 1234 })
+		close(built)
+	}()
+	select {
+	case <-built:
+	case <-time.After(5 * time.Second):
+		t.Fatal("building a node waited for a running add")
+	}
+	if uio.HAMTShardingSize == 1234 {
+		t.Error("node build changed the threshold of a running add")
+	}
+
+	// An add with other settings waits for the running ones
+	applied := make(chan func())
+	go func() {
+		release, err := AddOptions{Sharding: "never"}.applySharding()
+		if err != nil {
+			t.Error(err)
+		}
+		applied <- release
+	}()
+	select {
+	case <-applied:
+		t.Fatal("add with other sharding settings ran alongside another")
+	case <-time.After(50 * time.Millisecond):
+	}
+	releaseDefault()
+	releaseNever := <-applied
+	if uio.HAMTShardingSize != 0 {
+		t.Errorf("threshold is %d during an add with sharding \"never\"", uio.HAMTShardingSize)
+	}
+	releaseNever()
+
+	// The next default add uses the threshold of the last node built
+	release, err := AddOptions{}.applySharding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uio.HAMTShardingSize != 1234 {
+		t.Errorf("threshold is %d, want that of the last node built", uio.HAMTShardingSize)
+	}
+	release()
+	buildWithSharding(func() { uio.HAMTShardingSize = 256 * 1024 })
+}
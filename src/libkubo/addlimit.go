@@ -0,0 +1,81 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// maxAddSize is the largest number of bytes adds accept (see SetMaxAddSize),
+// or 0 for no limit
+var maxAddSize atomic.Int64
+
+// errAddTooLarge is returned for content larger than the SetMaxAddSize limit
+var errAddTooLarge = errors.New("content exceeds the maximum add size")
+
+// SetMaxAddSize sets the largest number of bytes that AddFile and the other
+// functions adding files or directories from disk, AddEncrypted and add
+// streams accept, as a safety rail against filling the disk of a constrained
+// device by mistake. The size of files is checked before anything is added,
+// while add streams fail at the write that exceeds the limit. Directories
+// are limited by the total size of their files. Only-hash adds, which store
+// nothing, aren't limited. 0, the default, means no limit.
+// Rejected adds fail with an error like "content exceeds the maximum add
+// size", which LastError returns. Returns 0, or -1 for a negative limit.
+//
+//export SetMaxAddSize
+func SetMaxAddSize(bytes C.longlong) C.int {
+	if bytes < 0 {
+		logError("invalid maximum add size %d", int64(bytes))
+		return C.int(-1)
+	}
+	maxAddSize.Store(int64(bytes))
+	return C.int(0)
+}
+
+// checkAddSize returns errAddTooLarge if the file or directory at path is
+// larger than the SetMaxAddSize limit. Symlinks are counted as themselves,
+// not as what they point to.
+func checkAddSize(path string) error {
+	limit := maxAddSize.Load()
+	if limit == 0 {
+		return nil
+	}
+
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		if size > limit {
+			return errAddTooLarge
+		}
+		return nil
+	})
+	if errors.Is(err, errAddTooLarge) {
+		return fmt.Errorf("%s: %w of %d bytes", path, errAddTooLarge, limit)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("getting size of %s: %w", path, err)
+	}
+	// Missing files are reported by the add itself
+	return nil
+}
+
+// checkAddedBytes returns errAddTooLarge if n bytes exceed the SetMaxAddSize
+// limit
+func checkAddedBytes(n int64) error {
+	if limit := maxAddSize.Load(); limit > 0 && n > limit {
+		return fmt.Errorf("%w of %d bytes", errAddTooLarge, limit)
+	}
+	return nil
+}
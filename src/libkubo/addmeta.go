@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	iface "github.com/ipfs/boxo/coreiface"
+	"github.com/ipfs/boxo/coreiface/options"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	"github.com/ipfs/boxo/files"
+	dag "github.com/ipfs/boxo/ipld/merkledag"
+	ft "github.com/ipfs/boxo/ipld/unixfs"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-cidutil"
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/kubo/core/coreunix"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the Unixfs mode and mtime metadata, which the boxo
+// version in use neither decodes nor writes itself
+const (
+	unixfsModeField  = 7
+	unixfsMtimeField = 8
+)
+
+// writesMetadata reports whether o adds Unixfs mode or mtime metadata
+func (o AddOptions) writesMetadata() bool {
+	return o.PreserveMode || o.PreserveMtime || o.FixedMtime != 0
+}
+
+// addWithMetadata adds fileNode, read from localPath, like an add with
+// unixfsOpts, then writes the mode and mtime metadata of o into the Unixfs
+// nodes of the DAG, bottom up, and returns the new root. Hash-only adds build
+// the DAG in memory, as the node doesn't keep their blocks.
+func addWithMetadata(ctx context.Context, api iface.CoreAPI, localPath string, fileNode files.Node, o AddOptions, unixfsOpts []options.UnixfsAddOption) (cidlib.Cid, error) {
+	settings, prefix, err := options.UnixfsAddOptions(unixfsOpts...)
+	if err != nil {
+		return cidlib.Undef, err
+	}
+	var builder cidlib.Builder = prefix
+	if settings.Inline {
+		builder = cidutil.InlineBuilder{Builder: prefix, Limit: settings.InlineLimit}
+	}
+
+	var (
+		dagService ipld.DAGService
+		root       cidlib.Cid
+	)
+	if o.OnlyHash {
+		dagService, root, err = addInMemory(ctx, fileNode, settings, builder)
+		if err != nil {
+			return cidlib.Undef, err
+		}
+	} else {
+		// The DAG is pinned once it has its metadata
+		resolved, err := api.Unixfs().Add(ctx, fileNode, append(unixfsOpts, options.Unixfs.Pin(false))...)
+		if err != nil {
+			return cidlib.Undef, fmt.Errorf("adding file to IPFS: %w", err)
+		}
+		dagService, root = api.Dag(), resolved.Cid()
+	}
+
+	nd, err := writeMetadata(ctx, dagService, root, localPath, o, builder)
+	if err != nil {
+		return cidlib.Undef, fmt.Errorf("writing Unixfs metadata: %w", err)
+	}
+
+	if o.pins() {
+		if err := api.Pin().Add(ctx, ipath.IpfsPath(nd.Cid())); err != nil {
+			return cidlib.Undef, fmt.Errorf("pinning %s: %w", nd.Cid(), err)
+		}
+	}
+	return nd.Cid(), nil
+}
+
+// addInMemory adds fileNode with settings to an in-memory DAG service,
+// returning it and the root of the added DAG
+func addInMemory(ctx context.Context, fileNode files.Node, settings *options.UnixfsAddSettings, builder cidlib.Builder) (ipld.DAGService, cidlib.Cid, error) {
+	// Inlined CIDs are read from the CID itself, as in a repo's blockstore
+	bs := blockstore.NewIdStore(blockstore.NewBlockstore(syncds.MutexWrap(datastore.NewMapDatastore())))
+	dagService := dag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	adder, err := coreunix.NewAdder(ctx, nil, blockstore.NewGCLocker(), dagService)
+	if err != nil {
+		return nil, cidlib.Undef, err
+	}
+	adder.Pin = false
+	adder.Chunker = settings.Chunker
+	if settings.Events != nil {
+		adder.Out = settings.Events
+		adder.Progress = settings.Progress
+	}
+	adder.RawLeaves = settings.RawLeaves
+	adder.Trickle = settings.Layout == options.TrickleLayout
+	adder.CidBuilder = builder
+
+	nd, err := adder.AddAllAndPin(ctx, fileNode)
+	if err != nil {
+		return nil, cidlib.Undef, fmt.Errorf("adding file to IPFS: %w", err)
+	}
+	return dagService, nd.Cid(), nil
+}
+
+// writeMetadata writes the mode and mtime of localPath and everything below
+// it into the Unixfs DAG at c, which was added from it, and returns the new
+// root node. Entries are matched by name, so ignored entries are skipped.
+func writeMetadata(ctx context.Context, dagService ipld.DAGService, c cidlib.Cid, localPath string, o AddOptions, builder cidlib.Builder) (ipld.Node, error) {
+	info, err := os.Lstat(localPath)
+	if err != nil {
+		return nil, err
+	}
+	nd, err := dagService.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var protoNode *dag.ProtoNode
+	switch n := nd.(type) {
+	case *dag.RawNode:
+		// Raw leaves carry no metadata, so the chunk is linked from a file node
+		fsNode := ft.NewFSNode(ft.TFile)
+		fsNode.AddBlockSize(uint64(len(n.RawData())))
+		data, err := fsNode.GetBytes()
+		if err != nil {
+			return nil, err
+		}
+		protoNode = dag.NodeWithData(data)
+		if err := protoNode.AddNodeLink("", n); err != nil {
+			return nil, err
+		}
+	case *dag.ProtoNode:
+		if info.IsDir() {
+			if protoNode, err = writeDirectoryMetadata(ctx, dagService, n, localPath, o, builder); err != nil {
+				return nil, err
+			}
+		} else {
+			protoNode = n.Copy().(*dag.ProtoNode)
+		}
+	default:
+		return nil, fmt.Errorf("%s is not a Unixfs node", c)
+	}
+
+	protoNode.SetData(withUnixfsMetadata(protoNode.Data(), info, o))
+	if err := protoNode.SetCidBuilder(builder); err != nil {
+		return nil, err
+	}
+	if err := dagService.Add(ctx, protoNode); err != nil {
+		return nil, err
+	}
+	return protoNode, nil
+}
+
+// writeDirectoryMetadata writes the metadata of the entries of the
+// directory at localPath into the directory node dir, which may be sharded
+func writeDirectoryMetadata(ctx context.Context, dagService ipld.DAGService, dir *dag.ProtoNode, localPath string, o AddOptions, builder cidlib.Builder) (*dag.ProtoNode, error) {
+	directory, err := uio.NewDirectoryFromNode(dagService, dir)
+	if err != nil {
+		return nil, err
+	}
+	directory.SetCidBuilder(builder)
+
+	var links []*ipld.Link
+	err = directory.ForEachLink(ctx, func(link *ipld.Link) error {
+		links = append(links, link)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		child, err := writeMetadata(ctx, dagService, link.Cid, filepath.Join(localPath, link.Name), o, builder)
+		if err != nil {
+			return nil, err
+		}
+		if err := directory.AddChild(ctx, link.Name, child); err != nil {
+			return nil, err
+		}
+	}
+
+	nd, err := directory.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	protoNode, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil, fmt.Errorf("unexpected directory node type %T", nd)
+	}
+	return protoNode.Copy().(*dag.ProtoNode), nil
+}
+
+// withUnixfsMetadata returns a Unixfs protobuf with the mode and mtime
+// metadata o asks for, taken from info, replacing any it had
+func withUnixfsMetadata(data []byte, info os.FileInfo, o AddOptions) []byte {
+	var out []byte
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			break
+		}
+		m := protowire.ConsumeFieldValue(num, typ, data[n:])
+		if m < 0 {
+			break
+		}
+		if num != unixfsModeField && num != unixfsMtimeField {
+			out = append(out, data[:n+m]...)
+		}
+		data = data[n+m:]
+	}
+
+	if o.PreserveMode {
+		out = protowire.AppendTag(out, unixfsModeField, protowire.VarintType)
+		out = protowire.AppendVarint(out, uint64(unixPermissions(info.Mode())))
+	}
+
+	var mtime time.Time
+	switch {
+	case o.FixedMtime != 0:
+		mtime = time.Unix(o.FixedMtime, 0)
+	case o.PreserveMtime:
+		mtime = info.ModTime()
+	default:
+		return out
+	}
+	// UnixTime message: int64 Seconds = 1, fixed32 FractionalNanoseconds = 2
+	var unixTime []byte
+	unixTime = protowire.AppendTag(unixTime, 1, protowire.VarintType)
+	unixTime = protowire.AppendVarint(unixTime, uint64(mtime.Unix()))
+	if nanos := mtime.Nanosecond(); nanos != 0 {
+		unixTime = protowire.AppendTag(unixTime, 2, protowire.Fixed32Type)
+		unixTime = protowire.AppendFixed32(unixTime, uint32(nanos))
+	}
+	out = protowire.AppendTag(out, unixfsMtimeField, protowire.BytesType)
+	return protowire.AppendBytes(out, unixTime)
+}
+
+// unixPermissions converts the permission bits of a Go file mode to the
+// POSIX ones stored in Unixfs
+func unixPermissions(mode os.FileMode) uint32 {
+	perms := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		perms |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		perms |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		perms |= 01000
+	}
+	return perms
+}
@@ -0,0 +1,183 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	"github.com/ipfs/boxo/files"
+)
+
+// Add stream sessions, indexed by session ID
+var (
+	addStreams      = make(map[int64]*addStreamSession)
+	addStreamsMutex sync.Mutex
+	nextAddStreamID int64 = 1
+)
+
+// addStreamSession holds a streaming add in progress
+type addStreamSession struct {
+	writer   *io.PipeWriter
+	result   chan addStreamResult
+	repoPath string
+	// written counts the bytes written, for the SetMaxAddSize limit
+	written int64
+}
+
+// addStreamResult is the outcome of the Unixfs add behind a session
+type addStreamResult struct {
+	cid string
+	err error
+}
+
+// errAddStreamAborted is the error an aborted session's add fails with
+var errAddStreamAborted = errors.New("add stream aborted")
+
+// AddStreamBegin starts adding a file whose content is written in pieces
+// with AddStreamWrite, for content that isn't fully in memory or on disk yet,
+// such as a live recording. The content is chunked and stored as it arrives.
+// Finish the session with AddStreamFinish to get the CID, or discard it with
+// AddStreamAbort. The content is pinned once added.
+// Returns the session ID, or a negative value on error.
+//
+//export AddStreamBegin
+func AddStreamBegin(repoPath *C.char) C.longlong {
+	path := C.GoString(repoPath)
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.longlong(-1)
+	}
+	// Note: We don't release the node here because the session needs it
+	// The node will be released when the session is finished or aborted
+
+	ctx, endOp := beginOperation(path)
+	reader, writer := io.Pipe()
+	session := &addStreamSession{
+		writer:   writer,
+		result:   make(chan addStreamResult, 1),
+		repoPath: path,
+	}
+
+	go func() {
+		defer endOp()
+		resolved, err := api.Unixfs().Add(ctx, files.NewReaderFile(reader), options.Unixfs.Pin(true))
+		if err != nil {
+			// Unblocks pending and later writes
+			reader.CloseWithError(err)
+			session.result <- addStreamResult{err: err}
+			return
+		}
+		reader.Close()
+		session.result <- addStreamResult{cid: resolved.Cid().String()}
+	}()
+
+	addStreamsMutex.Lock()
+	id := nextAddStreamID
+	nextAddStreamID++
+	addStreams[id] = session
+	addStreamsMutex.Unlock()
+
+	log.Printf("DEBUG: Started add stream %d using repo %s\n", id, path)
+	return C.longlong(id)
+}
+
+// AddStreamWrite appends data to the content of an add stream session. It
+// blocks until the data has been taken up by the add. Returns -1 if the
+// session doesn't exist, -2 if the add has failed, in which case
+// AddStreamFinish reports the error, and -3 if the data would exceed the
+// SetMaxAddSize limit, which fails the add.
+//
+//export AddStreamWrite
+func AddStreamWrite(sessionID C.longlong, data unsafe.Pointer, dataLen C.int) C.int {
+	session, ok := getAddStream(int64(sessionID))
+	if !ok {
+		return C.int(-1)
+	}
+
+	if err := checkAddedBytes(atomic.AddInt64(&session.written, int64(dataLen))); err != nil {
+		logError("writing to add stream %d: %s", int64(sessionID), err)
+		session.writer.CloseWithError(err)
+		return C.int(-3)
+	}
+
+	if _, err := session.writer.Write(C.GoBytes(data, dataLen)); err != nil {
+		logError("writing to add stream %d: %s", int64(sessionID), err)
+		return C.int(-2)
+	}
+	return C.int(0)
+}
+
+// AddStreamFinish ends the content of an add stream session, waits for the
+// add to complete and returns the CID, or NULL if the add failed.
+// The session ID is invalid afterwards.
+//
+//export AddStreamFinish
+func AddStreamFinish(sessionID C.longlong) *C.char {
+	session, ok := takeAddStream(int64(sessionID))
+	if !ok {
+		return nil
+	}
+	defer ReleaseNode(session.repoPath)
+
+	session.writer.Close()
+	result := <-session.result
+	if result.err != nil {
+		logError("adding stream %d: %s", int64(sessionID), result.err)
+		return nil
+	}
+
+	log.Printf("DEBUG: Add stream %d added with CID: %s\n", int64(sessionID), result.cid)
+	return C.CString(result.cid)
+}
+
+// AddStreamAbort discards an add stream session. Blocks already stored may
+// remain in the blockstore until garbage collection, but nothing is pinned.
+//
+//export AddStreamAbort
+func AddStreamAbort(sessionID C.longlong) C.int {
+	session, ok := takeAddStream(int64(sessionID))
+	if !ok {
+		return C.int(-1)
+	}
+	defer ReleaseNode(session.repoPath)
+
+	session.writer.CloseWithError(errAddStreamAborted)
+	<-session.result
+	return C.int(0)
+}
+
+// getAddStream looks up an add stream session
+func getAddStream(id int64) (*addStreamSession, bool) {
+	addStreamsMutex.Lock()
+	defer addStreamsMutex.Unlock()
+
+	session, exists := addStreams[id]
+	if !exists {
+		log.Printf("ERROR:  add stream %d not found\n", id)
+	}
+	return session, exists
+}
+
+// takeAddStream looks up an add stream session and removes it from the registry
+func takeAddStream(id int64) (*addStreamSession, bool) {
+	addStreamsMutex.Lock()
+	defer addStreamsMutex.Unlock()
+
+	session, exists := addStreams[id]
+	if !exists {
+		logError("add stream %d not found", id)
+		return nil, false
+	}
+	delete(addStreams, id)
+	return session, true
+}
@@ -0,0 +1,295 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	lockfile "github.com/ipfs/go-fs-lock"
+	"github.com/ipfs/kubo/config"
+	serialize "github.com/ipfs/kubo/config/serialize"
+	"github.com/ipfs/kubo/repo/fsrepo"
+)
+
+// BackupRepo writes a snapshot of a whole repo (config, identity, keystore,
+// datastore and all blocks) to a tar archive, e.g. to carry a node's identity
+// and pins over an app reinstall. The archive only holds the repo directory,
+// so repos keeping a datastore outside of it, like the blocks of repos created
+// with CreateRepoWithBlocksPath, are refused (-6). The repo lock is held while
+// the archive is written, so no other process can modify the repo meanwhile,
+// and a backup is refused (-2) while a node is running on the repo in this
+// process or another backup of it is in progress. No node can start on the
+// repo until the backup is done; nodes of other repos are unaffected.
+// The archive is written to a temporary file and only renamed to destTarPath
+// once complete. Restore it with RestoreRepo.
+//
+//export BackupRepo
+func BackupRepo(repoPath, destTarPath *C.char) C.int {
+	path := C.GoString(repoPath)
+	dest := C.GoString(destTarPath)
+
+	if !fsrepo.IsInitialized(path) {
+		logError("repository not initialized at %s", path)
+		return C.int(-1)
+	}
+
+	external, err := externalDatastorePaths(path)
+	if err != nil {
+		logError("reading datastore paths: %s", err)
+		return C.int(-1)
+	}
+	if len(external) > 0 {
+		logError("cannot back up %s: datastore outside the repo at %s", path, strings.Join(external, ", "))
+		return C.int(-6)
+	}
+
+	// Keeps nodes from starting on the repo meanwhile
+	release, err := reserveIdleRepo(path)
+	if err != nil {
+		logError("cannot back up %s: %s", path, err)
+		return C.int(-2)
+	}
+	defer release()
+
+	// Keeps other processes from opening the repo during the backup
+	lock, err := lockfile.Lock(path, fsrepo.LockFile)
+	if err != nil {
+		logError("locking repository: %s", err)
+		return C.int(-3)
+	}
+	defer lock.Close()
+
+	tmpPath := dest + ".tmp"
+	tarFile, err := os.Create(tmpPath)
+	if err != nil {
+		logError("creating backup archive: %s", err)
+		return C.int(-4)
+	}
+	err = writeRepoTar(path, tarFile)
+	if closeErr := tarFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		logError("writing backup archive: %s", err)
+		return C.int(-5)
+	}
+	if err := os.Rename(tmpPath, dest); err != nil {
+		os.Remove(tmpPath)
+		logError("moving backup archive into place: %s", err)
+		return C.int(-5)
+	}
+
+	log.Printf("DEBUG: Backed up repo %s to %s\n", path, dest)
+	return C.int(0)
+}
+
+// reserveIdleRepo marks a repo without a running node as busy, so no node
+// can start on it until the returned function is called. Fails if a node is
+// running on the repo or it is already busy.
+func reserveIdleRepo(repoPath string) (func(), error) {
+	activeNodesMutex.Lock()
+	defer activeNodesMutex.Unlock()
+	if _, exists := activeNodes[repoPath]; exists {
+		return nil, fmt.Errorf("a node is running on it")
+	}
+	if busyRepos[repoPath] {
+		return nil, errRepoBusy
+	}
+	busyRepos[repoPath] = true
+
+	return func() {
+		activeNodesMutex.Lock()
+		delete(busyRepos, repoPath)
+		activeNodesMutex.Unlock()
+	}, nil
+}
+
+// externalDatastorePaths returns the paths of the datastores configured for
+// the repo at repoPath that lie outside of its directory. Relative paths are
+// always inside the repo, as they are relative to it.
+func externalDatastorePaths(repoPath string) ([]string, error) {
+	configFile, err := config.Filename(repoPath, "")
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		Datastore struct {
+			Spec map[string]interface{}
+		}
+	}
+	if err := serialize.ReadConfigFile(configFile, &cfg); err != nil {
+		return nil, err
+	}
+	absRepoPath, err := filepath.Abs(repoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var external []string
+	var walk func(spec map[string]interface{})
+	walk = func(spec map[string]interface{}) {
+		if dsPath, ok := spec["path"].(string); ok && filepath.IsAbs(dsPath) {
+			rel, err := filepath.Rel(absRepoPath, dsPath)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				external = append(external, dsPath)
+			}
+		}
+		// Wrappers keep their datastore as child, mounts as mounts
+		if child, ok := spec["child"].(map[string]interface{}); ok {
+			walk(child)
+		}
+		mounts, _ := spec["mounts"].([]interface{})
+		for _, mount := range mounts {
+			if m, ok := mount.(map[string]interface{}); ok {
+				walk(m)
+			}
+		}
+	}
+	walk(cfg.Datastore.Spec)
+	return external, nil
+}
+
+// writeRepoTar writes the files below repoPath to a tar stream, leaving out
+// the repo lock
+func writeRepoTar(repoPath string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(repoPath, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(repoPath, file)
+		if err != nil {
+			return err
+		}
+		if rel == "." || rel == fsrepo.LockFile {
+			return nil
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return fmt.Errorf("unsupported file type in repo: %s", rel)
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// RestoreRepo restores a repo from an archive written by BackupRepo into
+// repoPath, which must not already contain a repo. If the archive can't be
+// restored completely, the partially restored files are removed again.
+//
+//export RestoreRepo
+func RestoreRepo(srcTarPath, repoPath *C.char) C.int {
+	src := C.GoString(srcTarPath)
+	path := C.GoString(repoPath)
+
+	if fsrepo.IsInitialized(path) {
+		logError("a repository already exists at %s", path)
+		return C.int(-1)
+	}
+
+	tarFile, err := os.Open(src)
+	if err != nil {
+		logError("opening backup archive: %s", err)
+		return C.int(-2)
+	}
+	defer tarFile.Close()
+
+	if err := os.MkdirAll(path, 0755); err != nil {
+		logError("creating repository directory: %s", err)
+		return C.int(-3)
+	}
+
+	restored, err := extractRepoTar(tarFile, path)
+	if err == nil && !fsrepo.IsInitialized(path) {
+		err = fmt.Errorf("archive doesn't contain a repository")
+	}
+	if err != nil {
+		// Remove what was restored, deepest paths first
+		for i := len(restored) - 1; i >= 0; i-- {
+			os.Remove(restored[i])
+		}
+		logError("restoring repository: %s", err)
+		return C.int(-4)
+	}
+
+	log.Printf("DEBUG: Restored repo %s from %s\n", path, src)
+	return C.int(0)
+}
+
+// extractRepoTar writes the entries of a tar stream below repoPath, returning
+// the paths created in the order they were created
+func extractRepoTar(r io.Reader, repoPath string) ([]string, error) {
+	var restored []string
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return restored, nil
+		}
+		if err != nil {
+			return restored, fmt.Errorf("reading archive: %w", err)
+		}
+
+		// Reject entries that would end up outside the repo
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return restored, fmt.Errorf("invalid path in archive: %s", header.Name)
+		}
+		target := filepath.Join(repoPath, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(header.Mode).Perm()|0700); err != nil {
+				return restored, err
+			}
+		case tar.TypeReg:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return restored, err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return append(restored, target), err
+			}
+		default:
+			return restored, fmt.Errorf("unsupported entry type in archive: %s", header.Name)
+		}
+		restored = append(restored, target)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	nodep2p "github.com/ipfs/kubo/core/node/libp2p"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// bandwidthChunkSize is the most a throttled stream reads or writes at once,
+// bounding how long a single read or write waits at low rates
+const bandwidthChunkSize = 16 * 1024
+
+// Bandwidth limits set with SetBandwidthLimit, indexed by repo path
+var (
+	bandwidthLimits      = make(map[string]*streamLimits)
+	bandwidthLimitsMutex sync.Mutex
+)
+
+// SetBandwidthLimit limits the rate in bytes per second at which the node of
+// the repo receives (maxInBps) and sends (maxOutBps) data over its libp2p
+// streams, such as Bitswap, DHT and pubsub traffic, e.g. to keep a node on a
+// metered connection from saturating it. 0 means unlimited, the default.
+// The limits apply right away, also to a running node, and are shared by all
+// of its streams. This is best-effort rate shaping: reads are delayed after
+// the data has arrived, so peers slow down through flow control rather than
+// being cut off, bursts of up to a second's worth of data pass unthrottled,
+// and libp2p's own protocols such as identify and ping aren't limited.
+// Returns 0 on success or -1 if a limit is negative.
+//
+//export SetBandwidthLimit
+func SetBandwidthLimit(repoPath *C.char, maxInBps C.longlong, maxOutBps C.longlong) C.int {
+	path := C.GoString(repoPath)
+
+	if maxInBps < 0 || maxOutBps < 0 {
+		logError("bandwidth limits must not be negative: %d, %d", int64(maxInBps), int64(maxOutBps))
+		return C.int(-1)
+	}
+
+	limits := streamLimitsFor(path)
+	limits.in.setRate(int64(maxInBps))
+	limits.out.setRate(int64(maxOutBps))
+
+	log.Printf("DEBUG: Set bandwidth limit of repo %s to %d B/s in, %d B/s out\n", path, int64(maxInBps), int64(maxOutBps))
+	return C.int(0)
+}
+
+// streamLimits holds the incoming and outgoing rate limits of a repo's node
+type streamLimits struct {
+	in  rateLimiter
+	out rateLimiter
+}
+
+// streamLimitsFor returns the limits of a repo, creating unlimited ones if
+// none have been set yet
+func streamLimitsFor(repoPath string) *streamLimits {
+	bandwidthLimitsMutex.Lock()
+	defer bandwidthLimitsMutex.Unlock()
+	limits, ok := bandwidthLimits[repoPath]
+	if !ok {
+		limits = &streamLimits{}
+		bandwidthLimits[repoPath] = limits
+	}
+	return limits
+}
+
+// throttledHostOption builds the libp2p host of the repo's node as Kubo
+// does, wrapped so that its streams are subject to the repo's bandwidth
+// limits. Kubo wraps the result in its routed host, which opens streams and
+// registers protocol handlers through it.
+func throttledHostOption(repoPath string) nodep2p.HostOption {
+	return func(id peer.ID, ps peerstore.Peerstore, options ...libp2p.Option) (host.Host, error) {
+		h, err := nodep2p.DefaultHostOption(id, ps, options...)
+		if err != nil {
+			return nil, err
+		}
+		return &throttledHost{Host: h, limits: streamLimitsFor(repoPath)}, nil
+	}
+}
+
+// throttledHost is a libp2p host whose streams are rate limited
+type throttledHost struct {
+	host.Host
+	limits *streamLimits
+}
+
+func (h *throttledHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	s, err := h.Host.NewStream(ctx, p, pids...)
+	if err != nil {
+		return nil, err
+	}
+	return &throttledStream{Stream: s, limits: h.limits}, nil
+}
+
+func (h *throttledHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.Host.SetStreamHandler(pid, h.throttleHandler(handler))
+}
+
+func (h *throttledHost) SetStreamHandlerMatch(pid protocol.ID, match func(protocol.ID) bool, handler network.StreamHandler) {
+	h.Host.SetStreamHandlerMatch(pid, match, h.throttleHandler(handler))
+}
+
+// throttleHandler wraps the streams a protocol handler is given
+func (h *throttledHost) throttleHandler(handler network.StreamHandler) network.StreamHandler {
+	return func(s network.Stream) {
+		handler(&throttledStream{Stream: s, limits: h.limits})
+	}
+}
+
+// throttledStream is a libp2p stream whose reads and writes wait for the
+// limits of its host
+type throttledStream struct {
+	network.Stream
+	limits *streamLimits
+}
+
+func (s *throttledStream) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunkSize && s.limits.in.limited() {
+		p = p[:bandwidthChunkSize]
+	}
+	n, err := s.Stream.Read(p)
+	s.limits.in.wait(n)
+	return n, err
+}
+
+func (s *throttledStream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > bandwidthChunkSize && s.limits.out.limited() {
+			chunk = chunk[:bandwidthChunkSize]
+		}
+		s.limits.out.wait(len(chunk))
+		n, err := s.Stream.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// rateLimiter is a token bucket allowing rate bytes per second, with bursts
+// of up to a second's worth. Waiters may take more than is available, which
+// later waiters then wait for. The zero value is unlimited.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// setRate changes the rate, 0 meaning unlimited. A new limit starts with a
+// full bucket.
+func (l *rateLimiter) setRate(rate int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.rate == 0 {
+		l.tokens = float64(rate)
+	} else {
+		l.refill(time.Now())
+		if l.tokens > float64(rate) {
+			l.tokens = float64(rate)
+		}
+	}
+	l.rate = rate
+	l.last = time.Now()
+}
+
+// limited returns whether a rate is set
+func (l *rateLimiter) limited() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate > 0
+}
+
+// wait blocks until n bytes may pass
+func (l *rateLimiter) wait(n int) {
+	if n <= 0 {
+		return
+	}
+	l.mutex.Lock()
+	if l.rate == 0 {
+		l.mutex.Unlock()
+		return
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// refill adds the tokens accrued since the last refill, up to the burst size
+func (l *rateLimiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+}
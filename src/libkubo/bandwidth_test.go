@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var limiter rateLimiter
+
+	start := time.Now()
+	limiter.wait(1 << 20)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("unlimited wait took %s", elapsed)
+	}
+
+	// A second's worth passes right away, the next half second's worth waits
+	limiter.setRate(64 * 1024)
+	start = time.Now()
+	for i := 0; i < 6; i++ {
+		limiter.wait(16 * 1024)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatalf("96KiB at 64KiB/s took %s", elapsed)
+	}
+
+	limiter.setRate(0)
+	start = time.Now()
+	limiter.wait(1 << 20)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("wait after removing the limit took %s", elapsed)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"encoding/json"
+
+	"github.com/ipfs/boxo/bitswap"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// BitswapLedgerInfo is the Bitswap accounting of the exchanges with a peer.
+// DebtRatio is the bytes sent to the peer divided by the bytes received from
+// it (plus one): peers with a high ratio take more than they give.
+type BitswapLedgerInfo struct {
+	Peer          string  `json:"peer"`
+	DebtRatio     float64 `json:"debtRatio"`
+	Exchanged     uint64  `json:"exchanged"`
+	BytesSent     uint64  `json:"bytesSent"`
+	BytesReceived uint64  `json:"bytesReceived"`
+}
+
+// BitswapLedger returns the Bitswap ledger of the exchanges with a peer as a
+// BitswapLedgerInfo JSON object, showing whether the peer contributes blocks
+// or only fetches them. Peers the node hasn't exchanged blocks with have an
+// empty ledger. Returns NULL for an invalid peer ID or an offline node.
+//
+//export BitswapLedger
+func BitswapLedger(repoPath, peerID *C.char) *C.char {
+	path := C.GoString(repoPath)
+
+	pid, err := peer.Decode(C.GoString(peerID))
+	if err != nil {
+		logError("decoding peer ID: %s", err)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	bs, ok := node.Exchange.(*bitswap.Bitswap)
+	if !ok {
+		logError("node for repo %s is not running Bitswap", path)
+		return nil
+	}
+	receipt := bs.LedgerForPeer(pid)
+
+	ledger := BitswapLedgerInfo{
+		Peer:          receipt.Peer,
+		DebtRatio:     receipt.Value,
+		Exchanged:     receipt.Exchanged,
+		BytesSent:     receipt.Sent,
+		BytesReceived: receipt.Recv,
+	}
+
+	// Convert to JSON
+	ledgerJSON, err := json.Marshal(ledger)
+	if err != nil {
+		logError("marshaling ledger to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(ledgerJSON))
+}
@@ -0,0 +1,68 @@
+package main
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+// Callbacks are passed from Python as plain function pointers (uintptr_t)
+
+typedef void (*progress_callback)(long long current, long long total);
+typedef void (*string_callback)(char* data);
+typedef void (*bytes_callback)(char* key, void* data, int len);
+
+static void call_progress_callback(uintptr_t cb, long long current, long long total) {
+	((progress_callback)cb)(current, total);
+}
+
+static void call_string_callback(uintptr_t cb, char* data) {
+	((string_callback)cb)(data);
+}
+
+static void call_bytes_callback(uintptr_t cb, char* key, void* data, int len) {
+	((bytes_callback)cb)(key, data, len);
+}
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+// callProgressCallback invokes a progress callback of type
+// void(long long current, long long total). A total of -1 means unknown.
+func callProgressCallback(cb C.uintptr_t, current, total int64) {
+	if cb == 0 {
+		return
+	}
+	C.call_progress_callback(cb, C.longlong(current), C.longlong(total))
+}
+
+// callStringCallback invokes a callback of type void(char* data).
+// The string is freed after the callback returns, so the callee must copy it.
+func callStringCallback(cb C.uintptr_t, data string) {
+	if cb == 0 {
+		return
+	}
+	cData := C.CString(data)
+	defer C.free(unsafe.Pointer(cData))
+	C.call_string_callback(cb, cData)
+}
+
+// callBytesCallback invokes a callback of type
+// void(char* key, void* data, int len), passing NULL and a len of -1 for nil
+// data. The key and data are freed after the callback returns, so the callee
+// must copy them.
+func callBytesCallback(cb C.uintptr_t, key string, data []byte) {
+	if cb == 0 {
+		return
+	}
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
+	if data == nil {
+		C.call_bytes_callback(cb, cKey, nil, C.int(-1))
+		return
+	}
+	cData := C.CBytes(data)
+	defer C.free(cData)
+	C.call_bytes_callback(cb, cKey, cData, C.int(len(data)))
+}
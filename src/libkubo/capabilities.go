@@ -0,0 +1,134 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/ipfs/kubo/config"
+	"github.com/ipfs/kubo/core"
+)
+
+// Capability tells whether an experimental feature was requested, by the
+// options nodes are built with or by the repo's config, and whether it is
+// actually active on the node. Reason explains why a feature isn't active.
+type Capability struct {
+	Requested bool   `json:"requested"`
+	Active    bool   `json:"active"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// onlineOnlyFeatures are the features that only exist on online nodes
+var onlineOnlyFeatures = map[string]bool{"pubsub": true, "ipnsPubsub": true, "p2p": true}
+
+// CapabilityReport lists the experimental features of a node by name:
+// "pubsub", "ipnsPubsub", "p2p" (the stream forwarding of P2PForward and
+// P2PListen), "p2pHttpProxy" and "filestore"
+type CapabilityReport struct {
+	Online   bool                  `json:"online"`
+	Features map[string]Capability `json:"features"`
+}
+
+// ValidateCapabilities reports which experimental features are active on
+// the repo's node compared to those requested, as a CapabilityReport, e.g.
+// to find out why P2PForward does nothing. Requesting a feature doesn't
+// guarantee it: an offline node has neither pubsub nor p2p streams, and the
+// filestore only takes effect for nodes started after enabling it. Features
+// requested but not active are also logged as warnings when a node starts.
+// Returns NULL if the node couldn't be acquired or its config can't be read.
+//
+//export ValidateCapabilities
+func ValidateCapabilities(repoPath *C.char) *C.char {
+	path := C.GoString(repoPath)
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	cfg, err := node.Repo.Config()
+	if err != nil {
+		logError("getting repository config: %s", err)
+		return nil
+	}
+
+	report := nodeCapabilities(node, cfg, nodeExtraOpts())
+	logInactiveCapabilities(path, report)
+
+	// Convert to JSON
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		logError("marshaling capabilities to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(reportJSON))
+}
+
+// logInactiveCapabilities warns about the experimental features requested
+// for the repo's node that it doesn't have. Features that only exist on
+// online nodes are expected to be missing from offline ones, which are
+// started to read the repo, so they are skipped for those.
+func logInactiveCapabilities(repoPath string, report CapabilityReport) {
+	for name, capability := range report.Features {
+		if onlineOnlyFeatures[name] && !report.Online {
+			continue
+		}
+		if capability.Requested && !capability.Active {
+			log.Printf("WARNING: %s is requested but not active on the node of repo %s: %s\n", name, repoPath, capability.Reason)
+		}
+	}
+}
+
+// nodeCapabilities compares the experimental features requested by
+// extraOpts and cfg with those the node was built with
+func nodeCapabilities(node *core.IpfsNode, cfg *config.Config, extraOpts map[string]bool) CapabilityReport {
+	features := make(map[string]Capability)
+	// online describes a feature that only exists on online nodes
+	online := func(requested, active bool) Capability {
+		capability := Capability{Requested: requested, Active: active}
+		if !active && !node.IsOnline {
+			capability.Reason = "node is offline"
+		}
+		return capability
+	}
+
+	features["pubsub"] = online(
+		extraOpts["pubsub"] || cfg.Pubsub.Enabled.WithDefault(false),
+		node.PubSub != nil,
+	)
+	features["ipnsPubsub"] = online(
+		extraOpts["ipnsps"] || cfg.Ipns.UsePubsub.WithDefault(false),
+		node.PSRouter != nil,
+	)
+	// Kubo sets up p2p streams on every online node; the config flag only
+	// guards the daemon's commands
+	features["p2p"] = online(
+		extraOpts["libp2p-stream-mounting"] || cfg.Experimental.Libp2pStreamMounting,
+		node.P2P != nil,
+	)
+	features["p2pHttpProxy"] = Capability{
+		Requested: cfg.Experimental.P2pHttpProxy,
+		Reason:    "only served by the gateway of the Kubo daemon",
+	}
+
+	filestore := Capability{
+		Requested: cfg.Experimental.FilestoreEnabled || cfg.Experimental.UrlstoreEnabled,
+		Active:    node.Filestore != nil,
+	}
+	switch {
+	case filestore.Requested && !filestore.Active:
+		filestore.Reason = "enabled after the node started"
+	case !filestore.Requested && !filestore.Active:
+		filestore.Reason = "Experimental.FilestoreEnabled is off (see SetFilestoreEnabled)"
+	}
+	features["filestore"] = filestore
+
+	return CapabilityReport{Online: node.IsOnline, Features: features}
+}
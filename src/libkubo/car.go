@@ -0,0 +1,302 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	dag "github.com/ipfs/boxo/ipld/merkledag"
+	cidlib "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	carv2 "github.com/ipld/go-car/v2"
+	carblockstore "github.com/ipld/go-car/v2/blockstore"
+	_ "github.com/ipld/go-codec-dagpb"
+	ipldprime "github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/multicodec"
+	"github.com/ipld/go-ipld-prime/traversal"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// CarVerification is the result of checking a CAR for the DAG of a root.
+// Blocks counts the blocks in the CAR and Reachable those of the root's DAG
+// among them. Missing lists the CIDs the DAG links to that the CAR doesn't
+// contain, and Corrupted the blocks whose data doesn't match their CID, which
+// are treated as missing. Complete is set if neither list has entries.
+type CarVerification struct {
+	Root      string   `json:"root"`
+	Roots     []string `json:"roots"`
+	Complete  bool     `json:"complete"`
+	Blocks    int      `json:"blocks"`
+	Reachable int      `json:"reachable"`
+	Missing   []string `json:"missing"`
+	Corrupted []string `json:"corrupted"`
+}
+
+// VerifyCar checks that the CAR file at srcPath contains the complete DAG of
+// rootCid, so incomplete archives are caught before they are imported rather
+// than when fetching their content hangs. The DAG is walked within the
+// CAR's blocks only, without a node or the network. rootCid may be empty for
+// a CAR with a single root. Returns a CarVerification JSON object, or NULL if
+// the CAR can't be read or the root is invalid.
+//
+//export VerifyCar
+func VerifyCar(srcPath, rootCid *C.char) *C.char {
+	src := C.GoString(srcPath)
+	root := C.GoString(rootCid)
+
+	verification, err := verifyCar(src, root)
+	if err != nil {
+		logError("verifying CAR %s: %s", src, err)
+		return nil
+	}
+
+	// Convert to JSON
+	verificationJSON, err := json.Marshal(verification)
+	if err != nil {
+		logError("marshaling CAR verification to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(verificationJSON))
+}
+
+// PackForSharing writes the complete DAG of cidStr to a CARv1 file at
+// destCarPath, e.g. to hand content to another device without internet
+// access. Each block is written once, in depth-first order from the root, and
+// the CAR has the CID as its only root, so the receiver can check it with
+// VerifyCar and import it into any node. Blocks not in the repo are fetched
+// from the network if the node is online. The CAR is written to a temporary
+// file and only renamed to destCarPath once complete.
+// Returns 0 on success, -1 if the node couldn't be acquired, -2 for an
+// invalid CID, -3 if a block of the DAG couldn't be read and -4 if the CAR
+// couldn't be written.
+//
+//export PackForSharing
+func PackForSharing(repoPath, cidStr, destCarPath *C.char) C.int {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+	cid := C.GoString(cidStr)
+	dest := C.GoString(destCarPath)
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return C.int(-2)
+	}
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	log.Printf("DEBUG: Packing DAG of %s into %s\n", cid, dest)
+	tmpPath := dest + ".tmp"
+	blocks, err := packCar(ctx, api.Dag(), decodedCid, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		logError("packing DAG of %s: %s", cid, err)
+		if errors.Is(err, errCarWrite) {
+			return C.int(-4)
+		}
+		return C.int(-3)
+	}
+	if err := os.Rename(tmpPath, dest); err != nil {
+		os.Remove(tmpPath)
+		logError("moving CAR into place: %s", err)
+		return C.int(-4)
+	}
+
+	log.Printf("DEBUG: Packed %d blocks of %s\n", blocks, cid)
+	return C.int(0)
+}
+
+// errCarWrite marks packCar errors writing the CAR rather than reading the DAG
+var errCarWrite = errors.New("writing CAR")
+
+// packCar writes the DAG of root to a CARv1 file at dest, each block once in
+// depth-first order, returning the number of blocks written
+func packCar(ctx context.Context, dagService ipld.DAGService, root cidlib.Cid, dest string) (int, error) {
+	car, err := carblockstore.OpenReadWrite(dest, []cidlib.Cid{root}, carv2.WriteAsCarV1(true))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", errCarWrite, err)
+	}
+
+	count := 0
+	getLinks := func(ctx context.Context, c cidlib.Cid) ([]*ipld.Link, error) {
+		nd, err := dagService.Get(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if err := car.Put(ctx, nd); err != nil {
+			return nil, fmt.Errorf("%w: %s", errCarWrite, err)
+		}
+		count++
+		return nd.Links(), nil
+	}
+	// Walk visits each block once, so it is only written once
+	visited := cidlib.NewSet()
+	if err := dag.Walk(ctx, getLinks, root, visited.Visit); err != nil {
+		car.Discard()
+		return 0, err
+	}
+
+	if err := car.Finalize(); err != nil {
+		return 0, fmt.Errorf("%w: %s", errCarWrite, err)
+	}
+	return count, nil
+}
+
+// verifyCar walks the DAG of root within the blocks of the CAR at src. Only
+// the links of each block are kept while reading, not its data, so large
+// CARs can be checked.
+func verifyCar(src, root string) (*CarVerification, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader, err := carv2.NewBlockReader(bufio.NewReader(f), carv2.ZeroLengthSectionAsEOF(true))
+	if err != nil {
+		return nil, fmt.Errorf("reading CAR header: %w", err)
+	}
+
+	verification := &CarVerification{
+		Roots:     make([]string, 0, len(reader.Roots)),
+		Missing:   []string{},
+		Corrupted: []string{},
+	}
+	for _, c := range reader.Roots {
+		verification.Roots = append(verification.Roots, c.String())
+	}
+
+	var rootCID cidlib.Cid
+	if root != "" {
+		if rootCID, err = cidlib.Decode(root); err != nil {
+			return nil, fmt.Errorf("decoding root CID: %w", err)
+		}
+	} else if len(reader.Roots) == 1 {
+		rootCID = reader.Roots[0]
+	} else {
+		return nil, fmt.Errorf("CAR has %d roots, a root CID must be given", len(reader.Roots))
+	}
+	verification.Root = rootCID.String()
+
+	// The links of each valid block, by CID; corrupted blocks are recorded
+	// separately so they are reported once even if linked several times
+	links := make(map[cidlib.Cid][]cidlib.Cid)
+	corrupted := make(map[cidlib.Cid]bool)
+	for {
+		// The reader doesn't check block data against the CIDs itself
+		block, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading CAR block: %w", err)
+		}
+		verification.Blocks++
+
+		c := block.Cid()
+		if sum, err := c.Prefix().Sum(block.RawData()); err != nil || !sum.Equals(c) {
+			corrupted[c] = true
+			continue
+		}
+		blockLinks, err := linksOf(c, block.RawData())
+		if err != nil {
+			return nil, fmt.Errorf("decoding block %s: %w", c, err)
+		}
+		links[c] = blockLinks
+	}
+
+	// Walk the DAG from the root over the blocks read
+	seen := map[cidlib.Cid]bool{rootCID: true}
+	queue := []cidlib.Cid{rootCID}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+
+		blockLinks, ok := links[c]
+		if !ok {
+			blockLinks, ok, err = identityLinks(c)
+			if err != nil {
+				return nil, fmt.Errorf("decoding block %s: %w", c, err)
+			}
+		} else {
+			verification.Reachable++
+		}
+		if !ok {
+			if corrupted[c] {
+				verification.Corrupted = append(verification.Corrupted, c.String())
+			} else {
+				verification.Missing = append(verification.Missing, c.String())
+			}
+			continue
+		}
+		for _, link := range blockLinks {
+			if !seen[link] {
+				seen[link] = true
+				queue = append(queue, link)
+			}
+		}
+	}
+
+	verification.Complete = len(verification.Missing) == 0 && len(verification.Corrupted) == 0
+	return verification, nil
+}
+
+// identityLinks returns the links of a block inlined in an identity CID,
+// which needs no block in the CAR. Returns false for other CIDs.
+func identityLinks(c cidlib.Cid) ([]cidlib.Cid, bool, error) {
+	decoded, err := mh.Decode(c.Hash())
+	if err != nil || decoded.Code != mh.IDENTITY {
+		return nil, false, nil
+	}
+	blockLinks, err := linksOf(c, decoded.Digest)
+	return blockLinks, true, err
+}
+
+// linksOf returns the CIDs a block links to
+func linksOf(c cidlib.Cid, data []byte) ([]cidlib.Cid, error) {
+	codec := c.Prefix().Codec
+	if codec == cidlib.Raw {
+		return nil, nil
+	}
+	decode, err := multicodec.LookupDecoder(codec)
+	if err != nil {
+		return nil, err
+	}
+	node, err := ipldprime.Decode(data, decode)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := traversal.SelectLinks(node)
+	if err != nil {
+		return nil, err
+	}
+
+	blockLinks := make([]cidlib.Cid, 0, len(selected))
+	for _, link := range selected {
+		cl, ok := link.(cidlink.Link)
+		if !ok {
+			return nil, errors.New("unsupported link type")
+		}
+		blockLinks = append(blockLinks, cl.Cid)
+	}
+	return blockLinks, nil
+}
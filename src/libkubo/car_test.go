@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	"github.com/ipfs/boxo/files"
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/ipld/go-car/v2/blockstore"
+)
+
+func TestVerifyCarReportsMissingBlocks(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	// Several distinct chunks, so the root links to leaves that can be left out
+	data := make([]byte, 16*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	resolved, err := api.Unixfs().Add(ctx, files.NewBytesFile(data), options.Unixfs.Chunker("size-4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := resolved.Cid()
+
+	rootNode, err := api.Dag().Get(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refs []cidlib.Cid
+	for _, link := range rootNode.Links() {
+		refs = append(refs, link.Cid)
+	}
+	if len(refs) < 2 {
+		t.Fatalf("expected several leaves, got %d", len(refs))
+	}
+	left := refs[0]
+
+	writeCar := func(name string, skip cidlib.Cid) string {
+		carPath := filepath.Join(t.TempDir(), name)
+		bs, err := blockstore.OpenReadWrite(carPath, []cidlib.Cid{root})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range append([]cidlib.Cid{root}, refs...) {
+			if c.Equals(skip) {
+				continue
+			}
+			block, err := api.Dag().Get(ctx, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := bs.Put(ctx, block); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := bs.Finalize(); err != nil {
+			t.Fatal(err)
+		}
+		return carPath
+	}
+
+	full, err := verifyCar(writeCar("full.car", cidlib.Undef), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !full.Complete || len(full.Missing) != 0 || full.Reachable != len(refs)+1 {
+		t.Fatalf("complete CAR reported as %+v", full)
+	}
+
+	partial, err := verifyCar(writeCar("partial.car", left), root.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial.Complete || len(partial.Missing) != 1 || partial.Missing[0] != left.String() {
+		t.Fatalf("expected %s missing, got %+v", left, partial)
+	}
+
+	if _, err := verifyCar(writeCar("other.car", cidlib.Undef), "not-a-cid"); err == nil {
+		t.Fatal("expected an error for an invalid root")
+	}
+}
+
+func TestPackCar(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	// Identical files share their blocks, which must be packed only once
+	data := make([]byte, 16*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	dir := files.NewMapDirectory(map[string]files.Node{
+		"a.bin": files.NewBytesFile(data),
+		"b.bin": files.NewBytesFile(data),
+	})
+	resolved, err := api.Unixfs().Add(ctx, dir, options.Unixfs.Chunker("size-4096"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := resolved.Cid()
+
+	carPath := filepath.Join(t.TempDir(), "shared.car")
+	blocks, err := packCar(ctx, api.Dag(), root, carPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The directory, the file root and its four leaves
+	if blocks != 6 {
+		t.Errorf("packed %d blocks, expected 6", blocks)
+	}
+
+	verification, err := verifyCar(carPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verification.Complete || verification.Blocks != blocks || verification.Root != root.String() {
+		t.Fatalf("unexpected verification %+v", verification)
+	}
+}
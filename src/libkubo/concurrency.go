@@ -0,0 +1,150 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"sync"
+)
+
+// defaultMaxConcurrency is how many operations of batch helpers run at once
+// unless set otherwise with SetMaxConcurrency
+const defaultMaxConcurrency = 4
+
+// The operations of batch helpers share one limit across all repos, as they
+// share the memory of the process. The cond is signalled whenever a slot is
+// freed or the limit changes.
+var (
+	concurrencyMutex sync.Mutex
+	concurrencyCond  = sync.NewCond(&concurrencyMutex)
+	maxConcurrency   = defaultMaxConcurrency
+	inFlight         int
+)
+
+// SetMaxConcurrency sets how many Unixfs and pin operations batch helpers
+// like AddFiles, PinCIDs and UnpinCIDs run at once, and how many files of
+// directory downloads are written at once, across all repos, e.g. 1 on
+// memory-constrained devices. Operations already running are not
+// affected; a lower limit applies as they finish. Operations nested in one
+// that counts against the limit run within its slot, one at a time, rather
+// than waiting for slots of their own. The default is 4.
+// Returns 0 on success or -1 if n is less than 1.
+//
+//export SetMaxConcurrency
+func SetMaxConcurrency(n C.int) C.int {
+	if n < 1 {
+		logError("max concurrency must be at least 1: %d", int(n))
+		return C.int(-1)
+	}
+
+	concurrencyMutex.Lock()
+	maxConcurrency = int(n)
+	concurrencyMutex.Unlock()
+	// A higher limit may let waiting operations start
+	concurrencyCond.Broadcast()
+	return C.int(0)
+}
+
+// GetInFlightCount returns how many operations of batch helpers are running,
+// for monitoring the limit set with SetMaxConcurrency.
+//
+//export GetInFlightCount
+func GetInFlightCount() C.int {
+	concurrencyMutex.Lock()
+	defer concurrencyMutex.Unlock()
+	return C.int(inFlight)
+}
+
+// slotKey marks the context of an operation holding a slot
+type slotKey struct{}
+
+// holdsSlot reports whether ctx belongs to an operation holding a slot
+func holdsSlot(ctx context.Context) bool {
+	return ctx.Value(slotKey{}) != nil
+}
+
+// acquireSlot waits until an operation may start under the concurrency limit.
+// The slot must be released with releaseSlot. Returns ctx's error, without a
+// slot, if ctx is cancelled first. Operations nested in one holding a slot
+// must not call it, as they would deadlock once the slots are all taken by
+// their parents; goInSlot takes care of that.
+func acquireSlot(ctx context.Context) error {
+	// Wakes the wait below on cancellation, which the cond doesn't observe
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			concurrencyMutex.Lock()
+			concurrencyCond.Broadcast()
+			concurrencyMutex.Unlock()
+		case <-done:
+		}
+	}()
+
+	concurrencyMutex.Lock()
+	defer concurrencyMutex.Unlock()
+	for inFlight >= maxConcurrency {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		concurrencyCond.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	inFlight++
+	return nil
+}
+
+// releaseSlot frees a slot taken with acquireSlot
+func releaseSlot() {
+	concurrencyMutex.Lock()
+	inFlight--
+	concurrencyMutex.Unlock()
+	concurrencyCond.Broadcast()
+}
+
+// goInSlot runs op in a new goroutine tracked by wg once a slot is free,
+// passing it a context derived from ctx that marks it as holding the slot.
+// If ctx already holds one, op is nested in another operation and runs
+// right away in the calling goroutine, within that slot. Returns ctx's
+// error, without running op, if ctx is cancelled before a slot is free.
+func goInSlot(ctx context.Context, wg *sync.WaitGroup, op func(ctx context.Context)) error {
+	if holdsSlot(ctx) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		op(ctx)
+		return nil
+	}
+
+	if err := acquireSlot(ctx); err != nil {
+		return err
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer releaseSlot()
+		op(context.WithValue(ctx, slotKey{}, true))
+	}()
+	return nil
+}
+
+// runBatch calls op for each index from 0 to count-1, running the calls
+// concurrently under the concurrency limit, and returns once all are done.
+// op must use the context it is passed, so that batches nested in it run
+// one call at a time within its slot instead of waiting for more slots.
+// Calls that can't start because ctx is cancelled are passed to skipped with
+// its error instead.
+func runBatch(ctx context.Context, count int, op func(ctx context.Context, i int), skipped func(i int, err error)) {
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		i := i
+		if err := goInSlot(ctx, &wg, func(ctx context.Context) { op(ctx, i) }); err != nil {
+			skipped(i, err)
+		}
+	}
+	wg.Wait()
+}
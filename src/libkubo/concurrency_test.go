@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setTestMaxConcurrency(t testing.TB, n int) {
+	t.Helper()
+	concurrencyMutex.Lock()
+	prev := maxConcurrency
+	maxConcurrency = n
+	concurrencyMutex.Unlock()
+	t.Cleanup(func() {
+		concurrencyMutex.Lock()
+		maxConcurrency = prev
+		concurrencyMutex.Unlock()
+	})
+}
+
+func TestRunBatchBoundsConcurrency(t *testing.T) {
+	setTestMaxConcurrency(t, 2)
+
+	var mutex sync.Mutex
+	running, peak := 0, 0
+	done := make([]bool, 10)
+	runBatch(context.Background(), len(done), func(ctx context.Context, i int) {
+		mutex.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		done[i] = true
+		mutex.Unlock()
+	}, func(i int, err error) {
+		t.Errorf("operation %d skipped: %s", i, err)
+	})
+
+	if peak > 2 {
+		t.Fatalf("%d operations ran at once with a limit of 2", peak)
+	}
+	for i, ok := range done {
+		if !ok {
+			t.Fatalf("operation %d didn't run", i)
+		}
+	}
+	if n := GetInFlightCount(); n != 0 {
+		t.Fatalf("%d operations still in flight", n)
+	}
+}
+
+func TestRunBatchSkipsAfterCancel(t *testing.T) {
+	setTestMaxConcurrency(t, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ran, skipped := 0, 0
+	runBatch(ctx, 3, func(ctx context.Context, i int) {
+		ran++
+		// The others wait for this slot until the batch is cancelled
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+	}, func(i int, err error) {
+		if err != context.Canceled {
+			t.Errorf("operation %d skipped with %v", i, err)
+		}
+		skipped++
+	})
+
+	if ran != 1 || skipped != 2 {
+		t.Fatalf("expected 1 run and 2 skipped, got %d and %d", ran, skipped)
+	}
+}
+
+func TestRunBatchNested(t *testing.T) {
+	setTestMaxConcurrency(t, 1)
+
+	var mutex sync.Mutex
+	ran := 0
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		runBatch(context.Background(), 2, func(ctx context.Context, i int) {
+			// Waiting for another slot would never end with a limit of 1
+			runBatch(ctx, 2, func(ctx context.Context, j int) {
+				mutex.Lock()
+				ran++
+				mutex.Unlock()
+			}, func(j int, err error) {
+				t.Errorf("nested operation %d skipped: %s", j, err)
+			})
+		}, func(i int, err error) {
+			t.Errorf("operation %d skipped: %s", i, err)
+		})
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nested batch deadlocked")
+	}
+	if ran != 4 {
+		t.Fatalf("expected 4 nested operations to run, got %d", ran)
+	}
+	if n := GetInFlightCount(); n != 0 {
+		t.Fatalf("%d operations still in flight", n)
+	}
+}
@@ -0,0 +1,488 @@
+package main
+
+// #include <stdlib.h>
+// #include <stdbool.h>
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/kubo/config"
+	serialize "github.com/ipfs/kubo/config/serialize"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// The setters in this file edit the repo config, so their changes take effect
+// the next time the node for the repo is started. They return the error codes
+// of updateRepoConfig, with -4 meaning the supplied values were rejected.
+
+// SetSwarmAddrs sets the multiaddrs the node listens on (Addresses.Swarm).
+// addrsJSON is a JSON array of multiaddr strings, e.g. "/ip4/0.0.0.0/tcp/4001".
+//
+//export SetSwarmAddrs
+func SetSwarmAddrs(repoPath, addrsJSON *C.char) C.int {
+	path := C.GoString(repoPath)
+	addrsStr := C.GoString(addrsJSON)
+
+	return updateRepoConfig(path, func(cfg *config.Config) error {
+		var addrs []string
+		if err := json.Unmarshal([]byte(addrsStr), &addrs); err != nil {
+			return fmt.Errorf("parsing swarm addresses JSON: %w", err)
+		}
+		for _, addr := range addrs {
+			if _, err := ma.NewMultiaddr(addr); err != nil {
+				return fmt.Errorf("invalid swarm address %q: %w", addr, err)
+			}
+		}
+		cfg.Addresses.Swarm = addrs
+		return nil
+	})
+}
+
+// SetTransports enables or disables the node's network transports
+// (Swarm.Transports.Network), e.g. to force TCP-only on networks blocking UDP
+//
+//export SetTransports
+func SetTransports(repoPath *C.char, tcp C.bool, quic C.bool, websocket C.bool, webtransport C.bool) C.int {
+	path := C.GoString(repoPath)
+
+	return updateRepoConfig(path, func(cfg *config.Config) error {
+		if !bool(tcp) && !bool(quic) && !bool(websocket) && !bool(webtransport) {
+			return fmt.Errorf("at least one transport must be enabled")
+		}
+		network := &cfg.Swarm.Transports.Network
+		network.TCP = flag(bool(tcp))
+		network.QUIC = flag(bool(quic))
+		network.Websocket = flag(bool(websocket))
+		network.WebTransport = flag(bool(webtransport))
+		return nil
+	})
+}
+
+// SetRelayConfig toggles the circuit relay client (Swarm.RelayClient.Enabled),
+// which lets a node behind NAT be reached via relays, and DCUtR hole punching
+// (Swarm.EnableHolePunching), which upgrades relayed connections to direct ones.
+// Both are read from the config by the node builder in createNewNode.
+//
+//export SetRelayConfig
+func SetRelayConfig(repoPath *C.char, enableClient C.bool, enableHolePunching C.bool) C.int {
+	path := C.GoString(repoPath)
+
+	return updateRepoConfig(path, func(cfg *config.Config) error {
+		if bool(enableHolePunching) && !bool(enableClient) {
+			return fmt.Errorf("hole punching requires the relay client to be enabled")
+		}
+		cfg.Swarm.RelayClient.Enabled = flag(bool(enableClient))
+		cfg.Swarm.EnableHolePunching = flag(bool(enableHolePunching))
+		return nil
+	})
+}
+
+// SetReprovideStrategy sets which content is periodically announced to the
+// DHT (Reprovider.Strategy: "all", "pinned" or "roots") and how often
+// (Reprovider.Interval, a Go duration such as "12h"; "0" disables reproviding).
+// An empty interval leaves the current one unchanged.
+//
+//export SetReprovideStrategy
+func SetReprovideStrategy(repoPath, strategy, interval *C.char) C.int {
+	path := C.GoString(repoPath)
+	strategyStr := C.GoString(strategy)
+	intervalStr := C.GoString(interval)
+
+	return updateRepoConfig(path, func(cfg *config.Config) error {
+		switch strategyStr {
+		case "all", "pinned", "roots":
+		default:
+			return fmt.Errorf("unknown reprovide strategy %q", strategyStr)
+		}
+
+		if intervalStr != "" {
+			duration, err := time.ParseDuration(intervalStr)
+			if err != nil {
+				return fmt.Errorf("parsing reprovide interval: %w", err)
+			}
+			if duration < 0 {
+				return fmt.Errorf("reprovide interval must not be negative")
+			}
+			cfg.Reprovider.Interval = config.NewOptionalDuration(duration)
+		}
+		cfg.Reprovider.Strategy = config.NewOptionalString(strategyStr)
+		return nil
+	})
+}
+
+// SetInternalConfig tunes the Bitswap workers that send blocks to peers
+// (Internal.Bitswap.TaskWorkerCount and EngineTaskWorkerCount, 8 each by
+// default), for serving content faster on high-bandwidth links.
+// provideWorkers sets both counts; 0 leaves them unchanged and a negative
+// value restores the defaults. Values up to a few hundred are reasonable.
+// Every worker can hold a message of blocks for a peer in memory, so memory
+// use grows with the count; raise it only as far as the link is saturated.
+// The number of providers Bitswap asks for a block (10) is fixed in this
+// Kubo version, so maxProviders must be 0 (-5 otherwise). For announcing many
+// CIDs quickly, use ProvideMany and SetAcceleratedDHT instead.
+// Changes take effect when the node is next started.
+//
+//export SetInternalConfig
+func SetInternalConfig(repoPath *C.char, provideWorkers C.int, maxProviders C.int) C.int {
+	path := C.GoString(repoPath)
+	workers := int64(provideWorkers)
+
+	if maxProviders != 0 {
+		logError("the maximum number of providers can't be configured")
+		return C.int(-5)
+	}
+	if workers == 0 {
+		return C.int(0)
+	}
+
+	return updateRepoConfig(path, func(cfg *config.Config) error {
+		if cfg.Internal.Bitswap == nil {
+			cfg.Internal.Bitswap = &config.InternalBitswap{}
+		}
+		if workers < 0 {
+			cfg.Internal.Bitswap.TaskWorkerCount = config.OptionalInteger{}
+			cfg.Internal.Bitswap.EngineTaskWorkerCount = config.OptionalInteger{}
+			return nil
+		}
+		cfg.Internal.Bitswap.TaskWorkerCount = *config.NewOptionalInteger(workers)
+		cfg.Internal.Bitswap.EngineTaskWorkerCount = *config.NewOptionalInteger(workers)
+		return nil
+	})
+}
+
+// SetAcceleratedDHT enables or disables the accelerated DHT client
+// (Routing.AcceleratedDHTClient). It keeps a full routing table by crawling
+// the whole DHT, which makes provides and lookups much faster, at the cost
+// of considerably more memory and bandwidth plus a crawl of several minutes
+// after startup. It only applies when DHT routing is in use.
+//
+//export SetAcceleratedDHT
+func SetAcceleratedDHT(repoPath *C.char, enabled C.bool) C.int {
+	path := C.GoString(repoPath)
+
+	return updateRepoConfig(path, func(cfg *config.Config) error {
+		cfg.Routing.AcceleratedDHTClient = bool(enabled)
+		return nil
+	})
+}
+
+// delegatedRouterTimeout is how long a delegated routing endpoint may take to
+// answer before its results are given up on
+const delegatedRouterTimeout = 30 * time.Second
+
+// SetDelegatedRouting makes nodes started on the repo find content, peers and
+// IPNS records through HTTP delegated routing endpoints (IPIP-337, e.g.
+// "https://cid.contact") instead of the DHT, which saves the cost of
+// maintaining DHT connections, e.g. on mobile. endpointsJSON is a JSON array
+// of endpoint URLs, which are queried in parallel. An empty array or string
+// restores the default DHT routing.
+// Returns -5 for an invalid endpoint URL, otherwise as setRepoConfigKeys.
+//
+//export SetDelegatedRouting
+func SetDelegatedRouting(repoPath, endpointsJSON *C.char) C.int {
+	path := C.GoString(repoPath)
+	endpointsStr := C.GoString(endpointsJSON)
+
+	var endpoints []string
+	if endpointsStr != "" {
+		if err := json.Unmarshal([]byte(endpointsStr), &endpoints); err != nil {
+			logError("parsing endpoints JSON: %s", err)
+			return C.int(-5)
+		}
+	}
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			logError("invalid delegated routing endpoint: %q", endpoint)
+			return C.int(-5)
+		}
+	}
+
+	if len(endpoints) == 0 {
+		return setRepoConfigKeys(path, map[string]interface{}{
+			"Routing.Type":    nil,
+			"Routing.Routers": nil,
+			"Routing.Methods": nil,
+		})
+	}
+
+	routers := config.Routers{}
+	var parallel []config.ConfigRouter
+	for i, endpoint := range endpoints {
+		name := fmt.Sprintf("delegated-%d", i)
+		routers[name] = config.RouterParser{Router: config.Router{
+			Type:       config.RouterTypeHTTP,
+			Parameters: &config.HTTPRouterParams{Endpoint: endpoint},
+		}}
+		parallel = append(parallel, config.ConfigRouter{
+			RouterName: name,
+			Timeout:    config.Duration{Duration: delegatedRouterTimeout},
+			// Some endpoints don't support every method, e.g. providing
+			IgnoreErrors: true,
+		})
+	}
+	routers["delegated"] = config.RouterParser{Router: config.Router{
+		Type:       config.RouterTypeParallel,
+		Parameters: &config.ComposableRouterParams{Routers: parallel},
+	}}
+
+	methods := config.Methods{}
+	for _, method := range config.MethodNameList {
+		methods[method] = config.Method{RouterName: "delegated"}
+	}
+
+	// Replaced rather than merged, so routers of earlier calls don't linger
+	return setRepoConfigKeys(path, map[string]interface{}{
+		"Routing.Type":    "custom",
+		"Routing.Routers": routers,
+		"Routing.Methods": methods,
+	})
+}
+
+// SetPubsubRouter selects the pubsub router (Pubsub.Router) used by nodes
+// started on the repo, "gossipsub" (the default) or "floodsub".
+// Floodsub sends every message to every peer subscribed to the topic. That
+// gives simple, predictable delivery in small private networks, but its
+// bandwidth grows with the number of peers. Gossipsub forwards messages over
+// a bounded mesh of peers and gossips about the rest, so it scales to large
+// topics. It still talks to floodsub peers. An empty router means gossipsub.
+//
+//export SetPubsubRouter
+func SetPubsubRouter(repoPath, router *C.char) C.int {
+	path := C.GoString(repoPath)
+	routerStr := C.GoString(router)
+
+	return updateRepoConfig(path, func(cfg *config.Config) error {
+		switch routerStr {
+		case "":
+			routerStr = "gossipsub"
+		case "gossipsub", "floodsub":
+		default:
+			return fmt.Errorf("unknown pubsub router %q", routerStr)
+		}
+		cfg.Pubsub.Router = routerStr
+		return nil
+	})
+}
+
+// SetPubsubPeerScoring turns gossipsub peer scoring on or off for nodes
+// started on the repo. With peer scoring, the node scores its pubsub peers
+// by their behaviour and stops gossiping with or forwarding messages to
+// peers that misbehave; PubSubPeerScores shows the scores, e.g. to find out
+// why messages don't reach some peers. The setting is stored in the repo
+// config as Pubsub.PeerScoring and read when an online node starts, so a
+// running node must be cleaned up and restarted to apply it. It has no
+// effect with the floodsub router (see SetPubsubRouter).
+//
+//export SetPubsubPeerScoring
+func SetPubsubPeerScoring(repoPath *C.char, enabled C.bool) C.int {
+	path := C.GoString(repoPath)
+
+	return setRepoConfigKeys(path, map[string]interface{}{peerScoringKey: bool(enabled)})
+}
+
+// SetFilestoreEnabled toggles the experimental filestore
+// (Experimental.FilestoreEnabled), which lets files be added with the
+// "nocopy" add option so the blockstore references them on disk instead of
+// holding a second copy. Referenced files must stay unchanged in place, or
+// their content can no longer be retrieved. The setting is read when a node
+// starts, so a running node must be cleaned up and restarted to apply it.
+//
+//export SetFilestoreEnabled
+func SetFilestoreEnabled(repoPath *C.char, enabled C.bool) C.int {
+	path := C.GoString(repoPath)
+
+	return updateRepoConfig(path, func(cfg *config.Config) error {
+		cfg.Experimental.FilestoreEnabled = bool(enabled)
+		return nil
+	})
+}
+
+// SetAutoNATServiceMode sets whether the node offers the AutoNAT service
+// (AutoNAT.ServiceMode), dialing back peers that ask whether they are
+// publicly reachable: "enabled", "disabled", or "" for Kubo's default, which
+// currently enables it. Dial-backs are throttled per AutoNAT.Throttle.
+// The node's own reachability checks (see Reachability) are not affected.
+//
+//export SetAutoNATServiceMode
+func SetAutoNATServiceMode(repoPath, mode *C.char) C.int {
+	path := C.GoString(repoPath)
+	modeStr := C.GoString(mode)
+
+	return updateRepoConfig(path, func(cfg *config.Config) error {
+		return cfg.AutoNAT.ServiceMode.UnmarshalText([]byte(modeStr))
+	})
+}
+
+// resourceOverridesFilename is the file in a repo from which Kubo reads
+// overrides of the resource manager limits it computes
+const resourceOverridesFilename = "libp2p-resource-limit-overrides.json"
+
+// SetResourceLimits enables the libp2p resource manager (Swarm.ResourceMgr)
+// with limits on the memory in bytes (maxMemory) and file descriptors
+// (maxFD) the node's connections and streams may use, and on its number of
+// connections (maxConns). Kubo derives its other limits from these when the
+// node is built. Repos on Android are created with the resource manager
+// disabled, which leaves resource use unbounded; this bounds it instead.
+// A limit of 0 keeps Kubo's default: half the system's memory and file
+// descriptors and no connection limit. maxConns must be 0 or at least 2.
+// Kubo won't start if the connection manager's watermarks
+// (Swarm.ConnMgr) aren't below maxConns, so they are lowered if needed.
+// Returns -4 for invalid limits and -5 if the connection limit couldn't be
+// written, otherwise as updateRepoConfig.
+//
+//export SetResourceLimits
+func SetResourceLimits(repoPath *C.char, maxMemory C.longlong, maxFD C.int, maxConns C.int) C.int {
+	path := C.GoString(repoPath)
+
+	ret := updateRepoConfig(path, func(cfg *config.Config) error {
+		if maxMemory < 0 || maxFD < 0 || maxConns < 0 || maxConns == 1 {
+			return fmt.Errorf("invalid resource limits: memory %d, file descriptors %d, connections %d",
+				int64(maxMemory), int(maxFD), int(maxConns))
+		}
+
+		resourceMgr := &cfg.Swarm.ResourceMgr
+		resourceMgr.Enabled = config.True
+		resourceMgr.MaxMemory = nil
+		if maxMemory > 0 {
+			resourceMgr.MaxMemory = config.NewOptionalString(strconv.FormatInt(int64(maxMemory), 10))
+		}
+		resourceMgr.MaxFileDescriptors = nil
+		if maxFD > 0 {
+			resourceMgr.MaxFileDescriptors = config.NewOptionalInteger(int64(maxFD))
+		}
+
+		connMgr := &cfg.Swarm.ConnMgr
+		if maxConns == 0 || connMgr.Type.WithDefault(config.DefaultConnMgrType) == "none" {
+			return nil
+		}
+		highWater := connMgr.HighWater.WithDefault(config.DefaultConnMgrHighWater)
+		lowWater := connMgr.LowWater.WithDefault(config.DefaultConnMgrLowWater)
+		if highWater >= int64(maxConns) {
+			highWater = int64(maxConns) - 1
+			connMgr.HighWater = config.NewOptionalInteger(highWater)
+		}
+		if lowWater >= highWater {
+			// Kubo's defaults keep a third of the connections when trimming
+			connMgr.LowWater = config.NewOptionalInteger(highWater / 3)
+		}
+		return nil
+	})
+	if ret != 0 {
+		return ret
+	}
+
+	if err := setConnectionLimit(path, int(maxConns)); err != nil {
+		logError("writing connection limit: %s", err)
+		return C.int(-5)
+	}
+	return C.int(0)
+}
+
+// setConnectionLimit sets the limit on the node's connections (System.Conns)
+// in the repo's resource limit overrides, keeping any other overrides.
+// A limit of 0 restores the computed default.
+func setConnectionLimit(path string, maxConns int) error {
+	filename := filepath.Join(path, resourceOverridesFilename)
+
+	var overrides rcmgr.PartialLimitConfig
+	err := serialize.ReadConfigFile(filename, &overrides)
+	if err == serialize.ErrNotInitialized {
+		if maxConns == 0 {
+			return nil
+		}
+	} else if err != nil {
+		return err
+	}
+
+	overrides.System.Conns = rcmgr.DefaultLimit
+	if maxConns > 0 {
+		overrides.System.Conns = rcmgr.LimitVal(maxConns)
+	}
+	return serialize.WriteConfigFile(filename, overrides)
+}
+
+// ConfigGet returns the value of a config key as JSON, e.g. "Addresses.Swarm"
+// (keys are matched case-insensitively), or the whole config if key is
+// empty. The config is read from the repo directly, so no node is started.
+// The private key and remote pinning service keys are never returned.
+//
+//export ConfigGet
+func ConfigGet(repoPath, key *C.char) *C.char {
+	path := C.GoString(repoPath)
+	keyStr := C.GoString(key)
+
+	cfg, err := readRepoConfig(path)
+	if err != nil {
+		logError("reading config: %s", err)
+		return nil
+	}
+
+	// Conceal secrets the same way `ipfs config show` does
+	cfg.Identity.PrivKey = ""
+	for name, service := range cfg.Pinning.RemoteServices {
+		service.API.Key = ""
+		cfg.Pinning.RemoteServices[name] = service
+	}
+
+	cfgMap, err := config.ToMap(cfg)
+	if err != nil {
+		logError("converting config: %s", err)
+		return nil
+	}
+
+	var value interface{} = cfgMap
+	if keyStr != "" {
+		for _, part := range strings.Split(keyStr, ".") {
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				logError("config key %s not found", keyStr)
+				return nil
+			}
+			value, ok = configMapValue(m, part)
+			if !ok {
+				logError("config key %s not found", keyStr)
+				return nil
+			}
+		}
+	}
+
+	// Convert to JSON
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		logError("marshaling config value to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(valueJSON))
+}
+
+// configMapValue looks up a key in a config map, falling back to a
+// case-insensitive match like Kubo does
+func configMapValue(m map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := m[key]; ok {
+		return v, true
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// flag converts a bool to an explicit config.Flag
+func flag(enabled bool) config.Flag {
+	if enabled {
+		return config.True
+	}
+	return config.False
+}
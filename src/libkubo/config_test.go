@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"testing"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	"github.com/ipfs/kubo/config"
+	"github.com/ipfs/kubo/repo/fsrepo"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+)
+
+func TestSetConnectionLimit(t *testing.T) {
+	path := t.TempDir()
+	ident, err := config.CreateIdentity(io.Discard, []options.KeyGenerateOption{
+		options.Key.Type(options.Ed25519Key),
+	})
+	if err != nil {
+		t.Fatalf("creating identity: %s", err)
+	}
+	cfg, err := config.InitWithIdentity(ident)
+	if err != nil {
+		t.Fatalf("creating config: %s", err)
+	}
+	if err := fsrepo.Init(path, cfg); err != nil {
+		t.Fatalf("initializing repo: %s", err)
+	}
+
+	systemConns := func() rcmgr.LimitVal {
+		t.Helper()
+		r, err := fsrepo.Open(path)
+		if err != nil {
+			t.Fatalf("opening repo: %s", err)
+		}
+		defer r.Close()
+		overrides, err := r.UserResourceOverrides()
+		if err != nil {
+			t.Fatalf("reading overrides: %s", err)
+		}
+		return overrides.System.Conns
+	}
+
+	if err := setConnectionLimit(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if conns := systemConns(); conns != rcmgr.DefaultLimit {
+		t.Fatalf("connection limit without overrides = %d", conns)
+	}
+
+	if err := setConnectionLimit(path, 50); err != nil {
+		t.Fatal(err)
+	}
+	if conns := systemConns(); conns != 50 {
+		t.Fatalf("connection limit = %d, want 50", conns)
+	}
+
+	if err := setConnectionLimit(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if conns := systemConns(); conns != rcmgr.DefaultLimit {
+		t.Fatalf("connection limit after removing it = %d", conns)
+	}
+}
@@ -0,0 +1,569 @@
+package main
+
+// #include <stdlib.h>
+// #include <stdbool.h>
+import "C"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+
+	iface "github.com/ipfs/boxo/coreiface"
+	"github.com/ipfs/boxo/coreiface/options"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	dag "github.com/ipfs/boxo/ipld/merkledag"
+	ft "github.com/ipfs/boxo/ipld/unixfs"
+	cidlib "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	ipldprime "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/multiformats/go-multicodec"
+)
+
+// Refs lists the CIDs linked from a DAG node as a JSON array, like `ipfs refs`.
+// With recursive set the whole DAG below the node is listed, and with unique
+// set each CID is listed only once.
+//
+//export Refs
+func Refs(repoPath, cidStr *C.char, recursive C.bool, unique C.bool) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	cid := C.GoString(cidStr)
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return nil
+	}
+
+	refs := []string{}
+	seen := cidlib.NewSet()
+	err = walkRefs(ctx, api.Dag(), decodedCid, bool(recursive), bool(unique), seen,
+		func(c cidlib.Cid) {
+			refs = append(refs, c.String())
+		},
+	)
+	if err != nil {
+		logError("listing refs: %s", err)
+		return nil
+	}
+
+	// Convert to JSON
+	refsJSON, err := json.Marshal(refs)
+	if err != nil {
+		logError("marshaling refs to JSON: %s", err)
+		return nil
+	}
+
+	log.Printf("DEBUG: Listed %d refs of %s\n", len(refs), cid)
+	return C.CString(string(refsJSON))
+}
+
+// walkRefs calls visit for each CID linked from the node at c, descending
+// into children if recursive is set. With unique set, CIDs already in seen
+// are neither visited nor descended into again.
+func walkRefs(
+	ctx context.Context, getter ipld.NodeGetter, c cidlib.Cid,
+	recursive, unique bool, seen *cidlib.Set, visit func(cidlib.Cid),
+) error {
+	nd, err := getter.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	for _, link := range nd.Links() {
+		if unique && !seen.Visit(link.Cid) {
+			continue
+		}
+		visit(link.Cid)
+
+		if recursive {
+			err := walkRefs(ctx, getter, link.Cid, recursive, unique, seen, visit)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DagStatResult describes the size of a DAG
+type DagStatResult struct {
+	Size      uint64 `json:"size"`
+	NumBlocks int    `json:"numBlocks"`
+	MaxDepth  int    `json:"maxDepth"`
+}
+
+// DagStat walks the DAG below a CID and returns its total block size, number
+// of distinct blocks and depth as a DagStatResult JSON object, e.g. to show
+// the size of a download before starting it. Walking remote content fetches
+// every block of the DAG; with localOnly set only blocks that are already
+// stored locally are used and the call fails if any block is missing.
+//
+//export DagStat
+func DagStat(repoPath, cidStr *C.char, localOnly C.bool) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	cid := C.GoString(cidStr)
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if bool(localOnly) {
+		api, err = api.WithOptions(options.Api.Offline(true))
+		if err != nil {
+			logError("creating offline API: %s", err)
+			return nil
+		}
+	}
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return nil
+	}
+
+	var stat DagStatResult
+	depths := map[cidlib.Cid]int{}
+	if err := walkDagStat(ctx, api.Dag(), decodedCid, 0, depths, &stat); err != nil {
+		logError("walking DAG: %s", err)
+		return nil
+	}
+
+	// Convert to JSON
+	statJSON, err := json.Marshal(stat)
+	if err != nil {
+		logError("marshaling DAG stat to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(statJSON))
+}
+
+// CIDInspection describes the root block of a CID. Type is "file", "dir"
+// or "symlink" for Unixfs nodes, "raw" for raw blocks, "dag-cbor" or
+// "dag-json" for IPLD documents and "unknown" for anything else, including
+// dag-pb nodes that aren't Unixfs. Size is the size of the block and Links
+// the number of links in it.
+type CIDInspection struct {
+	Codec  string `json:"codec"`
+	MhType string `json:"mhType"`
+	Size   int    `json:"size"`
+	Type   string `json:"type"`
+	Links  int    `json:"links"`
+}
+
+// InspectCID fetches only the root block of a CID and returns what kind of
+// content it holds as a CIDInspection JSON object, so callers can choose
+// between Download, LsCID and GetJSON without fetching the whole DAG.
+// Returns NULL for an invalid CID or if the block can't be fetched.
+//
+//export InspectCID
+func InspectCID(repoPath, cidStr *C.char) *C.char {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+	cid := C.GoString(cidStr)
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	reader, err := api.Block().Get(ctx, ipath.IpfsPath(decodedCid))
+	if err != nil {
+		logError("getting block: %s", err)
+		return nil
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		logError("reading block: %s", err)
+		return nil
+	}
+
+	// Convert to JSON
+	inspectionJSON, err := json.Marshal(inspectBlock(decodedCid, data))
+	if err != nil {
+		logError("marshaling CID inspection to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(inspectionJSON))
+}
+
+// inspectBlock describes the block data of c
+func inspectBlock(c cidlib.Cid, data []byte) CIDInspection {
+	prefix := c.Prefix()
+	inspection := CIDInspection{
+		Codec:  multicodec.Code(prefix.Codec).String(),
+		MhType: multicodec.Code(prefix.MhType).String(),
+		Size:   len(data),
+		Type:   "unknown",
+	}
+
+	// Blocks of codecs without a decoder are reported without links
+	if links, err := linksOf(c, data); err == nil {
+		inspection.Links = len(links)
+	}
+
+	switch prefix.Codec {
+	case cidlib.Raw:
+		inspection.Type = "raw"
+	case cidlib.DagCBOR:
+		inspection.Type = "dag-cbor"
+	case cidlib.DagJSON:
+		inspection.Type = "dag-json"
+	case cidlib.DagProtobuf:
+		protoNode, err := dag.DecodeProtobuf(data)
+		if err != nil {
+			break
+		}
+		fsNode, err := ft.FSNodeFromBytes(protoNode.Data())
+		if err != nil {
+			break
+		}
+		switch fsNode.Type() {
+		case ft.TFile, ft.TRaw:
+			inspection.Type = "file"
+		case ft.TDirectory, ft.THAMTShard:
+			inspection.Type = "dir"
+		case ft.TSymlink:
+			inspection.Type = "symlink"
+		}
+	}
+	return inspection
+}
+
+// walkDagStat adds the blocks below c, which sits at the given depth, to stat.
+// depths records the deepest level each block was seen at, so that shared
+// blocks are counted once but still contribute their deepest path to MaxDepth.
+func walkDagStat(
+	ctx context.Context, getter ipld.NodeGetter, c cidlib.Cid, depth int,
+	depths map[cidlib.Cid]int, stat *DagStatResult,
+) error {
+	seenDepth, seen := depths[c]
+	if seen && seenDepth >= depth {
+		return nil
+	}
+	depths[c] = depth
+
+	nd, err := getter.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+	if !seen {
+		stat.Size += uint64(len(nd.RawData()))
+		stat.NumBlocks++
+	}
+	if depth > stat.MaxDepth {
+		stat.MaxDepth = depth
+	}
+
+	for _, link := range nd.Links() {
+		if err := walkDagStat(ctx, getter, link.Cid, depth+1, depths, stat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddJSON stores a JSON document as a pinned dag-json block and returns its
+// CID. The document is re-encoded canonically (e.g. with sorted map keys), so
+// equal documents get the same CID regardless of formatting. Objects of the
+// form {"/": "<cid>"} are stored as links to other blocks.
+//
+//export AddJSON
+func AddJSON(repoPath, jsonStr *C.char) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	doc := []byte(C.GoString(jsonStr))
+
+	if !json.Valid(doc) {
+		logError("input is not valid JSON")
+		return nil
+	}
+	record, err := ipldprime.Decode(doc, dagjson.Decode)
+	if err != nil {
+		logError("decoding JSON as dag-json: %s", err)
+		return nil
+	}
+	data, err := ipldprime.Encode(record, dagjson.Encode)
+	if err != nil {
+		logError("encoding dag-json: %s", err)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	stat, err := api.Block().Put(ctx, bytes.NewReader(data),
+		options.Block.CidCodec("dag-json"),
+		options.Block.Pin(true),
+	)
+	if err != nil {
+		logError("storing JSON document: %s", err)
+		return nil
+	}
+
+	return C.CString(stat.Path().Cid().String())
+}
+
+// GetJSON returns the JSON document stored at a CID by AddJSON. dag-cbor
+// records are converted to dag-json.
+//
+//export GetJSON
+func GetJSON(repoPath, cidStr *C.char) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	cid := C.GoString(cidStr)
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return nil
+	}
+	codec := decodedCid.Type()
+	if codec != cidlib.DagJSON && codec != cidlib.DagCBOR {
+		logError("%s is not a dag-json or dag-cbor record", cid)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	reader, err := api.Block().Get(ctx, ipath.IpfsPath(decodedCid))
+	if err != nil {
+		logError("getting block: %s", err)
+		return nil
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		logError("reading block: %s", err)
+		return nil
+	}
+
+	jsonData, err := recordToJSON(data, codec)
+	if err != nil {
+		logError("%s", err)
+		return nil
+	}
+
+	return C.CString(string(jsonData))
+}
+
+// DagLink is a link of a dag-pb node built by DagPutLinked. Size is the
+// cumulative size of the target's DAG (its Tsize), or 0 if unknown.
+type DagLink struct {
+	Name string `json:"name"`
+	Cid  string `json:"cid"`
+	Size uint64 `json:"size"`
+}
+
+// DagPutLinked stores a dag-pb node linking to existing blocks, for building
+// directory-like structures or custom DAGs from content that has already been
+// added, without adding it again. dataJSON is the node's data as a base64
+// JSON string, or empty for a node without data, and linksJSON is a JSON
+// array of links of the form {"name", "cid", "size"}, kept in the order given.
+// The node is pinned recursively, which keeps the linked DAGs from being
+// garbage collected. Every link target must already be stored locally, as
+// targets aren't fetched and the pin would otherwise claim blocks the repo
+// doesn't have; only the targets themselves are checked, not the DAGs below
+// them. Returns the node's CID, or NULL if a target is missing.
+//
+//export DagPutLinked
+func DagPutLinked(repoPath, dataJSON, linksJSON *C.char) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	dataStr := C.GoString(dataJSON)
+
+	var data []byte
+	if dataStr != "" {
+		if err := json.Unmarshal([]byte(dataStr), &data); err != nil {
+			logError("parsing data JSON: %s", err)
+			return nil
+		}
+	}
+	var links []DagLink
+	if err := json.Unmarshal([]byte(C.GoString(linksJSON)), &links); err != nil {
+		logError("parsing links JSON: %s", err)
+		return nil
+	}
+
+	nd := dag.NodeWithData(data)
+	for _, link := range links {
+		target, err := cidlib.Decode(link.Cid)
+		if err != nil {
+			logError("decoding CID of link %q: %s", link.Name, err)
+			return nil
+		}
+		if err := nd.AddRawLink(link.Name, &ipld.Link{Name: link.Name, Size: link.Size, Cid: target}); err != nil {
+			logError("adding link %q: %s", link.Name, err)
+			return nil
+		}
+	}
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if err := putLinked(ctx, api, nd); err != nil {
+		logError("%s", err)
+		return nil
+	}
+
+	return C.CString(nd.Cid().String())
+}
+
+// putLinked stores and recursively pins nd, after checking that the targets
+// of its links are stored locally, without fetching them
+func putLinked(ctx context.Context, api iface.CoreAPI, nd *dag.ProtoNode) error {
+	offlineAPI, err := api.WithOptions(options.Api.Offline(true))
+	if err != nil {
+		return err
+	}
+	for _, link := range nd.Links() {
+		if _, err := offlineAPI.Block().Stat(ctx, ipath.IpfsPath(link.Cid)); err != nil {
+			return fmt.Errorf("target %s of link %q isn't stored locally: %w", link.Cid, link.Name, err)
+		}
+	}
+
+	// Stores and recursively pins the node, without fetching the targets
+	if err := api.Dag().Pinning().Add(ctx, nd); err != nil {
+		return fmt.Errorf("storing DAG node: %w", err)
+	}
+	return nil
+}
+
+// ObjectAddLink adds a link named linkName to targetCid to the dag-pb node
+// rootCid, like `ipfs object patch add-link -p`: a linkName containing slashes
+// creates the intermediate directories. This adds to an existing directory
+// DAG without adding the rest of it again. The new root isn't pinned; pin it
+// with PinCID once done building. Returns the CID of the new root.
+//
+//export ObjectAddLink
+func ObjectAddLink(repoPath, rootCid, linkName, targetCid *C.char) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	name := C.GoString(linkName)
+
+	root, err := cidlib.Decode(C.GoString(rootCid))
+	if err != nil {
+		logError("decoding root CID: %s", err)
+		return nil
+	}
+	target, err := cidlib.Decode(C.GoString(targetCid))
+	if err != nil {
+		logError("decoding target CID: %s", err)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	newRoot, err := api.Object().AddLink(ctx, ipath.IpfsPath(root), name, ipath.IpfsPath(target),
+		options.Object.Create(true),
+	)
+	if err != nil {
+		logError("adding link %q: %s", name, err)
+		return nil
+	}
+
+	return C.CString(newRoot.Cid().String())
+}
+
+// ObjectRmLink removes the link named linkName from the dag-pb node rootCid,
+// like `ipfs object patch rm-link`. The new root isn't pinned. Returns the
+// CID of the new root.
+//
+//export ObjectRmLink
+func ObjectRmLink(repoPath, rootCid, linkName *C.char) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	name := C.GoString(linkName)
+
+	root, err := cidlib.Decode(C.GoString(rootCid))
+	if err != nil {
+		logError("decoding root CID: %s", err)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	newRoot, err := api.Object().RmLink(ctx, ipath.IpfsPath(root), name)
+	if err != nil {
+		logError("removing link %q: %s", name, err)
+		return nil
+	}
+
+	return C.CString(newRoot.Cid().String())
+}
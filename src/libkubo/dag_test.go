@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	"github.com/ipfs/boxo/files"
+	dag "github.com/ipfs/boxo/ipld/merkledag"
+	cidlib "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestInspectBlock(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	inspect := func(c cidlib.Cid) CIDInspection {
+		t.Helper()
+		reader, err := api.Block().Get(ctx, ipath.IpfsPath(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inspectBlock(c, data)
+	}
+
+	// Three chunks of distinct content
+	content := make([]byte, 3*1024)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	file, err := api.Unixfs().Add(ctx, files.NewBytesFile(content), options.Unixfs.Chunker("size-1024"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := inspect(file.Cid()); got.Type != "file" || got.Links != 3 || got.Codec != "dag-pb" || got.MhType != "sha2-256" {
+		t.Errorf("file inspected as %+v", got)
+	}
+
+	dir, err := api.Unixfs().Add(ctx, files.NewMapDirectory(map[string]files.Node{
+		"a": files.NewBytesFile([]byte("a")),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := inspect(dir.Cid()); got.Type != "dir" || got.Links != 1 {
+		t.Errorf("directory inspected as %+v", got)
+	}
+
+	raw, err := api.Block().Put(ctx, strings.NewReader("raw data"), options.Block.Format("raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := inspect(raw.Path().Cid()); got.Type != "raw" || got.Size != len("raw data") || got.Links != 0 {
+		t.Errorf("raw block inspected as %+v", got)
+	}
+
+	hash, err := multihash.Sum([]byte(`{"a":1}`), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := inspectBlock(cidlib.NewCidV1(cidlib.DagJSON, hash), []byte(`{"a":1}`)); got.Type != "dag-json" {
+		t.Errorf("dag-json block inspected as %+v", got)
+	}
+	if got := inspectBlock(cidlib.NewCidV1(0x300000, hash), []byte("?")); got.Type != "unknown" {
+		t.Errorf("block of an unknown codec inspected as %+v", got)
+	}
+}
+
+func TestPutLinked(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	file, err := api.Unixfs().Add(ctx, files.NewBytesFile([]byte("linked")), options.Unixfs.Pin(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd := dag.NodeWithData(nil)
+	if err := nd.AddRawLink("file", &ipld.Link{Name: "file", Cid: file.Cid()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := putLinked(ctx, api, nd); err != nil {
+		t.Fatalf("linking a stored file: %s", err)
+	}
+	if _, pinned, err := api.Pin().IsPinned(ctx, ipath.IpfsPath(nd.Cid())); err != nil || !pinned {
+		t.Errorf("node isn't pinned (%v)", err)
+	}
+
+	hash, err := multihash.Sum([]byte("not stored"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := dag.NodeWithData(nil)
+	if err := missing.AddRawLink("missing", &ipld.Link{Name: "missing", Cid: cidlib.NewCidV1(cidlib.Raw, hash)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := putLinked(ctx, api, missing); err == nil {
+		t.Error("linking a block that isn't stored succeeded")
+	}
+	if _, pinned, _ := api.Pin().IsPinned(ctx, ipath.IpfsPath(missing.Cid())); pinned {
+		t.Error("node with a missing link was pinned")
+	}
+}
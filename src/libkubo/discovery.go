@@ -0,0 +1,101 @@
+package main
+
+// #include <stdlib.h>
+// #include <stdbool.h>
+import "C"
+
+import (
+	"encoding/json"
+
+	"github.com/ipfs/kubo/config"
+	"github.com/libp2p/go-libp2p/core/network"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// SetMdns enables or disables mDNS discovery of peers on the local network
+// (Discovery.MDNS), which Kubo's mDNS service uses to find and connect to
+// peers. Running nodes pick up the change when they are next started.
+// intervalSeconds is stored for older Kubo versions but ignored by the
+// current one, which no longer supports configuring it.
+//
+//export SetMdns
+func SetMdns(repoPath *C.char, enabled C.bool, intervalSeconds C.int) C.int {
+	path := C.GoString(repoPath)
+
+	return updateRepoConfig(path, func(cfg *config.Config) error {
+		cfg.Discovery.MDNS.Enabled = bool(enabled)
+		if intervalSeconds > 0 {
+			cfg.Discovery.MDNS.Interval = config.NewOptionalInteger(int64(intervalSeconds))
+		}
+		return nil
+	})
+}
+
+// ListPeersByDiscovery returns the IDs of connected peers grouped by how they
+// were most likely discovered, as JSON {"mdns": [...], "other": [...]}.
+// Kubo's mDNS service doesn't record the peers it finds, so while mDNS is
+// enabled, peers connected directly over the local network are listed under
+// "mdns", which also includes local peers found in other ways. "other" covers
+// peers found via the DHT, bootstrap, peering or inbound connections.
+//
+//export ListPeersByDiscovery
+func ListPeersByDiscovery(repoPath *C.char) *C.char {
+	path := C.GoString(repoPath)
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("Node is offline")
+		return nil
+	}
+
+	cfg, err := node.Repo.Config()
+	if err != nil {
+		logError("getting repository config: %s", err)
+		return nil
+	}
+
+	result := map[string][]string{
+		"mdns":  {},
+		"other": {},
+	}
+	for _, id := range node.PeerHost.Network().Peers() {
+		if cfg.Discovery.MDNS.Enabled && connectedLocally(node.PeerHost.Network().ConnsToPeer(id)) {
+			result["mdns"] = append(result["mdns"], id.String())
+		} else {
+			result["other"] = append(result["other"], id.String())
+		}
+	}
+
+	// Convert to JSON
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logError("marshaling peers to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(resultJSON))
+}
+
+// connectedLocally reports whether any of conns is a direct connection over
+// the local network, as to peers found via mDNS
+func connectedLocally(conns []network.Conn) bool {
+	for _, conn := range conns {
+		addr := conn.RemoteMultiaddr()
+		if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+			continue
+		}
+		if manet.IsPrivateAddr(addr) && !manet.IsIPLoopback(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,289 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	"github.com/ipfs/boxo/files"
+	cidlib "github.com/ipfs/go-cid"
+)
+
+// Encrypted content starts with a header of encryptionMagic followed by a
+// random nonce prefix, and continues with the content split into chunks of
+// encryptionChunkSize bytes, each sealed with AES-GCM. The nonce of a chunk
+// is the prefix, the chunk's index and a flag marking the last chunk, so
+// chunks can't be reordered, dropped or truncated unnoticed. This keeps
+// memory use bounded, as opposed to sealing the whole content at once.
+const (
+	encryptionMagic       = "LKE1"
+	encryptionPrefixSize  = 7
+	encryptionChunkSize   = 64 * 1024
+	encryptionHeaderSize  = len(encryptionMagic) + encryptionPrefixSize
+	encryptionLastChunk   = 1
+	encryptionNonceLength = encryptionPrefixSize + 4 + 1
+)
+
+// errDecryptionFailed is returned for content that wasn't encrypted with the
+// given key or has been modified
+var errDecryptionFailed = errors.New("decryption failed: wrong key or corrupted content")
+
+// AddEncrypted encrypts a file with AES-GCM and adds the encrypted content,
+// for keeping content private on a public network: only holders of the key
+// can read it, while the CID can still be shared, pinned and provided as
+// usual. key must be 16, 24 or 32 bytes long (AES-128, -192 or -256).
+// Retrieve the content with GetEncrypted. The content is pinned once added.
+// Returns the CID, or NULL on error.
+//
+//export AddEncrypted
+func AddEncrypted(repoPath, filePath *C.char, key unsafe.Pointer, keyLen C.int) *C.char {
+	path := C.GoString(repoPath)
+	file := C.GoString(filePath)
+
+	aead, err := newContentAEAD(C.GoBytes(key, keyLen))
+	if err != nil {
+		logError("%s", err)
+		return nil
+	}
+
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+
+	log.Printf("DEBUG: Adding encrypted file from path %s using repo %s\n", file, path)
+
+	f, err := os.Open(file)
+	if err != nil {
+		logError("opening file: %s", err)
+		return nil
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil {
+		if err := checkAddedBytes(info.Size()); err != nil {
+			logError("%s: %s", file, err)
+			return nil
+		}
+	}
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	// Encrypt while the add reads, so the file is never held in memory
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(encryptStream(writer, f, aead))
+	}()
+	resolved, err := api.Unixfs().Add(ctx, files.NewReaderFile(reader), options.Unixfs.Pin(true))
+	// Unblocks the encryption if the add stopped reading early
+	reader.CloseWithError(err)
+	if err != nil {
+		logError("adding encrypted file: %s", err)
+		return nil
+	}
+
+	cid := resolved.Cid().String()
+	log.Printf("DEBUG: Encrypted file added with CID: %s\n", cid)
+	return C.CString(cid)
+}
+
+// GetEncrypted retrieves content added with AddEncrypted and writes it
+// decrypted to destPath. Nothing is written to destPath unless the whole
+// content could be decrypted and authenticated.
+// Returns 0 on success, -2 for an invalid CID, -3 for an invalid key, -4 if
+// the content couldn't be retrieved and -5 if decryption failed, i.e. the
+// key is wrong or the content isn't encrypted content.
+//
+//export GetEncrypted
+func GetEncrypted(repoPath, cidStr, destPath *C.char, key unsafe.Pointer, keyLen C.int) C.int {
+	path := C.GoString(repoPath)
+	cid := C.GoString(cidStr)
+	dest := C.GoString(destPath)
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return C.int(-2)
+	}
+
+	aead, err := newContentAEAD(C.GoBytes(key, keyLen))
+	if err != nil {
+		logError("%s", err)
+		return C.int(-3)
+	}
+
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+
+	log.Printf("DEBUG: Getting encrypted content with CID %s to %s using repo %s\n", cid, dest, path)
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	node, err := api.Unixfs().Get(ctx, ipath.IpfsPath(decodedCid))
+	if err != nil {
+		logError("getting content: %s", err)
+		return C.int(-4)
+	}
+	defer node.Close()
+	file, ok := node.(files.File)
+	if !ok {
+		logError("%s is not a file", cid)
+		return C.int(-5)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		logError("creating destination directory: %s", err)
+		return C.int(-4)
+	}
+	tmpPath := dest + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		logError("creating destination file: %s", err)
+		return C.int(-4)
+	}
+	err = decryptStream(out, file, aead)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		logError("decrypting content: %s", err)
+		if errors.Is(err, errDecryptionFailed) {
+			return C.int(-5)
+		}
+		return C.int(-4)
+	}
+	if err := os.Rename(tmpPath, dest); err != nil {
+		os.Remove(tmpPath)
+		logError("moving decrypted file into place: %s", err)
+		return C.int(-4)
+	}
+
+	log.Printf("DEBUG: Decrypted %s to %s\n", cid, dest)
+	return C.int(0)
+}
+
+// newContentAEAD creates the AES-GCM cipher for encrypted content
+func newContentAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return cipher.NewGCMWithNonceSize(block, encryptionNonceLength)
+}
+
+// chunkNonce returns the nonce of the chunk at index
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, encryptionNonceLength)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptionPrefixSize:], index)
+	if last {
+		nonce[encryptionNonceLength-1] = encryptionLastChunk
+	}
+	return nonce
+}
+
+// encryptStream writes the header and the sealed chunks of src to dst
+func encryptStream(dst io.Writer, src io.Reader, aead cipher.AEAD) error {
+	header := make([]byte, encryptionHeaderSize)
+	copy(header, encryptionMagic)
+	prefix := header[len(encryptionMagic):]
+	if _, err := rand.Read(prefix); err != nil {
+		return fmt.Errorf("generating nonce: %w", err)
+	}
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	plain := make([]byte, encryptionChunkSize)
+	sealed := make([]byte, 0, encryptionChunkSize+aead.Overhead())
+	for index := uint32(0); ; index++ {
+		if index == ^uint32(0) {
+			return errors.New("content too large to encrypt")
+		}
+		n, err := io.ReadFull(src, plain)
+		// A short read ends the content; an exactly full last chunk is
+		// followed by an empty one carrying the last-chunk flag
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		sealed = aead.Seal(sealed[:0], chunkNonce(prefix, index, last), plain[:n], nil)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptStream reads content written by encryptStream from src and writes
+// the decrypted chunks to dst. Chunks are written as they are authenticated,
+// so dst must be discarded if an error is returned.
+func decryptStream(dst io.Writer, src io.Reader, aead cipher.AEAD) error {
+	reader := bufio.NewReader(src)
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return errDecryptionFailed
+	}
+	prefix := header[len(encryptionMagic):]
+
+	sealed := make([]byte, encryptionChunkSize+aead.Overhead())
+	plain := make([]byte, 0, encryptionChunkSize)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, sealed)
+		if err == io.EOF {
+			// The content ended without a last chunk
+			return errDecryptionFailed
+		}
+		last := err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if !last {
+			// A full chunk is the last one if nothing follows it
+			if _, err := reader.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		plain, err = aead.Open(plain[:0], chunkNonce(prefix, index, last), sealed[:n], nil)
+		if err != nil {
+			return errDecryptionFailed
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/kubo/config"
+	serialize "github.com/ipfs/kubo/config/serialize"
+	"github.com/ipfs/kubo/repo"
+	"github.com/ipfs/kubo/repo/fsrepo"
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptedDatastoreType is the datastore spec type that encrypts the values
+// of its child datastore, registered with the other datastore plugins
+const encryptedDatastoreType = "libkubo-encrypted"
+
+// encryptionCheck is encrypted with a repo's key when the repo is created,
+// so that UnlockRepo can tell a wrong passphrase from a right one
+var encryptionCheck = []byte("libkubo encrypted repo")
+
+// errRepoEncrypted is returned when opening an encrypted repo that hasn't
+// been unlocked with UnlockRepo
+var errRepoEncrypted = errors.New("repo is encrypted and locked")
+
+// Keys of the unlocked encrypted repos, indexed by absolute repo path
+var (
+	repoKeys      = make(map[string]cipher.AEAD)
+	repoKeysMutex sync.Mutex
+)
+
+// CreateEncryptedRepo initializes a new IPFS repository like CreateRepo whose
+// datastore, including all blocks, is encrypted on disk with a key derived
+// from passphrase. Values are decrypted in memory only; keys, such as the
+// hashes of stored blocks, stay readable, as do the config and the keystore.
+// The repo is unlocked for the rest of this process; in later processes it
+// must be unlocked with UnlockRepo before any node can use it.
+// Returns the codes of CreateRepo, and -4 if passphrase is empty.
+//
+//export CreateEncryptedRepo
+func CreateEncryptedRepo(repoPath, profile, passphrase *C.char) C.int {
+	pass := C.GoString(passphrase)
+	if pass == "" {
+		logError("an encrypted repo needs a passphrase")
+		return C.int(-4)
+	}
+	return createRepo(C.GoString(repoPath), C.GoString(profile), pass, "")
+}
+
+// UnlockRepo derives the key of an encrypted repo from passphrase and keeps
+// it in memory for the rest of this process, so nodes can open the repo.
+// Until then, starting a node on the repo fails with code -4, as do all
+// other functions that open it, including the config functions.
+// Returns 0 on success, -1 if there is no repo at the path or its config
+// can't be read, -2 if the repo isn't encrypted and -3 if the passphrase is
+// wrong.
+//
+//export UnlockRepo
+func UnlockRepo(repoPath, passphrase *C.char) C.int {
+	path := C.GoString(repoPath)
+
+	if !fsrepo.IsInitialized(path) {
+		logError("repository not initialized at %s", path)
+		return C.int(-1)
+	}
+	spec, err := readDatastoreSpec(path)
+	if err != nil {
+		logError("reading datastore spec: %s", err)
+		return C.int(-1)
+	}
+	if spec["type"] != encryptedDatastoreType {
+		logError("repo %s is not encrypted", path)
+		return C.int(-2)
+	}
+
+	aead, err := unlockDatastoreSpec(spec, C.GoString(passphrase))
+	if err != nil {
+		logError("unlocking repo %s: %s", path, err)
+		return C.int(-3)
+	}
+	setRepoKey(path, aead)
+
+	log.Printf("DEBUG: Unlocked repo %s\n", path)
+	return C.int(0)
+}
+
+// repoKeyPath returns the path repo keys are indexed by, so that the same
+// repo is found whether it is given by a relative or absolute path
+func repoKeyPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// setRepoKey keeps the key of an unlocked repo
+func setRepoKey(path string, aead cipher.AEAD) {
+	repoKeysMutex.Lock()
+	repoKeys[repoKeyPath(path)] = aead
+	repoKeysMutex.Unlock()
+}
+
+// repoKey returns the key of an unlocked repo, or nil if it is locked
+func repoKey(path string) cipher.AEAD {
+	repoKeysMutex.Lock()
+	defer repoKeysMutex.Unlock()
+	return repoKeys[repoKeyPath(path)]
+}
+
+// checkRepoUnlocked returns errRepoEncrypted if the repo at path is
+// encrypted and hasn't been unlocked. Repos whose config can't be read are
+// left for fsrepo.Open to report.
+func checkRepoUnlocked(path string) error {
+	spec, err := readDatastoreSpec(path)
+	if err != nil || spec["type"] != encryptedDatastoreType || repoKey(path) != nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errRepoEncrypted, path)
+}
+
+// readDatastoreSpec reads the datastore spec from the config file of the
+// repo at path, which unlike fsrepo.Open doesn't open the datastore
+func readDatastoreSpec(path string) (map[string]interface{}, error) {
+	filename, err := config.Filename(path, "")
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := serialize.Load(filename)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Datastore.Spec, nil
+}
+
+// encryptDatastoreSpec wraps the datastore spec of a new repo at path in an
+// encrypted datastore keyed by passphrase, and unlocks the repo
+func encryptDatastoreSpec(cfg *config.Config, path, passphrase string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := deriveRepoKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	check, err := sealValue(aead, ds.NewKey("/"), encryptionCheck)
+	if err != nil {
+		return err
+	}
+
+	cfg.Datastore.Spec = map[string]interface{}{
+		"type":  encryptedDatastoreType,
+		"salt":  base64.StdEncoding.EncodeToString(salt),
+		"check": base64.StdEncoding.EncodeToString(check),
+		"child": cfg.Datastore.Spec,
+	}
+	setRepoKey(path, aead)
+	return nil
+}
+
+// unlockDatastoreSpec derives the key of an encrypted datastore spec from
+// passphrase, failing if it is the wrong passphrase
+func unlockDatastoreSpec(spec map[string]interface{}, passphrase string) (cipher.AEAD, error) {
+	salt, err := specBytes(spec, "salt")
+	if err != nil {
+		return nil, err
+	}
+	check, err := specBytes(spec, "check")
+	if err != nil {
+		return nil, err
+	}
+	aead, err := deriveRepoKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if plain, err := openValue(aead, ds.NewKey("/"), check); err != nil || !bytes.Equal(plain, encryptionCheck) {
+		return nil, errors.New("wrong passphrase")
+	}
+	return aead, nil
+}
+
+// specBytes decodes a base64 field of a datastore spec
+func specBytes(spec map[string]interface{}, field string) ([]byte, error) {
+	value, ok := spec[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("'%s' field is missing or not a string", field)
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// deriveRepoKey derives an AES-256-GCM key from a passphrase
+func deriveRepoKey(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealValue encrypts the value stored under key with a random nonce, which is
+// prepended to the result. The key is authenticated too, so values can't be
+// swapped between keys on disk.
+func sealValue(aead cipher.AEAD, key ds.Key, value []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, value, key.Bytes()), nil
+}
+
+// openValue decrypts a value encrypted by sealValue
+func openValue(aead cipher.AEAD, key ds.Key, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted value of %s is too short", key)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, ciphertext, key.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("decrypting value of %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// encryptedDatastoreConfig is the parsed spec of an encrypted datastore
+type encryptedDatastoreConfig struct {
+	child fsrepo.DatastoreConfig
+	salt  string
+}
+
+// encryptedDatastoreConfigFromMap parses an encrypted datastore spec
+func encryptedDatastoreConfigFromMap(params map[string]interface{}) (fsrepo.DatastoreConfig, error) {
+	childField, ok := params["child"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("'child' field is missing or not a map")
+	}
+	child, err := fsrepo.AnyDatastoreConfig(childField)
+	if err != nil {
+		return nil, err
+	}
+	salt, ok := params["salt"].(string)
+	if !ok {
+		return nil, fmt.Errorf("'salt' field is missing or not a string")
+	}
+	return &encryptedDatastoreConfig{child: child, salt: salt}, nil
+}
+
+func (c *encryptedDatastoreConfig) DiskSpec() fsrepo.DiskSpec {
+	return fsrepo.DiskSpec{
+		"type":  encryptedDatastoreType,
+		"salt":  c.salt,
+		"child": map[string]interface{}(c.child.DiskSpec()),
+	}
+}
+
+func (c *encryptedDatastoreConfig) Create(path string) (repo.Datastore, error) {
+	aead := repoKey(path)
+	if aead == nil {
+		return nil, fmt.Errorf("%w: %s", errRepoEncrypted, path)
+	}
+	child, err := c.child.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedDatastore{child: child, aead: aead}, nil
+}
+
+// encryptedDatastore encrypts the values of its child datastore
+type encryptedDatastore struct {
+	child ds.Batching
+	aead  cipher.AEAD
+}
+
+// overhead is how much larger encrypted values are than their plaintext
+func (d *encryptedDatastore) overhead() int {
+	return d.aead.NonceSize() + d.aead.Overhead()
+}
+
+func (d *encryptedDatastore) Get(ctx context.Context, key ds.Key) ([]byte, error) {
+	sealed, err := d.child.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return openValue(d.aead, key, sealed)
+}
+
+func (d *encryptedDatastore) Has(ctx context.Context, key ds.Key) (bool, error) {
+	return d.child.Has(ctx, key)
+}
+
+func (d *encryptedDatastore) GetSize(ctx context.Context, key ds.Key) (int, error) {
+	size, err := d.child.GetSize(ctx, key)
+	if err != nil {
+		return size, err
+	}
+	return size - d.overhead(), nil
+}
+
+func (d *encryptedDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	sealed, err := sealValue(d.aead, key, value)
+	if err != nil {
+		return err
+	}
+	return d.child.Put(ctx, key, sealed)
+}
+
+func (d *encryptedDatastore) Delete(ctx context.Context, key ds.Key) error {
+	return d.child.Delete(ctx, key)
+}
+
+func (d *encryptedDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	return d.child.Sync(ctx, prefix)
+}
+
+func (d *encryptedDatastore) Close() error {
+	return d.child.Close()
+}
+
+// Query decrypts the results of the child datastore, filtering and ordering
+// them itself since the child can only see encrypted values
+func (d *encryptedDatastore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	childQuery := query.Query{
+		Prefix:            q.Prefix,
+		KeysOnly:          q.KeysOnly,
+		ReturnExpirations: q.ReturnExpirations,
+		ReturnsSizes:      q.ReturnsSizes,
+	}
+	results, err := d.child.Query(ctx, childQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted := query.ResultsFromIterator(childQuery, query.Iterator{
+		Next: func() (query.Result, bool) {
+			result, ok := results.NextSync()
+			if !ok || result.Error != nil {
+				return result, ok
+			}
+			if q.KeysOnly {
+				if result.Size > 0 {
+					result.Size -= d.overhead()
+				}
+				return result, true
+			}
+			result.Value, result.Error = openValue(d.aead, ds.RawKey(result.Key), result.Value)
+			result.Size = len(result.Value)
+			return result, true
+		},
+		Close: results.Close,
+	})
+
+	q.Prefix = ""
+	return query.NaiveQueryApply(q, decrypted), nil
+}
+
+func (d *encryptedDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	batch, err := d.child.Batch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedBatch{child: batch, aead: d.aead}, nil
+}
+
+// DiskUsage reports the disk usage of the child datastore, if it can
+func (d *encryptedDatastore) DiskUsage(ctx context.Context) (uint64, error) {
+	return ds.DiskUsage(ctx, d.child)
+}
+
+// encryptedBatch encrypts the values put into a batch of the child datastore
+type encryptedBatch struct {
+	child ds.Batch
+	aead  cipher.AEAD
+}
+
+func (b *encryptedBatch) Put(ctx context.Context, key ds.Key, value []byte) error {
+	sealed, err := sealValue(b.aead, key, value)
+	if err != nil {
+		return err
+	}
+	return b.child.Put(ctx, key, sealed)
+}
+
+func (b *encryptedBatch) Delete(ctx context.Context, key ds.Key) error {
+	return b.child.Delete(ctx, key)
+}
+
+func (b *encryptedBatch) Commit(ctx context.Context) error {
+	return b.child.Commit(ctx)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/kubo/repo/fsrepo"
+)
+
+func TestEncryptedDatastore(t *testing.T) {
+	ctx := context.Background()
+	aead, err := deriveRepoKey("correct horse", []byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := ds.NewMapDatastore()
+	d := &encryptedDatastore{child: child, aead: aead}
+
+	key, value := ds.NewKey("/blocks/a"), []byte("secret block")
+	if err := d.Put(ctx, key, value); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := child.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, value) {
+		t.Fatal("value stored in plaintext")
+	}
+	if got, err := d.Get(ctx, key); err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+	if size, err := d.GetSize(ctx, key); err != nil || size != len(value) {
+		t.Fatalf("GetSize = %d, %v", size, err)
+	}
+
+	batch, err := d.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Put(ctx, ds.NewKey("/blocks/b"), []byte("batched")); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := d.Query(ctx, query.Query{Prefix: "/blocks", Orders: []query.Order{query.OrderByKey{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := results.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || string(entries[0].Value) != "secret block" || string(entries[1].Value) != "batched" {
+		t.Fatalf("unexpected query results %+v", entries)
+	}
+
+	// Values can't be moved to another key
+	if err := child.Put(ctx, ds.NewKey("/blocks/c"), raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get(ctx, ds.NewKey("/blocks/c")); err == nil {
+		t.Fatal("value moved to another key was decrypted")
+	}
+}
+
+func TestEncryptedRepo(t *testing.T) {
+	if err := loadPlugins(); err != nil {
+		t.Fatal(err)
+	}
+	path := t.TempDir()
+
+	if code := createRepo(path, "", "correct horse", ""); code != 1 {
+		t.Fatalf("creating repo: %d", code)
+	}
+	r, err := openRepo(path)
+	if err != nil {
+		t.Fatalf("opening unlocked repo: %s", err)
+	}
+	r.Close()
+
+	// A new process has to unlock the repo first
+	repoKeysMutex.Lock()
+	delete(repoKeys, repoKeyPath(path))
+	repoKeysMutex.Unlock()
+	if _, err := openRepo(path); !errors.Is(err, errRepoEncrypted) {
+		t.Fatalf("expected errRepoEncrypted, got %v", err)
+	}
+
+	spec, err := readDatastoreSpec(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unlockDatastoreSpec(spec, "wrong horse"); err == nil {
+		t.Fatal("unlocked with a wrong passphrase")
+	}
+	aead, err := unlockDatastoreSpec(spec, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRepoKey(path, aead)
+	r, err = fsrepo.Open(path)
+	if err != nil {
+		t.Fatalf("opening repo after unlocking: %s", err)
+	}
+	r.Close()
+}
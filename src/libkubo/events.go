@@ -0,0 +1,174 @@
+package main
+
+// #include <stdint.h>
+// #include <stdlib.h>
+import "C"
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/ipfs/kubo/core"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// NodeEvent is an event of a node's libp2p host, as passed to the callback
+// registered with SetEventBusCallback. Type is "reachability" (with
+// Reachability), "addresses" (with Addrs, the current listen addresses, and
+// the Added and Removed ones), "protocols" (with the Added and Removed
+// protocols the node handles), or "peerConnected" or "peerDisconnected"
+// (with Peer).
+type NodeEvent struct {
+	Type         string   `json:"type"`
+	Reachability string   `json:"reachability,omitempty"`
+	Addrs        []string `json:"addrs,omitempty"`
+	Added        []string `json:"added,omitempty"`
+	Removed      []string `json:"removed,omitempty"`
+	Peer         string   `json:"peer,omitempty"`
+}
+
+// Event bus subscriptions, indexed by repo path
+var (
+	eventBusSubscriptions      = make(map[string]event.Subscription)
+	eventBusSubscriptionsMutex sync.Mutex
+)
+
+// SetEventBusCallback registers a callback void(char* eventJSON) that is
+// called with a NodeEvent whenever the repo's running node changes its
+// reachability, listen addresses or protocols, or connects to or disconnects
+// from a peer, e.g. to publish new addresses after switching networks. A
+// callback replaces the repo's previous one; pass a null callback to
+// unregister. The subscription doesn't keep the node running, and ends when
+// the node is released or cleaned up. The callback is called from a
+// background thread, one event at a time.
+// Returns 0 on success, -1 if the node couldn't be acquired and -2 if it is
+// offline.
+//
+//export SetEventBusCallback
+func SetEventBusCallback(repoPath *C.char, cb C.uintptr_t) C.int {
+	path := C.GoString(repoPath)
+
+	eventBusSubscriptionsMutex.Lock()
+	defer eventBusSubscriptionsMutex.Unlock()
+	if sub, exists := eventBusSubscriptions[path]; exists {
+		sub.Close()
+		delete(eventBusSubscriptions, path)
+	}
+	if cb == 0 {
+		return C.int(0)
+	}
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("node for repo %s is offline", path)
+		return C.int(-2)
+	}
+
+	sub, err := node.PeerHost.EventBus().Subscribe([]interface{}{
+		new(event.EvtLocalReachabilityChanged),
+		new(event.EvtLocalAddressesUpdated),
+		new(event.EvtLocalProtocolsUpdated),
+		new(event.EvtPeerConnectednessChanged),
+	})
+	if err != nil {
+		logError("subscribing to node events: %s", err)
+		return C.int(-2)
+	}
+	eventBusSubscriptions[path] = sub
+	go forwardNodeEvents(path, node, sub, cb)
+
+	log.Printf("DEBUG: Forwarding node events of repo %s\n", path)
+	return C.int(0)
+}
+
+// forwardNodeEvents passes the events of sub to cb until the subscription is
+// closed or the node closes
+func forwardNodeEvents(repoPath string, node *core.IpfsNode, sub event.Subscription, cb C.uintptr_t) {
+	defer func() {
+		// Subscriptions replaced or removed with SetEventBusCallback are
+		// already closed
+		eventBusSubscriptionsMutex.Lock()
+		if eventBusSubscriptions[repoPath] == sub {
+			delete(eventBusSubscriptions, repoPath)
+			sub.Close()
+		}
+		eventBusSubscriptionsMutex.Unlock()
+	}()
+
+	for {
+		select {
+		case <-node.Context().Done():
+			return
+		case evt, ok := <-sub.Out():
+			if !ok {
+				return
+			}
+			nodeEvent, ok := nodeEventFor(evt)
+			if !ok {
+				continue
+			}
+			// Convert to JSON
+			eventJSON, err := json.Marshal(nodeEvent)
+			if err != nil {
+				log.Printf("ERROR:  marshaling node event to JSON: %s\n", err)
+				continue
+			}
+			callStringCallback(cb, string(eventJSON))
+		}
+	}
+}
+
+// nodeEventFor converts an event bus event to a NodeEvent, returning false
+// for events that aren't forwarded, such as changes of a peer's
+// connectedness other than connecting or disconnecting
+func nodeEventFor(evt interface{}) (NodeEvent, bool) {
+	switch e := evt.(type) {
+	case event.EvtLocalReachabilityChanged:
+		return NodeEvent{Type: "reachability", Reachability: reachabilityName(e.Reachability)}, true
+	case event.EvtLocalAddressesUpdated:
+		nodeEvent := NodeEvent{Type: "addresses", Addrs: []string{}}
+		for _, addr := range e.Current {
+			nodeEvent.Addrs = append(nodeEvent.Addrs, addr.Address.String())
+			if addr.Action == event.Added {
+				nodeEvent.Added = append(nodeEvent.Added, addr.Address.String())
+			}
+		}
+		for _, addr := range e.Removed {
+			nodeEvent.Removed = append(nodeEvent.Removed, addr.Address.String())
+		}
+		return nodeEvent, true
+	case event.EvtLocalProtocolsUpdated:
+		return NodeEvent{Type: "protocols", Added: protocolStrings(e.Added), Removed: protocolStrings(e.Removed)}, true
+	case event.EvtPeerConnectednessChanged:
+		switch e.Connectedness {
+		case network.Connected:
+			return NodeEvent{Type: "peerConnected", Peer: e.Peer.String()}, true
+		case network.NotConnected:
+			return NodeEvent{Type: "peerDisconnected", Peer: e.Peer.String()}, true
+		}
+	}
+	return NodeEvent{}, false
+}
+
+// protocolStrings converts protocol IDs to strings
+func protocolStrings(ids []protocol.ID) []string {
+	if len(ids) == 0 {
+		return nil
+	}
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = string(id)
+	}
+	return strs
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// dupFile returns a file writing to a duplicate of the descriptor fd, so that
+// closing it, or its finalizer, leaves fd open
+func dupFile(fd uintptr) (*os.File, error) {
+	dup, err := syscall.Dup(int(fd))
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(dup)
+	return os.NewFile(uintptr(dup), fmt.Sprintf("fd %d", fd)), nil
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// dupFile returns a file writing to a duplicate of the handle fd, so that
+// closing it, or its finalizer, leaves fd open
+func dupFile(fd uintptr) (*os.File, error) {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return nil, err
+	}
+	var dup syscall.Handle
+	err = syscall.DuplicateHandle(process, syscall.Handle(fd), process, &dup, 0, false, syscall.DUPLICATE_SAME_ACCESS)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(dup), fmt.Sprintf("handle %d", fd)), nil
+}
@@ -2,30 +2,50 @@ package main
 
 // #include <stdlib.h>
 // #include <stdbool.h>
+// #include <stdint.h>
 import "C"
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
 	// "unsafe"
+	iface "github.com/ipfs/boxo/coreiface"
 	"github.com/ipfs/boxo/coreiface/options"
 	ipath "github.com/ipfs/boxo/coreiface/path"
 	"github.com/ipfs/boxo/files"
+	dag "github.com/ipfs/boxo/ipld/merkledag"
+	ft "github.com/ipfs/boxo/ipld/unixfs"
+	uio "github.com/ipfs/boxo/ipld/unixfs/io"
 	cidlib "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/kubo/core"
+	ipldprime "github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multicodec"
+	"google.golang.org/protobuf/encoding/protowire"
 	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// AddFile adds a file to IPFS
+// AddFile adds a file to IPFS.
+// If announce is set, the new CID is provided to the DHT immediately.
 //
 //export AddFile
-func AddFile(repoPath, filePath *C.char, onlyHash C.bool) *C.char {
-	ctx := context.Background()
-
+func AddFile(repoPath, filePath *C.char, onlyHash C.bool, announce C.bool) *C.char {
 	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
 	file := C.GoString(filePath)
 	only_hash := bool(onlyHash)
 	log.Printf("DEBUG: Adding file from path %s using repo %s\n", file, path)
@@ -33,68 +53,161 @@ func AddFile(repoPath, filePath *C.char, onlyHash C.bool) *C.char {
 	// Get or create a node from the registry
 	api, _, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR:  acquiring node: %s\n", err)
+		logError("acquiring node: %s", err)
 		return nil
 	}
 	// Release the node when done (decreases reference count)
 	defer ReleaseNode(path)
 
-	// Open the file
-	f, err := os.Open(file)
+	cid, err := addPath(ctx, api, file, AddOptions{
+		OnlyHash: only_hash,
+		Announce: bool(announce),
+	})
 	if err != nil {
-		log.Printf("ERROR:  opening file: %s\n", err)
+		logError("%s", err)
 		return nil
 	}
-	defer f.Close()
+	log.Printf("DEBUG: File added with CID: %s\n", cid)
 
-	// Add the file to IPFS
-	fileInfo, err := f.Stat()
-	if err != nil {
-		log.Printf("ERROR:  getting file info: %s\n", err)
+	// Return the CID as a C string
+	// Note: This allocates memory that should be freed by the caller
+	return C.CString(cid)
+}
+
+// AddResult describes the outcome of adding a single path in a batch
+type AddResult struct {
+	Path  string `json:"path"`
+	CID   string `json:"cid,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// AddFiles adds multiple files to IPFS, reusing a single node for the whole batch.
+// pathsJSON is a JSON array of file paths; the result is a JSON array of AddResult
+// in the same order. Up to SetMaxConcurrency files are added at once, so not
+// necessarily in the order given.
+//
+//export AddFiles
+func AddFiles(repoPath, pathsJSON *C.char, onlyHash C.bool) *C.char {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+	only_hash := bool(onlyHash)
+
+	var filePaths []string
+	if err := json.Unmarshal([]byte(C.GoString(pathsJSON)), &filePaths); err != nil {
+		logError("parsing paths JSON: %s", err)
 		return nil
 	}
+	log.Printf("DEBUG: Adding %d files using repo %s\n", len(filePaths), path)
 
-	var fileNode files.Node
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
 
-	if fileInfo.IsDir() {
-		// Handle directory
-		var dirErr error
-		fileNode, dirErr = files.NewSerialFile(file, true, fileInfo)
-		if dirErr != nil {
-			log.Printf("ERROR:  creating directory node: %s\n", dirErr)
-			return nil
-		}
-	} else {
-		// Handle file
-		log.Printf("DEBUG: Creating file node for %s\n", file)
-		var fileErr error
-		fileNode, fileErr = files.NewReaderPathFile(file, f, fileInfo)
-		if fileErr != nil {
-			log.Printf("ERROR:  creating file node: %s\n", fileErr)
-			return nil
+	// The files are added concurrently, bounded by SetMaxConcurrency
+	results := make([]AddResult, len(filePaths))
+	runBatch(ctx, len(filePaths), func(ctx context.Context, i int) {
+		results[i].Path = filePaths[i]
+		cid, err := addPath(ctx, api, filePaths[i], AddOptions{OnlyHash: only_hash})
+		if err != nil {
+			results[i].Error = err.Error()
+			return
 		}
+		results[i].CID = cid
+	}, func(i int, err error) {
+		results[i].Path = filePaths[i]
+		results[i].Error = err.Error()
+	})
+
+	// Convert to JSON
+	resultsJSON, err := json.Marshal(results)
+	if err != nil {
+		logError("marshaling add results to JSON: %s", err)
+		return nil
 	}
 
-	log.Printf("DEBUG: Adding file to IPFS\n")
+	return C.CString(string(resultsJSON))
+}
 
-	resolved, err := api.Unixfs().Add(
-		ctx,
-		fileNode,
-		options.Unixfs.Pin(!only_hash),
-		options.Unixfs.HashOnly(only_hash),
-	)
+// fileNodeForPath creates a Unixfs files.Node for a file, directory or
+// symlink on disk. Symlinks are preserved rather than followed.
+// Directory entries whose names match any of the gitignore-style ignore
+// patterns are left out. The caller is responsible for closing the returned node.
+func fileNodeForPath(file string, ignore []string) (files.Node, error) {
+	fileInfo, err := os.Lstat(file)
+	if err != nil {
+		return nil, fmt.Errorf("getting file info: %w", err)
+	}
 
+	// The filter matches entry names without a trailing slash, so directory
+	// patterns like "build/" would otherwise never match
+	rules := make([]string, len(ignore))
+	for i, pattern := range ignore {
+		rules[i] = strings.TrimSuffix(pattern, "/")
+	}
+	filter, err := files.NewFilter("", rules, true)
 	if err != nil {
-		log.Printf("ERROR:  adding file to IPFS: %s\n", err)
-		return nil
+		return nil, fmt.Errorf("parsing ignore patterns: %w", err)
 	}
 
-	cid := resolved.Cid().String()
-	log.Printf("DEBUG: File added with CID: %s\n", cid)
+	fileNode, err := files.NewSerialFileWithFilter(file, filter, fileInfo)
+	if err != nil {
+		return nil, fmt.Errorf("creating file node: %w", err)
+	}
+	return fileNode, nil
+}
 
-	// Return the CID as a C string
-	// Note: This allocates memory that should be freed by the caller
-	return C.CString(cid)
+// addPath adds a file or directory on disk to IPFS and returns its CID
+func addPath(ctx context.Context, api iface.CoreAPI, file string, opts AddOptions) (string, error) {
+	unixfsOpts, err := opts.unixfsOptions()
+	if err != nil {
+		return "", err
+	}
+	restoreSharding, err := opts.applySharding()
+	if err != nil {
+		return "", err
+	}
+	defer restoreSharding()
+
+	if !opts.OnlyHash {
+		if err := checkAddSize(file); err != nil {
+			return "", err
+		}
+	}
+
+	fileNode, err := fileNodeForPath(file, opts.Ignore)
+	if err != nil {
+		return "", err
+	}
+	defer fileNode.Close()
+
+	var root cidlib.Cid
+	if opts.writesMetadata() {
+		root, err = addWithMetadata(ctx, api, file, fileNode, opts, unixfsOpts)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		resolved, err := api.Unixfs().Add(ctx, fileNode, unixfsOpts...)
+		if err != nil {
+			return "", fmt.Errorf("adding file to IPFS: %w", err)
+		}
+		root = resolved.Cid()
+	}
+
+	// The content is added even if announcing it fails, so only log the error
+	if opts.Announce && !opts.OnlyHash {
+		if err := api.Dht().Provide(ctx, ipath.IpfsPath(root)); err != nil {
+			log.Printf("ERROR:  announcing %s: %s\n", root, err)
+		}
+	}
+
+	return root.String(), nil
 }
 
 // FreeString is a no-op for now - we'll let Go's garbage collection handle the memory
@@ -106,22 +219,1086 @@ func FreeString(str *C.char) {
 	// C.free(unsafe.Pointer(str))
 }
 
-// Download retrieves a file or directory from IPFS
+// Download retrieves a file or directory from IPFS.
+// Permissions recorded in the DAG's Unixfs mode metadata are applied to the
+// written files, except for executable bits (see DownloadWithMode).
+// Raw blocks are written as their bytes, and dag-cbor/dag-json records are
+// written as dag-json. Other non-Unixfs codecs are rejected (-12).
+// If pin is set, the content is pinned recursively once it has been
+// retrieved, so it is kept through garbage collection (-13 if pinning fails).
+// If verify is set, the written output is checked end to end against the CID
+// once it is complete (-11 on mismatch, see verifyDownload).
+//
+//export Download
+func Download(repoPath, cidStr, destPath *C.char, pin C.bool, verify C.bool) C.int {
+	return downloadCID(
+		C.GoString(repoPath), C.GoString(cidStr), C.GoString(destPath),
+		downloadOptions{pin: bool(pin), verify: bool(verify)},
+	)
+}
+
+// DownloadWithMode retrieves a file or directory from IPFS like Download,
+// optionally also restoring executable bits from the Unixfs mode metadata
+//
+//export DownloadWithMode
+func DownloadWithMode(repoPath, cidStr, destPath *C.char, restoreExec C.bool) C.int {
+	return downloadCID(
+		C.GoString(repoPath), C.GoString(cidStr), C.GoString(destPath),
+		downloadOptions{restoreExec: bool(restoreExec)},
+	)
+}
+
+// DownloadResumable retrieves a file from IPFS like Download, but writes it
+// to dest + "." + CID + ".part" first and only renames it to dest once it is
+// complete. If a previous attempt at the same CID left a partial file
+// behind, the download resumes from where it stopped; partial files of other
+// CIDs are never resumed from. With verify set, the finished file is compared
+// against the content of the CID before the rename (-11 on mismatch, in
+// which case the partial file is discarded).
+// Directories and symlinks are downloaded as with Download.
+//
+//export DownloadResumable
+func DownloadResumable(repoPath, cidStr, destPath *C.char, verify C.bool) C.int {
+	return downloadCID(
+		C.GoString(repoPath), C.GoString(cidStr), C.GoString(destPath),
+		downloadOptions{resume: true, verify: bool(verify)},
+	)
+}
+
+// DownloadWithProviders retrieves a file or directory from IPFS like Download,
+// but first looks up to numProviders providers of the CID and connects to
+// them, starting the download as soon as the first one is connected instead
+// of relying on Bitswap's own provider search alone. This makes fetches of
+// sparsely provided content start sooner.
+//
+//export DownloadWithProviders
+func DownloadWithProviders(repoPath, cidStr, destPath *C.char, numProviders C.int) C.int {
+	return downloadCID(
+		C.GoString(repoPath), C.GoString(cidStr), C.GoString(destPath),
+		downloadOptions{providers: int(numProviders)},
+	)
+}
+
+// DownloadFromPeers retrieves a file or directory from IPFS like Download,
+// but first connects to peers known to have the content, e.g. the peer that
+// shared the CID. peersJSON is a JSON array of multiaddrs ending in
+// /p2p/<peer ID>, or bare peer IDs whose addresses are looked up.
+// Bitswap asks connected peers for blocks before searching the DHT, so the
+// fetch goes straight to these peers. The connections are kept open for the
+// duration of the download. If none of the peers can be reached, the
+// download falls back to the usual provider search.
+// Returns -14 if peersJSON can't be parsed.
+//
+//export DownloadFromPeers
+func DownloadFromPeers(repoPath, cidStr, destPath, peersJSON *C.char) C.int {
+	peers, err := parsePeerHints(C.GoString(peersJSON))
+	if err != nil {
+		logError("%s", err)
+		return C.int(-14)
+	}
+	return downloadCID(
+		C.GoString(repoPath), C.GoString(cidStr), C.GoString(destPath),
+		downloadOptions{peers: peers},
+	)
+}
+
+// DownloadWithProgress retrieves a file or directory from IPFS like Download,
+// reporting the number of bytes written so far to a progress callback
+// void(long long written, long long total). The total is the file's size, or
+// -1 for directories, whose size isn't known in advance. The callback is
+// called from a single goroutine, at most every 200ms while the download
+// runs, with increasing values, and once more with the final count when
+// the download ends.
+//
+//export DownloadWithProgress
+func DownloadWithProgress(repoPath, cidStr, destPath *C.char, cb C.uintptr_t) C.int {
+	return downloadCID(
+		C.GoString(repoPath), C.GoString(cidStr), C.GoString(destPath),
+		downloadOptions{progress: cb},
+	)
+}
+
+// DownloadWithTimeout retrieves a file or directory from IPFS like Download,
+// but gives up on content that can't be found instead of waiting for it
+// indefinitely. If nothing of the content arrives for stallTimeoutSeconds,
+// the download is aborted as unavailable (-15), while a download that keeps
+// progressing may take longer. If timeoutSeconds is positive, the download
+// is aborted once it has taken that long (-16), even if it is progressing.
+// Pass 0 to disable either limit.
+//
+//export DownloadWithTimeout
+func DownloadWithTimeout(repoPath, cidStr, destPath *C.char, stallTimeoutSeconds, timeoutSeconds C.int) C.int {
+	return downloadCID(
+		C.GoString(repoPath), C.GoString(cidStr), C.GoString(destPath),
+		downloadOptions{
+			stallTimeout: time.Duration(stallTimeoutSeconds) * time.Second,
+			timeout:      time.Duration(timeoutSeconds) * time.Second,
+		},
+	)
+}
+
+// DownloadToFD retrieves a file from IPFS and writes its content to an
+// already open file descriptor, e.g. of a pipe, a socket or a temporary file,
+// starting at its current position. This streams content straight to another
+// process without the library opening any path. The descriptor is left open
+// for the caller to close. On Windows, fd must be an OS file handle (see
+// msvcrt.get_osfhandle) rather than a C runtime descriptor.
+// Returns 0 on success, -1 if the node couldn't be acquired, -2 if the CID
+// is invalid or can't be retrieved, -3 if fd can't be used, -5 if reading
+// the content failed, -6 if writing it failed, -9 if the content isn't a
+// file, e.g. a directory, and -12 for non-Unixfs codecs.
+//
+//export DownloadToFD
+func DownloadToFD(repoPath, cidStr *C.char, fd C.int) C.int {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+	cid := C.GoString(cidStr)
+
+	log.Printf("DEBUG: Getting content with CID %s to fd %d using repo %s\n", cid, int(fd), path)
+
+	// Writing through a duplicate leaves fd open once the file is closed
+	out, err := dupFile(uintptr(fd))
+	if err != nil {
+		logError("using fd %d: %s", int(fd), err)
+		return C.int(-3)
+	}
+	defer out.Close()
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return C.int(-2)
+	}
+
+	return downloadToWriter(ctx, api, decodedCid, out)
+}
+
+// downloadToWriter writes the content of the Unixfs file c to w, returning
+// the codes of DownloadToFD
+func downloadToWriter(ctx context.Context, api iface.CoreAPI, c cidlib.Cid, w io.Writer) C.int {
+	// Only dag-pb and raw blocks can be read as Unixfs
+	switch codec := c.Prefix().Codec; codec {
+	case cidlib.DagProtobuf, cidlib.Raw:
+	default:
+		logError("cannot write %s as a file: unsupported codec %s", c, multicodec.Code(codec))
+		return C.int(-12)
+	}
+
+	fileNode, err := api.Unixfs().Get(ctx, ipath.IpfsPath(c))
+	if err != nil {
+		logError("getting content from IPFS: %s", err)
+		return C.int(-2)
+	}
+	defer fileNode.Close()
+
+	// Symlinks also implement files.File, so they must be ruled out first
+	file, ok := fileNode.(files.File)
+	if _, isSymlink := fileNode.(*files.Symlink); isSymlink || !ok {
+		logError("%s is not a file: %T", c, fileNode)
+		return C.int(-9)
+	}
+
+	// Write errors are told apart from read errors by the writer
+	fw := &failingWriter{w: w}
+	if _, err := io.Copy(fw, file); err != nil {
+		if fw.err != nil {
+			logError("writing content: %s", fw.err)
+			return C.int(-6)
+		}
+		logError("reading file content: %s", err)
+		return C.int(-5)
+	}
+
+	log.Printf("DEBUG: Content of %s written\n", c)
+	return C.int(0)
+}
+
+// failingWriter records the first error of the writer it wraps
+type failingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (fw *failingWriter) Write(data []byte) (int, error) {
+	n, err := fw.w.Write(data)
+	if err != nil && fw.err == nil {
+		fw.err = err
+	}
+	return n, err
+}
+
+// downloadOptions holds the optional behaviours of downloadCID
+type downloadOptions struct {
+	// restoreExec applies executable bits from Unixfs mode metadata
+	restoreExec bool
+	// resume writes files via a ".part" file that later attempts at the same
+	// CID continue
+	resume bool
+	// verify checks the written output against the CID's content
+	verify bool
+	// providers, if positive, is the number of providers to look up and
+	// connect to before fetching; fetching starts once the first is connected
+	providers int
+	// pin pins the content recursively after retrieving it
+	pin bool
+	// peers are connected to before fetching, as likely holders of the content
+	peers []peer.AddrInfo
+	// progress is a progress callback reporting the bytes written
+	progress C.uintptr_t
+	// stallTimeout, if positive, aborts the download once nothing has
+	// arrived for this long
+	stallTimeout time.Duration
+	// timeout, if positive, aborts the download once it has taken this long
+	timeout time.Duration
+}
+
+// downloadProgressInterval is how often download progress is reported
+const downloadProgressInterval = 200 * time.Millisecond
+
+// downloadProgress counts the bytes written by a download, reporting them to
+// a progress callback and watching for stalls from a single goroutine. As the
+// content is written as it arrives, a download that writes nothing has
+// stalled. A nil *downloadProgress counts nothing, so downloads without a
+// callback or stall timeout can use it too.
+type downloadProgress struct {
+	cb           C.uintptr_t
+	total        atomic.Int64
+	written      atomic.Int64
+	stallTimeout time.Duration
+	cancel       context.CancelFunc
+	stalled      atomic.Bool
+	stopped      chan struct{}
+	done         chan struct{}
+}
+
+// startDownloadProgress starts reporting to cb if set, and calls cancel once
+// nothing has been written for stallTimeout if that is positive. Returns nil
+// if neither is requested.
+func startDownloadProgress(cb C.uintptr_t, stallTimeout time.Duration, cancel context.CancelFunc) *downloadProgress {
+	if cb == 0 && stallTimeout <= 0 {
+		return nil
+	}
+	p := &downloadProgress{
+		cb:           cb,
+		stallTimeout: stallTimeout,
+		cancel:       cancel,
+		stopped:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	p.total.Store(-1)
+	go p.report()
+	return p
+}
+
+// report calls the callback whenever the count has changed and cancels the
+// download if it stalls, until stopped
+func (p *downloadProgress) report() {
+	defer close(p.done)
+	ticker := time.NewTicker(downloadProgressInterval)
+	defer ticker.Stop()
+
+	lastReported := int64(-1)
+	lastWritten := int64(0)
+	lastActivity := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			written := p.written.Load()
+			if written != lastWritten {
+				lastWritten = written
+				lastActivity = now
+			} else if p.stallTimeout > 0 && now.Sub(lastActivity) >= p.stallTimeout && !p.stalled.Load() {
+				p.stalled.Store(true)
+				p.cancel()
+			}
+			if p.cb != 0 && written != lastReported {
+				callProgressCallback(p.cb, written, p.total.Load())
+				lastReported = written
+			}
+		case <-p.stopped:
+			if p.cb != 0 {
+				callProgressCallback(p.cb, p.written.Load(), p.total.Load())
+			}
+			return
+		}
+	}
+}
+
+// setTotal sets the total reported to the callback once it is known
+func (p *downloadProgress) setTotal(total int64) {
+	if p != nil {
+		p.total.Store(total)
+	}
+}
+
+// hasStalled returns whether the download was cancelled for stalling
+func (p *downloadProgress) hasStalled() bool {
+	return p != nil && p.stalled.Load()
+}
+
+// add counts n more bytes as written
+func (p *downloadProgress) add(n int64) {
+	if p != nil {
+		p.written.Add(n)
+	}
+}
+
+// writer returns a writer to w that counts the bytes written through it
+func (p *downloadProgress) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return &progressWriter{w: w, progress: p}
+}
+
+// stop reports the final count and waits until the callback has returned.
+// Only the first call has an effect.
+func (p *downloadProgress) stop() {
+	if p == nil {
+		return
+	}
+	select {
+	case <-p.stopped:
+	default:
+		close(p.stopped)
+	}
+	<-p.done
+}
+
+// progressWriter counts the bytes written to a writer
+type progressWriter struct {
+	w        io.Writer
+	progress *downloadProgress
+}
+
+func (pw *progressWriter) Write(data []byte) (int, error) {
+	n, err := pw.w.Write(data)
+	pw.progress.add(int64(n))
+	return n, err
+}
+
+// downloadPeersTag prefixes the tags protecting the connections to peers
+// given to DownloadFromPeers
+const downloadPeersTag = "libkubo-download-peers"
+
+// downloadCID retrieves a file or directory from IPFS, returning the error
+// codes documented by Download and DownloadWithTimeout
+func downloadCID(path, cid, dest string, opts downloadOptions) (code C.int) {
+	opCtx, endOp := beginOperation(path)
+	defer endOp()
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if opts.timeout > 0 {
+		ctx, cancel = context.WithTimeout(opCtx, opts.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(opCtx)
+	}
+	// Stops any provider lookup that is still running
+	defer cancel()
+
+	// Tracks the download from the start of the retrieval on
+	var progress *downloadProgress
+	defer func() { progress.stop() }()
+	// Failures caused by the timeouts are reported as such
+	defer func() {
+		if code == 0 {
+			return
+		}
+		if progress.hasStalled() {
+			logError("content unavailable: nothing of %s arrived for %s", cid, opts.stallTimeout)
+			code = C.int(-15)
+		} else if opts.timeout > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			logError("download of %s timed out after %s", cid, opts.timeout)
+			code = C.int(-16)
+		}
+	}()
+
+	log.Printf("DEBUG: Getting content with CID %s to %s using repo %s\n", cid, dest, path)
+
+	// Get or create a node from the registry
+	api, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return C.int(-2)
+	}
+
+	ipfsPath := ipath.IpfsPath(decodedCid)
+
+	if len(opts.peers) > 0 {
+		// Each download uses its own tag so that concurrent downloads from
+		// the same peers don't lift each other's protection
+		tag := fmt.Sprintf("%s:%s:%s", downloadPeersTag, cid, dest)
+		connectCtx, connectCancel := context.WithTimeout(ctx, 30*time.Second)
+		connected := connectToPeers(connectCtx, node, opts.peers, tag)
+		connectCancel()
+		log.Printf("DEBUG: Connected to %d of %d given peers\n", connected, len(opts.peers))
+		if connected > 0 {
+			defer func() {
+				for _, info := range opts.peers {
+					node.PeerHost.ConnManager().Unprotect(info.ID, tag)
+				}
+			}()
+		}
+	}
+
+	if opts.providers > 0 {
+		log.Printf("DEBUG: Looking for up to %d providers\n", opts.providers)
+		<-connectToProviders(ctx, node, decodedCid, opts.providers)
+	}
+
+	progress = startDownloadProgress(opts.progress, opts.stallTimeout, cancel)
+
+	// Only dag-pb and raw blocks can be read as Unixfs
+	switch codec := decodedCid.Prefix().Codec; codec {
+	case cidlib.DagProtobuf, cidlib.Raw:
+	case cidlib.DagCBOR, cidlib.DagJSON:
+		log.Printf("DEBUG: Writing %s record as dag-json\n", cid)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			logError("creating destination directory: %s", err)
+			return C.int(-3)
+		}
+		if err := downloadRecordJSON(ctx, api, ipfsPath, codec, dest); err != nil {
+			logError("writing record as JSON: %s", err)
+			return C.int(-12)
+		}
+		progress.stop()
+		if opts.verify {
+			if err := verifyRecordJSON(dest, decodedCid); err != nil {
+				logError("verifying downloaded record: %s", err)
+				return C.int(-11)
+			}
+		}
+		return pinDownloaded(ctx, api, ipfsPath, opts)
+	default:
+		logError("cannot write %s as a file: unsupported codec %s", cid, multicodec.Code(codec))
+		return C.int(-12)
+	}
+
+	// Get the node from IPFS
+	log.Printf("DEBUG: Retrieving content from IPFS\n")
+	fileNode, err := api.Unixfs().Get(ctx, ipfsPath)
+	if err != nil {
+		logError("getting content from IPFS: %s", err)
+		return C.int(-2)
+	}
+
+	// Create the destination directory if it doesn't exist
+	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	if err != nil {
+		logError("creating destination directory: %s", err)
+		return C.int(-3)
+	}
+
+	// Only a file's size is known before its content is read
+	if file, ok := fileNode.(files.File); ok {
+		if size, err := file.Size(); err == nil {
+			progress.setTotal(size)
+		}
+	}
+
+	// Resumed files are verified before they are moved into place
+	verified := false
+
+	// Handle different node types (symlink, file or directory)
+	switch node := fileNode.(type) {
+	case *files.Symlink:
+		// Symlinks also implement files.File, so they must be matched first
+		log.Printf("DEBUG: Retrieved node is a symlink to %s\n", node.Target)
+		err = writeSymlink(node.Target, dest)
+		if err != nil {
+			logError("creating symlink: %s", err)
+			return C.int(-6)
+		}
+
+	case files.File:
+		// Handle regular file
+		log.Printf("DEBUG: Retrieved node is a file\n")
+
+		if opts.resume {
+			if code := downloadFileResumable(ctx, api, ipfsPath, node, dest, opts.verify, progress); code != 0 {
+				return code
+			}
+			verified = opts.verify
+			break
+		}
+		
+		// Write the content to the destination as it arrives
+		log.Printf("DEBUG: Writing content to destination file: %s\n", dest)
+		out, err := os.Create(dest)
+		if err != nil {
+			logError("creating file: %s", err)
+			return C.int(-6)
+		}
+		_, err = io.Copy(progress.writer(out), node)
+		if closeErr := out.Close(); closeErr != nil {
+			logError("writing file: %s", closeErr)
+			return C.int(-6)
+		}
+		if err != nil {
+			logError("reading file content: %s", err)
+			return C.int(-5)
+		}
+		
+	case files.Directory:
+		// Handle directory
+		log.Printf("DEBUG: Retrieved node is a directory\n")
+		
+		// Create the destination directory if it doesn't exist
+		err = os.MkdirAll(dest, 0755)
+		if err != nil {
+			logError("creating destination directory: %s", err)
+			return C.int(-7)
+		}
+		
+		// Use the destination path exactly as specified
+		log.Printf("DEBUG: Downloading directory to: %s\n", dest)
+		
+		// Process all entries in the directory
+		err = downloadDirectory(ctx, node, dest, progress)
+		if err != nil {
+			logError("processing directory: %s", err)
+			return C.int(-8)
+		}
+		
+	default:
+		logError("unknown node type: %T", fileNode)
+		return C.int(-9)
+	}
+	// Everything has arrived; what follows works on local blocks
+	progress.stop()
+
+	// Apply permissions if the DAG carries Unixfs mode metadata
+	err = applyUnixfsModes(ctx, api, ipfsPath, dest, opts.restoreExec)
+	if err != nil {
+		logError("applying file modes: %s", err)
+		return C.int(-10)
+	}
+
+	if opts.verify && !verified {
+		log.Printf("DEBUG: Verifying downloaded content\n")
+		if err := verifyDownload(ctx, api, ipfsPath, dest); err != nil {
+			logError("verifying downloaded content: %s", err)
+			return C.int(-11)
+		}
+	}
+
+	log.Printf("DEBUG: Content retrieved successfully\n")
+	return pinDownloaded(ctx, api, ipfsPath, opts)
+}
+
+// pinDownloaded pins downloaded content if requested by opts. Its blocks are
+// all local by now, so this doesn't fetch anything again.
+func pinDownloaded(ctx context.Context, api iface.CoreAPI, p ipath.Path, opts downloadOptions) C.int {
+	if !opts.pin {
+		return C.int(0)
+	}
+	if err := api.Pin().Add(ctx, p, options.Pin.Recursive(true)); err != nil {
+		logError("pinning downloaded content: %s", err)
+		return C.int(-13)
+	}
+	log.Printf("DEBUG: Downloaded content pinned\n")
+	return C.int(0)
+}
+
+// downloadFileResumable writes the file at p to dest via its partial file
+// (see partialPath), continuing from the end of an existing one. Returns 0 on
+// success or one of the error codes documented by Download and
+// DownloadResumable.
+func downloadFileResumable(ctx context.Context, api iface.CoreAPI, p ipath.Resolved, file files.File, dest string, verify bool, progress *downloadProgress) C.int {
+	partPath := partialPath(dest, p.Cid())
+
+	size, err := file.Size()
+	if err != nil {
+		logError("getting file size: %s", err)
+		return C.int(-5)
+	}
+
+	part, err := os.OpenFile(partPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		logError("opening partial file: %s", err)
+		return C.int(-6)
+	}
+	defer part.Close()
+
+	info, err := part.Stat()
+	if err != nil {
+		logError("getting partial file info: %s", err)
+		return C.int(-6)
+	}
+	offset := info.Size()
+	if offset > size {
+		// Longer than the content, so not written by a download, start again
+		offset = 0
+	}
+	if err := part.Truncate(offset); err != nil {
+		logError("truncating partial file: %s", err)
+		return C.int(-6)
+	}
+	if offset > 0 {
+		log.Printf("DEBUG: Resuming download of %s at byte %d of %d\n", dest, offset, size)
+	}
+
+	if _, err := part.Seek(offset, io.SeekStart); err != nil {
+		logError("seeking partial file: %s", err)
+		return C.int(-6)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		logError("seeking file content: %s", err)
+		return C.int(-5)
+	}
+
+	// Write as the content arrives so an interrupted download keeps its progress
+	progress.add(offset)
+	if _, err := io.Copy(progress.writer(part), file); err != nil {
+		logError("downloading file content: %s", err)
+		return C.int(-5)
+	}
+	if err := part.Close(); err != nil {
+		logError("writing partial file: %s", err)
+		return C.int(-6)
+	}
+
+	if verify {
+		if err := verifyFileContent(ctx, api, p, partPath); err != nil {
+			logError("verifying downloaded file: %s", err)
+			os.Remove(partPath)
+			return C.int(-11)
+		}
+	}
+
+	if err := os.Rename(partPath, dest); err != nil {
+		logError("moving partial file into place: %s", err)
+		return C.int(-6)
+	}
+	return C.int(0)
+}
+
+// partialPath returns the path a resumable download of c to dest is written
+// to until it is complete. It contains the CID, so a partial file left over
+// from downloading other content to dest is never resumed from.
+func partialPath(dest string, c cidlib.Cid) string {
+	return dest + "." + c.String() + ".part"
+}
+
+// verifyFileContent checks that the file at localPath holds exactly the
+// content of the Unixfs file p. The content is read through the Unixfs API,
+// which checks every block against its CID.
+func verifyFileContent(ctx context.Context, api iface.CoreAPI, p ipath.Path, localPath string) error {
+	fileNode, err := api.Unixfs().Get(ctx, p)
+	if err != nil {
+		return err
+	}
+	defer fileNode.Close()
+	file, ok := fileNode.(files.File)
+	if !ok {
+		return fmt.Errorf("expected a file, got %T", fileNode)
+	}
+
+	local, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	const bufSize = 64 * 1024
+	expected := make([]byte, bufSize)
+	actual := make([]byte, bufSize)
+	var offset int64
+	for {
+		n, expectedErr := io.ReadFull(file, expected)
+		m, actualErr := io.ReadFull(local, actual)
+		if n != m || !bytes.Equal(expected[:n], actual[:m]) {
+			return fmt.Errorf("content differs from the CID at or after byte %d", offset)
+		}
+		offset += int64(n)
+
+		expectedDone := expectedErr == io.EOF || expectedErr == io.ErrUnexpectedEOF
+		actualDone := actualErr == io.EOF || actualErr == io.ErrUnexpectedEOF
+		if expectedErr != nil && !expectedDone {
+			return expectedErr
+		}
+		if actualErr != nil && !actualDone {
+			return actualErr
+		}
+		if expectedDone || actualDone {
+			if expectedDone != actualDone {
+				return fmt.Errorf("content length differs from the CID")
+			}
+			return nil
+		}
+	}
+}
+
+// verifyDownload checks that the file, directory or symlink written to dest
+// matches the Unixfs DAG at p. File contents are compared with the DAG as it
+// is read through the Unixfs API, which checks every block against its CID,
+// and a single raw block is re-hashed directly. Entries in dest that aren't
+// part of the DAG are ignored.
+func verifyDownload(ctx context.Context, api iface.CoreAPI, p ipath.Path, dest string) error {
+	resolved, err := api.ResolvePath(ctx, p)
+	if err != nil {
+		return err
+	}
+	c := resolved.Cid()
+
+	fileNode, err := api.Unixfs().Get(ctx, resolved)
+	if err != nil {
+		return err
+	}
+	defer fileNode.Close()
+
+	switch node := fileNode.(type) {
+	case *files.Symlink:
+		target, err := os.Readlink(dest)
+		if err != nil {
+			return err
+		}
+		if target != node.Target {
+			return fmt.Errorf("symlink %s points to %s instead of %s", dest, target, node.Target)
+		}
+		return nil
+	case files.File:
+		if c.Type() == cidlib.Raw {
+			data, err := os.ReadFile(dest)
+			if err != nil {
+				return err
+			}
+			sum, err := c.Prefix().Sum(data)
+			if err != nil {
+				return err
+			}
+			if !sum.Equals(c) {
+				return fmt.Errorf("%s hashes to %s instead of %s", dest, sum, c)
+			}
+			return nil
+		}
+		if err := verifyFileContent(ctx, api, resolved, dest); err != nil {
+			return fmt.Errorf("%s: %w", dest, err)
+		}
+		return nil
+	case files.Directory:
+		entries := node.Entries()
+		for entries.Next() {
+			entryPath := ipath.Join(ipath.IpfsPath(c), entries.Name())
+			if err := verifyDownload(ctx, api, entryPath, filepath.Join(dest, entries.Name())); err != nil {
+				return err
+			}
+		}
+		return entries.Err()
+	default:
+		return fmt.Errorf("unknown node type: %T", fileNode)
+	}
+}
+
+// verifyRecordJSON checks that the dag-json written to dest by
+// downloadRecordJSON encodes back to the record at c, by re-encoding it with
+// c's codec and hashing it with c's multihash. Records that weren't
+// canonically encoded in the first place can't be reproduced and fail.
+func verifyRecordJSON(dest string, c cidlib.Cid) error {
+	data, err := os.ReadFile(dest)
+	if err != nil {
+		return err
+	}
+	record, err := ipldprime.Decode(data, dagjson.Decode)
+	if err != nil {
+		return fmt.Errorf("decoding %s: %w", dest, err)
+	}
+	encode := dagjson.Encode
+	if c.Type() == cidlib.DagCBOR {
+		encode = dagcbor.Encode
+	}
+	encoded, err := ipldprime.Encode(record, encode)
+	if err != nil {
+		return fmt.Errorf("encoding record: %w", err)
+	}
+	sum, err := c.Prefix().Sum(encoded)
+	if err != nil {
+		return err
+	}
+	if !sum.Equals(c) {
+		return fmt.Errorf("%s hashes to %s instead of %s", dest, sum, c)
+	}
+	return nil
+}
+
+// downloadRecordJSON fetches a dag-cbor or dag-json block and writes it to
+// dest encoded as dag-json
+func downloadRecordJSON(ctx context.Context, api iface.CoreAPI, p ipath.Path, codec uint64, dest string) error {
+	reader, err := api.Block().Get(ctx, p)
+	if err != nil {
+		return fmt.Errorf("getting block: %w", err)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Errorf("reading block: %w", err)
+	}
+
+	jsonData, err := recordToJSON(data, codec)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(dest, jsonData, 0644)
+}
+
+// recordToJSON converts a dag-cbor or dag-json block to dag-json
+func recordToJSON(data []byte, codec uint64) ([]byte, error) {
+	decode := dagjson.Decode
+	if codec == cidlib.DagCBOR {
+		decode = dagcbor.Decode
+	}
+	record, err := ipldprime.Decode(data, decode)
+	if err != nil {
+		return nil, fmt.Errorf("decoding record: %w", err)
+	}
+	jsonData, err := ipldprime.Encode(record, dagjson.Encode)
+	if err != nil {
+		return nil, fmt.Errorf("encoding record as dag-json: %w", err)
+	}
+	return jsonData, nil
+}
+
+// downloadDirectory recursively downloads a directory and its contents,
+// counting the bytes written in progress (which may be nil). Directories and
+// symlinks are created in order as the entries are walked, while files are
+// fetched and written concurrently, up to the limit set with
+// SetMaxConcurrency, so fetches overlap on high-latency links. The first
+// error stops the download and is returned once the files being written
+// have finished.
+func downloadDirectory(ctx context.Context, dir files.Directory, destPath string, progress *downloadProgress) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	d := &directoryDownload{ctx: ctx, cancel: cancel, progress: progress}
+	if err := d.writeDirectory(dir, destPath); err != nil {
+		d.fail(err)
+	}
+	d.files.Wait()
+	return d.err
+}
+
+// directoryDownload tracks the files of a downloadDirectory call being
+// written in the background
+type directoryDownload struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	progress *downloadProgress
+	files    sync.WaitGroup
+
+	errMutex sync.Mutex
+	err      error
+}
+
+// fail records the first error of the download and stops the rest of it
+func (d *directoryDownload) fail(err error) {
+	d.errMutex.Lock()
+	if d.err == nil {
+		d.err = err
+	}
+	d.errMutex.Unlock()
+	d.cancel()
+}
+
+// writeDirectory creates destPath and walks the entries of dir into it
+func (d *directoryDownload) writeDirectory(dir files.Directory, destPath string) error {
+	// Ensure the destination path exists
+	if err := os.MkdirAll(destPath, 0755); err != nil {
+		return fmt.Errorf("creating base directory %s: %w", destPath, err)
+	}
+
+	// Process directory entries
+	entries := dir.Entries()
+	for entries.Next() {
+		entry := entries.Node()
+		name := entries.Name()
+
+		// Combine the destination path with the entry name
+		destFilePath := filepath.Join(destPath, name)
+		log.Printf("DEBUG: Processing entry: %s -> %s\n", name, destFilePath)
+
+		switch node := entry.(type) {
+		case *files.Symlink:
+			log.Printf("DEBUG: Creating symlink: %s -> %s\n", destFilePath, node.Target)
+			if err := writeSymlink(node.Target, destFilePath); err != nil {
+				return fmt.Errorf("creating symlink %s: %w", destFilePath, err)
+			}
+
+		case files.File:
+			// Wait for a free slot, which fails once the download has
+			// been stopped
+			err := goInSlot(d.ctx, &d.files, func(context.Context) {
+				if err := d.writeFile(node, name, destFilePath); err != nil {
+					d.fail(err)
+				}
+			})
+			if err != nil {
+				return err
+			}
+
+		case files.Directory:
+			// Recursively process the subdirectory
+			log.Printf("DEBUG: Creating directory: %s\n", destFilePath)
+			if err := d.writeDirectory(node, destFilePath); err != nil {
+				return err
+			}
+
+		default:
+			log.Printf("WARNING: Unknown node type for %s: %T\n", name, node)
+		}
+	}
+
+	if err := entries.Err(); err != nil {
+		return fmt.Errorf("error iterating directory entries: %w", err)
+	}
+
+	return nil
+}
+
+// writeFile writes the content of a file as it arrives
+func (d *directoryDownload) writeFile(node files.File, name, destFilePath string) error {
+	log.Printf("DEBUG: Writing file: %s\n", destFilePath)
+	out, err := os.OpenFile(destFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("writing file %s: %w", destFilePath, err)
+	}
+	_, err = io.Copy(d.progress.writer(out), node)
+	if closeErr := out.Close(); closeErr != nil {
+		return fmt.Errorf("writing file %s: %w", destFilePath, closeErr)
+	}
+	if err != nil {
+		return fmt.Errorf("reading file content for %s: %w", name, err)
+	}
+	return nil
+}
+
+// applyUnixfsModes walks the DAG at root alongside the downloaded copy at
+// dest, applying permissions from Unixfs mode metadata where present.
+// Executable bits on files are only kept if restoreExec is set.
+func applyUnixfsModes(ctx context.Context, api iface.CoreAPI, root ipath.Path, dest string, restoreExec bool) error {
+	nd, err := api.ResolveNode(ctx, root)
+	if err != nil {
+		return err
+	}
+	return applyNodeModes(ctx, api.Dag(), nd, dest, restoreExec)
+}
+
+// applyNodeModes recursively applies Unixfs mode metadata from nd to dest
+func applyNodeModes(ctx context.Context, dagService ipld.DAGService, nd ipld.Node, dest string, restoreExec bool) error {
+	// Raw leaves and other codecs carry no Unixfs metadata
+	protoNode, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil
+	}
+	fsNode, err := ft.FSNodeFromBytes(protoNode.Data())
+	if err != nil {
+		return nil
+	}
+	mode, hasMode := unixfsMode(protoNode.Data())
+
+	switch fsNode.Type() {
+	case ft.TDirectory, ft.THAMTShard:
+		dir, err := uio.NewDirectoryFromNode(dagService, nd)
+		if err != nil {
+			return err
+		}
+		err = dir.ForEachLink(ctx, func(link *ipld.Link) error {
+			child, err := link.GetNode(ctx, dagService)
+			if err != nil {
+				return err
+			}
+			return applyNodeModes(ctx, dagService, child, filepath.Join(dest, link.Name), restoreExec)
+		})
+		if err != nil {
+			return err
+		}
+		// Directories are chmodded after their contents in case they are read-only
+		if hasMode {
+			return os.Chmod(dest, mode)
+		}
+	case ft.TFile, ft.TRaw:
+		if hasMode {
+			if !restoreExec {
+				mode &^= 0111
+			}
+			return os.Chmod(dest, mode)
+		}
+	}
+	return nil
+}
+
+// unixfsMode extracts the permission bits from the optional mode field (7)
+// of a Unixfs protobuf, which the boxo version in use doesn't decode itself
+func unixfsMode(data []byte) (os.FileMode, bool) {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return 0, false
+		}
+		data = data[n:]
+
+		if num == 7 && typ == protowire.VarintType {
+			mode, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return 0, false
+			}
+			return os.FileMode(mode & 0777), true
+		}
+
+		n = protowire.ConsumeFieldValue(num, typ, data)
+		if n < 0 {
+			return 0, false
+		}
+		data = data[n:]
+	}
+	return 0, false
+}
+
+// writeSymlink creates a symlink at dest pointing to target,
+// replacing any existing non-directory entry at dest
+func writeSymlink(target, dest string) error {
+	if info, err := os.Lstat(dest); err == nil && !info.IsDir() {
+		if err := os.Remove(dest); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target, dest)
+}
+
+// HasBlock checks whether the block for a CID is available in the local
+// blockstore, without fetching anything from the network.
+// Returns 1 if the block is present, 0 if not, and a negative value on error.
 //
-//export Download
-func Download(repoPath, cidStr, destPath *C.char) C.int {
+//export HasBlock
+func HasBlock(repoPath, cidStr *C.char) C.int {
 	ctx := context.Background()
 
 	path := C.GoString(repoPath)
 	cid := C.GoString(cidStr)
-	dest := C.GoString(destPath)
-
-	log.Printf("DEBUG: Getting content with CID %s to %s using repo %s\n", cid, dest, path)
 
 	// Get or create a node from the registry
-	api, _, err := AcquireNode(path)
+	_, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR:  acquiring node: %s\n", err)
+		logError("acquiring node: %s", err)
 		return C.int(-1)
 	}
 	// Release the node when done (decreases reference count)
@@ -130,143 +1307,120 @@ func Download(repoPath, cidStr, destPath *C.char) C.int {
 	// Parse the CID
 	decodedCid, err := cidlib.Decode(cid)
 	if err != nil {
-		log.Printf("ERROR:  decoding CID: %s\n", err)
-		return C.int(-2)
-	}
-
-	ipfsPath := ipath.IpfsPath(decodedCid)
-
-	// Get the node from IPFS
-	log.Printf("DEBUG: Retrieving content from IPFS\n")
-	fileNode, err := api.Unixfs().Get(ctx, ipfsPath)
-	if err != nil {
-		log.Printf("ERROR:  getting content from IPFS: %s\n", err)
+		logError("decoding CID: %s", err)
 		return C.int(-2)
 	}
 
-	// Create the destination directory if it doesn't exist
-	err = os.MkdirAll(filepath.Dir(dest), 0755)
+	// Query the blockstore directly so no Bitswap session or DHT lookup is started
+	has, err := node.Blockstore.Has(ctx, decodedCid)
 	if err != nil {
-		log.Printf("ERROR:  creating destination directory: %s\n", err)
+		logError("checking blockstore: %s", err)
 		return C.int(-3)
 	}
+	if has {
+		return C.int(1)
+	}
+	return C.int(0)
+}
 
-	// Handle different node types (file or directory)
-	switch node := fileNode.(type) {
-	case files.File:
-		// Handle regular file
-		log.Printf("DEBUG: Retrieved node is a file\n")
-		
-		// Read file content
-		log.Printf("DEBUG: Reading file content\n")
-		content, err := ioutil.ReadAll(node)
+// BlockRmResult describes the outcome of BlockRm. Reason is "not-found" or
+// "pinned" when the block wasn't removed.
+type BlockRmResult struct {
+	CID     string `json:"cid"`
+	Removed bool   `json:"removed"`
+	Pinned  bool   `json:"pinned"`
+	PinInfo string `json:"pinInfo,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BlockRm removes a single block from the local blockstore and returns a
+// BlockRmResult as JSON. Blocks that are pinned, directly or as part of a
+// pinned DAG, are left in place unless force is set, in which case the pins
+// that include them will be incomplete until the block is fetched again.
+//
+//export BlockRm
+func BlockRm(repoPath, cidStr *C.char, force C.bool) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	cid := C.GoString(cidStr)
+
+	log.Printf("DEBUG: Removing block %s (force: %t) using repo %s\n", cid, bool(force), path)
+
+	result := BlockRmResult{CID: cid}
+	func() {
+		// Parse the CID
+		decodedCid, err := cidlib.Decode(cid)
 		if err != nil {
-			log.Printf("ERROR:  reading file content: %s\n", err)
-			return C.int(-5)
+			result.Error = fmt.Sprintf("decoding CID: %s", err)
+			return
 		}
 
-		// Write the file to the destination
-		log.Printf("DEBUG: Writing content to destination file: %s\n", dest)
-		err = ioutil.WriteFile(dest, content, 0644)
+		// Get or create a node from the registry
+		_, node, err := AcquireNode(path)
 		if err != nil {
-			log.Printf("ERROR:  writing file: %s\n", err)
-			return C.int(-6)
+			result.Error = fmt.Sprintf("acquiring node: %s", err)
+			return
 		}
-		
-	case files.Directory:
-		// Handle directory
-		log.Printf("DEBUG: Retrieved node is a directory\n")
-		
-		// Create the destination directory if it doesn't exist
-		err = os.MkdirAll(dest, 0755)
+		// Release the node when done (decreases reference count)
+		defer ReleaseNode(path)
+
+		// Keep GC and pinning from changing the pinset meanwhile
+		unlocker := node.Blockstore.GCLock(ctx)
+		defer unlocker.Unlock(ctx)
+
+		has, err := node.Blockstore.Has(ctx, decodedCid)
 		if err != nil {
-			log.Printf("ERROR:  creating destination directory: %s\n", err)
-			return C.int(-7)
+			result.Error = fmt.Sprintf("checking blockstore: %s", err)
+			return
 		}
-		
-		// Use the destination path exactly as specified
-		log.Printf("DEBUG: Downloading directory to: %s\n", dest)
-		
-		// Process all entries in the directory
-		err = downloadDirectory(node, dest)
-		if err != nil {
-			log.Printf("ERROR:  processing directory: %s\n", err)
-			return C.int(-8)
+		if !has {
+			result.Reason = "not-found"
+			return
 		}
-		
-	default:
-		log.Printf("ERROR:  unknown node type: %T\n", fileNode)
-		return C.int(-9)
-	}
-
-	log.Printf("DEBUG: Content retrieved successfully\n")
-	return C.int(0) // Success
-}
 
-// downloadDirectory recursively downloads a directory and its contents
-func downloadDirectory(dir files.Directory, destPath string) error {
-	// Ensure the destination path exists
-	if err := os.MkdirAll(destPath, 0755); err != nil {
-		return fmt.Errorf("creating base directory %s: %w", destPath, err)
-	}
-	
-	// Process directory entries
-	entries := dir.Entries()
-	for entries.Next() {
-		entry := entries.Node()
-		name := entries.Name()
-		
-		// Combine the destination path with the entry name
-		destFilePath := filepath.Join(destPath, name)
-		log.Printf("DEBUG: Processing entry: %s -> %s\n", name, destFilePath)
-		
-		switch node := entry.(type) {
-		case files.File:
-			// Create the file
-			content, err := ioutil.ReadAll(node)
-			if err != nil {
-				return fmt.Errorf("reading file content for %s: %w", name, err)
-			}
-			
-			log.Printf("DEBUG: Writing file: %s\n", destFilePath)
-			err = ioutil.WriteFile(destFilePath, content, 0644)
-			if err != nil {
-				return fmt.Errorf("writing file %s: %w", destFilePath, err)
-			}
-			
-		case files.Directory:
-			// Create the directory
-			log.Printf("DEBUG: Creating directory: %s\n", destFilePath)
-			err := os.MkdirAll(destFilePath, 0755)
-			if err != nil {
-				return fmt.Errorf("creating directory %s: %w", destFilePath, err)
-			}
-			
-			// Recursively process the subdirectory
-			err = downloadDirectory(node, destFilePath)
-			if err != nil {
-				return err
+		pinned, err := node.Pinning.CheckIfPinned(ctx, decodedCid)
+		if err != nil {
+			result.Error = fmt.Sprintf("checking pins: %s", err)
+			return
+		}
+		if len(pinned) > 0 && pinned[0].Pinned() {
+			result.Pinned = true
+			result.PinInfo = pinned[0].String()
+			if !force {
+				result.Reason = "pinned"
+				return
 			}
-			
-		default:
-			log.Printf("WARNING: Unknown node type for %s: %T\n", name, node)
 		}
+
+		if err := node.Blockstore.DeleteBlock(ctx, decodedCid); err != nil {
+			result.Error = fmt.Sprintf("deleting block: %s", err)
+			return
+		}
+		result.Removed = true
+	}()
+	if result.Error != "" {
+		log.Printf("ERROR:  removing block %s: %s\n", cid, result.Error)
 	}
-	
-	if err := entries.Err(); err != nil {
-		return fmt.Errorf("error iterating directory entries: %w", err)
+
+	// Convert to JSON
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logError("marshaling block removal result to JSON: %s", err)
+		return nil
 	}
-	
-	return nil
+
+	return C.CString(string(resultJSON))
 }
 
 // PinCID pins a CID to the IPFS node
 //
 //export PinCID
 func PinCID(repoPath, cidStr *C.char) C.int {
-	ctx := context.Background()
-
 	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
 	cid := C.GoString(cidStr)
 
 	log.Printf("DEBUG: Pinning CID %s using repo %s\n", cid, path)
@@ -274,7 +1428,7 @@ func PinCID(repoPath, cidStr *C.char) C.int {
 	// Get or create a node from the registry
 	api, _, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR:  acquiring node: %s\n", err)
+		logError("acquiring node: %s", err)
 		return C.int(-1)
 	}
 	// Release the node when done (decreases reference count)
@@ -283,7 +1437,7 @@ func PinCID(repoPath, cidStr *C.char) C.int {
 	// Parse the CID
 	decodedCid, err := cidlib.Decode(cid)
 	if err != nil {
-		log.Printf("ERROR:  decoding CID: %s\n", err)
+		logError("decoding CID: %s", err)
 		return C.int(-2)
 	}
 
@@ -292,7 +1446,63 @@ func PinCID(repoPath, cidStr *C.char) C.int {
 	// Pin the CID
 	err = api.Pin().Add(ctx, ipfsPath, options.Pin.Recursive(true))
 	if err != nil {
-		log.Printf("ERROR:  pinning CID: %s\n", err)
+		logError("pinning CID: %s", err)
+		return C.int(-3)
+	}
+
+	log.Printf("DEBUG: CID pinned successfully\n")
+	return C.int(0) // Success
+}
+
+// PinCIDOnline pins a CID recursively, choosing explicitly whether missing
+// blocks may be fetched from the network. With online set, the node is
+// started online if needed and blocks are fetched from peers; with online
+// unset, the pin only succeeds if the whole DAG is already stored locally
+// and fails fast otherwise (-3).
+// Returns -4 if online is requested but the repo's node is running offline.
+//
+//export PinCIDOnline
+func PinCIDOnline(repoPath, cidStr *C.char, online C.bool) C.int {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	cid := C.GoString(cidStr)
+
+	log.Printf("DEBUG: Pinning CID %s (online: %t) using repo %s\n", cid, bool(online), path)
+
+	// Get or create a node from the registry
+	api, node, err := acquireNode(path, bool(online), nil)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return C.int(-2)
+	}
+
+	if bool(online) && !node.IsOnline {
+		logError("cannot fetch %s from the network: node for repo %s is offline", cid, path)
+		return C.int(-4)
+	}
+	if !bool(online) {
+		// Restrict an online node to the local blockstore
+		api, err = api.WithOptions(options.Api.Offline(true))
+		if err != nil {
+			logError("creating offline API: %s", err)
+			return C.int(-1)
+		}
+	}
+
+	// Pin the CID
+	err = api.Pin().Add(ctx, ipath.IpfsPath(decodedCid), options.Pin.Recursive(true))
+	if err != nil {
+		logError("pinning CID: %s", err)
 		return C.int(-3)
 	}
 
@@ -300,6 +1510,70 @@ func PinCID(repoPath, cidStr *C.char) C.int {
 	return C.int(0) // Success
 }
 
+// PinCIDWithProgress pins a CID recursively, reporting the number of blocks
+// fetched so far to a progress callback void(long long blocks, long long total).
+// The total is always -1 since the DAG size isn't known in advance.
+//
+//export PinCIDWithProgress
+func PinCIDWithProgress(repoPath, cidStr *C.char, cb C.uintptr_t) C.int {
+	path := C.GoString(repoPath)
+	opCtx, endOp := beginOperation(path)
+	defer endOp()
+	cid := C.GoString(cidStr)
+
+	log.Printf("DEBUG: Pinning CID %s with progress using repo %s\n", cid, path)
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return C.int(-2)
+	}
+
+	ipfsPath := ipath.IpfsPath(decodedCid)
+
+	// The DAG fetcher increments the tracker for every block it visits
+	tracker := new(dag.ProgressTracker)
+	ctx := tracker.DeriveContext(opCtx)
+
+	// Pin in the background so that this goroutine can report progress
+	done := make(chan error, 1)
+	go func() {
+		done <- api.Pin().Add(ctx, ipfsPath, options.Pin.Recursive(true))
+	}()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	lastReported := -1
+	for {
+		select {
+		case err = <-done:
+			callProgressCallback(cb, int64(tracker.Value()), -1)
+			if err != nil {
+				logError("pinning CID: %s", err)
+				return C.int(-3)
+			}
+			log.Printf("DEBUG: CID pinned successfully (%d blocks)\n", tracker.Value())
+			return C.int(0) // Success
+		case <-ticker.C:
+			if fetched := tracker.Value(); fetched != lastReported {
+				callProgressCallback(cb, int64(fetched), -1)
+				lastReported = fetched
+			}
+		}
+	}
+}
+
 // UnpinCID unpins a CID from the IPFS node
 //
 //export UnpinCID
@@ -312,9 +1586,9 @@ func UnpinCID(repoPath, cidStr *C.char) C.int {
 	log.Printf("DEBUG: Unpinning CID %s using repo %s\n", cid, path)
 
 	// Get or create a node from the registry
-	api, _, err := AcquireNode(path)
+	api, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR:  acquiring node: %s\n", err)
+		logError("acquiring node: %s", err)
 		return C.int(-1)
 	}
 	// Release the node when done (decreases reference count)
@@ -323,7 +1597,7 @@ func UnpinCID(repoPath, cidStr *C.char) C.int {
 	// Parse the CID
 	decodedCid, err := cidlib.Decode(cid)
 	if err != nil {
-		log.Printf("ERROR:  decoding CID: %s\n", err)
+		logError("decoding CID: %s", err)
 		return C.int(-2)
 	}
 
@@ -332,15 +1606,28 @@ func UnpinCID(repoPath, cidStr *C.char) C.int {
 	// Unpin the CID
 	err = api.Pin().Rm(ctx, ipfsPath)
 	if err != nil {
-		log.Printf("ERROR:  unpinning CID: %s\n", err)
+		logError("unpinning CID: %s", err)
 		return C.int(-3)
 	}
 
+	// The pin is gone either way, so only log failing to remove its metadata
+	if err := forgetPin(ctx, node.Repo.Datastore(), decodedCid); err != nil {
+		log.Printf("ERROR:  removing pin name and metadata: %s\n", err)
+	}
+
 	log.Printf("DEBUG: CID unpinned successfully\n")
 	return C.int(0) // Success
 }
 
-// ListPins returns a list of pinned CIDs
+// PinInfo describes a pinned CID. Type is "recursive", "direct" or
+// "indirect", and Name the label given with PinCIDNamed, if any.
+type PinInfo struct {
+	CID  string `json:"cid"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// ListPins returns the pinned CIDs as a JSON array of PinInfo
 //
 //export ListPins
 func ListPins(repoPath *C.char) *C.char {
@@ -350,32 +1637,43 @@ func ListPins(repoPath *C.char) *C.char {
 
 	log.Printf("DEBUG: Listing pins using repo %s\n", path)
 
-	// Get or create a node from the registry
-	api, _, err := AcquireNode(path)
+	// Get or create a node from the registry; listing pins needs no networking
+	api, node, err := acquireNode(path, false, nil)
 	if err != nil {
-		log.Printf("ERROR:  acquiring node: %s\n", err)
+		logError("acquiring node: %s", err)
 		return nil
 	}
 	// Release the node when done (decreases reference count)
 	defer ReleaseNode(path)
 
+	names, err := pinNames(ctx, node.Repo.Datastore())
+	if err != nil {
+		logError("reading pin names: %s", err)
+		return nil
+	}
+
 	// List all pins
 	pinCh, err := api.Pin().Ls(ctx)
 	if err != nil {
-		log.Printf("ERROR:  listing pins: %s\n", err)
+		logError("listing pins: %s", err)
 		return nil
 	}
 
 	// Collect all pins
-	pins := []string{}
+	pins := []PinInfo{}
 	for pin := range pinCh {
-		pins = append(pins, pin.Path().Cid().String())
+		if err := pin.Err(); err != nil {
+			logError("listing pins: %s", err)
+			return nil
+		}
+		cid := pin.Path().Cid().String()
+		pins = append(pins, PinInfo{CID: cid, Name: names[cid], Type: pin.Type()})
 	}
 
 	// Convert to JSON
 	pinsJSON, err := json.Marshal(pins)
 	if err != nil {
-		log.Printf("ERROR:  marshaling pins to JSON: %s\n", err)
+		logError("marshaling pins to JSON: %s", err)
 		return nil
 	}
 
@@ -383,6 +1681,69 @@ func ListPins(repoPath *C.char) *C.char {
 	return C.CString(string(pinsJSON))
 }
 
+// PinStatus describes whether and how a CID is pinned. Via is the recursively
+// pinned root that an indirectly pinned CID is part of.
+type PinStatus struct {
+	Pinned bool   `json:"pinned"`
+	Type   string `json:"type"`
+	Via    string `json:"via,omitempty"`
+}
+
+// IsPinned returns the pin status of a single CID as a PinStatus JSON object,
+// with type "recursive", "direct", "indirect" or "none". This is much faster
+// than searching the output of ListPins on large pinsets. Checking for an
+// indirect pin walks the recursively pinned DAGs in the local blockstore.
+//
+//export IsPinned
+func IsPinned(repoPath, cidStr *C.char) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	cid := C.GoString(cidStr)
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return nil
+	}
+
+	// Get or create a node from the registry; the pinset is local
+	api, _, err := acquireNode(path, false, nil)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	reason, pinned, err := api.Pin().IsPinned(ctx, ipath.IpfsPath(decodedCid))
+	if err != nil {
+		logError("checking pin status: %s", err)
+		return nil
+	}
+
+	status := PinStatus{Pinned: pinned, Type: "none"}
+	switch {
+	case !pinned:
+	case reason == "recursive" || reason == "direct":
+		status.Type = reason
+	default:
+		// Indirect pins are reported with the CID of their pinned root
+		status.Type = "indirect"
+		status.Via = reason
+	}
+
+	// Convert to JSON
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		logError("marshaling pin status to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(statusJSON))
+}
+
 // RemoveCID removes a pinned CID from IPFS (alias for UnpinCID for clarity)
 //
 //export RemoveCID
@@ -390,3 +1751,100 @@ func RemoveCID(repoPath, cidStr *C.char) C.int {
 	// This is just an alias for UnpinCID for clarity in the API
 	return UnpinCID(repoPath, cidStr)
 }
+
+// CIDResult describes the outcome of a batch operation on a single CID
+type CIDResult struct {
+	CID     string `json:"cid"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// PinCIDs pins multiple CIDs, reusing a single node for the whole batch.
+// cidsJSON is a JSON array of CIDs; the result is a JSON array of CIDResult
+// in the same order. Up to SetMaxConcurrency CIDs are processed at once, so
+// not necessarily in the order given.
+//
+//export PinCIDs
+func PinCIDs(repoPath, cidsJSON *C.char) *C.char {
+	return batchCIDOperation(repoPath, cidsJSON, "pinning",
+		func(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, p ipath.Resolved) error {
+			return api.Pin().Add(ctx, p, options.Pin.Recursive(true))
+		},
+	)
+}
+
+// UnpinCIDs unpins multiple CIDs, reusing a single node for the whole batch.
+// cidsJSON is a JSON array of CIDs; the result is a JSON array of CIDResult
+// in the same order. Up to SetMaxConcurrency CIDs are processed at once, so
+// not necessarily in the order given.
+//
+//export UnpinCIDs
+func UnpinCIDs(repoPath, cidsJSON *C.char) *C.char {
+	return batchCIDOperation(repoPath, cidsJSON, "unpinning",
+		func(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, p ipath.Resolved) error {
+			if err := api.Pin().Rm(ctx, p); err != nil {
+				return err
+			}
+			// The pin is gone either way, so only log failing to remove its metadata
+			if err := forgetPin(ctx, node.Repo.Datastore(), p.Cid()); err != nil {
+				log.Printf("ERROR:  removing pin name and metadata: %s\n", err)
+			}
+			return nil
+		},
+	)
+}
+
+// batchCIDOperation applies op to each CID in a JSON array using one acquired node
+func batchCIDOperation(
+	repoPath, cidsJSON *C.char, opName string,
+	op func(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, p ipath.Resolved) error,
+) *C.char {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+
+	var cids []string
+	if err := json.Unmarshal([]byte(C.GoString(cidsJSON)), &cids); err != nil {
+		logError("parsing CIDs JSON: %s", err)
+		return nil
+	}
+	log.Printf("DEBUG: Batch %s %d CIDs using repo %s\n", opName, len(cids), path)
+
+	// Get or create a node from the registry
+	api, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	// The CIDs are processed concurrently, bounded by SetMaxConcurrency
+	results := make([]CIDResult, len(cids))
+	runBatch(ctx, len(cids), func(ctx context.Context, i int) {
+		results[i].CID = cids[i]
+
+		decodedCid, err := cidlib.Decode(cids[i])
+		if err != nil {
+			results[i].Error = fmt.Sprintf("decoding CID: %s", err)
+			return
+		}
+		if err := op(ctx, api, node, ipath.IpfsPath(decodedCid)); err != nil {
+			results[i].Error = fmt.Sprintf("%s CID: %s", opName, err)
+			return
+		}
+		results[i].Success = true
+	}, func(i int, err error) {
+		results[i].CID = cids[i]
+		results[i].Error = fmt.Sprintf("%s CID: %s", opName, err)
+	})
+
+	// Convert to JSON
+	resultsJSON, err := json.Marshal(results)
+	if err != nil {
+		logError("marshaling batch results to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(resultsJSON))
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	iface "github.com/ipfs/boxo/coreiface"
+	"github.com/ipfs/boxo/coreiface/options"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	"github.com/ipfs/boxo/files"
+	"github.com/ipfs/boxo/keystore"
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/kubo/config"
+	"github.com/ipfs/kubo/core"
+	"github.com/ipfs/kubo/core/coreapi"
+	"github.com/ipfs/kubo/repo"
+	"github.com/multiformats/go-multihash"
+)
+
+// newTestAPI creates an offline node backed by an in-memory repo
+func newTestAPI(t *testing.T) iface.CoreAPI {
+	t.Helper()
+
+	ident, err := config.CreateIdentity(io.Discard, []options.KeyGenerateOption{
+		options.Key.Type(options.Ed25519Key),
+	})
+	if err != nil {
+		t.Fatalf("creating identity: %s", err)
+	}
+	r := &repo.Mock{
+		C: config.Config{Identity: ident},
+		D: syncds.MutexWrap(datastore.NewMapDatastore()),
+		K: keystore.NewMemKeystore(),
+	}
+
+	node, err := core.NewNode(context.Background(), &core.BuildCfg{Repo: r})
+	if err != nil {
+		t.Fatalf("creating node: %s", err)
+	}
+	t.Cleanup(func() { node.Close() })
+
+	api, err := coreapi.NewCoreAPI(node)
+	if err != nil {
+		t.Fatalf("creating API: %s", err)
+	}
+	return api
+}
+
+func TestSymlinkRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	srcDir := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "sub", "target.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("sub", "target.txt"), filepath.Join(srcDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	cid, err := addPath(ctx, api, srcDir, AddOptions{})
+	if err != nil {
+		t.Fatalf("adding directory: %s", err)
+	}
+
+	fileNode, err := api.Unixfs().Get(ctx, ipath.New("/ipfs/"+cid))
+	if err != nil {
+		t.Fatalf("getting directory: %s", err)
+	}
+	dir, ok := fileNode.(files.Directory)
+	if !ok {
+		t.Fatalf("expected a directory, got %T", fileNode)
+	}
+
+	destDir := filepath.Join(t.TempDir(), "dest")
+	if err := downloadDirectory(ctx, dir, destDir, nil); err != nil {
+		t.Fatalf("downloading directory: %s", err)
+	}
+
+	target, err := os.Readlink(filepath.Join(destDir, "link"))
+	if err != nil {
+		t.Fatalf("reading symlink: %s", err)
+	}
+	if target != filepath.Join("sub", "target.txt") {
+		t.Errorf("symlink target = %q, want %q", target, filepath.Join("sub", "target.txt"))
+	}
+
+	content, err := os.ReadFile(filepath.Join(destDir, "link"))
+	if err != nil {
+		t.Fatalf("reading through symlink: %s", err)
+	}
+	if string(content) != "hello" {
+		t.Errorf("content through symlink = %q, want %q", content, "hello")
+	}
+}
+
+func TestDownloadTimeouts(t *testing.T) {
+	path := registerTestPubSubNode(t)
+
+	// No peer has content that was never added anywhere
+	hash, err := multihash.Sum([]byte("content nobody has: "+t.Name()), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cid := cidlib.NewCidV1(cidlib.Raw, hash).String()
+
+	tests := []struct {
+		name string
+		opts downloadOptions
+		want int
+	}{
+		{"stalled", downloadOptions{stallTimeout: time.Second}, -15},
+		{"timed out", downloadOptions{timeout: time.Second}, -16},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "dest")
+			start := time.Now()
+			if code := int(downloadCID(path, cid, dest, tt.opts)); code != tt.want {
+				t.Errorf("downloadCID returned %d, want %d", code, tt.want)
+			}
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Errorf("downloadCID took %s to give up", elapsed)
+			}
+		})
+	}
+}
+
+func TestDownloadDirectoryReturnsFileError(t *testing.T) {
+	failure := errors.New("fetch failed")
+	entries := map[string]files.Node{
+		"sub": files.NewMapDirectory(map[string]files.Node{
+			"bad": files.NewReaderFile(iotest.ErrReader(failure)),
+		}),
+	}
+	for i := 0; i < 10; i++ {
+		entries[fmt.Sprintf("file-%d", i)] = files.NewBytesFile([]byte("ok"))
+	}
+
+	destDir := filepath.Join(t.TempDir(), "dest")
+	err := downloadDirectory(context.Background(), files.NewMapDirectory(entries), destDir, nil)
+	if !errors.Is(err, failure) {
+		t.Fatalf("expected the failing file's error, got %v", err)
+	}
+	if n := GetInFlightCount(); n != 0 {
+		t.Fatalf("%d file writes still in flight", n)
+	}
+}
+
+func TestDownloadToFD(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	data := bytes.Repeat([]byte("content "), 64*1024)
+	file, err := api.Unixfs().Add(ctx, files.NewBytesFile(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := api.Unixfs().Add(ctx, files.NewMapDirectory(map[string]files.Node{
+		"a": files.NewBytesFile([]byte("a")),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// The pipe is read while the content is written to a duplicate of it
+	received := make(chan []byte)
+	go func() {
+		got, _ := io.ReadAll(r)
+		received <- got
+	}()
+	out, err := dupFile(w.Fd())
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := downloadToWriter(ctx, api, file.Cid(), out)
+	out.Close()
+	if code != 0 {
+		t.Fatalf("writing file failed with code %d", code)
+	}
+
+	// The original descriptor stays usable
+	if _, err := w.Write([]byte("!")); err != nil {
+		t.Fatalf("writing to the original descriptor: %s", err)
+	}
+	w.Close()
+	if got := <-received; !bytes.Equal(got, append(data, '!')) {
+		t.Fatalf("received %d bytes, want %d", len(got), len(data)+1)
+	}
+
+	if code := downloadToWriter(ctx, api, dir.Cid(), io.Discard); code != -9 {
+		t.Fatalf("writing a directory returned %d, want -9", code)
+	}
+}
+
+// latencyReader delays the first read, like a fetch over a slow link
+type latencyReader struct {
+	io.Reader
+	delay time.Duration
+}
+
+func (r *latencyReader) Read(p []byte) (int, error) {
+	if r.delay > 0 {
+		time.Sleep(r.delay)
+		r.delay = 0
+	}
+	return r.Reader.Read(p)
+}
+
+func BenchmarkDownloadDirectory(b *testing.B) {
+	const fileCount = 100
+	const latency = 5 * time.Millisecond
+
+	newDir := func() files.Directory {
+		entries := make(map[string]files.Node, fileCount)
+		for i := 0; i < fileCount; i++ {
+			content := strings.Repeat("x", 1024)
+			entries[fmt.Sprintf("file-%03d", i)] = files.NewReaderFile(&latencyReader{Reader: strings.NewReader(content), delay: latency})
+		}
+		return files.NewMapDirectory(entries)
+	}
+
+	for _, limit := range []int{1, defaultMaxConcurrency, 16} {
+		b.Run(fmt.Sprintf("concurrency-%d", limit), func(b *testing.B) {
+			setTestMaxConcurrency(b, limit)
+			for i := 0; i < b.N; i++ {
+				dir := newDir()
+				destDir := filepath.Join(b.TempDir(), "dest")
+				if err := downloadDirectory(context.Background(), dir, destDir, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadPreview(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	data := bytes.Repeat([]byte("0123456789"), 100*1024)
+	file, err := api.Unixfs().Add(ctx, files.NewBytesFile(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	preview, err := readPreview(ctx, api, file.Cid(), 300*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(preview, data[:300*1024]) {
+		t.Fatalf("preview of %d bytes doesn't match the start of the file", len(preview))
+	}
+
+	// Files shorter than the preview are returned whole
+	preview, err = readPreview(ctx, api, file.Cid(), 2*len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(preview, data) {
+		t.Fatalf("preview of %d bytes doesn't match the file", len(preview))
+	}
+}
+
+func TestRehashMatches(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	srcDir := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "small.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Repeat([]byte("0123456789abcdef"), 4*1024)
+	if err := os.WriteFile(filepath.Join(srcDir, "sub", "big.bin"), big, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cidV1, rawLeaves := 1, false
+	cases := []AddOptions{
+		{},
+		{CidVersion: &cidV1, HashFunction: "blake2b-256", Chunker: "size-1024", RawLeaves: &rawLeaves},
+		{CidVersion: &cidV1, Chunker: "size-4096", Trickle: true},
+	}
+	for _, opts := range cases {
+		added, err := addPath(ctx, api, srcDir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := cidlib.Decode(added)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inferred, err := inferAddOptions(ctx, api.Dag(), c)
+		if err != nil {
+			t.Fatalf("inferring options of %s: %s", c, err)
+		}
+		if opts.Chunker != "" && inferred.Chunker != opts.Chunker {
+			t.Errorf("inferred chunker %q instead of %q", inferred.Chunker, opts.Chunker)
+		}
+		if matched, err := rehashMatches(ctx, api, srcDir, c, inferred); err != nil || !matched {
+			t.Errorf("%s didn't match its own directory with options %+v (%v)", c, inferred, err)
+		}
+	}
+
+	// Extra files break the match
+	added, err := addPath(ctx, api, srcDir, AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := cidlib.Decode(added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "extra.txt"), []byte("extra"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	inferred, err := inferAddOptions(ctx, api.Dag(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched, err := rehashMatches(ctx, api, srcDir, c, inferred); err != nil || matched {
+		t.Errorf("changed directory matched %s (%v)", c, err)
+	}
+}
+
+func TestGetManyBytes(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	content := bytes.Repeat([]byte("record "), 1000)
+	file, err := api.Unixfs().Add(ctx, files.NewBytesFile(content), options.Unixfs.Chunker("size-1024"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := api.Block().Put(ctx, bytes.NewReader([]byte{0xa1, 0x61, 0x61, 0x01}), options.Block.Format("dag-cbor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := api.Unixfs().Add(ctx, files.NewMapDirectory(map[string]files.Node{
+		"a": files.NewBytesFile([]byte("a")),
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]byte{
+		file.Cid().String():          content,
+		record.Path().Cid().String(): {0xa1, 0x61, 0x61, 0x01},
+		dir.Cid().String():           nil,
+		"invalid":                    nil,
+	}
+	cids := make([]string, 0, len(want))
+	for cid := range want {
+		cids = append(cids, cid)
+	}
+
+	got := make(map[string][]byte)
+	getManyBytes(ctx, api, cids, func(cid string, data []byte, err error) {
+		if _, seen := got[cid]; seen {
+			t.Errorf("%s reported twice", cid)
+		}
+		if (err != nil) != (want[cid] == nil) {
+			t.Errorf("%s: unexpected error %v", cid, err)
+		}
+		got[cid] = data
+	})
+	for cid, data := range want {
+		if fetched, ok := got[cid]; !ok || !bytes.Equal(fetched, data) {
+			t.Errorf("%s: got %d bytes, want %d", cid, len(fetched), len(data))
+		}
+	}
+}
+
+func TestDownloadFileResumable(t *testing.T) {
+	ctx := context.Background()
+	api := newTestAPI(t)
+
+	contentA := bytes.Repeat([]byte("a"), 10000)
+	contentB := bytes.Repeat([]byte("b"), 10000)
+	addedA, err := api.Unixfs().Add(ctx, files.NewBytesFile(contentA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addedB, err := api.Unixfs().Add(ctx, files.NewBytesFile(contentB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join(t.TempDir(), "out")
+
+	download := func(p ipath.Resolved) {
+		t.Helper()
+		fileNode, err := api.Unixfs().Get(ctx, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fileNode.Close()
+		if code := downloadFileResumable(ctx, api, p, fileNode.(files.File), dest, true, nil); code != 0 {
+			t.Fatalf("downloading %s: code %d", p.Cid(), code)
+		}
+	}
+
+	// A partial download of A is only resumed by a download of A
+	if err := os.WriteFile(partialPath(dest, addedA.Cid()), contentA[:4000], 0644); err != nil {
+		t.Fatal(err)
+	}
+	download(addedB)
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, contentB) {
+		t.Fatal("download of B resumed from the partial file of A")
+	}
+	download(addedA)
+	if got, _ := os.ReadFile(dest); !bytes.Equal(got, contentA) {
+		t.Fatal("download of A not completed from its partial file")
+	}
+	if _, err := os.Stat(partialPath(dest, addedA.Cid())); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"encoding/json"
+	"log"
+
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/ipfs/kubo/core/corerepo"
+	"github.com/ipfs/kubo/gc"
+)
+
+// RepoGCProtect runs garbage collection on a repo, keeping the DAGs below the
+// CIDs in protectCidsJSON (a JSON array) as if they were pinned, as far as
+// their blocks are stored locally. This protects content that has been
+// downloaded but not pinned yet from a concurrent collection. Pass an empty
+// string or array to collect with only the pinset and MFS root as roots.
+// Returns the removed CIDs as a JSON array.
+//
+//export RepoGCProtect
+func RepoGCProtect(repoPath, protectCidsJSON *C.char) *C.char {
+	path := C.GoString(repoPath)
+	protectStr := C.GoString(protectCidsJSON)
+
+	var protectCids []string
+	if protectStr != "" {
+		if err := json.Unmarshal([]byte(protectStr), &protectCids); err != nil {
+			logError("parsing CIDs JSON: %s", err)
+			return nil
+		}
+	}
+
+	// Every CID must parse, or its content would go unprotected
+	roots := make([]cidlib.Cid, 0, len(protectCids))
+	for _, cid := range protectCids {
+		decodedCid, err := cidlib.Decode(cid)
+		if err != nil {
+			logError("decoding CID %s: %s", cid, err)
+			return nil
+		}
+		roots = append(roots, decodedCid)
+	}
+
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+
+	// Get or create a node from the registry; collecting needs no networking
+	_, node, err := acquireNode(path, false, nil)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	// Keep the MFS root, as Kubo's own GC does
+	mfsRoots, err := corerepo.BestEffortRoots(node.FilesRoot)
+	if err != nil {
+		logError("getting MFS root: %s", err)
+		return nil
+	}
+	roots = append(roots, mfsRoots...)
+
+	log.Printf("DEBUG: Collecting garbage in repo %s, protecting %d CIDs\n", path, len(protectCids))
+	removed := []string{}
+	var gcErr error
+	for result := range gc.GC(ctx, node.Blockstore, node.Repo.Datastore(), node.Pinning, roots) {
+		if result.Error != nil {
+			logError("collecting garbage: %s", result.Error)
+			gcErr = result.Error
+			continue
+		}
+		removed = append(removed, result.KeyRemoved.String())
+	}
+	if gcErr != nil {
+		return nil
+	}
+
+	// Convert to JSON
+	removedJSON, err := json.Marshal(removed)
+	if err != nil {
+		logError("marshaling removed CIDs to JSON: %s", err)
+		return nil
+	}
+
+	log.Printf("DEBUG: Removed %d blocks\n", len(removed))
+	return C.CString(string(removedJSON))
+}
@@ -0,0 +1,120 @@
+package main
+
+// #include <stdint.h>
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	iface "github.com/ipfs/boxo/coreiface"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	"github.com/ipfs/boxo/files"
+	cidlib "github.com/ipfs/go-cid"
+)
+
+// GetManyBytes fetches the data of multiple CIDs into memory, reusing a
+// single node for the whole batch, e.g. to hydrate the many small records a
+// dag-cbor index links to. cidsJSON is a JSON array of CIDs. Unixfs files
+// (dag-pb and raw CIDs) are read in full; for any other codec, the CID's
+// block is returned as is. Up to SetMaxConcurrency CIDs are fetched at once.
+//
+// cb has the type void(char* cid, void* data, int len) and is called once per
+// CID as soon as it has been fetched, so not necessarily in order, and never
+// concurrently. For a CID that can't be fetched, data is NULL and len is -1;
+// the error is logged and the rest of the batch continues. The CID and data
+// are freed after the callback returns, so the callee must copy them.
+// Returns the number of CIDs that couldn't be fetched, -1 if cidsJSON isn't
+// a JSON array of strings and -2 if the node couldn't be acquired.
+//
+//export GetManyBytes
+func GetManyBytes(repoPath, cidsJSON *C.char, cb C.uintptr_t) C.int {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+
+	var cids []string
+	if err := json.Unmarshal([]byte(C.GoString(cidsJSON)), &cids); err != nil {
+		logError("parsing CIDs JSON: %s", err)
+		return C.int(-1)
+	}
+	log.Printf("DEBUG: Fetching %d CIDs using repo %s\n", len(cids), path)
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-2)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	failed := 0
+	getManyBytes(ctx, api, cids, func(cid string, data []byte, err error) {
+		if err != nil {
+			log.Printf("ERROR:  fetching %s: %s\n", cid, err)
+			failed++
+			callBytesCallback(cb, cid, nil)
+			return
+		}
+		callBytesCallback(cb, cid, data)
+	})
+
+	log.Printf("DEBUG: Fetched %d of %d CIDs\n", len(cids)-failed, len(cids))
+	return C.int(failed)
+}
+
+// getManyBytes fetches the data of each CID concurrently under the
+// concurrency limit, passing it or the error fetching it to result. Calls to
+// result are serialized.
+func getManyBytes(ctx context.Context, api iface.CoreAPI, cids []string, result func(cid string, data []byte, err error)) {
+	var resultMutex sync.Mutex
+	report := func(cid string, data []byte, err error) {
+		resultMutex.Lock()
+		defer resultMutex.Unlock()
+		result(cid, data, err)
+	}
+
+	runBatch(ctx, len(cids), func(ctx context.Context, i int) {
+		decodedCid, err := cidlib.Decode(cids[i])
+		if err != nil {
+			report(cids[i], nil, fmt.Errorf("decoding CID: %w", err))
+			return
+		}
+		data, err := readCIDBytes(ctx, api, decodedCid)
+		report(cids[i], data, err)
+	}, func(i int, err error) {
+		report(cids[i], nil, err)
+	})
+}
+
+// readCIDBytes reads the whole Unixfs file at a dag-pb or raw CID, or the
+// block of a CID of any other codec
+func readCIDBytes(ctx context.Context, api iface.CoreAPI, c cidlib.Cid) ([]byte, error) {
+	switch c.Prefix().Codec {
+	case cidlib.DagProtobuf, cidlib.Raw:
+		fileNode, err := api.Unixfs().Get(ctx, ipath.IpfsPath(c))
+		if err != nil {
+			return nil, err
+		}
+		defer fileNode.Close()
+
+		// Symlinks also implement files.File, so they must be ruled out first
+		file, ok := fileNode.(files.File)
+		if _, isSymlink := fileNode.(*files.Symlink); isSymlink || !ok {
+			return nil, fmt.Errorf("not a file: %T", fileNode)
+		}
+		return io.ReadAll(file)
+	default:
+		reader, err := api.Block().Get(ctx, ipath.IpfsPath(c))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(reader)
+	}
+}
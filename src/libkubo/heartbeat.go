@@ -0,0 +1,123 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+	"unsafe"
+
+	iface "github.com/ipfs/boxo/coreiface"
+	"github.com/ipfs/kubo/core"
+)
+
+// Running pubsub heartbeats, indexed by handle
+var (
+	heartbeats      = make(map[int64]context.CancelFunc)
+	heartbeatsMutex sync.Mutex
+	nextHeartbeatID int64 = 1
+)
+
+// PubSubStartHeartbeat publishes payload to topic right away and then every
+// intervalSeconds in the background, e.g. to announce an app's presence to
+// the topic's other peers. The heartbeat runs on the repo's running node
+// without holding a reference to it, so it stops by itself once the node is
+// released or cleaned up; keep the node running, e.g. with RunNode, for as
+// long as the heartbeat is needed. Failed publishes are logged and retried
+// with the next beat.
+// Returns a handle for PubSubStopHeartbeat, -1 if the node couldn't be
+// acquired or is offline and -2 if intervalSeconds is less than 1.
+//
+//export PubSubStartHeartbeat
+func PubSubStartHeartbeat(repoPath, topic *C.char, payload unsafe.Pointer, payloadLen C.int, intervalSeconds C.int) C.longlong {
+	path := C.GoString(repoPath)
+	topicStr := C.GoString(topic)
+	data := C.GoBytes(payload, payloadLen)
+
+	if intervalSeconds < 1 {
+		logError("heartbeat interval must be at least 1 second: %d", int(intervalSeconds))
+		return C.longlong(-2)
+	}
+
+	// Get or create a node from the registry
+	api, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.longlong(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("node for repo %s is offline", path)
+		return C.longlong(-1)
+	}
+
+	id := startHeartbeat(api, node, topicStr, data, time.Duration(intervalSeconds)*time.Second)
+	log.Printf("DEBUG: Started heartbeat %d on topic %s every %ds\n", id, topicStr, int(intervalSeconds))
+	return C.longlong(id)
+}
+
+// PubSubStopHeartbeat stops a heartbeat started with PubSubStartHeartbeat.
+// Returns 0 on success or -1 if there is no such heartbeat, e.g. because it
+// already stopped with its node.
+//
+//export PubSubStopHeartbeat
+func PubSubStopHeartbeat(handle C.longlong) C.int {
+	if !stopHeartbeat(int64(handle)) {
+		logError("heartbeat %d not found", int64(handle))
+		return C.int(-1)
+	}
+	return C.int(0)
+}
+
+// stopHeartbeat stops a heartbeat, returning false if it isn't running
+func stopHeartbeat(id int64) bool {
+	heartbeatsMutex.Lock()
+	cancel, exists := heartbeats[id]
+	delete(heartbeats, id)
+	heartbeatsMutex.Unlock()
+
+	if exists {
+		cancel()
+	}
+	return exists
+}
+
+// startHeartbeat publishes data to topic every interval until the heartbeat
+// is stopped or the node closes, returning the heartbeat's handle
+func startHeartbeat(api iface.CoreAPI, node *core.IpfsNode, topic string, data []byte, interval time.Duration) int64 {
+	ctx, cancel := context.WithCancel(node.Context())
+
+	heartbeatsMutex.Lock()
+	id := nextHeartbeatID
+	nextHeartbeatID++
+	heartbeats[id] = cancel
+	heartbeatsMutex.Unlock()
+
+	go func() {
+		defer func() {
+			heartbeatsMutex.Lock()
+			delete(heartbeats, id)
+			heartbeatsMutex.Unlock()
+			cancel()
+		}()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := api.PubSub().Publish(ctx, topic, data); err != nil && ctx.Err() == nil {
+				log.Printf("ERROR:  publishing heartbeat %d to topic %s: %s\n", id, topic, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return id
+}
@@ -0,0 +1,170 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	version "github.com/ipfs/kubo"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify"
+	"github.com/libp2p/go-libp2p/p2p/protocol/identify/pb"
+	"github.com/libp2p/go-msgio/pbio"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"google.golang.org/protobuf/proto"
+)
+
+// pushIdentifyTimeout bounds sending an identify push to a peer
+const pushIdentifyTimeout = 10 * time.Second
+
+// identifyLegacySize is the largest identify message older peers accept;
+// larger messages are split, sending the signed peer record separately, as
+// libp2p's identify service does
+const identifyLegacySize = 2 * 1024
+
+// PushIdentify sends the node's current identify information (addresses,
+// protocols and signed peer record) to a connected peer right away, so that
+// it learns new addresses after a network change, e.g. when a phone switches
+// from Wi-Fi to cellular. libp2p pushes this to all peers by itself when it
+// notices the change, which can take a while.
+// Returns 0 on success, -1 if the node couldn't be acquired or is offline,
+// -2 for an invalid peer ID, -3 if the peer isn't connected, -4 if it doesn't
+// support identify push and -5 if sending failed.
+//
+//export PushIdentify
+func PushIdentify(repoPath, peerID *C.char) C.int {
+	path := C.GoString(repoPath)
+
+	pid, err := peer.Decode(C.GoString(peerID))
+	if err != nil {
+		logError("decoding peer ID: %s", err)
+		return C.int(-2)
+	}
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("node for repo %s is offline", path)
+		return C.int(-1)
+	}
+	h := node.PeerHost
+
+	if h.Network().Connectedness(pid) != network.Connected {
+		logError("peer %s is not connected", pid)
+		return C.int(-3)
+	}
+	// Peers whose protocols aren't known yet are tried anyway
+	if protos, err := h.Peerstore().GetProtocols(pid); err == nil && len(protos) > 0 {
+		if supported, err := h.Peerstore().SupportsProtocols(pid, identify.IDPush); err == nil && len(supported) == 0 {
+			logError("peer %s doesn't support identify push", pid)
+			return C.int(-4)
+		}
+	}
+
+	// Nodes announce the agent version they were built with
+	restore := applyAgentSuffix(path)
+	agentVersion := version.GetUserAgentVersion()
+	restore()
+
+	ctx, cancel := context.WithTimeout(context.Background(), pushIdentifyTimeout)
+	defer cancel()
+	if err := sendIdentifyPush(ctx, h, pid, agentVersion); err != nil {
+		logError("pushing identify to %s: %s", pid, err)
+		return C.int(-5)
+	}
+
+	log.Printf("DEBUG: Pushed identify to peer %s\n", pid)
+	return C.int(0)
+}
+
+// sendIdentifyPush opens an identify push stream to pid and writes the
+// host's identify message on it
+func sendIdentifyPush(ctx context.Context, h host.Host, pid peer.ID, agentVersion string) error {
+	s, err := h.NewStream(network.WithNoDial(ctx, "identify push"), pid, identify.IDPush)
+	if err != nil {
+		return fmt.Errorf("opening stream: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	mes, err := identifyMessage(h, s.Conn(), agentVersion)
+	if err != nil {
+		s.Reset()
+		return err
+	}
+
+	writer := pbio.NewDelimitedWriter(s)
+	record := mes.SignedPeerRecord
+	if record != nil && proto.Size(mes) > identifyLegacySize {
+		mes.SignedPeerRecord = nil
+	} else {
+		record = nil
+	}
+	err = writer.WriteMsg(mes)
+	if err == nil && record != nil {
+		err = writer.WriteMsg(&pb.Identify{SignedPeerRecord: record})
+	}
+	if err != nil {
+		s.Reset()
+		return fmt.Errorf("writing identify message: %w", err)
+	}
+	return s.Close()
+}
+
+// identifyMessage builds the identify message of the host for a connection,
+// with the same contents libp2p's identify service sends
+func identifyMessage(h host.Host, conn network.Conn, agentVersion string) (*pb.Identify, error) {
+	// Kubo doesn't set a protocol version, so none is announced
+	protocolVersion := ""
+	mes := &pb.Identify{
+		Protocols:       protocol.ConvertToStrings(h.Mux().Protocols()),
+		ObservedAddr:    conn.RemoteMultiaddr().Bytes(),
+		ProtocolVersion: &protocolVersion,
+		AgentVersion:    &agentVersion,
+	}
+
+	// Loopback addresses are only of use to peers on the same machine
+	viaLoopback := manet.IsIPLoopback(conn.LocalMultiaddr()) || manet.IsIPLoopback(conn.RemoteMultiaddr())
+	for _, addr := range h.Addrs() {
+		if !viaLoopback && manet.IsIPLoopback(addr) {
+			continue
+		}
+		mes.ListenAddrs = append(mes.ListenAddrs, addr.Bytes())
+	}
+
+	if pubKey := h.Peerstore().PubKey(h.ID()); pubKey != nil {
+		keyBytes, err := crypto.MarshalPublicKey(pubKey)
+		if err != nil {
+			return nil, fmt.Errorf("marshaling public key: %w", err)
+		}
+		mes.PublicKey = keyBytes
+	}
+
+	if cab, ok := peerstore.GetCertifiedAddrBook(h.Peerstore()); ok {
+		if record := cab.GetPeerRecord(h.ID()); record != nil {
+			recordBytes, err := record.Marshal()
+			if err != nil {
+				return nil, fmt.Errorf("marshaling signed peer record: %w", err)
+			}
+			mes.SignedPeerRecord = recordBytes
+		}
+	}
+	return mes, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	httpclient "github.com/ipfs/boxo/routing/http/client"
+	"github.com/ipfs/boxo/routing/http/types"
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// defaultIndexerURL is the IPNI indexer queried when no URL is given, and
+// defaultIndexerTimeout how long a query may take
+const (
+	defaultIndexerURL     = "https://cid.contact"
+	defaultIndexerTimeout = 30 * time.Second
+)
+
+// FindProvidersViaIndexer looks up providers of a CID with an IPNI indexer
+// over HTTP, using the delegated routing API (/routing/v1/providers/), and
+// returns them as a JSON array like FindProviders. Unlike FindProviders, it
+// needs no node, so it works before the DHT is bootstrapped. indexerURL is
+// the indexer's base URL (cid.contact if empty), and timeoutSeconds bounds
+// the query (30 if <= 0). Only providers serving the CID over Bitswap are
+// returned, as only those can be fetched from.
+// Returns NULL for an invalid CID or if the query fails.
+//
+//export FindProvidersViaIndexer
+func FindProvidersViaIndexer(cidStr, indexerURL *C.char, timeoutSeconds C.int) *C.char {
+	cid := C.GoString(cidStr)
+	url := C.GoString(indexerURL)
+	if url == "" {
+		url = defaultIndexerURL
+	}
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return nil
+	}
+
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultIndexerTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	providers, err := findProvidersViaIndexer(ctx, url, decodedCid)
+	if err != nil {
+		logError("querying indexer %s: %s", url, err)
+		return nil
+	}
+	log.Printf("DEBUG: Indexer %s returned %d providers for %s\n", url, len(providers), cid)
+
+	// Convert to JSON
+	providersJSON, err := json.Marshal(providers)
+	if err != nil {
+		logError("marshaling providers to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(providersJSON))
+}
+
+// findProvidersViaIndexer queries the delegated routing API at baseURL for
+// Bitswap providers of c, merging the addresses of records for the same peer
+func findProvidersViaIndexer(ctx context.Context, baseURL string, c cidlib.Cid) ([]peer.AddrInfo, error) {
+	client, err := httpclient.New(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	results, err := client.FindProviders(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	providers := []peer.AddrInfo{}
+	indexes := make(map[peer.ID]int)
+	for results.Next() {
+		result := results.Val()
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		record, ok := result.Val.(*types.ReadBitswapProviderRecord)
+		if !ok || record.ID == nil {
+			continue
+		}
+
+		i, seen := indexes[*record.ID]
+		if !seen {
+			i = len(providers)
+			indexes[*record.ID] = i
+			providers = append(providers, peer.AddrInfo{ID: *record.ID})
+		}
+		for _, addr := range record.Addrs {
+			providers[i].Addrs = append(providers[i].Addrs, addr.Multiaddr)
+		}
+	}
+	return providers, nil
+}
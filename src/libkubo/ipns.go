@@ -0,0 +1,489 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	iface "github.com/ipfs/boxo/coreiface"
+	"github.com/ipfs/boxo/coreiface/options"
+	nsopts "github.com/ipfs/boxo/coreiface/options/namesys"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	"github.com/ipfs/boxo/ipns"
+	"github.com/ipfs/boxo/namesys"
+	"github.com/ipfs/kubo/core"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	dhtpb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-msgio"
+)
+
+// ResolveStep describes one hop of a name resolution chain
+type ResolveStep struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ResolveChain resolves an /ipns/ path (an IPNS name or DNSLink) one hop at a
+// time, returning every hop as a JSON array of ResolveStep until an /ipfs/
+// path is reached. If a hop fails, it is the last step and carries the error,
+// which shows where a chain of names is broken. At most maxDepth hops are
+// followed (32 if maxDepth <= 0).
+//
+//export ResolveChain
+func ResolveChain(repoPath, namePath *C.char, maxDepth C.int) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	name := C.GoString(namePath)
+
+	depth := int(maxDepth)
+	if depth <= 0 {
+		depth = nsopts.DefaultDepthLimit
+	}
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if !strings.HasPrefix(name, "/ipns/") && !strings.HasPrefix(name, "/ipfs/") {
+		name = "/ipns/" + name
+	}
+
+	steps := []ResolveStep{}
+	current := name
+	for i := 0; i < depth && strings.HasPrefix(current, "/ipns/"); i++ {
+		step := ResolveStep{Name: current}
+
+		// A depth of one returns the next hop along with ErrResolveRecursion
+		// if it is another name
+		resolved, err := api.Name().Resolve(ctx, current,
+			options.Name.ResolveOption(nsopts.Depth(1)),
+		)
+		if err != nil && !(errors.Is(err, namesys.ErrResolveRecursion) && resolved != nil) {
+			step.Error = err.Error()
+			steps = append(steps, step)
+			break
+		}
+
+		step.Value = resolved.String()
+		steps = append(steps, step)
+		current = step.Value
+	}
+
+	// Convert to JSON
+	stepsJSON, err := json.Marshal(steps)
+	if err != nil {
+		logError("marshaling resolve steps to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(stepsJSON))
+}
+
+// NameRecord describes an IPNS record. Record holds the raw signed record,
+// base64 encoded in JSON.
+type NameRecord struct {
+	Name            string  `json:"name"`
+	Value           string  `json:"value"`
+	Sequence        uint64  `json:"sequence"`
+	Validity        string  `json:"validity,omitempty"`
+	TTLSeconds      float64 `json:"ttlSeconds"`
+	Valid           bool    `json:"valid"`
+	ValidationError string  `json:"validationError,omitempty"`
+	Record          []byte  `json:"record"`
+}
+
+// NameInspect fetches the current IPNS record for a name (a peer ID or key
+// CID, optionally prefixed with /ipns/, or "self" for the node's own name)
+// from the routing system and returns it as a NameRecord JSON object,
+// including whether its signature and validity period check out.
+//
+//export NameInspect
+func NameInspect(repoPath, name *C.char) *C.char {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	path := C.GoString(repoPath)
+	nameStr := C.GoString(name)
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	var ipnsName ipns.Name
+	if nameStr == "self" {
+		ipnsName = ipns.NameFromPeer(node.Identity)
+	} else {
+		ipnsName, err = ipns.NameFromString(nameStr)
+		if err != nil {
+			logError("parsing IPNS name: %s", err)
+			return nil
+		}
+	}
+
+	if node.Routing == nil {
+		logError("node for repo %s has no routing", path)
+		return nil
+	}
+	// Offline nodes answer from the records stored in the repo
+	data, err := node.Routing.GetValue(ctx, string(ipnsName.RoutingKey()))
+	if err != nil {
+		logError("getting IPNS record for %s: %s", ipnsName, err)
+		return nil
+	}
+
+	rec, err := ipns.UnmarshalRecord(data)
+	if err != nil {
+		logError("parsing IPNS record: %s", err)
+		return nil
+	}
+
+	result := NameRecord{Name: ipnsName.String(), Record: data}
+	if value, err := rec.Value(); err == nil {
+		result.Value = value.String()
+	}
+	if sequence, err := rec.Sequence(); err == nil {
+		result.Sequence = sequence
+	}
+	if validity, err := rec.Validity(); err == nil {
+		result.Validity = validity.UTC().Format(time.RFC3339Nano)
+	}
+	if ttl, err := rec.TTL(); err == nil {
+		result.TTLSeconds = ttl.Seconds()
+	}
+	if err := ipns.ValidateWithName(rec, ipnsName); err != nil {
+		result.ValidationError = err.Error()
+	} else {
+		result.Valid = true
+	}
+
+	// Convert to JSON
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logError("marshaling IPNS record to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(resultJSON))
+}
+
+// NameRepublish publishes the value last published under a key again with a
+// fresh 24h validity window and the same TTL, so that a name pointing at
+// static content doesn't expire. keyName is the name of a key in the repo's
+// keystore, with "self" or an empty string meaning the node's own key.
+// Returns -2 if the key is unknown and -3 if nothing was published with it.
+//
+//export NameRepublish
+func NameRepublish(repoPath, keyName *C.char) C.int {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	key := C.GoString(keyName)
+	if key == "" {
+		key = "self"
+	}
+
+	// Get or create a node from the registry
+	api, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	id, err := keyID(ctx, api, node, key)
+	if err != nil {
+		logError("%s", err)
+		if errors.Is(err, errUnknownKey) {
+			return C.int(-2)
+		}
+		return C.int(-1)
+	}
+
+	// The publisher keeps the latest record for each of the node's keys
+	data, err := node.Repo.Datastore().Get(ctx, namesys.IpnsDsKey(id))
+	if err != nil {
+		logError("no IPNS record published with key %s: %s", key, err)
+		return C.int(-3)
+	}
+	rec, err := ipns.UnmarshalRecord(data)
+	if err != nil {
+		logError("parsing IPNS record: %s", err)
+		return C.int(-3)
+	}
+	value, err := rec.Value()
+	if err != nil {
+		logError("reading IPNS record value: %s", err)
+		return C.int(-3)
+	}
+
+	opts := []options.NamePublishOption{
+		options.Name.Key(key),
+		// Offline nodes keep the refreshed record until they next go online
+		options.Name.AllowOffline(true),
+	}
+	if ttl, err := rec.TTL(); err == nil {
+		opts = append(opts, options.Name.TTL(ttl))
+	}
+
+	log.Printf("DEBUG: Republishing %s under key %s\n", value, key)
+	if _, err := api.Name().Publish(ctx, ipath.New(value.String()), opts...); err != nil {
+		logError("republishing IPNS record: %s", err)
+		return C.int(-4)
+	}
+
+	return C.int(0)
+}
+
+// nameConfirmInterval is how long NamePublishAndConfirm waits between
+// checks of the DHT, and nameConfirmPeerTimeout how long it waits for a
+// single peer to answer
+const (
+	nameConfirmInterval    = 5 * time.Second
+	nameConfirmPeerTimeout = 10 * time.Second
+)
+
+// NamePublishResult is the outcome of NamePublishAndConfirm. ConfirmingPeers
+// is the number of DHT peers that returned the new record when last asked.
+type NamePublishResult struct {
+	Name            string `json:"name"`
+	Value           string `json:"value"`
+	Sequence        uint64 `json:"sequence"`
+	Confirmed       bool   `json:"confirmed"`
+	ConfirmingPeers int    `json:"confirmingPeers"`
+}
+
+// NamePublishAndConfirm publishes a CID or /ipfs/ path under a key like
+// NameRepublish's keyName ("self" or empty for the node's own key), then
+// asks the DHT peers closest to the name for the record until one of them
+// returns the new value, so that others are known to be able to resolve it.
+// Publishing alone only tries to store the record on those peers, without
+// telling whether it succeeded. The node's own copy of the record doesn't
+// count. timeoutSeconds bounds the whole call (60 if <= 0); if it runs out
+// first, the record is still published, but Confirmed is false.
+// Returns a NamePublishResult JSON object, or NULL if publishing failed or
+// the node has no DHT to confirm with.
+//
+//export NamePublishAndConfirm
+func NamePublishAndConfirm(repoPath, cidStr, keyName *C.char, timeoutSeconds C.int) *C.char {
+	path := C.GoString(repoPath)
+	value := C.GoString(cidStr)
+	key := C.GoString(keyName)
+	if key == "" {
+		key = "self"
+	}
+	if !strings.HasPrefix(value, "/") {
+		value = "/ipfs/" + value
+	}
+	valuePath := ipath.New(value)
+	if err := valuePath.IsValid(); err != nil {
+		logError("invalid path %s: %s", value, err)
+		return nil
+	}
+
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Get or create a node from the registry
+	api, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if !node.IsOnline || node.DHT == nil {
+		logError("node for repo %s has no DHT to publish to", path)
+		return nil
+	}
+
+	log.Printf("DEBUG: Publishing %s under key %s\n", value, key)
+	name, err := api.Name().Publish(ctx, valuePath, options.Name.Key(key))
+	if err != nil {
+		logError("publishing IPNS record: %s", err)
+		return nil
+	}
+
+	// The publisher keeps the record it just published
+	result := NamePublishResult{Name: name.String(), Value: valuePath.String()}
+	data, err := node.Repo.Datastore().Get(ctx, namesys.IpnsDsKey(name.Peer()))
+	if err != nil {
+		logError("reading published IPNS record: %s", err)
+		return nil
+	}
+	rec, err := ipns.UnmarshalRecord(data)
+	if err != nil {
+		logError("parsing IPNS record: %s", err)
+		return nil
+	}
+	if result.Sequence, err = rec.Sequence(); err != nil {
+		logError("reading IPNS record sequence: %s", err)
+		return nil
+	}
+
+	result.ConfirmingPeers = awaitRecordHolders(ctx, node, string(name.RoutingKey()), result.Value, result.Sequence)
+	result.Confirmed = result.ConfirmingPeers > 0
+	log.Printf("DEBUG: Published %s to %s, confirmed by %d peers\n", result.Value, result.Name, result.ConfirmingPeers)
+
+	// Convert to JSON
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logError("marshaling publish result to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(resultJSON))
+}
+
+// errUnknownKey is returned by keyID for names not in the keystore
+var errUnknownKey = errors.New("no such key")
+
+// keyID returns the peer ID of a key in the repo's keystore, with "self"
+// being the node's own key
+func keyID(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, key string) (peer.ID, error) {
+	if key == "self" {
+		return node.Identity, nil
+	}
+	keys, err := api.Key().List(ctx)
+	if err != nil {
+		return "", fmt.Errorf("listing keys: %w", err)
+	}
+	for _, k := range keys {
+		if k.Name() == key {
+			return k.ID(), nil
+		}
+	}
+	return "", fmt.Errorf("%w named %s", errUnknownKey, key)
+}
+
+// awaitRecordHolders checks the DHT with countRecordHolders every
+// nameConfirmInterval until a peer holds the record or ctx is done,
+// returning the last count
+func awaitRecordHolders(ctx context.Context, node *core.IpfsNode, routingKey, value string, sequence uint64) int {
+	for {
+		count := countRecordHolders(ctx, node, routingKey, value, sequence)
+		if count > 0 {
+			return count
+		}
+		select {
+		case <-ctx.Done():
+			return count
+		case <-time.After(nameConfirmInterval):
+		}
+	}
+}
+
+// countRecordHolders asks the WAN DHT peers closest to an IPNS routing key
+// for their record and counts those returning value with at least the given
+// sequence number
+func countRecordHolders(ctx context.Context, node *core.IpfsNode, routingKey, value string, sequence uint64) int {
+	peers, err := node.DHT.WAN.GetClosestPeers(ctx, routingKey)
+	if err != nil {
+		log.Printf("DEBUG: Finding peers closest to %s: %s\n", routingKey, err)
+		return 0
+	}
+
+	var (
+		count int
+		mutex sync.Mutex
+		wg    sync.WaitGroup
+	)
+	for _, p := range peers {
+		if p == node.Identity {
+			continue
+		}
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			data, err := getRecordFromPeer(ctx, node.PeerHost, p, routingKey)
+			if err != nil || data == nil {
+				return
+			}
+			rec, err := ipns.UnmarshalRecord(data)
+			if err != nil {
+				return
+			}
+			recValue, err := rec.Value()
+			if err != nil || recValue.String() != value {
+				return
+			}
+			if recSequence, err := rec.Sequence(); err != nil || recSequence < sequence {
+				return
+			}
+			mutex.Lock()
+			count++
+			mutex.Unlock()
+		}(p)
+	}
+	wg.Wait()
+	return count
+}
+
+// getRecordFromPeer sends a DHT GET_VALUE request to a single peer, returning
+// the value of the record it stores under key, or nil if it has none. The
+// DHT's own lookups can't be used here, as they merge the answers of all
+// peers with the local record.
+func getRecordFromPeer(ctx context.Context, h host.Host, p peer.ID, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, nameConfirmPeerTimeout)
+	defer cancel()
+
+	s, err := h.NewStream(ctx, p, dht.ProtocolDHT)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	request, err := dhtpb.NewMessage(dhtpb.Message_GET_VALUE, []byte(key), 0).Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if err := msgio.NewVarintWriter(s).WriteMsg(request); err != nil {
+		return nil, err
+	}
+	reader := msgio.NewVarintReaderSize(s, network.MessageSizeMax)
+	response, err := reader.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.ReleaseMsg(response)
+
+	var msg dhtpb.Message
+	if err := msg.Unmarshal(response); err != nil {
+		return nil, err
+	}
+	if msg.GetRecord() == nil {
+		return nil, nil
+	}
+	return msg.GetRecord().GetValue(), nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestPreviousNameValue(t *testing.T) {
+	ctx := context.Background()
+	ds := datastore.NewMapDatastore()
+
+	id, err := peer.Decode("12D3KooWD3eckifWpRn9wQpMG9R9hX3sD158z7EqHWmweQAJU5SA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := previousNameValue(ctx, ds, id); err != datastore.ErrNotFound {
+		t.Fatalf("expected no previous value, got %v", err)
+	}
+
+	value := "/ipfs/bafkreigh2akiscaildcqabsyg3dfr6chu3fgpregiymsck7e7aqa4s52zy"
+	if err := setPreviousNameValue(ctx, ds, id, value); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := previousNameValue(ctx, ds, id); err != nil || got != value {
+		t.Fatalf("expected %s, got %q (%v)", value, got, err)
+	}
+
+	// Removing twice is fine, e.g. after a rollback
+	for i := 0; i < 2; i++ {
+		if err := removePreviousNameValue(ctx, ds, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := previousNameValue(ctx, ds, id); err != datastore.ErrNotFound {
+		t.Fatalf("expected no previous value, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+/*
+#include <stdlib.h>
+
+// The last error is kept per thread, so that it belongs to the call made on
+// the calling thread even when several threads call into the library
+static _Thread_local char *last_error = NULL;
+
+static void set_last_error(char *msg) {
+	free(last_error);
+	last_error = msg;
+}
+
+static char *take_last_error(void) {
+	char *msg = last_error;
+	last_error = NULL;
+	return msg;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"log"
+)
+
+// LastError returns the message of the last error that occurred in a call
+// made from the calling thread, e.g. "acquiring node: repo not initialized"
+// after AddFile returned NULL, or NULL if there was none since the last call
+// to LastError. Reading the error clears it, so call LastError once before a
+// call to discard errors left over from earlier calls. Only errors that make
+// a call fail are recorded, not those it logs and recovers from, nor those
+// of background work such as subscriptions.
+//
+//export LastError
+func LastError() *C.char {
+	return C.take_last_error()
+}
+
+// logError logs the error that makes the current call fail and records it
+// as the last error of the calling thread, for LastError. It must be called
+// from the goroutine of the exported function, which cgo runs on the calling
+// thread, not from goroutines it starts.
+func logError(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Printf("ERROR:  %s\n", msg)
+	C.set_last_error(C.CString(msg))
+}
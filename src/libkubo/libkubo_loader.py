@@ -93,3 +93,13 @@ def from_c_str(string_ptr):
 
 def c_bool(value: bool):
     return ffi.new("bool *", value)[0]
+
+
+def last_error() -> str | None:
+    """Get the message of the last error of a libkubo call on this thread."""
+    error_ptr = libkubo.LastError()
+    if not error_ptr:
+        return None
+    error = from_c_str(error_ptr)
+    libkubo.FreeString(error_ptr)
+    return error
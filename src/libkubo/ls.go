@@ -0,0 +1,127 @@
+package main
+
+// #include <stdint.h>
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	iface "github.com/ipfs/boxo/coreiface"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	cidlib "github.com/ipfs/go-cid"
+)
+
+// LsEntry describes an entry of a Unixfs directory
+type LsEntry struct {
+	Name   string `json:"name"`
+	CID    string `json:"cid"`
+	Type   string `json:"type"`
+	Size   uint64 `json:"size"`
+	Target string `json:"target,omitempty"`
+}
+
+// LsCID lists the entries of a Unixfs directory as a JSON array of LsEntry.
+// For very large directories use LsCIDStream instead.
+//
+//export LsCID
+func LsCID(repoPath, cidStr *C.char) *C.char {
+	path := C.GoString(repoPath)
+	cid := C.GoString(cidStr)
+
+	entries := []LsEntry{}
+	_, err := lsCID(path, cid, func(entry LsEntry) {
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		logError("listing %s: %s", cid, err)
+		return nil
+	}
+
+	// Convert to JSON
+	entriesJSON, err := json.Marshal(entries)
+	if err != nil {
+		logError("marshaling directory entries to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(entriesJSON))
+}
+
+// LsCIDStream lists the entries of a Unixfs directory, calling a callback
+// void(char* entryJSON) with each LsEntry as soon as it is read, so that huge
+// directories can be processed without holding the whole listing in memory.
+// Returns the number of entries listed, or a negative value on error.
+//
+//export LsCIDStream
+func LsCIDStream(repoPath, cidStr *C.char, cb C.uintptr_t) C.int {
+	path := C.GoString(repoPath)
+	cid := C.GoString(cidStr)
+
+	count, err := lsCID(path, cid, func(entry LsEntry) {
+		entryJSON, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("ERROR:  marshaling directory entry to JSON: %s\n", err)
+			return
+		}
+		callStringCallback(cb, string(entryJSON))
+	})
+	if err != nil {
+		logError("listing %s: %s", cid, err)
+		return C.int(-1)
+	}
+
+	return C.int(count)
+}
+
+// lsCID calls visit for every entry of the directory cid, returning the
+// number of entries visited
+func lsCID(path, cid string, visit func(LsEntry)) (int, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// Stops the listing if it is abandoned on an error
+	defer cancel()
+
+	log.Printf("DEBUG: Listing directory %s using repo %s\n", cid, path)
+
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		return 0, fmt.Errorf("decoding CID: %w", err)
+	}
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		return 0, fmt.Errorf("acquiring node: %w", err)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	dirEntries, err := api.Unixfs().Ls(ctx, ipath.IpfsPath(decodedCid))
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for dirEntry := range dirEntries {
+		if dirEntry.Err != nil {
+			return count, dirEntry.Err
+		}
+		visit(lsEntry(dirEntry))
+		count++
+	}
+	return count, nil
+}
+
+// lsEntry converts a directory entry from the Unixfs API to an LsEntry
+func lsEntry(dirEntry iface.DirEntry) LsEntry {
+	return LsEntry{
+		Name:   dirEntry.Name,
+		CID:    dirEntry.Cid.String(),
+		Type:   dirEntry.Type.String(),
+		Size:   dirEntry.Size,
+		Target: dirEntry.Target,
+	}
+}
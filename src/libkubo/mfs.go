@@ -0,0 +1,130 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/ipfs/boxo/blockservice"
+	"github.com/ipfs/boxo/blockstore"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	dag "github.com/ipfs/boxo/ipld/merkledag"
+	ft "github.com/ipfs/boxo/ipld/unixfs"
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/kubo/repo/fsrepo"
+)
+
+// mfsRootKey is the datastore key under which Kubo persists the MFS root CID
+var mfsRootKey = datastore.NewKey("/local/filesroot")
+
+// GetMfsRoot returns the CID of the repo's MFS root directory, including
+// any changes made through MFS that haven't been flushed yet
+//
+//export GetMfsRoot
+func GetMfsRoot(repoPath *C.char) *C.char {
+	path := C.GoString(repoPath)
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	rootNode, err := node.FilesRoot.GetDirectory().GetNode()
+	if err != nil {
+		logError("getting MFS root: %s", err)
+		return nil
+	}
+
+	return C.CString(rootNode.Cid().String())
+}
+
+// SetMfsRoot replaces the repo's MFS root with the Unixfs directory at a CID,
+// which must be stored locally (e.g. pinned or downloaded beforehand).
+// The MFS root is loaded when a node starts, so this is refused (-3) while a
+// node is running on the repo.
+//
+//export SetMfsRoot
+func SetMfsRoot(repoPath, cidStr *C.char) C.int {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	cid := C.GoString(cidStr)
+
+	if !fsrepo.IsInitialized(path) {
+		logError("repository not initialized at %s", path)
+		return C.int(-1)
+	}
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return C.int(-2)
+	}
+
+	// Hold the registry lock so no node can start on the repo meanwhile
+	activeNodesMutex.Lock()
+	defer activeNodesMutex.Unlock()
+	if _, exists := activeNodes[path]; exists {
+		logError("cannot replace MFS root of %s while a node is running on it", path)
+		return C.int(-3)
+	}
+
+	repo, err := fsrepo.Open(path)
+	if err != nil {
+		logError("opening repository: %s", err)
+		return C.int(-4)
+	}
+	defer repo.Close()
+
+	if err := checkMfsRootCandidate(ctx, repo.Datastore(), decodedCid); err != nil {
+		logError("%s", err)
+		return C.int(-5)
+	}
+
+	if err := repo.Datastore().Put(ctx, mfsRootKey, decodedCid.Bytes()); err != nil {
+		logError("writing MFS root: %s", err)
+		return C.int(-6)
+	}
+	if err := repo.Datastore().Sync(ctx, mfsRootKey); err != nil {
+		logError("syncing MFS root: %s", err)
+		return C.int(-6)
+	}
+
+	log.Printf("DEBUG: MFS root of %s set to %s\n", path, cid)
+	return C.int(0)
+}
+
+// checkMfsRootCandidate checks that c is a Unixfs directory whose root block
+// is in the repo's local blockstore, so a node can load it as its MFS root
+func checkMfsRootCandidate(ctx context.Context, ds datastore.Batching, c cidlib.Cid) error {
+	bs := blockstore.NewBlockstore(ds)
+	dagService := dag.NewDAGService(blockservice.New(bs, offline.Exchange(bs)))
+
+	nd, err := dagService.Get(ctx, c)
+	if err != nil {
+		return fmt.Errorf("loading %s from the local blockstore: %w", c, err)
+	}
+	pbNode, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return fmt.Errorf("%s is not a Unixfs directory", c)
+	}
+	fsNode, err := ft.FSNodeFromBytes(pbNode.Data())
+	if err != nil {
+		return fmt.Errorf("%s is not a Unixfs directory: %w", c, err)
+	}
+	switch fsNode.Type() {
+	case ft.TDirectory, ft.THAMTShard:
+		return nil
+	default:
+		return fmt.Errorf("%s is not a Unixfs directory", c)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/ipfs/kubo/repo/fsrepo"
+	"github.com/ipfs/kubo/repo/fsrepo/migrations"
+)
+
+// RepoNeedsMigration reports whether a repo was created by an older Kubo
+// version and must be migrated before a node can be started on it.
+// Returns 1 if a migration is needed, 0 if the repo is current,
+// or a negative value on error (-2 if the repo is newer than this library)
+//
+//export RepoNeedsMigration
+func RepoNeedsMigration(repoPath *C.char) C.int {
+	path := C.GoString(repoPath)
+
+	version, err := migrations.RepoVersion(path)
+	if err != nil {
+		logError("reading repo version: %s", err)
+		return C.int(-1)
+	}
+	if version > fsrepo.RepoVersion {
+		logError("repo version %d is newer than supported version %d", version, fsrepo.RepoVersion)
+		return C.int(-2)
+	}
+	if version < fsrepo.RepoVersion {
+		return C.int(1)
+	}
+	return C.int(0)
+}
+
+// MigrateRepo upgrades a repo to the version this library expects, fetching
+// the fs-repo-migrations binaries from the sources in the repo's Migration
+// config. The repo must not be in use by a running node.
+// Returns 0 on success or if no migration was needed, negative on error
+//
+//export MigrateRepo
+func MigrateRepo(repoPath *C.char) C.int {
+	ctx := context.Background()
+	path := C.GoString(repoPath)
+
+	needed := RepoNeedsMigration(repoPath)
+	if needed < 0 {
+		return needed
+	}
+	if needed == 0 {
+		return C.int(0)
+	}
+
+	activeNodesMutex.Lock()
+	defer activeNodesMutex.Unlock()
+	if _, exists := activeNodes[path]; exists {
+		logError("cannot migrate repo %s while a node is running on it", path)
+		return C.int(-3)
+	}
+
+	log.Printf("DEBUG: Migrating repo %s to version %d\n", path, fsrepo.RepoVersion)
+
+	migrationCfg, err := migrations.ReadMigrationConfig(path, "")
+	if err != nil {
+		logError("reading migration config: %s", err)
+		return C.int(-4)
+	}
+
+	// No IPFS fetcher: the repo can't be opened until it has been migrated
+	fetcher, err := migrations.GetMigrationFetcher(migrationCfg.DownloadSources,
+		migrations.GetDistPathEnv(migrations.CurrentIpfsDist), nil)
+	if err != nil {
+		logError("creating migration fetcher: %s", err)
+		return C.int(-5)
+	}
+	defer fetcher.Close()
+
+	if migrationCfg.Keep == "cache" || migrationCfg.Keep == "pin" {
+		// Keep downloaded migration archives out of the working directory
+		migrations.DownloadDirectory, err = os.MkdirTemp("", "migrations")
+		if err != nil {
+			logError("creating migration download directory: %s", err)
+			return C.int(-6)
+		}
+		defer func() {
+			os.RemoveAll(migrations.DownloadDirectory)
+			migrations.DownloadDirectory = ""
+		}()
+	}
+
+	if err := migrations.RunMigration(ctx, fetcher, fsrepo.RepoVersion, path, false); err != nil {
+		logError("migrating repo: %s", err)
+		return C.int(-7)
+	}
+
+	log.Printf("DEBUG: Repo %s migrated to version %d\n", path, fsrepo.RepoVersion)
+	return C.int(0)
+}
@@ -0,0 +1,255 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	"github.com/ipfs/boxo/ipns"
+	"github.com/ipfs/boxo/namesys"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/kubo/core"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// namePreviousPrefix is the datastore prefix under which NamePublishAtomic
+// stores the value each key pointed to before, for NameRollback
+var namePreviousPrefix = datastore.NewKey("/libkubo/nameprevious")
+
+// nameAtomicTimeout bounds publishing and confirming in NamePublishAtomic,
+// and nameRestoreTimeout republishing the previous value if that fails
+const (
+	nameAtomicTimeout  = time.Minute
+	nameRestoreTimeout = time.Minute
+)
+
+// NameSwapResult is the outcome of NamePublishAtomic. OldValue is empty if
+// nothing was published with the key before. RolledBack tells whether the
+// name was set back to OldValue after the new value failed.
+type NameSwapResult struct {
+	Name       string `json:"name"`
+	OldValue   string `json:"oldValue,omitempty"`
+	NewValue   string `json:"newValue"`
+	Success    bool   `json:"success"`
+	RolledBack bool   `json:"rolledBack"`
+	Error      string `json:"error,omitempty"`
+}
+
+// NamePublishAtomic switches the value of an IPNS name like a deployment:
+// it publishes newCid (a CID or /ipfs/ path) with the key and waits for a
+// DHT peer to confirm it like NamePublishAndConfirm. If publishing fails or
+// isn't confirmed within a minute, the old value is published again, so the
+// name doesn't stay on a value others may not be able to resolve. keyName is
+// like NameRepublish's. After a successful switch, NameRollback reverts the
+// name to the old value; a failed switch keeps the rollback point of the
+// last successful one.
+// Returns a NameSwapResult JSON object, or NULL if newCid or the key is
+// invalid or the node has no DHT to publish to.
+//
+//export NamePublishAtomic
+func NamePublishAtomic(repoPath, newCid, keyName *C.char) *C.char {
+	path := C.GoString(repoPath)
+	value := C.GoString(newCid)
+	key := C.GoString(keyName)
+	if key == "" {
+		key = "self"
+	}
+	if !strings.HasPrefix(value, "/") {
+		value = "/ipfs/" + value
+	}
+	valuePath := ipath.New(value)
+	if err := valuePath.IsValid(); err != nil {
+		logError("invalid path %s: %s", value, err)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nameAtomicTimeout)
+	defer cancel()
+
+	// Get or create a node from the registry
+	api, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if !node.IsOnline || node.DHT == nil {
+		logError("node for repo %s has no DHT to publish to", path)
+		return nil
+	}
+	id, err := keyID(ctx, api, node, key)
+	if err != nil {
+		logError("%s", err)
+		return nil
+	}
+
+	ds := node.Repo.Datastore()
+	result := NameSwapResult{Name: "/ipns/" + ipns.NameFromPeer(id).String(), NewValue: valuePath.String()}
+	if old, _, err := publishedValue(ctx, node, id); err == nil {
+		result.OldValue = old
+	}
+
+	log.Printf("DEBUG: Switching %s under key %s from %q to %s\n", result.Name, key, result.OldValue, result.NewValue)
+	name, err := api.Name().Publish(ctx, valuePath, options.Name.Key(key))
+	if err != nil {
+		result.Error = "publishing: " + err.Error()
+	} else if _, sequence, err := publishedValue(ctx, node, id); err != nil {
+		result.Error = "reading published record: " + err.Error()
+	} else if awaitRecordHolders(ctx, node, string(name.RoutingKey()), result.NewValue, sequence) == 0 {
+		result.Error = "no DHT peer confirmed the new record"
+	} else {
+		result.Success = true
+	}
+
+	// Only a successful switch replaces the rollback point, so a failed one
+	// leaves that of the last successful switch in place
+	if result.Success && result.OldValue != "" {
+		if err := setPreviousNameValue(ctx, ds, id, result.OldValue); err != nil {
+			log.Printf("ERROR:  storing previous IPNS value: %s\n", err)
+		}
+	}
+
+	if !result.Success {
+		log.Printf("ERROR:  switching %s to %s: %s\n", result.Name, result.NewValue, result.Error)
+		if result.OldValue != "" {
+			restoreCtx, cancel := context.WithTimeout(context.Background(), nameRestoreTimeout)
+			defer cancel()
+			if _, err := api.Name().Publish(restoreCtx, ipath.New(result.OldValue), options.Name.Key(key)); err != nil {
+				log.Printf("ERROR:  republishing previous value %s: %s\n", result.OldValue, err)
+			} else {
+				result.RolledBack = true
+			}
+		}
+	}
+
+	// Convert to JSON
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logError("marshaling swap result to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(resultJSON))
+}
+
+// NameRollback publishes the value a name pointed to before the last
+// successful NamePublishAtomic with the same key again. keyName is like
+// NameRepublish's. A rollback can only be done once per switch.
+// Returns 0 on success, -1 if the node couldn't be acquired, -2 if the key
+// is unknown, -3 if there is no previous value and -4 if publishing failed.
+//
+//export NameRollback
+func NameRollback(repoPath, keyName *C.char) C.int {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	key := C.GoString(keyName)
+	if key == "" {
+		key = "self"
+	}
+
+	// Get or create a node from the registry
+	api, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	id, err := keyID(ctx, api, node, key)
+	if err != nil {
+		logError("%s", err)
+		if errors.Is(err, errUnknownKey) {
+			return C.int(-2)
+		}
+		return C.int(-1)
+	}
+
+	ds := node.Repo.Datastore()
+	previous, err := previousNameValue(ctx, ds, id)
+	if err != nil {
+		logError("no previous value recorded for key %s: %s", key, err)
+		return C.int(-3)
+	}
+
+	log.Printf("DEBUG: Rolling back key %s to %s\n", key, previous)
+	opts := []options.NamePublishOption{
+		options.Name.Key(key),
+		// Offline nodes keep the record until they next go online
+		options.Name.AllowOffline(true),
+	}
+	if _, err := api.Name().Publish(ctx, ipath.New(previous), opts...); err != nil {
+		logError("republishing previous value: %s", err)
+		return C.int(-4)
+	}
+	if err := removePreviousNameValue(ctx, ds, id); err != nil {
+		log.Printf("ERROR:  removing previous IPNS value: %s\n", err)
+	}
+
+	return C.int(0)
+}
+
+// publishedValue returns the value and sequence number of the record the
+// node last published with the key of the given ID
+func publishedValue(ctx context.Context, node *core.IpfsNode, id peer.ID) (string, uint64, error) {
+	// The publisher keeps the latest record for each of the node's keys
+	data, err := node.Repo.Datastore().Get(ctx, namesys.IpnsDsKey(id))
+	if err != nil {
+		return "", 0, err
+	}
+	rec, err := ipns.UnmarshalRecord(data)
+	if err != nil {
+		return "", 0, err
+	}
+	value, err := rec.Value()
+	if err != nil {
+		return "", 0, err
+	}
+	sequence, err := rec.Sequence()
+	if err != nil {
+		return "", 0, err
+	}
+	return value.String(), sequence, nil
+}
+
+// previousNameValueKey returns the datastore key of the previous value of
+// the key with the given ID
+func previousNameValueKey(id peer.ID) datastore.Key {
+	return namePreviousPrefix.ChildString(ipns.NameFromPeer(id).String())
+}
+
+// setPreviousNameValue stores the value a key pointed to before a switch
+func setPreviousNameValue(ctx context.Context, ds datastore.Datastore, id peer.ID, value string) error {
+	return ds.Put(ctx, previousNameValueKey(id), []byte(value))
+}
+
+// previousNameValue returns the stored previous value of a key, or
+// datastore.ErrNotFound if there is none
+func previousNameValue(ctx context.Context, ds datastore.Datastore, id peer.ID) (string, error) {
+	value, err := ds.Get(ctx, previousNameValueKey(id))
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// removePreviousNameValue removes the stored previous value of a key, if
+// there is one
+func removePreviousNameValue(ctx context.Context, ds datastore.Datastore, id peer.ID) error {
+	err := ds.Delete(ctx, previousNameValueKey(id))
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	return err
+}
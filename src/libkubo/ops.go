@@ -0,0 +1,96 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// In-flight operations, indexed by repo path and then operation ID, so they
+// can be cancelled before their node is shut down
+var (
+	operations      = make(map[string]map[int64]context.CancelFunc)
+	operationsMutex sync.Mutex
+	nextOperationID int64 = 1
+)
+
+// operationsPollInterval is how often waitForOperations checks for
+// remaining operations
+const operationsPollInterval = 50 * time.Millisecond
+
+// beginOperation registers a long-running operation on a repo. The returned
+// context is cancelled when the operations of the repo are cancelled, e.g. by
+// CleanupNodeGraceful, and the returned function must be called once the
+// operation has finished.
+func beginOperation(repoPath string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	operationsMutex.Lock()
+	id := nextOperationID
+	nextOperationID++
+	if operations[repoPath] == nil {
+		operations[repoPath] = make(map[int64]context.CancelFunc)
+	}
+	operations[repoPath][id] = cancel
+	operationsMutex.Unlock()
+
+	return ctx, func() {
+		cancel()
+		operationsMutex.Lock()
+		delete(operations[repoPath], id)
+		if len(operations[repoPath]) == 0 {
+			delete(operations, repoPath)
+		}
+		operationsMutex.Unlock()
+	}
+}
+
+// CancelAllOps cancels every in-flight operation on a repo (downloads, adds,
+// pins and the like), e.g. right before CleanupNode, so they return with an
+// error instead of failing on a closed node. The operations return shortly
+// after; CleanupNodeGraceful combines both steps and waits for them.
+// Returns the number of operations cancelled.
+//
+//export CancelAllOps
+func CancelAllOps(repoPath *C.char) C.int {
+	path := C.GoString(repoPath)
+
+	cancelled := cancelOperations(path)
+	log.Printf("DEBUG: Cancelled %d operations on repo %s\n", cancelled, path)
+	return C.int(cancelled)
+}
+
+// cancelOperations cancels every in-flight operation on a repo, returning
+// how many were cancelled. The operations remain registered until they end.
+func cancelOperations(repoPath string) int {
+	operationsMutex.Lock()
+	defer operationsMutex.Unlock()
+
+	for _, cancel := range operations[repoPath] {
+		cancel()
+	}
+	return len(operations[repoPath])
+}
+
+// waitForOperations waits until no operations are in flight on a repo or the
+// timeout passes, returning whether they all finished
+func waitForOperations(repoPath string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		operationsMutex.Lock()
+		remaining := len(operations[repoPath])
+		operationsMutex.Unlock()
+
+		if remaining == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(operationsPollInterval)
+	}
+}
@@ -35,7 +35,7 @@ func P2PForward(repoPath, proto, listenAddr, targetPeerID *C.char) C.int {
 	// Get the node for this repo
 	_, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR acquiring node for P2P forwarding: %v\n", err)
+		logError("acquiring node for P2P forwarding: %v", err)
 		return C.int(-1)
 	}
 	defer ReleaseNode(path)
@@ -46,21 +46,21 @@ func P2PForward(repoPath, proto, listenAddr, targetPeerID *C.char) C.int {
 	// Parse the listen address as a multiaddr
 	listenMA, err := ma.NewMultiaddr(listenAddress)
 	if err != nil {
-		log.Printf("ERROR parsing listen address: %v\n", err)
+		logError("parsing listen address: %v", err)
 		return C.int(-3)
 	}
 
 	// Parse the peer ID
 	peerID, err := peer.Decode(peerIDStr)
 	if err != nil {
-		log.Printf("ERROR parsing peer ID: %v\n", err)
+		logError("parsing peer ID: %v", err)
 		return C.int(-4)
 	}
 
 	// Create the forwarding (ForwardLocal is used to connect to a remote peer)
 	listener, err := p2pService.ForwardLocal(context.Background(), peerID, protocol.ID(protocolName), listenMA)
 	if err != nil {
-		log.Printf("ERROR creating P2P forward: %v\n", err)
+		logError("creating P2P forward: %v", err)
 		return C.int(-2)
 	}
 
@@ -85,7 +85,7 @@ func P2PListen(repoPath, proto, targetAddr *C.char) C.int {
 	// Get the node for this repo
 	_, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR acquiring node for P2P listening: %v\n", err)
+		logError("acquiring node for P2P listening: %v", err)
 		return C.int(-1)
 	}
 	defer ReleaseNode(path)
@@ -96,7 +96,7 @@ func P2PListen(repoPath, proto, targetAddr *C.char) C.int {
 	// Parse the target address as a multiaddr
 	targetMA, err := ma.NewMultiaddr(targetAddress)
 	if err != nil {
-		log.Printf("ERROR parsing target address: %v\n", err)
+		logError("parsing target address: %v", err)
 		return C.int(-3)
 	}
 
@@ -104,7 +104,7 @@ func P2PListen(repoPath, proto, targetAddr *C.char) C.int {
 	// The last parameter is reportRemote which we set to false
 	listener, err := p2pService.ForwardRemote(context.Background(), protocol.ID(protocolName), targetMA, false)
 	if err != nil {
-		log.Printf("ERROR creating P2P listener: %v\n", err)
+		logError("creating P2P listener: %v", err)
 		return C.int(-2)
 	}
 
@@ -141,7 +141,7 @@ func P2PClose(
 	if listenAddress != "" {
 		_, err := ma.NewMultiaddr(listenAddress)
 		if err != nil {
-			log.Printf("ERROR parsing listen address for P2P close: %v\n", err)
+			logError("parsing listen address for P2P close: %v", err)
 			return C.int(-1)
 		}
 	}
@@ -149,7 +149,7 @@ func P2PClose(
 	if targetAddress != "" {
 	_, err := ma.NewMultiaddr(targetAddress)
 	if err != nil {
-		log.Printf("ERROR parsing target address for P2P close: %v\n", err)
+		logError("parsing target address for P2P close: %v", err)
 		return C.int(-1)
 	}
 }
@@ -157,12 +157,12 @@ func P2PClose(
 	// Get the node for this repo
 	_, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR acquiring node for P2P close: %v\n", err)
+		logError("acquiring node for P2P close: %v", err)
 		return C.int(-1)
 	}
 	defer ReleaseNode(path)
 
-	log.Printf("Closing connections for: %s, %s, %s, %b, %b,%b", protocolName, listenAddress, targetAddress, all, closeListeners, closeForwarders)
+	log.Printf("Closing connections for: %s, %s, %s, %t, %t, %t", protocolName, listenAddress, targetAddress, all, closeListeners, closeForwarders)
 
 	// Get the P2P service from the node
 	p2pService := node.P2P
@@ -221,7 +221,7 @@ func P2PListListeners(repoPath *C.char) *C.char {
 	// Get the node for this repo
 	_, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR acquiring node for P2P list: %v\n", err)
+		logError("acquiring node for P2P list: %v", err)
 		return C.CString("")
 	}
 	defer ReleaseNode(path)
@@ -275,7 +275,7 @@ func P2PListListeners(repoPath *C.char) *C.char {
 	// Convert to JSON
 	jsonData, err := json.Marshal(result)
 	if err != nil {
-		log.Printf("ERROR marshaling P2P listener data: %v\n", err)
+		logError("marshaling P2P listener data: %v", err)
 		return C.CString("")
 	}
 
@@ -291,7 +291,7 @@ func P2PEnable(repoPath *C.char) C.int {
 	// Use AcquireNode just to make sure the node is running
 	_, _, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR acquiring node: %v\n", err)
+		logError("acquiring node: %v", err)
 		return C.int(-1)
 	}
 	defer ReleaseNode(path)
@@ -311,7 +311,7 @@ func P2PListForwards(repoPath *C.char) *C.char {
 	// Get the node for this repo
 	_, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR acquiring node for P2P forwards list: %v\n", err)
+		logError("acquiring node for P2P forwards list: %v", err)
 		return C.CString("")
 	}
 	defer ReleaseNode(path)
@@ -352,7 +352,7 @@ func P2PListForwards(repoPath *C.char) *C.char {
 	// Convert to JSON
 	jsonData, err := json.Marshal(result)
 	if err != nil {
-		log.Printf("ERROR marshaling P2P forwards data: %v\n", err)
+		logError("marshaling P2P forwards data: %v", err)
 		return C.CString("")
 	}
 
@@ -368,7 +368,7 @@ func P2PCloseAllListeners(repoPath *C.char) C.int {
 	// Get the node for this repo
 	_, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR acquiring node for P2P close all listeners: %v\n", err)
+		logError("acquiring node for P2P close all listeners: %v", err)
 		return C.int(-1)
 	}
 	defer ReleaseNode(path)
@@ -402,7 +402,7 @@ func P2PCloseAllForwards(repoPath *C.char) C.int {
 	// Get the node for this repo
 	_, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR acquiring node for P2P close all forwards: %v\n", err)
+		logError("acquiring node for P2P close all forwards: %v", err)
 		return C.int(-1)
 	}
 	defer ReleaseNode(path)
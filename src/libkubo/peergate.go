@@ -0,0 +1,220 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	nodep2p "github.com/ipfs/kubo/core/node/libp2p"
+	"github.com/libp2p/go-libp2p"
+	p2pconfig "github.com/libp2p/go-libp2p/config"
+	"github.com/libp2p/go-libp2p/core/connmgr"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// Peer gates set with SetPeerGate, indexed by repo path
+var (
+	peerGates      = make(map[string]*peerGate)
+	peerGatesMutex sync.Mutex
+)
+
+// SetPeerGate restricts which peers the node of the repo connects to. With
+// mode "allow", only the peers in peersJSON (a JSON array of peer IDs) can
+// connect or be dialed, e.g. for a private deployment; note that this also
+// cuts the node off from the bootstrap peers and the public DHT unless they
+// are listed. With mode "deny", the listed peers are blocked, e.g. to shut
+// out abusive peers. An empty mode removes the gate. The gate applies right
+// away, also to a running node, whose connections to peers it no longer
+// allows are closed; it lasts for the rest of this process. It is checked in
+// addition to the address filters of Swarm.AddrFilters.
+// Returns 0 on success, -1 for an unknown mode and -2 if peersJSON isn't a
+// JSON array of valid peer IDs.
+//
+//export SetPeerGate
+func SetPeerGate(repoPath *C.char, mode *C.char, peersJSON *C.char) C.int {
+	path := C.GoString(repoPath)
+	gateMode := C.GoString(mode)
+
+	switch gateMode {
+	case "", "allow", "deny":
+	default:
+		logError("unknown peer gate mode %q", gateMode)
+		return C.int(-1)
+	}
+
+	var peerStrs []string
+	if gateMode != "" {
+		if err := json.Unmarshal([]byte(C.GoString(peersJSON)), &peerStrs); err != nil {
+			logError("parsing peers JSON: %s", err)
+			return C.int(-2)
+		}
+	}
+	peers := make(map[peer.ID]bool, len(peerStrs))
+	for _, peerStr := range peerStrs {
+		id, err := peer.Decode(peerStr)
+		if err != nil {
+			logError("invalid peer ID %s: %s", peerStr, err)
+			return C.int(-2)
+		}
+		peers[id] = true
+	}
+
+	gate := peerGateFor(path)
+	gate.set(gateMode, peers)
+	log.Printf("DEBUG: Set peer gate of repo %s to %q with %d peers\n", path, gateMode, len(peers))
+
+	// Disconnect a running node from the peers it no longer allows, without
+	// starting one
+	activeNodesMutex.Lock()
+	nodeInfo, running := activeNodes[path]
+	activeNodesMutex.Unlock()
+	if running && nodeInfo.Node.PeerHost != nil {
+		network := nodeInfo.Node.PeerHost.Network()
+		for _, p := range network.Peers() {
+			if !gate.allows(p) {
+				if err := network.ClosePeer(p); err != nil {
+					log.Printf("ERROR:  disconnecting from gated peer %s: %s\n", p, err)
+				}
+			}
+		}
+	}
+
+	return C.int(0)
+}
+
+// peerGate is the allowlist or denylist of a repo's node. It also keeps the
+// node from dialling the direct addresses of peers being dialled through a
+// relay (see relayOnly).
+type peerGate struct {
+	mutex sync.RWMutex
+	mode  string
+	peers map[peer.ID]bool
+	// relayOnly counts the ongoing relayed dials to each peer
+	relayOnly map[peer.ID]int
+}
+
+// peerGateFor returns the gate of a repo, creating an open one if none has
+// been set yet
+func peerGateFor(repoPath string) *peerGate {
+	peerGatesMutex.Lock()
+	defer peerGatesMutex.Unlock()
+	gate, ok := peerGates[repoPath]
+	if !ok {
+		gate = &peerGate{}
+		peerGates[repoPath] = gate
+	}
+	return gate
+}
+
+// set replaces the mode and peers of the gate
+func (g *peerGate) set(mode string, peers map[peer.ID]bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.mode = mode
+	g.peers = peers
+}
+
+// allows reports whether the gate lets the node connect to p
+func (g *peerGate) allows(p peer.ID) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	switch g.mode {
+	case "allow":
+		return g.peers[p]
+	case "deny":
+		return !g.peers[p]
+	}
+	return true
+}
+
+// restrictToRelays makes the node dial only relayed addresses of p until the
+// returned function is called, leaving the peerstore untouched
+func (g *peerGate) restrictToRelays(p peer.ID) func() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.relayOnly == nil {
+		g.relayOnly = make(map[peer.ID]int)
+	}
+	g.relayOnly[p]++
+	return func() {
+		g.mutex.Lock()
+		defer g.mutex.Unlock()
+		if g.relayOnly[p]--; g.relayOnly[p] == 0 {
+			delete(g.relayOnly, p)
+		}
+	}
+}
+
+// allowsAddr reports whether the gate lets the node dial p at addr
+func (g *peerGate) allowsAddr(p peer.ID, addr ma.Multiaddr) bool {
+	g.mutex.RLock()
+	relayOnly := g.relayOnly[p] > 0
+	g.mutex.RUnlock()
+	return !relayOnly || isRelayAddr(addr)
+}
+
+// gatedHostOption builds the libp2p host of the repo's node with next, with
+// the repo's peer gate installed as connection gater in front of the one
+// Kubo sets up for Swarm.AddrFilters
+func gatedHostOption(repoPath string, next nodep2p.HostOption) nodep2p.HostOption {
+	return func(id peer.ID, ps peerstore.Peerstore, options ...libp2p.Option) (host.Host, error) {
+		gate := peerGateFor(repoPath)
+		// libp2p takes only one gater, so this must come after Kubo's options
+		gaterOption := func(cfg *p2pconfig.Config) error {
+			cfg.ConnectionGater = &peerGater{gate: gate, next: cfg.ConnectionGater}
+			return nil
+		}
+		return next(id, ps, append(options, gaterOption)...)
+	}
+}
+
+// peerGater is a connection gater checking a peer gate before passing the
+// connection on to the next gater, if any
+type peerGater struct {
+	gate *peerGate
+	next connmgr.ConnectionGater
+}
+
+var _ connmgr.ConnectionGater = (*peerGater)(nil)
+
+func (g *peerGater) InterceptPeerDial(p peer.ID) bool {
+	if !g.gate.allows(p) {
+		return false
+	}
+	return g.next == nil || g.next.InterceptPeerDial(p)
+}
+
+func (g *peerGater) InterceptAddrDial(p peer.ID, addr ma.Multiaddr) bool {
+	if !g.gate.allows(p) || !g.gate.allowsAddr(p, addr) {
+		return false
+	}
+	return g.next == nil || g.next.InterceptAddrDial(p, addr)
+}
+
+// InterceptAccept can't check the peer, which isn't known before the
+// connection is secured
+func (g *peerGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	return g.next == nil || g.next.InterceptAccept(addrs)
+}
+
+func (g *peerGater) InterceptSecured(dir network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	if !g.gate.allows(p) {
+		return false
+	}
+	return g.next == nil || g.next.InterceptSecured(dir, p, addrs)
+}
+
+func (g *peerGater) InterceptUpgraded(conn network.Conn) (bool, control.DisconnectReason) {
+	if g.next == nil {
+		return true, 0
+	}
+	return g.next.InterceptUpgraded(conn)
+}
@@ -0,0 +1,142 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/ipfs/kubo/config"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// PeeringAdd adds a peer to the repo's peering list (Peering.Peers), so the
+// node keeps a connection to it open and reconnects whenever it drops.
+// addrsJSON is a JSON array of multiaddrs for the peer, which may be empty to
+// rely on peer routing. Adding a peer that is already listed replaces its
+// addresses. If a node is running on the repo, it starts peering right away.
+//
+//export PeeringAdd
+func PeeringAdd(repoPath, peerID, addrsJSON *C.char) C.int {
+	path := C.GoString(repoPath)
+	idStr := C.GoString(peerID)
+	addrsStr := C.GoString(addrsJSON)
+
+	var info peer.AddrInfo
+	result := updateRepoConfig(path, func(cfg *config.Config) error {
+		id, err := peer.Decode(idStr)
+		if err != nil {
+			return fmt.Errorf("decoding peer ID: %w", err)
+		}
+		info.ID = id
+
+		var addrs []string
+		if addrsStr != "" {
+			if err := json.Unmarshal([]byte(addrsStr), &addrs); err != nil {
+				return fmt.Errorf("parsing peer addresses JSON: %w", err)
+			}
+		}
+		for _, addr := range addrs {
+			maddr, err := ma.NewMultiaddr(addr)
+			if err != nil {
+				return fmt.Errorf("invalid peer address %q: %w", addr, err)
+			}
+			// Accept addresses with or without a trailing /p2p/<id>
+			transport, addrID := peer.SplitAddr(maddr)
+			if addrID != "" && addrID != id {
+				return fmt.Errorf("address %q belongs to a different peer", addr)
+			}
+			info.Addrs = append(info.Addrs, transport)
+		}
+
+		for i, existing := range cfg.Peering.Peers {
+			if existing.ID == id {
+				cfg.Peering.Peers[i] = info
+				return nil
+			}
+		}
+		cfg.Peering.Peers = append(cfg.Peering.Peers, info)
+		return nil
+	})
+	if result != 0 {
+		return result
+	}
+
+	activeNodesMutex.Lock()
+	defer activeNodesMutex.Unlock()
+	if nodeInfo, exists := activeNodes[path]; exists && nodeInfo.Node.Peering != nil {
+		nodeInfo.Node.Peering.AddPeer(info)
+	}
+
+	log.Printf("DEBUG: Added peering with %s\n", info.ID)
+	return C.int(0)
+}
+
+// PeeringList returns the repo's peering list as a JSON array of
+// {"ID": ..., "Addrs": [...]} objects
+//
+//export PeeringList
+func PeeringList(repoPath *C.char) *C.char {
+	path := C.GoString(repoPath)
+
+	cfg, err := readRepoConfig(path)
+	if err != nil {
+		logError("reading config: %s", err)
+		return nil
+	}
+
+	peers := cfg.Peering.Peers
+	if peers == nil {
+		peers = []peer.AddrInfo{}
+	}
+
+	// Convert to JSON
+	peersJSON, err := json.Marshal(peers)
+	if err != nil {
+		logError("marshaling peering list to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(peersJSON))
+}
+
+// PeeringRm removes a peer from the repo's peering list. If a node is running
+// on the repo, it stops keeping the connection alive right away.
+// Returns -4 if the peer isn't in the peering list.
+//
+//export PeeringRm
+func PeeringRm(repoPath, peerID *C.char) C.int {
+	path := C.GoString(repoPath)
+	idStr := C.GoString(peerID)
+
+	var id peer.ID
+	result := updateRepoConfig(path, func(cfg *config.Config) error {
+		var err error
+		id, err = peer.Decode(idStr)
+		if err != nil {
+			return fmt.Errorf("decoding peer ID: %w", err)
+		}
+		for i, existing := range cfg.Peering.Peers {
+			if existing.ID == id {
+				cfg.Peering.Peers = append(cfg.Peering.Peers[:i], cfg.Peering.Peers[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("peer %s is not in the peering list", id)
+	})
+	if result != 0 {
+		return result
+	}
+
+	activeNodesMutex.Lock()
+	defer activeNodesMutex.Unlock()
+	if nodeInfo, exists := activeNodes[path]; exists && nodeInfo.Node.Peering != nil {
+		nodeInfo.Node.Peering.RemovePeer(id)
+	}
+
+	log.Printf("DEBUG: Removed peering with %s\n", id)
+	return C.int(0)
+}
@@ -1,6 +1,7 @@
 package main
 
 // #include <stdlib.h>
+// #include <stdbool.h>
 import "C"
 
 import (
@@ -8,9 +9,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/ipfs/kubo/core"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
 	routing "github.com/libp2p/go-libp2p/core/routing"
+	"github.com/libp2p/go-libp2p/p2p/protocol/ping"
+	ma "github.com/multiformats/go-multiaddr"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -27,7 +35,7 @@ func ConnectToPeer(repoPath, peerAddr *C.char) C.int {
 	// Get or create a node from the registry
 	api, _, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR: Error acquiring node: %s\n", err)
+		logError("acquiring node: %s", err)
 		return C.int(-1)
 	}
 	// Release the node when done (decreases reference count)
@@ -36,20 +44,280 @@ func ConnectToPeer(repoPath, peerAddr *C.char) C.int {
 	// Parse the peer address
 	peerInfo, err := peer.AddrInfoFromString(addr)
 	if err != nil {
-		log.Printf("ERROR: Error parsing peer address: %s\n", err)
+		logError("parsing peer address: %s", err)
 		return C.int(-2)
 	}
 
 	// Connect to the peer
 	err = api.Swarm().Connect(ctx, *peerInfo)
 	if err != nil {
-		log.Printf("ERROR: Error connecting to peer %s: %s\n", peerAddr, err)
+		logError("connecting to peer %s: %s", addr, err)
 		return C.int(-3)
 	}
 
 	return C.int(0) // Success
 }
 
+// ConnectToPeerVia connects to a peer like ConnectToPeer, but only over the
+// given transport: "relay" dials only relayed (/p2p-circuit) addresses, for
+// peers behind NATs that can't be dialled directly, and "direct" dials only
+// direct addresses, avoiding a relay's overhead and limits even if the peer
+// is already connected through one. An empty transport dials as
+// ConnectToPeer does. peerAddr is a multiaddr ending in /p2p/<peer ID> or a
+// bare peer ID, whose known addresses are used or else looked up.
+// During a relayed dial, the node dials none of the peer's direct addresses,
+// also for other dials to the peer, such as the DHT's; the peerstore keeps
+// them.
+// Returns 0 once connected over the transport, -2 for an invalid address or
+// transport, -3 if dialling failed, -4 if the peer has no addresses for the
+// transport and -5 for a relayed dial to a peer that is already connected
+// directly.
+//
+//export ConnectToPeerVia
+func ConnectToPeerVia(repoPath, peerAddr, transport *C.char) C.int {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	path := C.GoString(repoPath)
+	addr := C.GoString(peerAddr)
+	via := C.GoString(transport)
+
+	if via != "" && via != "relay" && via != "direct" {
+		logError("unknown transport %q, expected \"relay\" or \"direct\"", via)
+		return C.int(-2)
+	}
+	// Parse the peer address, which may be a bare peer ID
+	info := &peer.AddrInfo{}
+	if id, err := peer.Decode(addr); err == nil {
+		info.ID = id
+	} else if info, err = peer.AddrInfoFromString(addr); err != nil {
+		logError("parsing peer address: %s", err)
+		return C.int(-2)
+	}
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if !node.IsOnline || node.PeerHost == nil {
+		logError("node for repo %s is offline", path)
+		return C.int(-3)
+	}
+	host := node.PeerHost
+	relayed, direct := peerConnectionKinds(host.Network().ConnsToPeer(info.ID))
+
+	switch {
+	case via == "relay" && relayed, via == "direct" && direct:
+		return C.int(0)
+	case via == "relay" && direct:
+		logError("peer %s is already connected directly", info.ID)
+		return C.int(-5)
+	}
+
+	addrs := info.Addrs
+	if len(addrs) == 0 {
+		addrs = host.Peerstore().Addrs(info.ID)
+	}
+	if len(addrs) == 0 {
+		found, err := findPeerAddrInfo(ctx, node, info.ID, 30)
+		if err != nil {
+			logError("finding peer %s: %s", info.ID, err)
+			return C.int(-4)
+		}
+		addrs = found.Addrs
+	}
+	if via != "" {
+		addrs = filterRelayAddrs(addrs, via == "relay")
+	}
+	if len(addrs) == 0 {
+		logError("peer %s has no addresses for transport %q", info.ID, via)
+		return C.int(-4)
+	}
+
+	switch via {
+	case "relay":
+		// Dialling uses every address in the peerstore, so the peer gate
+		// filters out the direct ones until the dial is done
+		defer peerGateFor(path).restrictToRelays(info.ID)()
+	case "direct":
+		// Makes the host dial even if connected through a relay, and skips
+		// relayed addresses
+		ctx = network.WithForceDirectDial(ctx, "direct dial requested")
+	}
+
+	log.Printf("DEBUG: Connecting to peer %s (transport %q)\n", info.ID, via)
+	if err := host.Connect(ctx, peer.AddrInfo{ID: info.ID, Addrs: addrs}); err != nil {
+		logError("connecting to peer %s: %s", info.ID, err)
+		return C.int(-3)
+	}
+	return C.int(0)
+}
+
+// ConnectionInfo describes the connection ConnectAndInfo established.
+// Transport is one of the transports of PeerConnection. LatencyMs is the
+// round-trip time of a ping over the connection, or omitted if the peer
+// didn't answer it; ConnectMs is how long connecting took.
+type ConnectionInfo struct {
+	Peer      string   `json:"peer"`
+	Addr      string   `json:"addr"`
+	Transport string   `json:"transport"`
+	Direction string   `json:"direction"`
+	Relayed   bool     `json:"relayed"`
+	LatencyMs *float64 `json:"latencyMs,omitempty"`
+	ConnectMs float64  `json:"connectMs"`
+}
+
+// ConnectAndInfo connects to a peer like ConnectToPeer and describes the
+// connection: the multiaddr actually used, its transport, whether it goes
+// through a relay, and its latency, measured with a ping. A connection that
+// "succeeds" through a slow relay can so be told apart from a direct one.
+// peerAddr is a multiaddr ending in /p2p/<peer ID> or a bare peer ID, whose
+// known addresses are used or else looked up. timeoutSeconds bounds the
+// whole call; 0 or less means a minute. If the peer was already connected,
+// its existing connection is described, preferring direct connections.
+// Returns a ConnectionInfo JSON object, or NULL if the address is invalid,
+// the node is offline or the peer can't be reached.
+//
+//export ConnectAndInfo
+func ConnectAndInfo(repoPath, peerAddr *C.char, timeoutSeconds C.int) *C.char {
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	path := C.GoString(repoPath)
+	addr := C.GoString(peerAddr)
+
+	// Parse the peer address, which may be a bare peer ID
+	info := &peer.AddrInfo{}
+	if id, err := peer.Decode(addr); err == nil {
+		info.ID = id
+	} else if info, err = peer.AddrInfoFromString(addr); err != nil {
+		logError("parsing peer address: %s", err)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("node for repo %s is offline", path)
+		return nil
+	}
+	host := node.PeerHost
+
+	if len(info.Addrs) == 0 && len(host.Peerstore().Addrs(info.ID)) == 0 {
+		found, err := findPeerAddrInfo(ctx, node, info.ID, int(timeout/time.Second))
+		if err != nil {
+			logError("finding peer %s: %s", info.ID, err)
+			return nil
+		}
+		info.Addrs = found.Addrs
+	}
+
+	log.Printf("DEBUG: Connecting to peer %s\n", info.ID)
+	start := time.Now()
+	if err := host.Connect(ctx, *info); err != nil {
+		logError("connecting to peer %s: %s", info.ID, err)
+		return nil
+	}
+	connectTime := time.Since(start)
+
+	result, err := describeConnection(ctx, host, info.ID)
+	if err != nil {
+		logError("%s", err)
+		return nil
+	}
+	result.ConnectMs = float64(connectTime) / float64(time.Millisecond)
+
+	// Convert to JSON
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logError("marshaling connection info to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(resultJSON))
+}
+
+// describeConnection describes the host's connection to a connected peer,
+// pinging it over the connection. Of several connections, a direct one is
+// described, as libp2p prefers those for new streams.
+func describeConnection(ctx context.Context, h host.Host, pid peer.ID) (ConnectionInfo, error) {
+	conns := h.Network().ConnsToPeer(pid)
+	if len(conns) == 0 {
+		return ConnectionInfo{}, fmt.Errorf("peer %s is not connected", pid)
+	}
+	conn := conns[0]
+	for _, c := range conns {
+		if !isRelayAddr(c.RemoteMultiaddr()) {
+			conn = c
+			break
+		}
+	}
+
+	info := ConnectionInfo{
+		Peer:      pid.String(),
+		Addr:      conn.RemoteMultiaddr().String(),
+		Transport: addrTransport(conn.RemoteMultiaddr()),
+		Direction: connDirection(conn.Stat().Direction),
+		Relayed:   isRelayAddr(conn.RemoteMultiaddr()),
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	if res, ok := <-ping.Ping(pingCtx, h, pid); ok && res.Error == nil {
+		latency := float64(res.RTT) / float64(time.Millisecond)
+		info.LatencyMs = &latency
+	} else {
+		log.Printf("DEBUG: Ping to %s failed: %v\n", pid, res.Error)
+	}
+	return info, nil
+}
+
+// isRelayAddr returns whether a multiaddr goes through a relay
+func isRelayAddr(addr ma.Multiaddr) bool {
+	_, err := addr.ValueForProtocol(ma.P_CIRCUIT)
+	return err == nil
+}
+
+// filterRelayAddrs returns the relayed addresses in addrs if relayed is set,
+// and the direct ones otherwise
+func filterRelayAddrs(addrs []ma.Multiaddr, relayed bool) []ma.Multiaddr {
+	filtered := make([]ma.Multiaddr, 0, len(addrs))
+	for _, addr := range addrs {
+		if isRelayAddr(addr) == relayed {
+			filtered = append(filtered, addr)
+		}
+	}
+	return filtered
+}
+
+// peerConnectionKinds returns whether any of conns are relayed and direct
+func peerConnectionKinds(conns []network.Conn) (relayed, direct bool) {
+	for _, conn := range conns {
+		if isRelayAddr(conn.RemoteMultiaddr()) {
+			relayed = true
+		} else {
+			direct = true
+		}
+	}
+	return relayed, direct
+}
+
 // ListPeers connects to a peer
 //
 //export ListPeers
@@ -62,7 +330,7 @@ func ListPeers(repoPath *C.char) *C.char {
 	// Get or create a node from the registry
 	api, _, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR: Error acquiring node: %s\n", err)
+		logError("acquiring node: %s", err)
 		return C.CString("[]") // Return empty JSON array
 	}
 	// Release the node when done (decreases reference count)
@@ -71,7 +339,7 @@ func ListPeers(repoPath *C.char) *C.char {
 	// Connect to the peer
 	peers, err := api.Swarm().Peers(ctx)
 	if err != nil {
-		log.Printf("ERROR: Error listing peers: %s\n", err)
+		logError("listing peers: %s", err)
 		return C.CString("[]") // Return empty JSON array
 	}
 	peer_ids := make([]string, len(peers))
@@ -81,7 +349,7 @@ func ListPeers(repoPath *C.char) *C.char {
 	// Convert to JSON
 	peersJSON, err := json.Marshal(peer_ids)
 	if err != nil {
-		log.Printf("Error marshaling peers to JSON: %s\n", err)
+		logError("marshaling peers to JSON: %s", err)
 		return C.CString("[]") // Return empty JSON array
 	}
 
@@ -100,7 +368,7 @@ func ListPeersIDs(repoPath *C.char) *C.char {
 	// Get or create a node from the registry
 	api, _, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR: Error acquiring node: %s\n", err)
+		logError("acquiring node: %s", err)
 		return C.CString("[]") // Return empty JSON array
 	}
 	// Release the node when done (decreases reference count)
@@ -109,7 +377,7 @@ func ListPeersIDs(repoPath *C.char) *C.char {
 	// Connect to the peer
 	peers, err := api.Swarm().Peers(ctx)
 	if err != nil {
-		log.Printf("ERROR: Error listing peer IDs: %s\n", err)
+		logError("listing peer IDs: %s", err)
 		return C.CString("[]") // Return empty JSON array
 	}
 	peer_ids := make([]string, len(peers))
@@ -119,13 +387,404 @@ func ListPeersIDs(repoPath *C.char) *C.char {
 	// Convert to JSON
 	peersJSON, err := json.Marshal(peer_ids)
 	if err != nil {
-		log.Printf("Error marshaling peers to JSON: %s\n", err)
+		logError("marshaling peers to JSON: %s", err)
+		return C.CString("[]") // Return empty JSON array
+	}
+
+	return C.CString(string(peersJSON))
+
+}
+
+// PeerConnection describes a connection to a peer. Direction is "inbound"
+// or "outbound" and Transport one of the transports accepted by
+// ListPeersFiltered. A peer can have several connections.
+type PeerConnection struct {
+	Peer      string `json:"peer"`
+	Addr      string `json:"addr"`
+	Direction string `json:"direction"`
+	Transport string `json:"transport"`
+}
+
+// peerTransports are the transports connections are classified as
+var peerTransports = map[string]bool{
+	"relay": true, "webtransport": true, "webrtc": true, "quic": true,
+	"websocket": true, "tcp": true, "other": true,
+}
+
+// ListPeersFiltered returns the node's connections as a JSON array of
+// PeerConnection, optionally only those in one direction ("inbound" or
+// "outbound") and over one transport ("tcp", "quic", "websocket",
+// "webtransport", "webrtc", "relay" or "other"), e.g. to see how many
+// connections are relayed versus direct. Empty filters match everything.
+// Returns NULL for an unknown filter value or an offline node.
+//
+//export ListPeersFiltered
+func ListPeersFiltered(repoPath, direction, transport *C.char) *C.char {
+	path := C.GoString(repoPath)
+	dirFilter := C.GoString(direction)
+	transportFilter := C.GoString(transport)
+
+	if dirFilter != "" && dirFilter != "inbound" && dirFilter != "outbound" {
+		logError("unknown connection direction %q", dirFilter)
+		return nil
+	}
+	if transportFilter != "" && !peerTransports[transportFilter] {
+		logError("unknown transport %q", transportFilter)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("node for repo %s is offline", path)
+		return nil
+	}
+
+	conns := []PeerConnection{}
+	for _, conn := range node.PeerHost.Network().Conns() {
+		info := PeerConnection{
+			Peer:      conn.RemotePeer().String(),
+			Addr:      conn.RemoteMultiaddr().String(),
+			Direction: connDirection(conn.Stat().Direction),
+			Transport: addrTransport(conn.RemoteMultiaddr()),
+		}
+		if (dirFilter == "" || info.Direction == dirFilter) &&
+			(transportFilter == "" || info.Transport == transportFilter) {
+			conns = append(conns, info)
+		}
+	}
+
+	// Convert to JSON
+	connsJSON, err := json.Marshal(conns)
+	if err != nil {
+		logError("marshaling connections to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(connsJSON))
+}
+
+// connDirection names the direction of a connection
+func connDirection(dir network.Direction) string {
+	switch dir {
+	case network.DirInbound:
+		return "inbound"
+	case network.DirOutbound:
+		return "outbound"
+	}
+	return "unknown"
+}
+
+// addrTransport classifies the transport of a connection by its remote
+// multiaddr. Transports layered on others, like WebTransport on QUIC, are
+// named after the outermost one.
+func addrTransport(addr ma.Multiaddr) string {
+	has := func(code int) bool {
+		_, err := addr.ValueForProtocol(code)
+		return err == nil
+	}
+	switch {
+	case isRelayAddr(addr):
+		return "relay"
+	case has(ma.P_WEBTRANSPORT):
+		return "webtransport"
+	case has(ma.P_WEBRTC_DIRECT):
+		return "webrtc"
+	case has(ma.P_QUIC) || has(ma.P_QUIC_V1):
+		return "quic"
+	case has(ma.P_WS) || has(ma.P_WSS):
+		return "websocket"
+	case has(ma.P_TCP):
+		return "tcp"
+	}
+	return "other"
+}
+
+// PeersSupportingProtocol returns the IDs of connected peers that advertise
+// support for a protocol, as a JSON array. Protocol names without a leading
+// "/" are treated as P2PListen protocols and get the "/x/" prefix, so apps can
+// find the peers that serve their custom protocol before dialing.
+// Support is known from the identify exchange done when connecting.
+//
+//export PeersSupportingProtocol
+func PeersSupportingProtocol(repoPath, protocolID *C.char) *C.char {
+	path := C.GoString(repoPath)
+	proto := C.GoString(protocolID)
+
+	if !strings.HasPrefix(proto, "/") {
+		proto = "/x/" + proto
+	}
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.CString("[]") // Return empty JSON array
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("Node for repo %s is offline", path)
+		return C.CString("[]") // Return empty JSON array
+	}
+
+	peerIDs := []string{}
+	for _, p := range node.PeerHost.Network().Peers() {
+		supported, err := node.PeerHost.Peerstore().SupportsProtocols(p, protocol.ID(proto))
+		if err != nil {
+			log.Printf("DEBUG: Could not get protocols of peer %s: %s\n", p, err)
+			continue
+		}
+		if len(supported) > 0 {
+			peerIDs = append(peerIDs, p.String())
+		}
+	}
+
+	// Convert to JSON
+	peersJSON, err := json.Marshal(peerIDs)
+	if err != nil {
+		logError("marshaling peers to JSON: %s", err)
 		return C.CString("[]") // Return empty JSON array
 	}
 
 	return C.CString(string(peersJSON))
+}
+
+// Reachability returns whether the node is reachable from the public
+// internet as determined by AutoNAT: "public", "private" (behind NAT or a
+// firewall, so relays are needed) or "unknown" while AutoNAT hasn't reached
+// a conclusion yet, which takes a few minutes after startup.
+//
+//export Reachability
+func Reachability(repoPath *C.char) *C.char {
+	path := C.GoString(repoPath)
 
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("Node for repo %s is offline", path)
+		return nil
+	}
+
+	// The reachability event is stateful, so a new subscription receives
+	// the latest one right away if AutoNAT has emitted any
+	sub, err := node.PeerHost.EventBus().Subscribe(new(event.EvtLocalReachabilityChanged))
+	if err != nil {
+		logError("subscribing to reachability events: %s", err)
+		return nil
+	}
+	defer sub.Close()
+
+	reachability := network.ReachabilityUnknown
+	select {
+	case evt := <-sub.Out():
+		reachability = evt.(event.EvtLocalReachabilityChanged).Reachability
+	default:
+	}
+
+	return C.CString(reachabilityName(reachability))
+}
+
+// reachabilityName returns "public", "private" or "unknown"
+func reachabilityName(reachability network.Reachability) string {
+	switch reachability {
+	case network.ReachabilityPublic:
+		return "public"
+	case network.ReachabilityPrivate:
+		return "private"
+	default:
+		return "unknown"
+	}
+}
+
+// defaultProtectTag is used by ProtectPeer and UnprotectPeer when no tag is given
+const defaultProtectTag = "libkubo"
+
+// ProtectPeer protects the connection to a peer from being closed when the
+// connection manager trims connections down to its low-water mark, e.g. for
+// a pinning service or a known collaborator. Protections are kept per tag,
+// so different parts of an app can protect the same peer independently; an
+// empty tag uses a default. The protection lasts until UnprotectPeer or
+// until the node closes, and doesn't open a connection by itself.
+// Returns -2 for an invalid peer ID and -3 if the node is offline.
+//
+//export ProtectPeer
+func ProtectPeer(repoPath, peerID, tag *C.char) C.int {
+	return setPeerProtection(C.GoString(repoPath), C.GoString(peerID), C.GoString(tag), true)
 }
+
+// UnprotectPeer removes a protection added by ProtectPeer with the same tag.
+// Returns 1 if the peer is still protected under another tag, otherwise 0.
+//
+//export UnprotectPeer
+func UnprotectPeer(repoPath, peerID, tag *C.char) C.int {
+	return setPeerProtection(C.GoString(repoPath), C.GoString(peerID), C.GoString(tag), false)
+}
+
+// setPeerProtection protects or unprotects the connection to a peer
+func setPeerProtection(path, idStr, tag string, protect bool) C.int {
+	if tag == "" {
+		tag = defaultProtectTag
+	}
+
+	// Parse the peer ID
+	pid, err := peer.Decode(idStr)
+	if err != nil {
+		logError("decoding peer ID: %s", err)
+		return C.int(-2)
+	}
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("Node for repo %s is offline", path)
+		return C.int(-3)
+	}
+
+	connManager := node.PeerHost.ConnManager()
+	if protect {
+		connManager.Protect(pid, tag)
+		return C.int(0)
+	}
+	if connManager.Unprotect(pid, tag) {
+		return C.int(1)
+	}
+	return C.int(0)
+}
+
+// pingTimeout is how long PingPeer waits for a single ping's response, and
+// for finding and connecting to the peer
+const pingTimeout = 10 * time.Second
+
+// PingResult holds the outcome of PingPeer. Round-trip times are given in
+// milliseconds; Lost counts pings that got no response.
+type PingResult struct {
+	PeerID     string    `json:"peerID"`
+	RTTs       []float64 `json:"rtts"`
+	AverageRTT float64   `json:"averageRtt"`
+	Lost       int       `json:"lost"`
+}
+
+// PingPeer measures the round-trip time to a peer with count pings over the
+// libp2p ping protocol, connecting to the peer first if needed. This
+// measures the quality of the connection, e.g. to choose the closest of
+// several peers. Returns a PingResult JSON object, or NULL if the peer can't
+// be reached at all.
+//
+//export PingPeer
+func PingPeer(repoPath, peerID *C.char, count C.int) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	idStr := C.GoString(peerID)
+	pings := int(count)
+	if pings <= 0 {
+		pings = 1
+	}
+
+	// Parse the peer ID
+	pid, err := peer.Decode(idStr)
+	if err != nil {
+		logError("decoding peer ID: %s", err)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("Node for repo %s is offline", path)
+		return nil
+	}
+	if pid == node.Identity {
+		logError("Cannot ping own peer ID")
+		return nil
+	}
+
+	if node.PeerHost.Network().Connectedness(pid) != network.Connected {
+		addrInfo, err := findPeerAddrInfo(ctx, node, pid, int(pingTimeout/time.Second))
+		if err != nil {
+			logError("finding peer: %s", err)
+			return nil
+		}
+		connectCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+		err = node.PeerHost.Connect(connectCtx, addrInfo)
+		cancel()
+		if err != nil {
+			logError("connecting to peer: %s", err)
+			return nil
+		}
+	}
+
+	pingCtx, cancel := context.WithCancel(ctx)
+	// Stops the pinging once enough results are in
+	defer cancel()
+	results := ping.Ping(pingCtx, node.PeerHost, pid)
+
+	result := PingResult{PeerID: pid.String(), RTTs: []float64{}}
+	var total time.Duration
+	for len(result.RTTs) < pings {
+		var res ping.Result
+		var ok bool
+		select {
+		case res, ok = <-results:
+		case <-time.After(pingTimeout):
+			res.Error = fmt.Errorf("timed out")
+		}
+		if !ok && res.Error == nil {
+			res.Error = fmt.Errorf("ping stream closed")
+		}
+		if res.Error != nil {
+			// Pinging stops at the first error
+			log.Printf("DEBUG: Ping to %s failed: %s\n", pid, res.Error)
+			result.Lost = pings - len(result.RTTs)
+			break
+		}
+		total += res.RTT
+		result.RTTs = append(result.RTTs, float64(res.RTT)/float64(time.Millisecond))
+	}
+	if len(result.RTTs) > 0 {
+		result.AverageRTT = float64(total) / float64(len(result.RTTs)) / float64(time.Millisecond)
+	}
+
+	// Convert to JSON
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logError("marshaling ping result to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(resultJSON))
+}
+
 func SearchForPeer(ctx context.Context, node *core.IpfsNode, pid peer.ID, timeout int) ([]*peer.AddrInfo, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
 	defer cancel()
@@ -186,7 +845,7 @@ func FindPeer(repoPath, peerAddr *C.char, timeOut C.int) *C.char {
 	// Get or create a node from the registry
 	_, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("ERROR: Error acquiring node: %s\n", err)
+		logError("acquiring node: %s", err)
 		return C.CString("[]") // Return empty JSON array
 	}
 	// Release the node when done (decreases reference count)
@@ -198,29 +857,132 @@ func FindPeer(repoPath, peerAddr *C.char, timeOut C.int) *C.char {
 		return C.CString("[]") // Return empty JSON array
 	}
 	// Connect to the peer
+	multi_addresses, err := findPeerAddrInfo(ctx, node, pid, timeout)
+	if err != nil {
+		logError("finding peer: %s", err)
+		return C.CString("[]") // Return empty JSON array
+	}
+
+	// Convert to JSON
+	multi_addressesJSON, err := json.Marshal(multi_addresses.Addrs)
+	if err != nil {
+		logError("marshaling multi_addresses to JSON: %s", err)
+		return nil
+	}
+	// log.Printf( "Got next message! %s\n", messageJSON)
+
+	return C.CString(string(multi_addressesJSON))
+}
+
+// findPeerAddrInfo looks up the addresses of a peer, searching the DHT for up
+// to timeout seconds if the routing system doesn't know them right away
+func findPeerAddrInfo(ctx context.Context, node *core.IpfsNode, pid peer.ID, timeout int) (peer.AddrInfo, error) {
 	multi_addresses, err := node.Routing.FindPeer(ctx, pid)
 	if err != nil || len(multi_addresses.Addrs) == 0 {
 		SearchForPeer(ctx, node, pid, timeout)
 		multi_addresses2, err2 := node.Routing.FindPeer(ctx, pid)
 		if err2 != nil {
-			log.Printf("ERROR: Error finding peer: %s\n", err)
-			return C.CString("[]") // Return empty JSON array
+			if err == nil {
+				err = err2
+			}
+			return peer.AddrInfo{}, err
 		}
 		multi_addresses = multi_addresses2
-	}else{
+	} else {
 		log.Printf("DEBUG: finding peer: found peer immediately\n")
-		
 	}
-	
-	
+	return multi_addresses, nil
+}
+
+// PeerInfo describes a peer found by FindPeerInfo. AgentVersion and
+// Protocols are only known once the peer has been connected to.
+type PeerInfo struct {
+	ID           string   `json:"id"`
+	Addrs        []string `json:"addrs"`
+	AgentVersion string   `json:"agentVersion,omitempty"`
+	Protocols    []string `json:"protocols"`
+	Connected    bool     `json:"connected"`
+}
+
+// FindPeerInfo looks up a peer like FindPeer, but returns a PeerInfo JSON
+// object that also includes the peer's agent version and supported
+// protocols, which help decide how to interact with it. These come from the
+// identify exchange, so with identify set the peer is connected to (waiting
+// for identify to complete) if it isn't already; otherwise they are only
+// filled in from earlier connections.
+//
+//export FindPeerInfo
+func FindPeerInfo(repoPath, peerID *C.char, timeOut C.int, identify C.bool) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	idStr := C.GoString(peerID)
+	timeout := int(timeOut)
+
+	// Parse the peer ID
+	pid, err := peer.Decode(idStr)
+	if err != nil {
+		logError("decoding peer ID: %s", err)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("Node for repo %s is offline", path)
+		return nil
+	}
+
+	addrInfo, err := findPeerAddrInfo(ctx, node, pid, timeout)
+	if err != nil {
+		logError("finding peer: %s", err)
+		return nil
+	}
+
+	connected := node.PeerHost.Network().Connectedness(pid) == network.Connected
+	if bool(identify) && !connected {
+		connectCtx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+		// Connecting completes the identify exchange before returning
+		if err := node.PeerHost.Connect(connectCtx, addrInfo); err != nil {
+			log.Printf("DEBUG: Could not connect to peer %s: %s\n", pid, err)
+		} else {
+			connected = true
+		}
+		cancel()
+	}
+
+	info := PeerInfo{
+		ID:        pid.String(),
+		Addrs:     []string{},
+		Protocols: []string{},
+		Connected: connected,
+	}
+	for _, addr := range addrInfo.Addrs {
+		info.Addrs = append(info.Addrs, addr.String())
+	}
+	peerstore := node.PeerHost.Peerstore()
+	if agent, err := peerstore.Get(pid, "AgentVersion"); err == nil {
+		info.AgentVersion, _ = agent.(string)
+	}
+	if protocols, err := peerstore.GetProtocols(pid); err == nil {
+		for _, proto := range protocols {
+			info.Protocols = append(info.Protocols, string(proto))
+		}
+	}
 
 	// Convert to JSON
-	multi_addressesJSON, err := json.Marshal(multi_addresses.Addrs)
+	infoJSON, err := json.Marshal(info)
 	if err != nil {
-		log.Printf("Error marshaling multi_addresses to JSON: %s\n", err)
+		logError("marshaling peer info to JSON: %s", err)
 		return nil
 	}
-	// log.Printf( "Got next message! %s\n", messageJSON)
 
-	return C.CString(string(multi_addressesJSON))
+	return C.CString(string(infoJSON))
 }
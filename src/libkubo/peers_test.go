@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestAddrTransport(t *testing.T) {
+	cases := map[string]string{
+		"/ip4/1.2.3.4/tcp/4001":                      "tcp",
+		"/ip4/1.2.3.4/udp/4001/quic":                 "quic",
+		"/ip6/::1/udp/4001/quic-v1":                  "quic",
+		"/ip4/1.2.3.4/udp/4001/quic-v1/webtransport": "webtransport",
+		"/ip4/1.2.3.4/tcp/443/wss":                   "websocket",
+		"/ip4/1.2.3.4/udp/4001/webrtc-direct":        "webrtc",
+		"/ip4/1.2.3.4/tcp/4001/p2p/QmNnooDu7bfjPFoTZYxMNLWUQJyrVwtbZg5gBMjTezGAJN/p2p-circuit": "relay",
+		"/dns4/example.com": "other",
+	}
+	for addr, want := range cases {
+		if got := addrTransport(ma.StringCast(addr)); got != want {
+			t.Errorf("%s: transport = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestDescribeConnection(t *testing.T) {
+	ctx := context.Background()
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatalf("creating host: %s", err)
+	}
+	defer h.Close()
+	remote, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatalf("creating host: %s", err)
+	}
+	defer remote.Close()
+
+	if _, err := describeConnection(ctx, h, remote.ID()); err == nil {
+		t.Fatal("expected an error for an unconnected peer")
+	}
+	if err := h.Connect(ctx, peer.AddrInfo{ID: remote.ID(), Addrs: remote.Addrs()}); err != nil {
+		t.Fatalf("connecting: %s", err)
+	}
+
+	info, err := describeConnection(ctx, h, remote.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Transport != "tcp" || info.Relayed || info.Direction != "outbound" {
+		t.Fatalf("unexpected connection info %+v", info)
+	}
+	if info.LatencyMs == nil {
+		t.Fatal("no latency measured")
+	}
+}
+
+func TestNodeEventFor(t *testing.T) {
+	id, err := peer.Decode("12D3KooWD3eckifWpRn9wQpMG9R9hX3sD158z7EqHWmweQAJU5SA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := ma.StringCast("/ip4/127.0.0.1/tcp/4001")
+	added := ma.StringCast("/ip4/192.168.1.2/tcp/4001")
+	removed := ma.StringCast("/ip4/10.0.0.2/tcp/4001")
+
+	cases := []struct {
+		evt  interface{}
+		want *NodeEvent
+	}{
+		{event.EvtLocalReachabilityChanged{Reachability: network.ReachabilityPrivate},
+			&NodeEvent{Type: "reachability", Reachability: "private"}},
+		{event.EvtLocalAddressesUpdated{
+			Diffs: true,
+			Current: []event.UpdatedAddress{
+				{Address: kept, Action: event.Maintained},
+				{Address: added, Action: event.Added},
+			},
+			Removed: []event.UpdatedAddress{{Address: removed, Action: event.Removed}},
+		}, &NodeEvent{
+			Type:    "addresses",
+			Addrs:   []string{kept.String(), added.String()},
+			Added:   []string{added.String()},
+			Removed: []string{removed.String()},
+		}},
+		{event.EvtLocalProtocolsUpdated{Added: []protocol.ID{"/app/1.0.0"}},
+			&NodeEvent{Type: "protocols", Added: []string{"/app/1.0.0"}}},
+		{event.EvtPeerConnectednessChanged{Peer: id, Connectedness: network.Connected},
+			&NodeEvent{Type: "peerConnected", Peer: id.String()}},
+		{event.EvtPeerConnectednessChanged{Peer: id, Connectedness: network.NotConnected},
+			&NodeEvent{Type: "peerDisconnected", Peer: id.String()}},
+		{event.EvtPeerConnectednessChanged{Peer: id, Connectedness: network.CanConnect}, nil},
+		{event.EvtNATDeviceTypeChanged{}, nil},
+	}
+	for _, c := range cases {
+		got, ok := nodeEventFor(c.evt)
+		if c.want == nil {
+			if ok {
+				t.Errorf("%T forwarded as %+v", c.evt, got)
+			}
+			continue
+		}
+		if !ok || !reflect.DeepEqual(got, *c.want) {
+			t.Errorf("%T: got %+v (%v), want %+v", c.evt, got, ok, *c.want)
+		}
+	}
+}
+
+func TestPeerGate(t *testing.T) {
+	ctx := context.Background()
+	repoPath := t.TempDir()
+	newHost := func(id peer.ID, ps peerstore.Peerstore, options ...libp2p.Option) (host.Host, error) {
+		return libp2p.New(options...)
+	}
+	h, err := gatedHostOption(repoPath, newHost)("", nil, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatalf("creating host: %s", err)
+	}
+	defer h.Close()
+	remote, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatalf("creating host: %s", err)
+	}
+	defer remote.Close()
+	remoteInfo := peer.AddrInfo{ID: remote.ID(), Addrs: remote.Addrs()}
+
+	gate := peerGateFor(repoPath)
+	gate.set("deny", map[peer.ID]bool{remote.ID(): true})
+	if err := h.Connect(ctx, remoteInfo); err == nil {
+		t.Fatal("connected to a denied peer")
+	}
+	if err := remote.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}); err == nil &&
+		h.Network().Connectedness(remote.ID()) == network.Connected {
+		t.Fatal("accepted a connection from a denied peer")
+	}
+
+	gate.set("allow", map[peer.ID]bool{remote.ID(): true})
+	if err := h.Connect(ctx, remoteInfo); err != nil {
+		t.Fatalf("connecting to an allowed peer: %s", err)
+	}
+	if gate.allows(h.ID()) {
+		t.Fatal("allowed an unlisted peer")
+	}
+
+	gate.set("", nil)
+	if !gate.allows(h.ID()) {
+		t.Fatal("removed gate still blocks peers")
+	}
+
+	// A relayed dial leaves the direct addresses in the peerstore
+	if err := h.Network().ClosePeer(remote.ID()); err != nil {
+		t.Fatal(err)
+	}
+	release := gate.restrictToRelays(remote.ID())
+	if err := h.Connect(ctx, peer.AddrInfo{ID: remote.ID()}); err == nil {
+		t.Fatal("dialled a direct address during a relayed dial")
+	}
+	if len(h.Peerstore().Addrs(remote.ID())) == 0 {
+		t.Fatal("relayed dial removed the direct addresses from the peerstore")
+	}
+	release()
+	if err := h.Connect(ctx, peer.AddrInfo{ID: remote.ID()}); err != nil {
+		t.Fatalf("connecting after a relayed dial: %s", err)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ipfs/kubo/config"
+	"github.com/ipfs/kubo/core"
+	"github.com/ipfs/kubo/core/node/helpers"
+	"github.com/ipfs/kubo/repo"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p-pubsub/timecache"
+	"github.com/libp2p/go-libp2p/core/discovery"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"go.uber.org/fx"
+)
+
+// peerScoringKey is the config key of the peer scoring toggle set with
+// SetPubsubPeerScoring. It isn't one of Kubo's settings, which Kubo leaves
+// in the config file untouched.
+const peerScoringKey = "Pubsub.PeerScoring"
+
+// peerScoreInspectInterval is how often the peer scores returned by
+// PubSubPeerScores are refreshed
+const peerScoreInspectInterval = 5 * time.Second
+
+// peerScoringMutex is held while a node is built: exclusively if it is built
+// with peer scoring, which is then signalled to the fx option registered in
+// init by scoredBuild, as Kubo has no option to configure its gossipsub router
+var (
+	peerScoringMutex sync.RWMutex
+	scoredBuild      bool
+)
+
+// Latest peer scores of the gossipsub routers built with peer scoring,
+// indexed by router
+var (
+	peerScoreTables      = make(map[*pubsub.PubSub]*peerScoreTable)
+	peerScoreTablesMutex sync.Mutex
+)
+
+// Peer scores are tracked from gossipsub's own score parameters. Without
+// topic parameters, a peer's score only drops for protocol violations and
+// for sharing its IP address with many other peers, so well-behaved peers
+// keep a score of 0.
+var (
+	peerScoreParams = &pubsub.PeerScoreParams{
+		AppSpecificScore:            func(peer.ID) float64 { return 0 },
+		IPColocationFactorWeight:    -10,
+		IPColocationFactorThreshold: 10,
+		BehaviourPenaltyWeight:      -10,
+		BehaviourPenaltyThreshold:   6,
+		BehaviourPenaltyDecay:       pubsub.ScoreParameterDecay(10 * time.Minute),
+		DecayInterval:               pubsub.DefaultDecayInterval,
+		DecayToZero:                 pubsub.DefaultDecayToZero,
+		RetainScore:                 10 * time.Minute,
+	}
+	peerScoreThresholds = &pubsub.PeerScoreThresholds{
+		GossipThreshold:             -500,
+		PublishThreshold:            -1000,
+		GraylistThreshold:           -2500,
+		AcceptPXThreshold:           10,
+		OpportunisticGraftThreshold: 3.5,
+	}
+)
+
+func init() {
+	core.RegisterFXOptionFunc(func(info core.FXNodeInfo) ([]fx.Option, error) {
+		if !scoredBuild {
+			return info.FXOptions, nil
+		}
+		return append(info.FXOptions, fx.Decorate(scoredGossipSub)), nil
+	})
+}
+
+// PeerScore is a peer's gossipsub score with the components it is made of
+type PeerScore struct {
+	Peer               string  `json:"peer"`
+	Score              float64 `json:"score"`
+	AppSpecificScore   float64 `json:"appSpecificScore"`
+	IPColocationFactor float64 `json:"ipColocationFactor"`
+	BehaviourPenalty   float64 `json:"behaviourPenalty"`
+}
+
+// peerScoreTable holds the latest score snapshots of a gossipsub router
+type peerScoreTable struct {
+	mutex     sync.Mutex
+	snapshots map[peer.ID]*pubsub.PeerScoreSnapshot
+}
+
+// update is the router's peer score inspector
+func (t *peerScoreTable) update(snapshots map[peer.ID]*pubsub.PeerScoreSnapshot) {
+	t.mutex.Lock()
+	t.snapshots = snapshots
+	t.mutex.Unlock()
+}
+
+// peerScoringEnabled reports whether peer scoring is turned on in the config
+// of r (see SetPubsubPeerScoring)
+func peerScoringEnabled(r repo.Repo) bool {
+	value, err := r.GetConfigKey(peerScoringKey)
+	enabled, _ := value.(bool)
+	return err == nil && enabled
+}
+
+// applyPeerScoring has the node built from the repo use peer scoring if it
+// is turned on for it, returning a function to call once the node is built.
+// Peer scoring only applies to online nodes using gossipsub.
+func applyPeerScoring(r repo.Repo, cfg *config.Config, online bool) func() {
+	scored := online && peerScoringEnabled(r)
+	if scored && cfg.Pubsub.Router == "floodsub" {
+		log.Printf("WARNING: Peer scoring is enabled but only applies to gossipsub, not floodsub\n")
+		scored = false
+	}
+
+	if !scored {
+		peerScoringMutex.RLock()
+		return peerScoringMutex.RUnlock
+	}
+	peerScoringMutex.Lock()
+	scoredBuild = true
+	return func() {
+		scoredBuild = false
+		peerScoringMutex.Unlock()
+	}
+}
+
+// scoredGossipSub builds the gossipsub router of a node in place of Kubo's,
+// with the same options plus peer scoring
+func scoredGossipSub(mctx helpers.MetricsCtx, lc fx.Lifecycle, cfg *config.Config, h host.Host, disc discovery.Discovery) (*pubsub.PubSub, error) {
+	var seenMessagesStrategy timecache.Strategy
+	switch strategy := cfg.Pubsub.SeenMessagesStrategy.WithDefault(config.DefaultSeenMessagesStrategy); strategy {
+	case config.LastSeenMessagesStrategy:
+		seenMessagesStrategy = timecache.Strategy_LastSeen
+	case config.FirstSeenMessagesStrategy:
+		seenMessagesStrategy = timecache.Strategy_FirstSeen
+	default:
+		return nil, fmt.Errorf("unsupported Pubsub.SeenMessagesStrategy %q", strategy)
+	}
+
+	table := &peerScoreTable{}
+	ps, err := pubsub.NewGossipSub(helpers.LifecycleCtx(mctx, lc), h,
+		pubsub.WithMessageSigning(!cfg.Pubsub.DisableSigning),
+		pubsub.WithSeenMessagesTTL(cfg.Pubsub.SeenMessagesTTL.WithDefault(pubsub.TimeCacheDuration)),
+		pubsub.WithSeenMessagesStrategy(seenMessagesStrategy),
+		pubsub.WithDiscovery(disc),
+		pubsub.WithFloodPublish(true),
+		pubsub.WithPeerScore(peerScoreParams, peerScoreThresholds),
+		pubsub.WithPeerScoreInspect(pubsub.ExtendedPeerScoreInspectFn(table.update), peerScoreInspectInterval),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	peerScoreTablesMutex.Lock()
+	peerScoreTables[ps] = table
+	peerScoreTablesMutex.Unlock()
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			peerScoreTablesMutex.Lock()
+			delete(peerScoreTables, ps)
+			peerScoreTablesMutex.Unlock()
+			return nil
+		},
+	})
+	return ps, nil
+}
+
+// topicPeerScores returns the scores of the peers in a topic, or of all
+// scored peers if topic is empty, lowest first. It returns false if the node
+// wasn't built with peer scoring.
+func topicPeerScores(node *core.IpfsNode, topic string) ([]PeerScore, bool) {
+	peerScoreTablesMutex.Lock()
+	table, ok := peerScoreTables[node.PubSub]
+	peerScoreTablesMutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	table.mutex.Lock()
+	snapshots := table.snapshots
+	table.mutex.Unlock()
+
+	var peers []peer.ID
+	if topic == "" {
+		for id := range snapshots {
+			peers = append(peers, id)
+		}
+	} else {
+		peers = node.PubSub.ListPeers(topic)
+	}
+
+	scores := []PeerScore{}
+	for _, id := range peers {
+		// Peers that joined since the scores were last refreshed have none yet
+		snapshot, ok := snapshots[id]
+		if !ok {
+			continue
+		}
+		scores = append(scores, PeerScore{
+			Peer:               id.String(),
+			Score:              snapshot.Score,
+			AppSpecificScore:   snapshot.AppSpecificScore,
+			IPColocationFactor: snapshot.IPColocationFactor,
+			BehaviourPenalty:   snapshot.BehaviourPenalty,
+		})
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].Score < scores[j].Score })
+	return scores, true
+}
+
+// PubSubPeerScores returns the gossipsub scores of the peers in a topic, or
+// of all scored peers if topic is empty, as a JSON array of PeerScore objects
+// sorted from the lowest score, so that the peers gossipsub penalizes come
+// first. Peers scoring below -500 get no gossip from the node, below -1000
+// none of its published messages and below -2500 are ignored altogether.
+// Scores are refreshed every 5 seconds. Returns NULL if the node couldn't be
+// acquired, has no pubsub or wasn't started with peer scoring (see
+// SetPubsubPeerScoring).
+//
+//export PubSubPeerScores
+func PubSubPeerScores(repoPath, topic *C.char) *C.char {
+	path := C.GoString(repoPath)
+	topicStr := C.GoString(topic)
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if !checkPubSubEnabled(path, node) {
+		return nil
+	}
+	scores, ok := topicPeerScores(node, topicStr)
+	if !ok {
+		logError("peer scoring not enabled: node for repo %s was started without it", path)
+		return nil
+	}
+
+	// Convert to JSON
+	scoresJSON, err := json.Marshal(scores)
+	if err != nil {
+		logError("marshaling peer scores to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(scoresJSON))
+}
@@ -0,0 +1,198 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// pinMetaPrefix is the datastore prefix under which the metadata of tracked
+// pins is stored, keyed by the pinned CID, as the pinner doesn't record when
+// content was pinned
+var pinMetaPrefix = datastore.NewKey("/libkubo/pinmeta")
+
+// pinMeta is the metadata stored for a pin made with PinCIDTracked
+type pinMeta struct {
+	PinnedAt int64  `json:"pinnedAt"`
+	Tag      string `json:"tag"`
+}
+
+// PinMetaInfo describes a pin with its metadata. PinnedAt is the Unix time in
+// seconds at which the CID was pinned with PinCIDTracked, or null for pins
+// made otherwise, and Tag the tag given then.
+type PinMetaInfo struct {
+	CID      string `json:"cid"`
+	PinnedAt *int64 `json:"pinnedAt"`
+	Tag      string `json:"tag"`
+}
+
+// PinCIDTracked pins a CID recursively like PinCID and records the time of
+// pinning and an app-supplied tag, which ListPinsWithMeta returns, e.g. for
+// evicting the least recently pinned content first. Pinning an already
+// pinned CID again updates its time and tag. The metadata is removed when
+// the CID is unpinned.
+// Returns the error codes of PinCID, and -4 if the metadata couldn't be
+// stored.
+//
+//export PinCIDTracked
+func PinCIDTracked(repoPath, cidStr, tag *C.char) C.int {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+	cid := C.GoString(cidStr)
+	pinTag := C.GoString(tag)
+
+	log.Printf("DEBUG: Pinning CID %s with tag %q using repo %s\n", cid, pinTag, path)
+
+	// Get or create a node from the registry
+	api, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return C.int(-2)
+	}
+
+	// Pin the CID
+	err = api.Pin().Add(ctx, ipath.IpfsPath(decodedCid), options.Pin.Recursive(true))
+	if err != nil {
+		logError("pinning CID: %s", err)
+		return C.int(-3)
+	}
+
+	meta := pinMeta{PinnedAt: time.Now().Unix(), Tag: pinTag}
+	if err := setPinMeta(ctx, node.Repo.Datastore(), decodedCid, meta); err != nil {
+		logError("storing pin metadata: %s", err)
+		return C.int(-4)
+	}
+
+	log.Printf("DEBUG: CID pinned successfully\n")
+	return C.int(0) // Success
+}
+
+// ListPinsWithMeta returns the recursively and directly pinned CIDs as a JSON
+// array of PinMetaInfo
+//
+//export ListPinsWithMeta
+func ListPinsWithMeta(repoPath *C.char) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+
+	log.Printf("DEBUG: Listing pins with metadata using repo %s\n", path)
+
+	// Get or create a node from the registry; listing pins needs no networking
+	api, node, err := acquireNode(path, false, nil)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	metas, err := pinMetas(ctx, node.Repo.Datastore())
+	if err != nil {
+		logError("reading pin metadata: %s", err)
+		return nil
+	}
+
+	// Indirect pins can't be tracked, and listing them walks every pinned DAG
+	pins := []PinMetaInfo{}
+	for _, pinType := range []options.PinLsOption{options.Pin.Ls.Recursive(), options.Pin.Ls.Direct()} {
+		pinCh, err := api.Pin().Ls(ctx, pinType)
+		if err != nil {
+			logError("listing pins: %s", err)
+			return nil
+		}
+		for pin := range pinCh {
+			if err := pin.Err(); err != nil {
+				logError("listing pins: %s", err)
+				return nil
+			}
+			info := PinMetaInfo{CID: pin.Path().Cid().String()}
+			if meta, tracked := metas[info.CID]; tracked {
+				pinnedAt := meta.PinnedAt
+				info.PinnedAt = &pinnedAt
+				info.Tag = meta.Tag
+			}
+			pins = append(pins, info)
+		}
+	}
+
+	// Convert to JSON
+	pinsJSON, err := json.Marshal(pins)
+	if err != nil {
+		logError("marshaling pins to JSON: %s", err)
+		return nil
+	}
+
+	log.Printf("DEBUG: Listed %d pins with metadata\n", len(pins))
+	return C.CString(string(pinsJSON))
+}
+
+// pinMetaKey returns the datastore key of the metadata of a pin
+func pinMetaKey(c cidlib.Cid) datastore.Key {
+	return pinMetaPrefix.ChildString(c.String())
+}
+
+// setPinMeta stores the metadata of a pin
+func setPinMeta(ctx context.Context, ds datastore.Datastore, c cidlib.Cid, meta pinMeta) error {
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ds.Put(ctx, pinMetaKey(c), value)
+}
+
+// forgetPin removes the name and metadata of an unpinned CID, if it has any
+func forgetPin(ctx context.Context, ds datastore.Datastore, c cidlib.Cid) error {
+	if err := removePinName(ctx, ds, c); err != nil {
+		return err
+	}
+	err := ds.Delete(ctx, pinMetaKey(c))
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// pinMetas returns the metadata of all tracked pins, by CID string
+func pinMetas(ctx context.Context, ds datastore.Datastore) (map[string]pinMeta, error) {
+	results, err := ds.Query(ctx, query.Query{Prefix: pinMetaPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	metas := make(map[string]pinMeta)
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		var meta pinMeta
+		if err := json.Unmarshal(result.Value, &meta); err != nil {
+			return nil, err
+		}
+		cid := strings.TrimPrefix(result.Key, pinMetaPrefix.String()+"/")
+		metas[cid] = meta
+	}
+	return metas, nil
+}
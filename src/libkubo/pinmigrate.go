@@ -0,0 +1,209 @@
+package main
+
+// #include <stdlib.h>
+// #include <stdbool.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"path/filepath"
+
+	"github.com/ipfs/boxo/blockservice"
+	blockstore "github.com/ipfs/boxo/blockstore"
+	"github.com/ipfs/boxo/coreiface/options"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	offline "github.com/ipfs/boxo/exchange/offline"
+	dag "github.com/ipfs/boxo/ipld/merkledag"
+	pin "github.com/ipfs/boxo/pinning/pinner"
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+)
+
+// PinMigrationFailure is a pin MigratePins couldn't migrate
+type PinMigrationFailure struct {
+	CID   string `json:"cid"`
+	Error string `json:"error"`
+}
+
+// PinMigrationResult is the outcome of MigratePins
+type PinMigrationResult struct {
+	Migrated []string              `json:"migrated"`
+	Failed   []PinMigrationFailure `json:"failed"`
+}
+
+// MigratePins copies every recursively or directly pinned CID of the source
+// repo, with all the blocks it pins, to the destination repo and pins it
+// there the same way, e.g. to merge repos or move to another datastore.
+// Pin names and tracking metadata are copied too. Nothing is fetched from
+// the network: pins whose blocks aren't all in the source repo fail. With
+// move, migrated pins are removed from the source; their blocks are freed
+// by the source's next garbage collection.
+// Returns a PinMigrationResult JSON object, or NULL if a repo couldn't be
+// opened or both paths are the same repo.
+//
+//export MigratePins
+func MigratePins(srcRepoPath, dstRepoPath *C.char, move C.bool) *C.char {
+	ctx := context.Background()
+
+	srcPath := C.GoString(srcRepoPath)
+	dstPath := C.GoString(dstRepoPath)
+	if absSrc, err := filepath.Abs(srcPath); err == nil {
+		if absDst, err := filepath.Abs(dstPath); err == nil && absSrc == absDst {
+			logError("source and destination are the same repo: %s", srcPath)
+			return nil
+		}
+	}
+
+	log.Printf("DEBUG: Migrating pins from %s to %s (move: %v)\n", srcPath, dstPath, bool(move))
+
+	// Get or create the nodes from the registry; migrating needs no networking
+	srcAPI, srcNode, err := acquireNode(srcPath, false, nil)
+	if err != nil {
+		logError("acquiring source node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(srcPath)
+	_, dstNode, err := acquireNode(dstPath, false, nil)
+	if err != nil {
+		logError("acquiring destination node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(dstPath)
+
+	result := PinMigrationResult{Migrated: []string{}, Failed: []PinMigrationFailure{}}
+	srcDs := srcNode.Repo.Datastore()
+	dstDs := dstNode.Repo.Datastore()
+
+	// Indirect pins are migrated with the recursive pins they belong to
+	for _, recursive := range []bool{true, false} {
+		pinType := options.Pin.Ls.Direct()
+		if recursive {
+			pinType = options.Pin.Ls.Recursive()
+		}
+		pinCh, err := srcAPI.Pin().Ls(ctx, pinType)
+		if err != nil {
+			logError("listing pins: %s", err)
+			return nil
+		}
+		var pins []cidlib.Cid
+		for pin := range pinCh {
+			if err := pin.Err(); err != nil {
+				logError("listing pins: %s", err)
+				return nil
+			}
+			pins = append(pins, pin.Path().Cid())
+		}
+
+		for _, c := range pins {
+			if err := migratePin(ctx, srcNode.Blockstore, dstNode.Blockstore, dstNode.Pinning, c, recursive); err != nil {
+				log.Printf("ERROR:  migrating pin %s: %s\n", c, err)
+				result.Failed = append(result.Failed, PinMigrationFailure{CID: c.String(), Error: err.Error()})
+				continue
+			}
+			if err := copyPinInfo(ctx, srcDs, dstDs, c); err != nil {
+				log.Printf("ERROR:  copying name and metadata of pin %s: %s\n", c, err)
+			}
+			result.Migrated = append(result.Migrated, c.String())
+
+			if !move {
+				continue
+			}
+			if err := srcAPI.Pin().Rm(ctx, ipath.IpfsPath(c), options.Pin.RmRecursive(recursive)); err != nil {
+				log.Printf("ERROR:  unpinning %s from source: %s\n", c, err)
+				continue
+			}
+			if err := forgetPin(ctx, srcDs, c); err != nil {
+				log.Printf("ERROR:  removing name and metadata of pin %s: %s\n", c, err)
+			}
+		}
+	}
+
+	log.Printf("DEBUG: Migrated %d pins, %d failed\n", len(result.Migrated), len(result.Failed))
+
+	// Convert to JSON
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logError("marshaling migration result to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(resultJSON))
+}
+
+// migratePin copies the blocks pinned by c, only c itself unless recursive,
+// from src to dst and then pins c with dst's pinner. Blocks missing from src
+// make it fail before anything is pinned.
+func migratePin(ctx context.Context, src, dst blockstore.GCBlockstore, pinner pin.Pinner, c cidlib.Cid, recursive bool) error {
+	// Keep the source's garbage collection from removing blocks being copied
+	// and the destination's from removing them before they're pinned
+	defer src.GCLock(ctx).Unlock(ctx)
+	defer dst.PinLock(ctx).Unlock(ctx)
+
+	if err := copyPinnedBlocks(ctx, src, dst, c, recursive); err != nil {
+		return err
+	}
+	dstDAG := dag.NewDAGService(blockservice.New(dst, offline.Exchange(dst)))
+	nd, err := dstDAG.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+	if err := pinner.Pin(ctx, nd, recursive); err != nil {
+		return err
+	}
+	return pinner.Flush(ctx)
+}
+
+// copyPinnedBlocks copies c and, if recursive, every block it links to,
+// from src to dst
+func copyPinnedBlocks(ctx context.Context, src, dst blockstore.Blockstore, c cidlib.Cid, recursive bool) error {
+	cids := []cidlib.Cid{c}
+	if recursive {
+		// Only look in the source's blockstore, never on the network
+		srcDAG := dag.NewDAGService(blockservice.New(src, offline.Exchange(src)))
+		visited := cidlib.NewSet()
+		if err := dag.Walk(ctx, dag.GetLinksWithDAG(srcDAG), c, visited.Visit); err != nil {
+			return err
+		}
+		cids = visited.Keys()
+	}
+
+	for _, k := range cids {
+		has, err := dst.Has(ctx, k)
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		block, err := src.Get(ctx, k)
+		if err != nil {
+			return err
+		}
+		if err := dst.Put(ctx, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyPinInfo copies the name and metadata of a pin, if it has any, from one
+// repo's datastore to another's
+func copyPinInfo(ctx context.Context, src, dst datastore.Datastore, c cidlib.Cid) error {
+	for _, key := range []datastore.Key{pinNameKey(c), pinMetaKey(c)} {
+		value, err := src.Get(ctx, key)
+		if err == datastore.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := dst.Put(ctx, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// pinNamesPrefix is the datastore prefix under which pin names are stored,
+// keyed by the pinned CID, as the pinner of this Kubo version can't name pins
+var pinNamesPrefix = datastore.NewKey("/libkubo/pinnames")
+
+// PinCIDNamed pins a CID recursively like PinCID and labels the pin with a
+// name, which ListPins returns alongside the CID. Pinning an already pinned
+// CID replaces its name, and an empty name removes it. The name is removed
+// when the CID is unpinned.
+// Returns the error codes of PinCID, and -4 if the name couldn't be stored.
+//
+//export PinCIDNamed
+func PinCIDNamed(repoPath, cidStr, name *C.char) C.int {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+	cid := C.GoString(cidStr)
+	pinName := C.GoString(name)
+
+	log.Printf("DEBUG: Pinning CID %s as %q using repo %s\n", cid, pinName, path)
+
+	// Get or create a node from the registry
+	api, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return C.int(-2)
+	}
+
+	// Pin the CID
+	err = api.Pin().Add(ctx, ipath.IpfsPath(decodedCid), options.Pin.Recursive(true))
+	if err != nil {
+		logError("pinning CID: %s", err)
+		return C.int(-3)
+	}
+
+	if err := setPinName(ctx, node.Repo.Datastore(), decodedCid, pinName); err != nil {
+		logError("storing pin name: %s", err)
+		return C.int(-4)
+	}
+
+	log.Printf("DEBUG: CID pinned successfully\n")
+	return C.int(0) // Success
+}
+
+// pinNameKey returns the datastore key of the name of a pin
+func pinNameKey(c cidlib.Cid) datastore.Key {
+	return pinNamesPrefix.ChildString(c.String())
+}
+
+// setPinName stores the name of a pin, removing it if name is empty
+func setPinName(ctx context.Context, ds datastore.Datastore, c cidlib.Cid, name string) error {
+	if name == "" {
+		return removePinName(ctx, ds, c)
+	}
+	return ds.Put(ctx, pinNameKey(c), []byte(name))
+}
+
+// removePinName removes the name of a pin, if it has one
+func removePinName(ctx context.Context, ds datastore.Datastore, c cidlib.Cid) error {
+	err := ds.Delete(ctx, pinNameKey(c))
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// pinNames returns the names of all named pins, by CID string
+func pinNames(ctx context.Context, ds datastore.Datastore) (map[string]string, error) {
+	results, err := ds.Query(ctx, query.Query{Prefix: pinNamesPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+
+	names := make(map[string]string)
+	for result := range results.Next() {
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		cid := strings.TrimPrefix(result.Key, pinNamesPrefix.String()+"/")
+		names[cid] = string(result.Value)
+	}
+	return names, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	blockstore "github.com/ipfs/boxo/blockstore"
+	dag "github.com/ipfs/boxo/ipld/merkledag"
+	blocks "github.com/ipfs/go-block-format"
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/multiformats/go-multihash"
+)
+
+func TestPinNames(t *testing.T) {
+	ctx := context.Background()
+	ds := datastore.NewMapDatastore()
+
+	hash, err := multihash.Sum([]byte("pinned content"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cidlib.NewCidV1(cidlib.Raw, hash)
+
+	if err := setPinName(ctx, ds, c, "holiday photos"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := pinNames(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names[c.String()] != "holiday photos" || len(names) != 1 {
+		t.Fatalf("unexpected names %v", names)
+	}
+
+	// An empty name removes it, as does removing an already removed name
+	if err := setPinName(ctx, ds, c, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := removePinName(ctx, ds, c); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := pinNames(ctx, ds); err != nil || len(names) != 0 {
+		t.Fatalf("expected no names, got %v (%v)", names, err)
+	}
+}
+
+func TestPinMeta(t *testing.T) {
+	ctx := context.Background()
+	ds := datastore.NewMapDatastore()
+
+	hash, err := multihash.Sum([]byte("tracked content"), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cidlib.NewCidV1(cidlib.Raw, hash)
+
+	meta := pinMeta{PinnedAt: 1700000000, Tag: "cache"}
+	if err := setPinMeta(ctx, ds, c, meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := setPinName(ctx, ds, c, "named"); err != nil {
+		t.Fatal(err)
+	}
+	metas, err := pinMetas(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metas[c.String()] != meta || len(metas) != 1 {
+		t.Fatalf("unexpected metadata %v", metas)
+	}
+
+	// Forgetting a pin removes both its name and metadata
+	if err := forgetPin(ctx, ds, c); err != nil {
+		t.Fatal(err)
+	}
+	if metas, err := pinMetas(ctx, ds); err != nil || len(metas) != 0 {
+		t.Fatalf("expected no metadata, got %v (%v)", metas, err)
+	}
+	if names, err := pinNames(ctx, ds); err != nil || len(names) != 0 {
+		t.Fatalf("expected no names, got %v (%v)", names, err)
+	}
+	if err := forgetPin(ctx, ds, c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCopyPinnedBlocks(t *testing.T) {
+	ctx := context.Background()
+	src := blockstore.NewBlockstore(datastore.NewMapDatastore())
+
+	leaf := dag.NewRawNode([]byte("leaf"))
+	root := dag.NodeWithData([]byte("root"))
+	if err := root.AddNodeLink("leaf", leaf); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.PutMany(ctx, []blocks.Block{leaf, root}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A direct pin only needs its own block
+	dst := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	if err := copyPinnedBlocks(ctx, src, dst, root.Cid(), false); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := dst.Has(ctx, leaf.Cid()); has {
+		t.Fatal("direct pin copied linked block")
+	}
+
+	if err := copyPinnedBlocks(ctx, src, dst, root.Cid(), true); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []cidlib.Cid{root.Cid(), leaf.Cid()} {
+		if has, err := dst.Has(ctx, c); err != nil || !has {
+			t.Fatalf("block %s not copied (%v)", c, err)
+		}
+	}
+
+	// Missing blocks are never fetched from elsewhere
+	if err := src.DeleteBlock(ctx, leaf.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	empty := blockstore.NewBlockstore(datastore.NewMapDatastore())
+	if err := copyPinnedBlocks(ctx, src, empty, root.Cid(), true); err == nil {
+		t.Fatal("expected an error for a missing block")
+	}
+}
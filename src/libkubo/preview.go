@@ -0,0 +1,96 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"unsafe"
+
+	iface "github.com/ipfs/boxo/coreiface"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	"github.com/ipfs/boxo/files"
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+)
+
+// Preview returns the first maxBytes bytes of a file on IPFS, or the whole
+// file if it is shorter, e.g. for thumbnailing large media or showing the
+// first lines of a text file. The file's blocks are fetched in order and
+// fetching stops as soon as enough bytes have been read, so only the blocks
+// covering the preview, and those already requested ahead of them, are
+// retrieved. The preview's length is written to outLen, which is set to -1
+// on error (returning NULL). The returned buffer must be freed with
+// FreeBytes.
+//
+//export Preview
+func Preview(repoPath, cidStr *C.char, maxBytes C.int, outLen *C.int) unsafe.Pointer {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+	cid := C.GoString(cidStr)
+	*outLen = C.int(-1)
+
+	if maxBytes < 1 {
+		logError("invalid preview size %d", int(maxBytes))
+		return nil
+	}
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	preview, err := readPreview(ctx, api, decodedCid, int(maxBytes))
+	if err != nil {
+		logError("previewing %s: %s", cid, err)
+		return nil
+	}
+
+	log.Printf("DEBUG: Read %d bytes of %s for a preview\n", len(preview), cid)
+	*outLen = C.int(len(preview))
+	return C.CBytes(preview)
+}
+
+// readPreview reads up to maxBytes bytes from the start of the Unixfs file
+// c. Blocks requested ahead of the reader are cancelled once it returns.
+func readPreview(ctx context.Context, api iface.CoreAPI, c cidlib.Cid, maxBytes int) ([]byte, error) {
+	// Only dag-pb and raw blocks can be read as Unixfs
+	switch codec := c.Prefix().Codec; codec {
+	case cidlib.DagProtobuf, cidlib.Raw:
+	default:
+		return nil, fmt.Errorf("unsupported codec %s", multicodec.Code(codec))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	fileNode, err := api.Unixfs().Get(ctx, ipath.IpfsPath(c))
+	if err != nil {
+		return nil, err
+	}
+	defer fileNode.Close()
+
+	// Symlinks also implement files.File, so they must be ruled out first
+	file, ok := fileNode.(files.File)
+	if _, isSymlink := fileNode.(*files.Symlink); isSymlink || !ok {
+		return nil, fmt.Errorf("not a file: %T", fileNode)
+	}
+
+	// Grows with the data read rather than allocating the whole limit
+	return io.ReadAll(io.LimitReader(file, int64(maxBytes)))
+}
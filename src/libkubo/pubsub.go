@@ -6,12 +6,14 @@ import "C"
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"sync"
 	"time"
 	"unsafe"
 "log"
 	iface "github.com/ipfs/boxo/coreiface"
 	"github.com/ipfs/boxo/coreiface/options"
+	"github.com/ipfs/kubo/core"
 	"github.com/libp2p/go-libp2p/core/peer"
 )
 
@@ -20,9 +22,16 @@ var (
 	subscriptions      = make(map[int64]*subscriptionInfo) // <-- pointer
 	subscriptionsMutex sync.Mutex
 	nextSubID          int64 = 1
+
+	// Topics subscribed to per repo path, indexed by subID. Entries outlive
+	// subscriptions closed with their node so RestoreSubscriptions can
+	// re-subscribe; only PubSubUnsubscribe forgets a topic.
+	subscribedTopics = make(map[string]map[int64]string)
 )
 
-// Message represents a pubsub message
+// Message represents a pubsub message. Payloads are arbitrary bytes, so in
+// JSON Data (like Seqno) is a standard base64 string, which PubSubNextMessage
+// callers must decode. PubSubNextMessageRaw returns the payload unencoded.
 type Message struct {
 	From    string   `json:"from"`
 	Data    []byte   `json:"data"`
@@ -40,6 +49,17 @@ type subscriptionInfo struct {
 	ctx          context.Context
 	cancel       context.CancelFunc
 	repoPath     string // Store repo path instead of node reference
+
+	// Activity statistics, protected by mutex
+	subscribedAt     time.Time
+	messagesReceived uint64
+	lastMessageAt    time.Time
+	publishers       map[string]struct{}
+
+	// deliver, if set, receives the messages instead of the queue, starting
+	// with the replayed ones (see PubSubTail)
+	deliver func(Message)
+	replay  []Message
 }
 
 // PubSubListTopics lists the topics the node is subscribed to
@@ -52,7 +72,7 @@ func PubSubListTopics(repoPath *C.char) *C.char {
 	// Get or create a node from the registry
 	api, _, err := AcquireNode(path)
 	if err != nil {
-		log.Printf( "Error acquiring node: %s\n", err)
+		logError("acquiring node: %s", err)
 		return C.CString("[]") // Return empty JSON array
 	}
 	defer ReleaseNode(path)
@@ -60,21 +80,58 @@ func PubSubListTopics(repoPath *C.char) *C.char {
 	// List topics
 	topics, err := api.PubSub().Ls(ctx)
 	if err != nil {
-		log.Printf( "Error listing topics: %s\n", err)
+		logError("listing topics: %s", err)
 		return C.CString("[]") // Return empty JSON array
 	}
 
 	// Convert to JSON
 	topicsJSON, err := json.Marshal(topics)
 	if err != nil {
-		log.Printf( "Error marshaling topics to JSON: %s\n", err)
+		logError("marshaling topics to JSON: %s", err)
 		return C.CString("[]") // Return empty JSON array
 	}
 
 	return C.CString(string(topicsJSON))
 }
 
-// PubSubPublish publishes a message to a topic
+// IsPubSubEnabled reports whether pubsub can be used on the repo's node.
+// Online nodes always run pubsub, while nodes started offline, e.g. with
+// RunNodeOffline or OpenRepoReadOnly, have none; on those PubSubPublish and
+// PubSubSubscribe fail with -3. Returns 1 if pubsub is enabled, 0 if it isn't
+// and -1 if the node couldn't be acquired.
+//
+//export IsPubSubEnabled
+func IsPubSubEnabled(repoPath *C.char) C.int {
+	path := C.GoString(repoPath)
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PubSub == nil {
+		return C.int(0)
+	}
+	return C.int(1)
+}
+
+// checkPubSubEnabled logs an error and returns false if the node has no
+// pubsub, instead of letting the call fail with Kubo's internal error
+func checkPubSubEnabled(path string, node *core.IpfsNode) bool {
+	if node.PubSub == nil {
+		logError("pubsub not enabled: node for repo %s was started offline", path)
+		return false
+	}
+	return true
+}
+
+// PubSubPublish publishes a message to a topic. Returns 0 on success, -1 if
+// the node couldn't be acquired, -2 if publishing failed and -3 if pubsub
+// isn't enabled on the node (see IsPubSubEnabled).
 //
 //export PubSubPublish
 func PubSubPublish(repoPath, topic *C.char, data unsafe.Pointer, dataLen C.int) C.int {
@@ -87,46 +144,79 @@ func PubSubPublish(repoPath, topic *C.char, data unsafe.Pointer, dataLen C.int)
 	dataBytes := C.GoBytes(data, dataLen)
 
 	// Get or create a node from the registry
-	api, _, err := AcquireNode(path)
+	api, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf( "Error acquiring node: %s\n", err)
+		logError("acquiring node: %s", err)
 		return C.int(-1)
 	}
 	defer ReleaseNode(path)
 
+	if !checkPubSubEnabled(path, node) {
+		return C.int(-3)
+	}
+
 	// Publish message
 	err = api.PubSub().Publish(ctx, topicStr, dataBytes)
 	if err != nil {
-		log.Printf( "Error publishing to topic: %s\n", err)
+		logError("publishing to topic: %s", err)
 		return C.int(-2)
 	}
 
 	return C.int(0)
 }
 
-// PubSubSubscribe subscribes to a topic
+// PubSubSubscribe subscribes to a topic, returning the subscription ID, -1
+// if the node couldn't be acquired, -2 if subscribing failed and -3 if pubsub
+// isn't enabled on the node (see IsPubSubEnabled)
 //
 //export PubSubSubscribe
 func PubSubSubscribe(repoPath, topic *C.char) C.longlong {
 	path := C.GoString(repoPath)
 	topicStr := C.GoString(topic)
 
+	subID := subscribeTopic(path, topicStr)
+	if subID < 0 {
+		return subID
+	}
+
+	// Remember the topic so it can be restored after the node is recreated
+	subscriptionsMutex.Lock()
+	recordSubscribedTopic(path, int64(subID), topicStr)
+	subscriptionsMutex.Unlock()
+
+	return subID
+}
+
+// subscribeTopic subscribes to a topic on the repo's node, returning the new
+// subID or a negative error code as PubSubSubscribe does
+func subscribeTopic(path, topicStr string) C.longlong {
+	return subscribeTopicWith(path, topicStr, nil, nil)
+}
+
+// subscribeTopicWith subscribes like subscribeTopic, passing the replayed and
+// then the received messages to deliver, if given, instead of queuing them
+func subscribeTopicWith(path, topicStr string, deliver func(Message), replay []Message) C.longlong {
 	// Get or create a node from the registry
-	api, _, err := AcquireNode(path)
+	api, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf( "Error acquiring node: %s\n", err)
+		logError("acquiring node: %s", err)
 		return C.longlong(-1)
 	}
 	// Note: We don't release the node here because the subscription needs it
 	// The node will be released when the subscription is closed
 
+	if !checkPubSubEnabled(path, node) {
+		ReleaseNode(path)
+		return C.longlong(-3)
+	}
+
 	// Create a context with cancel for this subscription
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// Subscribe to topic
 	subscription, err := api.PubSub().Subscribe(ctx, topicStr)
 	if err != nil {
-		log.Printf( "Error subscribing to topic: %s\n", err)
+		logError("subscribing to topic: %s", err)
 		ReleaseNode(path) // Release the node since we failed
 		cancel()
 		return C.longlong(-2)
@@ -146,6 +236,10 @@ func PubSubSubscribe(repoPath, topic *C.char) C.longlong {
 		ctx:          ctx,
 		cancel:       cancel,
 		repoPath:     path,
+		subscribedAt: time.Now(),
+		publishers:   make(map[string]struct{}),
+		deliver:      deliver,
+		replay:       replay,
 	}
 	subscriptions[subID] = subInfo
 	subscriptionsMutex.Unlock()
@@ -156,6 +250,77 @@ func PubSubSubscribe(repoPath, topic *C.char) C.longlong {
 	return C.longlong(subID)
 }
 
+// recordSubscribedTopic adds a subscription to subscribedTopics.
+// The caller must hold subscriptionsMutex.
+func recordSubscribedTopic(path string, subID int64, topic string) {
+	if subscribedTopics[path] == nil {
+		subscribedTopics[path] = make(map[int64]string)
+	}
+	subscribedTopics[path][subID] = topic
+}
+
+// RestoredSubscription maps a subscription lost when its node was closed to
+// the subscription that replaces it
+type RestoredSubscription struct {
+	Topic    string `json:"topic"`
+	OldSubID int64  `json:"oldSubID"`
+	NewSubID int64  `json:"newSubID,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// RestoreSubscriptions re-subscribes to the topics whose subscriptions were
+// closed along with the repo's node (e.g. by CleanupNode), which invalidates
+// their subIDs. Call it after the node is acquired again. Returns a JSON
+// array of RestoredSubscription mapping each old subID to its new one.
+// Topics that fail to re-subscribe carry an error and are retried on the
+// next call. Subscriptions that are still active are left untouched.
+//
+//export RestoreSubscriptions
+func RestoreSubscriptions(repoPath *C.char) *C.char {
+	path := C.GoString(repoPath)
+
+	// Collect the recorded subscriptions that are no longer active
+	subscriptionsMutex.Lock()
+	lost := map[int64]string{}
+	for subID, topic := range subscribedTopics[path] {
+		if _, active := subscriptions[subID]; !active {
+			lost[subID] = topic
+		}
+	}
+	subscriptionsMutex.Unlock()
+
+	restored := []RestoredSubscription{}
+	for oldSubID, topic := range lost {
+		result := RestoredSubscription{Topic: topic, OldSubID: oldSubID}
+
+		newSubID := subscribeTopic(path, topic)
+		if newSubID < 0 {
+			result.Error = fmt.Sprintf("subscribing to topic failed with code %d", newSubID)
+			restored = append(restored, result)
+			continue
+		}
+		result.NewSubID = int64(newSubID)
+
+		// Track the topic under its new subID from now on
+		subscriptionsMutex.Lock()
+		delete(subscribedTopics[path], oldSubID)
+		recordSubscribedTopic(path, result.NewSubID, topic)
+		subscriptionsMutex.Unlock()
+
+		log.Printf("DEBUG: Restored subscription to %s (subID %d -> %d)\n", topic, oldSubID, result.NewSubID)
+		restored = append(restored, result)
+	}
+
+	// Convert to JSON
+	restoredJSON, err := json.Marshal(restored)
+	if err != nil {
+		logError("marshaling restored subscriptions to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(restoredJSON))
+}
+
 // messageReceiver continuously receives messages from a subscription and adds them to the queue
 func messageReceiver(subID int64, subscription iface.PubSubSubscription, topic string) {
 	subscriptionsMutex.Lock()
@@ -166,6 +331,13 @@ func messageReceiver(subID int64, subscription iface.PubSubSubscription, topic s
 		return
 	}
 
+	if subInfo.deliver != nil {
+		for _, message := range subInfo.replay {
+			subInfo.deliver(message)
+		}
+		subInfo.replay = nil
+	}
+
 	// Process messages until context is canceled
 	for {
 		select {
@@ -203,19 +375,88 @@ func messageReceiver(subID int64, subscription iface.PubSubSubscription, topic s
 				message.Topics = msg.Topics()
 			}
 
-			// Add message to queue
+			// Add message to queue, unless it is delivered right away
 			subInfo.mutex.Lock()
-			subInfo.messageQueue = append(subInfo.messageQueue, message)
+			if subInfo.deliver == nil {
+				subInfo.messageQueue = append(subInfo.messageQueue, message)
+			}
+			subInfo.messagesReceived++
+			subInfo.lastMessageAt = time.Now()
+			subInfo.publishers[message.From] = struct{}{}
 			subInfo.mutex.Unlock()
+
+			if subInfo.deliver != nil {
+				subInfo.deliver(message)
+			}
 		}
 	}
 }
 
-// PubSubNextMessage gets the next message from a subscription
+// PubSubNextMessage gets the next message from a subscription as a Message
+// JSON object, with the payload base64 encoded
 //
 //export PubSubNextMessage
 func PubSubNextMessage(subID C.longlong) *C.char {
+	message, ok := nextMessage(int64(subID))
+	if !ok {
+		return nil
+	}
+
+	// Convert to JSON
+	messageJSON, err := json.Marshal(message)
+	if err != nil {
+		logError("marshaling message to JSON: %s", err)
+		return nil
+	}
+	// log.Printf( "Got next message! %s\n", messageJSON)
+
+	return C.CString(string(messageJSON))
+}
+
+// PubSubNextMessageRaw gets the payload of the next message from a
+// subscription as raw bytes, without the JSON encoding and message metadata.
+// The payload length is written to outLen, which is set to -1 if no message
+// is available and -2 if the subscription doesn't exist (returning NULL).
+// The returned buffer must be freed with FreeBytes.
+//
+//export PubSubNextMessageRaw
+func PubSubNextMessageRaw(subID C.longlong, outLen *C.int) unsafe.Pointer {
 	id := int64(subID)
+
+	subscriptionsMutex.Lock()
+	_, exists := subscriptions[id]
+	subscriptionsMutex.Unlock()
+	if !exists {
+		logError("Subscription %d not found", id)
+		*outLen = C.int(-2)
+		return nil
+	}
+
+	message, ok := nextMessage(id)
+	if !ok {
+		*outLen = C.int(-1)
+		return nil
+	}
+
+	*outLen = C.int(len(message.Data))
+	if len(message.Data) == 0 {
+		// Empty payloads still get a buffer, so NULL always means no message
+		return C.malloc(1)
+	}
+	return C.CBytes(message.Data)
+}
+
+// FreeBytes frees a buffer returned by PubSubNextMessageRaw,
+// GetNodePublicKey or SignData
+//
+//export FreeBytes
+func FreeBytes(ptr unsafe.Pointer) {
+	C.free(ptr)
+}
+
+// nextMessage removes the next message from a subscription's queue, returning
+// false if the subscription doesn't exist or has no messages
+func nextMessage(id int64) (Message, bool) {
 	// log.Printf( "Getting next message..\n")
 
 	subscriptionsMutex.Lock()
@@ -223,8 +464,8 @@ func PubSubNextMessage(subID C.longlong) *C.char {
 	subscriptionsMutex.Unlock()
 
 	if !exists {
-		log.Printf( "Error: Subscription %d not found\n", id)
-		return nil
+		logError("Subscription %d not found", id)
+		return Message{}, false
 	}
 
 	// Check if there are messages in the queue
@@ -234,7 +475,7 @@ func PubSubNextMessage(subID C.longlong) *C.char {
 	if len(subInfo.messageQueue) == 0 {
 		// No messages available
 		// log.Printf( "SubID: %d No message available.\n", subID)
-		return nil
+		return Message{}, false
 	}
 
 	// Get the first message
@@ -242,15 +483,7 @@ func PubSubNextMessage(subID C.longlong) *C.char {
 	// Remove it from the queue
 	subInfo.messageQueue = subInfo.messageQueue[1:]
 
-	// Convert to JSON
-	messageJSON, err := json.Marshal(message)
-	if err != nil {
-		log.Printf( "Error marshaling message to JSON: %s\n", err)
-		return nil
-	}
-	// log.Printf( "Got next message! %s\n", messageJSON)
-
-	return C.CString(string(messageJSON))
+	return message, true
 }
 
 // PubSubUnsubscribe unsubscribes from a topic
@@ -264,7 +497,7 @@ func PubSubUnsubscribe(subID C.longlong) C.int {
 
 	subInfo, exists := subscriptions[id]
 	if !exists {
-		log.Printf( "Error: Subscription %d not found\n", id)
+		logError("Subscription %d not found", id)
 		return C.int(-1)
 	}
 
@@ -279,12 +512,79 @@ func PubSubUnsubscribe(subID C.longlong) C.int {
 	// Release the node associated with this subscription
 	ReleaseNode(subInfo.repoPath)
 
-	// Remove from map
+	// Remove from map; an explicit unsubscribe isn't restored later
 	delete(subscriptions, id)
+	delete(subscribedTopics[subInfo.repoPath], id)
 
 	return C.int(0)
 }
 
+// TopicStats describes the activity on a topic seen by a subscription
+type TopicStats struct {
+	Topic            string  `json:"topic"`
+	SubID            int64   `json:"subID"`
+	SubscribedAt     string  `json:"subscribedAt"`
+	MessagesReceived uint64  `json:"messagesReceived"`
+	MessagesPerMin   float64 `json:"messagesPerMinute"`
+	LastMessageAt    string  `json:"lastMessageAt,omitempty"`
+	UniquePublishers int     `json:"uniquePublishers"`
+}
+
+// PubSubTopicStats returns activity statistics for a topic the repo's node is
+// subscribed to as a TopicStats JSON object: the number of messages received,
+// their average rate, when the last one arrived and how many distinct peers
+// published them. Messages are counted when they arrive, whether or not they
+// have been read yet. The statistics belong to the oldest subscription to the
+// topic and start over when it is unsubscribed. Returns NULL if there is no
+// subscription to the topic.
+//
+//export PubSubTopicStats
+func PubSubTopicStats(repoPath, topic *C.char) *C.char {
+	path := C.GoString(repoPath)
+	topicStr := C.GoString(topic)
+
+	// Find the oldest subscription to the topic, which has seen the most
+	subscriptionsMutex.Lock()
+	var subID int64
+	var subInfo *subscriptionInfo
+	for id, info := range subscriptions {
+		if info.repoPath == path && info.topic == topicStr && (subInfo == nil || id < subID) {
+			subID, subInfo = id, info
+		}
+	}
+	subscriptionsMutex.Unlock()
+
+	if subInfo == nil {
+		logError("No subscription to topic %s", topicStr)
+		return nil
+	}
+
+	subInfo.mutex.Lock()
+	stats := TopicStats{
+		Topic:            topicStr,
+		SubID:            subID,
+		SubscribedAt:     subInfo.subscribedAt.UTC().Format(time.RFC3339Nano),
+		MessagesReceived: subInfo.messagesReceived,
+		UniquePublishers: len(subInfo.publishers),
+	}
+	if !subInfo.lastMessageAt.IsZero() {
+		stats.LastMessageAt = subInfo.lastMessageAt.UTC().Format(time.RFC3339Nano)
+	}
+	if elapsed := time.Since(subInfo.subscribedAt).Minutes(); elapsed > 0 {
+		stats.MessagesPerMin = float64(subInfo.messagesReceived) / elapsed
+	}
+	subInfo.mutex.Unlock()
+
+	// Convert to JSON
+	statsJSON, err := json.Marshal(stats)
+	if err != nil {
+		logError("marshaling topic stats to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(statsJSON))
+}
+
 // PubSubPeers lists peers participating in a topic
 //
 //export PubSubPeers
@@ -297,7 +597,7 @@ func PubSubPeers(repoPath, topic *C.char) *C.char {
 	// Get or create a node from the registry
 	api, _, err := AcquireNode(path)
 	if err != nil {
-		log.Printf( "Error acquiring node: %s\n", err)
+		logError("acquiring node: %s", err)
 		return C.CString("[]") // Return empty JSON array
 	}
 	defer ReleaseNode(path)
@@ -313,7 +613,7 @@ func PubSubPeers(repoPath, topic *C.char) *C.char {
 	}
 
 	if err != nil {
-		log.Printf( "Error listing peers: %s\n", err)
+		logError("listing peers: %s", err)
 		return C.CString("[]") // Return empty JSON array
 	}
 
@@ -326,14 +626,15 @@ func PubSubPeers(repoPath, topic *C.char) *C.char {
 	// Convert to JSON
 	peersJSON, err := json.Marshal(peerStrs)
 	if err != nil {
-		log.Printf( "Error marshaling peers to JSON: %s\n", err)
+		logError("marshaling peers to JSON: %s", err)
 		return C.CString("[]") // Return empty JSON array
 	}
 log.Printf("Returning peers")
 	return C.CString(string(peersJSON))
 }
 
-// PubSubCloseRepoSubscriptions closes all active pubsub subscriptions for a specific repository
+// PubSubCloseRepoSubscriptions closes all active pubsub subscriptions for a specific repository.
+// Their topics can be subscribed to again with RestoreSubscriptions.
 //
 //export PubSubCloseRepoSubscriptions
 func PubSubCloseRepoSubscriptions(repoPath *C.char) C.int {
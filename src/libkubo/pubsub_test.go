@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	"github.com/ipfs/boxo/keystore"
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/kubo/config"
+	"github.com/ipfs/kubo/core"
+	"github.com/ipfs/kubo/core/coreapi"
+	"github.com/ipfs/kubo/repo"
+	"github.com/libp2p/go-libp2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// registerTestPubSubNode starts an online node with pubsub, listening on
+// localhost only, and registers it in activeNodes under a fake repo path
+func registerTestPubSubNode(t *testing.T) string {
+	t.Helper()
+
+	ident, err := config.CreateIdentity(io.Discard, []options.KeyGenerateOption{
+		options.Key.Type(options.Ed25519Key),
+	})
+	if err != nil {
+		t.Fatalf("creating identity: %s", err)
+	}
+	cfg, err := config.InitWithIdentity(ident)
+	if err != nil {
+		t.Fatalf("creating config: %s", err)
+	}
+	cfg.Addresses.Swarm = []string{"/ip4/127.0.0.1/tcp/0"}
+	cfg.Bootstrap = nil
+	cfg.Discovery.MDNS.Enabled = false
+	cfg.Routing.Type = config.NewOptionalString("none")
+
+	r := &repo.Mock{
+		C: *cfg,
+		D: syncds.MutexWrap(datastore.NewMapDatastore()),
+		K: keystore.NewMemKeystore(),
+	}
+	node, err := core.NewNode(context.Background(), &core.BuildCfg{
+		Online:    true,
+		Repo:      r,
+		ExtraOpts: map[string]bool{"pubsub": true},
+	})
+	if err != nil {
+		t.Fatalf("creating node: %s", err)
+	}
+	api, err := coreapi.NewCoreAPI(node)
+	if err != nil {
+		node.Close()
+		t.Fatalf("creating API: %s", err)
+	}
+
+	path := "test-repo-" + t.Name()
+	activeNodesMutex.Lock()
+	activeNodes[path] = &NodeInfo{API: api, Node: node, RefCount: 1, LastUsed: time.Now(), Started: time.Now()}
+	activeNodesMutex.Unlock()
+	t.Cleanup(func() { ReleaseNode(path) })
+	return path
+}
+
+func TestPubSubBinaryRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	path := registerTestPubSubNode(t)
+
+	const topic = "binary-test"
+	subID := subscribeTopic(path, topic)
+	if subID < 0 {
+		t.Fatalf("subscribing failed with code %d", subID)
+	}
+	t.Cleanup(func() { PubSubUnsubscribe(subID) })
+
+	// Every byte value, including invalid UTF-8 sequences and NUL bytes
+	payloads := [][]byte{{}, {0x00}, {0xff, 0xfe, 0x80, 0xc3, 0x28}}
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	payloads = append(payloads, all)
+
+	activeNodesMutex.Lock()
+	api := activeNodes[path].API
+	activeNodesMutex.Unlock()
+	for _, payload := range payloads {
+		if err := api.PubSub().Publish(ctx, topic, payload); err != nil {
+			t.Fatalf("publishing: %s", err)
+		}
+	}
+
+	for i, want := range payloads {
+		var message Message
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			var ok bool
+			if message, ok = nextMessage(int64(subID)); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("message %d not received", i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if !bytes.Equal(message.Data, want) {
+			t.Fatalf("message %d: got %x, want %x", i, message.Data, want)
+		}
+
+		// The JSON wire format must carry the payload exactly too
+		messageJSON, err := json.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Message
+		if err := json.Unmarshal(messageJSON, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded.Data, want) {
+			t.Fatalf("message %d after JSON: got %x, want %x", i, decoded.Data, want)
+		}
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	path := registerTestPubSubNode(t)
+
+	const topic = "heartbeat-test"
+	subID := subscribeTopic(path, topic)
+	if subID < 0 {
+		t.Fatalf("subscribing failed with code %d", subID)
+	}
+	t.Cleanup(func() { PubSubUnsubscribe(subID) })
+
+	activeNodesMutex.Lock()
+	info := activeNodes[path]
+	activeNodesMutex.Unlock()
+	id := startHeartbeat(info.API, info.Node, topic, []byte("here"), 20*time.Millisecond)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for received := 0; received < 3; {
+		if message, ok := nextMessage(int64(subID)); ok {
+			if string(message.Data) != "here" {
+				t.Fatalf("unexpected heartbeat payload %q", message.Data)
+			}
+			received++
+			continue
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d heartbeats received", received)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !stopHeartbeat(id) {
+		t.Fatal("heartbeat not running")
+	}
+	if stopHeartbeat(id) {
+		t.Fatal("heartbeat stopped twice")
+	}
+
+	// Heartbeats stop with their node
+	id = startHeartbeat(info.API, info.Node, topic, []byte("here"), time.Hour)
+	PubSubUnsubscribe(subID)
+	ReleaseNode(path)
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		heartbeatsMutex.Lock()
+		_, running := heartbeats[id]
+		heartbeatsMutex.Unlock()
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("heartbeat still running after its node was closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSubscribeWithoutPubSub(t *testing.T) {
+	path := registerTestPubSubNode(t)
+
+	activeNodesMutex.Lock()
+	node := activeNodes[path].Node
+	activeNodesMutex.Unlock()
+	if !checkPubSubEnabled(path, node) {
+		t.Fatal("pubsub reported as disabled on an online node")
+	}
+
+	// Nodes started offline have no pubsub
+	pubsub := node.PubSub
+	node.PubSub = nil
+	defer func() { node.PubSub = pubsub }()
+	if subID := subscribeTopic(path, "no-pubsub"); subID != -3 {
+		t.Fatalf("subscribing without pubsub returned %d, want -3", subID)
+	}
+	activeNodesMutex.Lock()
+	refs := activeNodes[path].RefCount
+	activeNodesMutex.Unlock()
+	if refs != 1 {
+		t.Fatalf("failed subscription left %d node references, want 1", refs)
+	}
+}
+
+func TestPubSubTailReplay(t *testing.T) {
+	ctx := context.Background()
+	path := registerTestPubSubNode(t)
+
+	const topic = "tail-test"
+	subID := subscribeTopic(path, topic)
+	if subID < 0 {
+		t.Fatalf("subscribing failed with code %d", subID)
+	}
+	t.Cleanup(func() { PubSubUnsubscribe(subID) })
+
+	activeNodesMutex.Lock()
+	api := activeNodes[path].API
+	activeNodesMutex.Unlock()
+	publish := func(data string) {
+		if err := api.PubSub().Publish(ctx, topic, []byte(data)); err != nil {
+			t.Fatalf("publishing: %s", err)
+		}
+	}
+	for _, data := range []string{"one", "two", "three"} {
+		publish(data)
+	}
+
+	// Wait until the first subscription has buffered all three
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		subscriptionsMutex.Lock()
+		queued := len(recentTopicMessages(path, topic, 10))
+		subscriptionsMutex.Unlock()
+		if queued == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d messages buffered", queued)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	subscriptionsMutex.Lock()
+	replay := recentTopicMessages(path, topic, 2)
+	subscriptionsMutex.Unlock()
+	received := make(chan string, 10)
+	tailID := subscribeTopicWith(path, topic, func(message Message) {
+		received <- string(message.Data)
+	}, replay)
+	if tailID < 0 {
+		t.Fatalf("tailing failed with code %d", tailID)
+	}
+	t.Cleanup(func() { PubSubUnsubscribe(tailID) })
+
+	// Replayed messages come first, then live ones
+	publish("four")
+	for _, want := range []string{"two", "three", "four"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("got message %q, want %q", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("message %q not delivered", want)
+		}
+	}
+	if _, ok := nextMessage(int64(tailID)); ok {
+		t.Fatal("delivered message also queued")
+	}
+}
+
+func TestPubSubPeerScores(t *testing.T) {
+	ctx := context.Background()
+
+	peerScoringMutex.Lock()
+	scoredBuild = true
+	path := registerTestPubSubNode(t)
+	scoredBuild = false
+	peerScoringMutex.Unlock()
+	activeNodesMutex.Lock()
+	scored := activeNodes[path].Node
+	activeNodesMutex.Unlock()
+
+	// A peer with a gossipsub router of its own, without peer scoring
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatalf("creating host: %s", err)
+	}
+	defer h.Close()
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		t.Fatalf("creating gossipsub: %s", err)
+	}
+
+	if _, ok := topicPeerScores(&core.IpfsNode{PubSub: ps}, ""); ok {
+		t.Fatal("router built without peer scoring has peer scores")
+	}
+	if scores, ok := topicPeerScores(scored, ""); !ok || len(scores) != 0 {
+		t.Fatalf("got %v, %t before any peer connected, want no scores", scores, ok)
+	}
+
+	const topic = "peer-score-test"
+	for _, router := range []*pubsub.PubSub{ps, scored.PubSub} {
+		sub, err := router.Subscribe(topic)
+		if err != nil {
+			t.Fatalf("subscribing: %s", err)
+		}
+		defer sub.Cancel()
+	}
+	if err := scored.PeerHost.Connect(ctx, peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}); err != nil {
+		t.Fatalf("connecting: %s", err)
+	}
+
+	// The peer is scored once the scores are refreshed
+	deadline := time.Now().Add(3 * peerScoreInspectInterval)
+	for {
+		scores, _ := topicPeerScores(scored, topic)
+		if len(scores) == 1 && scores[0].Peer == h.ID().String() {
+			if scores[0].Score != 0 {
+				t.Fatalf("well-behaved peer has score %f", scores[0].Score)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got scores %v, want the peer's", scores)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
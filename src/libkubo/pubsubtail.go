@@ -0,0 +1,73 @@
+package main
+
+// #include <stdint.h>
+// #include <stdlib.h>
+import "C"
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// PubSubTail subscribes to a topic and passes its messages to a callback
+// void(char* messageJSON), with each message a Message JSON object as
+// returned by PubSubNextMessage. Before any new message, up to lastN recent
+// messages still buffered by the repo's other subscriptions to the topic are
+// replayed, so that e.g. a chat view opened late shows the latest activity.
+// Messages are passed to the callback one at a time, from a background
+// thread. Stop the tail with PubSubUnsubscribe; it isn't restored by
+// RestoreSubscriptions. Returns the subscription ID, or the error codes of
+// PubSubSubscribe.
+//
+//export PubSubTail
+func PubSubTail(repoPath, topic *C.char, lastN C.int, cb C.uintptr_t) C.longlong {
+	path := C.GoString(repoPath)
+	topicStr := C.GoString(topic)
+
+	subscriptionsMutex.Lock()
+	replay := recentTopicMessages(path, topicStr, int(lastN))
+	subscriptionsMutex.Unlock()
+
+	subID := subscribeTopicWith(path, topicStr, func(message Message) {
+		messageJSON, err := json.Marshal(message)
+		if err != nil {
+			log.Printf("ERROR:  marshaling message to JSON: %s\n", err)
+			return
+		}
+		callStringCallback(cb, string(messageJSON))
+	}, replay)
+	if subID < 0 {
+		return subID
+	}
+
+	log.Printf("DEBUG: Tailing topic %s with subID %d, replaying %d messages\n", topicStr, int64(subID), len(replay))
+	return subID
+}
+
+// recentTopicMessages returns up to n of the latest messages buffered by the
+// repo's subscriptions to topic, oldest first, without taking them from the
+// queues. All subscriptions to a topic receive the same messages, so each
+// queue holds the latest ones, back to where it was last read, and the
+// longest queue contains all others. The caller must hold subscriptionsMutex.
+func recentTopicMessages(path, topic string, n int) []Message {
+	if n <= 0 {
+		return nil
+	}
+
+	var longest []Message
+	for _, subInfo := range subscriptions {
+		if subInfo.repoPath != path || subInfo.topic != topic {
+			continue
+		}
+		subInfo.mutex.Lock()
+		if len(subInfo.messageQueue) > len(longest) {
+			longest = append([]Message(nil), subInfo.messageQueue...)
+		}
+		subInfo.mutex.Unlock()
+	}
+
+	if len(longest) > n {
+		longest = longest[len(longest)-n:]
+	}
+	return longest
+}
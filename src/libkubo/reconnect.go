@@ -0,0 +1,172 @@
+package main
+
+// #include <stdlib.h>
+// #include <stdbool.h>
+import "C"
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ipfs/kubo/core"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// reconnectDialTimeout bounds each redial of the auto-reconnect watchdog
+const reconnectDialTimeout = 30 * time.Second
+
+// autoReconnectSettings is how a repo's watchdog checks its node's peers
+type autoReconnectSettings struct {
+	interval time.Duration
+	minPeers int
+}
+
+// Auto-reconnect settings set with SetAutoReconnect and the watchdogs of
+// running nodes, indexed by repo path
+var (
+	autoReconnects     = make(map[string]autoReconnectSettings)
+	reconnectWatchdogs = make(map[string]chan struct{})
+	autoReconnectMutex sync.Mutex
+)
+
+// SetAutoReconnect enables or disables a watchdog for the repo's node that
+// checks its number of connected peers every checkIntervalSeconds and, when
+// it has dropped below minPeers, redials the bootstrap peers (Bootstrap) and
+// the peering list (Peering.Peers). This brings nodes on flaky networks,
+// e.g. phones switching between Wi-Fi and cellular, back online sooner than
+// Kubo's own bootstrapping does after they have lost all their peers.
+// The setting applies to the running node right away and to nodes started
+// later in this process; the watchdog stops when the node is closed.
+// Returns 0 on success or -1 if enabling with an interval or minimum number
+// of peers of less than 1.
+//
+//export SetAutoReconnect
+func SetAutoReconnect(repoPath *C.char, enabled C.bool, checkIntervalSeconds C.int, minPeers C.int) C.int {
+	path := C.GoString(repoPath)
+
+	if bool(enabled) && (checkIntervalSeconds < 1 || minPeers < 1) {
+		logError("invalid auto-reconnect interval %d or minimum peers %d", int(checkIntervalSeconds), int(minPeers))
+		return C.int(-1)
+	}
+
+	// Nodes are created holding activeNodesMutex, and start their watchdog
+	activeNodesMutex.Lock()
+	defer activeNodesMutex.Unlock()
+	autoReconnectMutex.Lock()
+	defer autoReconnectMutex.Unlock()
+
+	if stop, running := reconnectWatchdogs[path]; running {
+		close(stop)
+		delete(reconnectWatchdogs, path)
+	}
+	if !bool(enabled) {
+		delete(autoReconnects, path)
+		log.Printf("DEBUG: Disabled auto-reconnect for repo %s\n", path)
+		return C.int(0)
+	}
+
+	settings := autoReconnectSettings{
+		interval: time.Duration(checkIntervalSeconds) * time.Second,
+		minPeers: int(minPeers),
+	}
+	autoReconnects[path] = settings
+	if nodeInfo, exists := activeNodes[path]; exists {
+		startReconnectWatchdog(path, nodeInfo.Node, settings)
+	}
+
+	log.Printf("DEBUG: Enabled auto-reconnect for repo %s below %d peers\n", path, settings.minPeers)
+	return C.int(0)
+}
+
+// startAutoReconnect starts the watchdog of a newly created node if
+// auto-reconnect is enabled for its repo
+func startAutoReconnect(repoPath string, node *core.IpfsNode) {
+	autoReconnectMutex.Lock()
+	defer autoReconnectMutex.Unlock()
+	if settings, enabled := autoReconnects[repoPath]; enabled {
+		startReconnectWatchdog(repoPath, node, settings)
+	}
+}
+
+// startReconnectWatchdog runs the watchdog of an online node until the node
+// closes or the watchdog is stopped. The caller must hold autoReconnectMutex.
+func startReconnectWatchdog(repoPath string, node *core.IpfsNode, settings autoReconnectSettings) {
+	if !node.IsOnline || node.PeerHost == nil {
+		return
+	}
+	stop := make(chan struct{})
+	reconnectWatchdogs[repoPath] = stop
+
+	go func() {
+		defer func() {
+			autoReconnectMutex.Lock()
+			if reconnectWatchdogs[repoPath] == stop {
+				delete(reconnectWatchdogs, repoPath)
+			}
+			autoReconnectMutex.Unlock()
+		}()
+
+		ticker := time.NewTicker(settings.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-node.Context().Done():
+				return
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			connected := len(node.PeerHost.Network().Peers())
+			if connected >= settings.minPeers {
+				continue
+			}
+			cfg, err := node.Repo.Config()
+			if err != nil {
+				log.Printf("ERROR:  reading config of repo %s: %s\n", repoPath, err)
+				continue
+			}
+			peers, err := cfg.BootstrapPeers()
+			if err != nil {
+				log.Printf("ERROR:  parsing bootstrap peers of repo %s: %s\n", repoPath, err)
+			}
+			peers = append(peers, cfg.Peering.Peers...)
+
+			log.Printf("DEBUG: Repo %s has %d peers, redialing %d bootstrap and peering peers\n", repoPath, connected, len(peers))
+			reconnected := redialPeers(node.Context(), node.PeerHost, peers)
+			log.Printf("DEBUG: Reconnected repo %s to %d peers\n", repoPath, reconnected)
+		}
+	}()
+}
+
+// redialPeers connects to the peers that aren't connected, all at once,
+// returning how many connections succeeded
+func redialPeers(ctx context.Context, h host.Host, peers []peer.AddrInfo) int {
+	ctx, cancel := context.WithTimeout(ctx, reconnectDialTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	reconnected := 0
+	for _, info := range peers {
+		if info.ID == h.ID() || h.Network().Connectedness(info.ID) == network.Connected {
+			continue
+		}
+		wg.Add(1)
+		go func(info peer.AddrInfo) {
+			defer wg.Done()
+			if err := h.Connect(ctx, info); err != nil {
+				return
+			}
+			mutex.Lock()
+			reconnected++
+			mutex.Unlock()
+		}(info)
+	}
+	wg.Wait()
+	return reconnected
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestRedialPeers(t *testing.T) {
+	newHost := func() peer.AddrInfo {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		if err != nil {
+			t.Fatalf("creating host: %s", err)
+		}
+		t.Cleanup(func() { h.Close() })
+		return peer.AddrInfo{ID: h.ID(), Addrs: h.Addrs()}
+	}
+
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatalf("creating host: %s", err)
+	}
+	defer h.Close()
+
+	peers := []peer.AddrInfo{newHost(), newHost(), {ID: h.ID(), Addrs: h.Addrs()}}
+	if n := redialPeers(context.Background(), h, peers); n != 2 {
+		t.Fatalf("reconnected to %d peers, want 2", n)
+	}
+	for _, info := range peers[:2] {
+		if h.Network().Connectedness(info.ID) != network.Connected {
+			t.Fatalf("not connected to %s", info.ID)
+		}
+	}
+
+	// Connected peers aren't dialled again
+	if n := redialPeers(context.Background(), h, peers); n != 0 {
+		t.Fatalf("reconnected to %d already connected peers", n)
+	}
+}
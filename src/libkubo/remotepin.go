@@ -0,0 +1,352 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	neturl "net/url"
+	gopath "path"
+	"path/filepath"
+	"strings"
+
+	pinclient "github.com/ipfs/boxo/pinning/remote/client"
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/ipfs/kubo/config"
+	"github.com/ipfs/kubo/core"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// RemotePinStatus describes a pin request on a remote pinning service
+type RemotePinStatus struct {
+	RequestID string `json:"requestId"`
+	Status    string `json:"status"`
+	CID       string `json:"cid"`
+	Name      string `json:"name"`
+}
+
+// RemotePinServiceAdd registers a remote pinning service in the repo config
+//
+//export RemotePinServiceAdd
+func RemotePinServiceAdd(repoPath, name, endpoint, key *C.char) C.int {
+	path := C.GoString(repoPath)
+	serviceName := C.GoString(name)
+	serviceEndpoint := C.GoString(endpoint)
+	serviceKey := C.GoString(key)
+
+	return updateRepoConfig(path, func(cfg *config.Config) error {
+		if serviceName == "" {
+			return fmt.Errorf("remote pinning service name not specified")
+		}
+		normalized, err := normalizeEndpoint(serviceEndpoint)
+		if err != nil {
+			return err
+		}
+		if cfg.Pinning.RemoteServices == nil {
+			cfg.Pinning.RemoteServices = map[string]config.RemotePinningService{}
+		}
+		cfg.Pinning.RemoteServices[serviceName] = config.RemotePinningService{
+			API: config.RemotePinningServiceAPI{
+				Endpoint: normalized,
+				Key:      serviceKey,
+			},
+		}
+		return nil
+	})
+}
+
+// RemotePin asks a remote pinning service to pin a CID, returning the
+// resulting pin status as JSON
+//
+//export RemotePin
+func RemotePin(repoPath, serviceName, cidStr, label *C.char) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	service := C.GoString(serviceName)
+	cid := C.GoString(cidStr)
+	name := C.GoString(label)
+
+	log.Printf("DEBUG: Remote pinning CID %s on service %s\n", cid, service)
+
+	client, err := getRemotePinClient(path, service)
+	if err != nil {
+		logError("getting remote pinning service: %s", err)
+		return nil
+	}
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return nil
+	}
+
+	opts := []pinclient.AddOption{}
+	if name != "" {
+		opts = append(opts, pinclient.PinOpts.WithName(name))
+	}
+
+	// Tell the service where it can fetch the content from
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	defer ReleaseNode(path)
+	if origins := pinOrigins(node); len(origins) > 0 {
+		opts = append(opts, pinclient.PinOpts.WithOrigins(origins...))
+	}
+
+	status, err := client.Add(ctx, decodedCid, opts...)
+	if err != nil {
+		logError("remote pinning CID: %s", err)
+		return nil
+	}
+
+	// Convert to JSON
+	statusJSON, err := json.Marshal(remotePinStatus(status))
+	if err != nil {
+		logError("marshaling remote pin status to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(statusJSON))
+}
+
+// AddRemotePinResult describes a file added with AddAndRemotePin. Error is
+// set, and RemoteStatus null, if the file was added locally but the remote
+// pinning service didn't accept the pin request.
+type AddRemotePinResult struct {
+	CID          string           `json:"cid"`
+	RemoteStatus *RemotePinStatus `json:"remoteStatus"`
+	Error        string           `json:"error,omitempty"`
+}
+
+// AddAndRemotePin adds a file or directory like AddFile, pinning it locally,
+// and asks a remote pinning service to pin the new CID, fetching it from
+// this node. This suits nodes that can't stay online, which keep the local
+// pin until RemotePinLs reports the remote pin as "pinned". The pin request
+// is named after the file. Returns an AddRemotePinResult as JSON, or NULL if
+// the service is unknown or the file couldn't be added.
+//
+//export AddAndRemotePin
+func AddAndRemotePin(repoPath, filePath, serviceName *C.char) *C.char {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+	file := C.GoString(filePath)
+	service := C.GoString(serviceName)
+
+	log.Printf("DEBUG: Adding %s and remote pinning it on service %s\n", file, service)
+
+	// Check the service before adding anything
+	client, err := getRemotePinClient(path, service)
+	if err != nil {
+		logError("getting remote pinning service: %s", err)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	api, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	cid, err := addPath(ctx, api, file, AddOptions{})
+	if err != nil {
+		logError("%s", err)
+		return nil
+	}
+	log.Printf("DEBUG: File added with CID: %s\n", cid)
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return nil
+	}
+
+	result := AddRemotePinResult{CID: cid}
+	opts := []pinclient.AddOption{pinclient.PinOpts.WithName(filepath.Base(file))}
+	if origins := pinOrigins(node); len(origins) > 0 {
+		opts = append(opts, pinclient.PinOpts.WithOrigins(origins...))
+	}
+	if status, err := client.Add(ctx, decodedCid, opts...); err != nil {
+		log.Printf("ERROR:  remote pinning CID: %s\n", err)
+		result.Error = err.Error()
+	} else {
+		remoteStatus := remotePinStatus(status)
+		result.RemoteStatus = &remoteStatus
+	}
+
+	// Convert to JSON
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logError("marshaling add result to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(resultJSON))
+}
+
+// RemotePinLs lists the pins held by a remote pinning service
+//
+//export RemotePinLs
+func RemotePinLs(repoPath, serviceName *C.char) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	service := C.GoString(serviceName)
+
+	client, err := getRemotePinClient(path, service)
+	if err != nil {
+		logError("getting remote pinning service: %s", err)
+		return nil
+	}
+
+	pins, err := client.LsSync(ctx, pinclient.PinOpts.FilterStatus(
+		pinclient.StatusQueued, pinclient.StatusPinning,
+		pinclient.StatusPinned, pinclient.StatusFailed,
+	))
+	if err != nil {
+		logError("listing remote pins: %s", err)
+		return nil
+	}
+
+	statuses := make([]RemotePinStatus, len(pins))
+	for i, pin := range pins {
+		statuses[i] = remotePinStatus(pin)
+	}
+
+	// Convert to JSON
+	statusesJSON, err := json.Marshal(statuses)
+	if err != nil {
+		logError("marshaling remote pins to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(statusesJSON))
+}
+
+// RemotePinRm removes all pin requests for a CID from a remote pinning service,
+// returning the number of requests removed or a negative value on error
+//
+//export RemotePinRm
+func RemotePinRm(repoPath, serviceName, cidStr *C.char) C.int {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+	service := C.GoString(serviceName)
+	cid := C.GoString(cidStr)
+
+	client, err := getRemotePinClient(path, service)
+	if err != nil {
+		logError("getting remote pinning service: %s", err)
+		return C.int(-1)
+	}
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return C.int(-2)
+	}
+
+	pins, err := client.LsSync(ctx,
+		pinclient.PinOpts.FilterCIDs(decodedCid),
+		pinclient.PinOpts.FilterStatus(
+			pinclient.StatusQueued, pinclient.StatusPinning,
+			pinclient.StatusPinned, pinclient.StatusFailed,
+		),
+	)
+	if err != nil {
+		logError("listing remote pins: %s", err)
+		return C.int(-3)
+	}
+
+	removed := 0
+	for _, pin := range pins {
+		if err := client.DeleteByID(ctx, pin.GetRequestId()); err != nil {
+			logError("removing remote pin %s: %s", pin.GetRequestId(), err)
+			return C.int(-4)
+		}
+		removed++
+	}
+
+	return C.int(removed)
+}
+
+// getRemotePinClient creates a client for a remote pinning service
+// registered in the repo config
+func getRemotePinClient(path, name string) (*pinclient.Client, error) {
+	if name == "" {
+		return nil, fmt.Errorf("remote pinning service name not specified")
+	}
+	cfg, err := readRepoConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	service, present := cfg.Pinning.RemoteServices[name]
+	if !present {
+		return nil, fmt.Errorf("remote pinning service %q not known", name)
+	}
+	endpoint, err := normalizeEndpoint(service.API.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return pinclient.NewClient(endpoint, service.API.Key), nil
+}
+
+// pinOrigins returns the addresses a remote pinning service can fetch
+// content from this node at, or nil if the node is offline
+func pinOrigins(node *core.IpfsNode) []ma.Multiaddr {
+	if node.PeerHost == nil {
+		return nil
+	}
+	origins, err := peer.AddrInfoToP2pAddrs(&peer.AddrInfo{
+		ID:    node.Identity,
+		Addrs: node.PeerHost.Addrs(),
+	})
+	if err != nil {
+		return nil
+	}
+	return origins
+}
+
+// remotePinStatus converts a pinning service response to a RemotePinStatus
+func remotePinStatus(status pinclient.PinStatusGetter) RemotePinStatus {
+	return RemotePinStatus{
+		RequestID: status.GetRequestId(),
+		Status:    status.GetStatus().String(),
+		CID:       status.GetPin().GetCid().String(),
+		Name:      status.GetPin().GetName(),
+	}
+}
+
+// normalizeEndpoint validates a pinning service endpoint the same way Kubo does
+func normalizeEndpoint(endpoint string) (string, error) {
+	uri, err := neturl.ParseRequestURI(endpoint)
+	if err != nil || !(uri.Scheme == "http" || uri.Scheme == "https") {
+		return "", fmt.Errorf("service endpoint must be a valid HTTP URL")
+	}
+
+	// cleanup trailing and duplicate slashes
+	uri.Path = gopath.Clean(uri.Path)
+	uri.Path = strings.TrimSuffix(uri.Path, ".")
+	uri.Path = strings.TrimSuffix(uri.Path, "/")
+
+	if uri.RawQuery != "" {
+		return "", fmt.Errorf("service endpoint should be provided without any query parameters")
+	}
+	if strings.HasSuffix(uri.Path, "/pins") {
+		return "", fmt.Errorf("service endpoint should be provided without the /pins suffix")
+	}
+
+	return uri.String(), nil
+}
@@ -1,23 +1,38 @@
 package main
 
+// #include <stdbool.h>
 // #include <stdlib.h>
 import "C"
 
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	iface "github.com/ipfs/boxo/coreiface"
+	ds "github.com/ipfs/go-datastore"
+	version "github.com/ipfs/kubo"
 	"github.com/ipfs/kubo/config"
+	serialize "github.com/ipfs/kubo/config/serialize"
 	"github.com/ipfs/kubo/core"
 	"github.com/ipfs/kubo/core/coreapi"
+	"github.com/ipfs/kubo/core/corerepo"
 	nodep2p "github.com/ipfs/kubo/core/node/libp2p"
 	"github.com/ipfs/kubo/plugin/loader"
+	"github.com/ipfs/kubo/repo"
 	"github.com/ipfs/kubo/repo/fsrepo"
-	// "github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
+	"time"
+	"unsafe"
 )
 
 func init() {
@@ -40,36 +55,108 @@ type NodeInfo struct {
 	Node *core.IpfsNode
 	// We count references to know when to safely close a node
 	RefCount int
+	// LastUsed is when the node was last acquired or released
+	LastUsed time.Time
+	// Started is when the node was created
+	Started time.Time
+	// SessionIdentity is set for nodes using an identity other than the
+	// repo's (see RunNodeWithKey)
+	SessionIdentity bool
 }
 
 // Registry for active nodes, indexed by repo path
 var (
 	activeNodes      = make(map[string]*NodeInfo)
 	activeNodesMutex sync.Mutex
+
+	// busyRepos holds the repos no node may start on, e.g. while they are
+	// backed up (see reserveIdleRepo). Guarded by activeNodesMutex.
+	busyRepos = make(map[string]bool)
+
+	// nodeIdleTimeout is how long a node without references is kept open
+	// (see SetNodeIdleTimeout); zero closes it as soon as it is released
+	nodeIdleTimeout time.Duration
+	reaperOnce      sync.Once
 )
 
 func init() {
-	// Load plugins
-	plugins, _ = loader.NewPluginLoader("")
-	plugins.Initialize()
-	plugins.Inject()
+	if err := loadPlugins(); err != nil {
+		log.Printf("ERROR:  loading plugins: %s\n", err)
+	}
+}
+
+var (
+	pluginsOnce sync.Once
+	pluginsErr  error
+)
+
+// loadPlugins initializes and injects Kubo's plugins. Plugins can only be
+// injected once per process, so repeated calls return the first result.
+func loadPlugins() error {
+	pluginsOnce.Do(func() {
+		plugins, pluginsErr = loader.NewPluginLoader("")
+		if pluginsErr != nil {
+			return
+		}
+		if pluginsErr = plugins.Initialize(); pluginsErr != nil {
+			return
+		}
+		if pluginsErr = plugins.Inject(); pluginsErr != nil {
+			return
+		}
+		pluginsErr = fsrepo.AddDatastoreConfigHandler(encryptedDatastoreType, encryptedDatastoreConfigFromMap)
+	})
+	return pluginsErr
 }
 
-// CreateRepo initializes a new IPFS repository
+// CreateRepo initializes a new IPFS repository.
+// profile is a comma-separated list of Kubo config profiles to apply, like
+// `ipfs init --profile`, or empty for the defaults. For example "badgerds"
+// stores blocks in badger, which is much faster for write-heavy workloads
+// than the default flatfs but less robust and portable, "lowpower" reduces
+// background work for battery-powered devices and "server" disables local
+// network discovery. Returns -3 for an unknown profile.
 //
 //export CreateRepo
-func CreateRepo(repoPath *C.char) C.int {
-	path := C.GoString(repoPath)
+func CreateRepo(repoPath, profile *C.char) C.int {
+	return createRepo(C.GoString(repoPath), C.GoString(profile), "", "")
+}
+
+// CreateRepoWithBlocksPath initializes a new IPFS repository like CreateRepo,
+// but stores its blocks at blocksPath instead of inside the repo, e.g. on an
+// SD card while the config, keystore and the rest of the datastore stay on
+// faster internal storage. blocksPath is made absolute and created if
+// needed. With the "badgerds" profile, where blocks share one datastore with
+// everything else, that whole datastore is moved. The repo can only be
+// opened while blocksPath is available.
+// Returns the codes of CreateRepo, and -4 if the datastore layout has no
+// separate path to move.
+//
+//export CreateRepoWithBlocksPath
+func CreateRepoWithBlocksPath(repoPath, profile, blocksPath *C.char) C.int {
+	return createRepo(C.GoString(repoPath), C.GoString(profile), "", C.GoString(blocksPath))
+}
 
+// createRepo initializes a repo at path with the given profiles, returning
+// the codes documented by CreateRepo. A non-empty passphrase encrypts the
+// repo's datastore (see CreateEncryptedRepo), and a non-empty blocksPath
+// moves its blockstore (see CreateRepoWithBlocksPath).
+func createRepo(path, profileStr, passphrase, blocksPath string) C.int {
 	// Check if repo already exists
 	if fsrepo.IsInitialized(path) {
 		return C.int(0) // Already initialized
 	}
 
+	// The repo's datastore config is written by the plugins
+	if err := loadPlugins(); err != nil {
+		logError("loading plugins: %s", err)
+		return C.int(-1)
+	}
+
 	// Create and initialize a new config with default settings
 	cfg, err := config.Init(os.Stdin, 2048)
 	if err != nil {
-		log.Printf("Error initializing IPFS config: %s\n", err)
+		logError("initializing IPFS config: %s", err)
 		return C.int(-1)
 	}
 
@@ -80,57 +167,367 @@ func CreateRepo(repoPath *C.char) C.int {
 		cfg.Swarm.ResourceMgr.Enabled = config.False
 	}
 
+	// Apply the requested profiles, which may also change the datastore spec
+	if profileStr != "" {
+		for _, name := range strings.Split(profileStr, ",") {
+			transformer, ok := config.Profiles[strings.TrimSpace(name)]
+			if !ok {
+				logError("unknown config profile %s", name)
+				return C.int(-3)
+			}
+			if err := transformer.Transform(cfg); err != nil {
+				logError("applying config profile %s: %s", name, err)
+				return C.int(-3)
+			}
+		}
+	}
+
+	if blocksPath != "" {
+		if err := setBlocksPath(cfg, blocksPath); err != nil {
+			logError("setting blocks path: %s", err)
+			return C.int(-4)
+		}
+	}
+
+	// Encryption wraps the final datastore spec
+	if passphrase != "" {
+		if err := encryptDatastoreSpec(cfg, path, passphrase); err != nil {
+			logError("setting up repo encryption: %s", err)
+			return C.int(-1)
+		}
+	}
+
 	// Initialize the repo
 	err = fsrepo.Init(path, cfg)
 	if err != nil {
-		log.Printf("Error initializing IPFS repo: %s\n", err)
+		logError("initializing IPFS repo: %s", err)
 		return C.int(-2)
 	}
 	return C.int(1) // Success
 }
 
+// Errors opening a repo, which RunNode reports with distinct codes
+var (
+	errRepoNotInitialized = errors.New("repo not initialized")
+	errRepoLocked         = errors.New("repo is locked by another process")
+	errRepoCorrupt        = errors.New("repo is corrupt")
+	errRepoBusy           = errors.New("repo is being backed up")
+)
+
+// setBlocksPath points the blockstore of cfg's datastore spec, the "/blocks"
+// mount or otherwise the single datastore, to the absolute form of
+// blocksPath, creating its parent directory
+func setBlocksPath(cfg *config.Config, blocksPath string) error {
+	absPath, err := filepath.Abs(blocksPath)
+	if err != nil {
+		return err
+	}
+
+	spec := cfg.Datastore.Spec
+	if spec["type"] == "mount" {
+		mounts, _ := spec["mounts"].([]interface{})
+		spec = nil
+		for _, mount := range mounts {
+			if m, ok := mount.(map[string]interface{}); ok && m["mountpoint"] == "/blocks" {
+				spec = m
+				break
+			}
+		}
+		if spec == nil {
+			return fmt.Errorf("datastore has no /blocks mount")
+		}
+	}
+	// Wrappers such as "measure" keep the actual datastore as their child
+	for spec["path"] == nil {
+		child, ok := spec["child"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("blockstore of type %v has no path", spec["type"])
+		}
+		spec = child
+	}
+
+	if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+		return err
+	}
+	spec["path"] = absPath
+	return nil
+}
+
+// Whether nodes are started on uninitialized repos by creating them, with
+// which profiles (see SetAutoCreateRepo)
+var (
+	autoCreateRepo        bool
+	autoCreateRepoProfile string
+	autoCreateRepoMutex   sync.Mutex
+)
+
+// SetAutoCreateRepo sets whether starting a node on a path without a repo,
+// e.g. a fresh directory passed on first run, creates the repo like
+// CreateRepo with the given profiles instead of failing. It is off by
+// default, so a mistyped path doesn't silently get an empty repo.
+// Returns 0, or -3 for an unknown profile.
+//
+//export SetAutoCreateRepo
+func SetAutoCreateRepo(enabled C.bool, profile *C.char) C.int {
+	profileStr := C.GoString(profile)
+
+	if profileStr != "" {
+		for _, name := range strings.Split(profileStr, ",") {
+			if _, ok := config.Profiles[strings.TrimSpace(name)]; !ok {
+				logError("unknown config profile %s", name)
+				return C.int(-3)
+			}
+		}
+	}
+
+	autoCreateRepoMutex.Lock()
+	autoCreateRepo = bool(enabled)
+	autoCreateRepoProfile = profileStr
+	autoCreateRepoMutex.Unlock()
+	return C.int(0)
+}
+
+// openRepo opens the repo at path, creating it first if it doesn't exist
+// and SetAutoCreateRepo is enabled. Failures are reported as
+// errRepoNotInitialized, errRepoLocked, errRepoCorrupt or errRepoEncrypted.
+func openRepo(path string) (repo.Repo, error) {
+	if !fsrepo.IsInitialized(path) {
+		autoCreateRepoMutex.Lock()
+		create, profile := autoCreateRepo, autoCreateRepoProfile
+		autoCreateRepoMutex.Unlock()
+		if !create {
+			return nil, fmt.Errorf("%w at %s", errRepoNotInitialized, path)
+		}
+
+		log.Printf("DEBUG: Creating repo at %s\n", path)
+		if code := createRepo(path, profile, "", ""); code < 0 {
+			return nil, fmt.Errorf("%w at %s: creating it failed with code %d", errRepoNotInitialized, path, int(code))
+		}
+	}
+
+	if err := checkRepoUnlocked(path); err != nil {
+		return nil, err
+	}
+
+	r, err := fsrepo.Open(path)
+	if err != nil {
+		if locked, lockErr := fsrepo.LockedByOtherProcess(path); lockErr == nil && locked {
+			return nil, fmt.Errorf("%w: %s", errRepoLocked, err)
+		}
+		return nil, fmt.Errorf("%w: %s", errRepoCorrupt, err)
+	}
+	return r, nil
+}
+
+// repoErrorCode returns the RunNode code of an error starting a node
+func repoErrorCode(err error) C.int {
+	switch {
+	case errors.Is(err, errRepoNotInitialized):
+		return C.int(-1)
+	case errors.Is(err, errRepoLocked), errors.Is(err, errRepoBusy):
+		return C.int(-2)
+	case errors.Is(err, errRepoCorrupt):
+		return C.int(-3)
+	case errors.Is(err, errRepoEncrypted):
+		return C.int(-4)
+	}
+	return C.int(0)
+}
+
 // AcquireNode gets or creates an IPFS node, increasing its reference count
 func AcquireNode(repoPath string) (iface.CoreAPI, *core.IpfsNode, error) {
+	return acquireNode(repoPath, true, nil)
+}
+
+// acquireNode gets or creates an IPFS node, increasing its reference count.
+// The online flag only applies when a new node is created; an already
+// running node is reused as is. A non-nil identity is used instead of the
+// repo's (see RunNodeWithKey), and a running node is then only reused if it
+// has that identity.
+func acquireNode(repoPath string, online bool, identity crypto.PrivKey) (iface.CoreAPI, *core.IpfsNode, error) {
+	var id peer.ID
+	if identity != nil {
+		var err error
+		if id, err = peer.IDFromPrivateKey(identity); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	activeNodesMutex.Lock()
 	defer activeNodesMutex.Unlock()
 
 	// Check if we already have an active node for this repo
 	if nodeInfo, exists := activeNodes[repoPath]; exists {
+		if identity != nil && nodeInfo.Node.Identity != id {
+			return nil, nil, fmt.Errorf("%w %s", errNodeIdentity, nodeInfo.Node.Identity)
+		}
 		// log.Printf("DEBUG: Reusing existing node for repo %s (refcount: %d -> %d)\n",
 		// repoPath, nodeInfo.RefCount, nodeInfo.RefCount+1)
 		nodeInfo.RefCount++
+		nodeInfo.LastUsed = time.Now()
 		return nodeInfo.API, nodeInfo.Node, nil
 	}
+	if busyRepos[repoPath] {
+		return nil, nil, errRepoBusy
+	}
 
 	// Otherwise create a new node
 	// log.Printf("DEBUG: Creating new node for repo %s\n", repoPath)
-	api, node, err := createNewNode(repoPath)
+	api, node, err := createNewNode(repoPath, online, identity)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Register the new node
 	activeNodes[repoPath] = &NodeInfo{
-		API:      api,
-		Node:     node,
-		RefCount: 1,
+		API:             api,
+		Node:            node,
+		RefCount:        1,
+		LastUsed:        time.Now(),
+		Started:         time.Now(),
+		SessionIdentity: identity != nil,
 	}
 
 	return api, node, nil
 }
 
+// RunNode spawns a node on a repo, which functions called on the repo
+// afterwards reuse until it is cleaned up. Returns 1 on success, -1 if there
+// is no repo at the path (see SetAutoCreateRepo), -2 if the repo is locked
+// by another process or being backed up (see BackupRepo), -3 if it can't be opened, e.g. because its config or
+// datastore is corrupt, -4 if it is encrypted and hasn't been unlocked with
+// UnlockRepo, and 0 for other errors.
+//
 //export RunNode
 func RunNode(repoPath *C.char) C.int {
 	path := C.GoString(repoPath)
 	// Spawn a node
 	_, _, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("Error spawning node: %s\n", err)
-		return C.int(0)
+		logError("spawning node: %s", err)
+		return repoErrorCode(err)
 	}
 	return C.int(1) // Success
 }
 
+// RunNodeOffline spawns a node without any networking, for working with the
+// local blockstore and pinset only. Functions called on this repo afterwards
+// reuse the offline node until it is cleaned up. Returns the codes of RunNode.
+//
+//export RunNodeOffline
+func RunNodeOffline(repoPath *C.char) C.int {
+	path := C.GoString(repoPath)
+	// Spawn a node
+	_, _, err := acquireNode(path, false, nil)
+	if err != nil {
+		logError("spawning offline node: %s", err)
+		return repoErrorCode(err)
+	}
+	return C.int(1) // Success
+}
+
+// OpenRepoReadOnly opens a repo for inspection, without any networking.
+// Functions called on the repo afterwards, such as ListPins, ConfigGet and
+// RepoStat, reuse the offline node until it is closed with CleanupNode.
+// Nothing stops writes through the offline node; it only avoids the cost
+// and failure modes of starting an online node just to read repo data.
+//
+//export OpenRepoReadOnly
+func OpenRepoReadOnly(repoPath *C.char) C.int {
+	path := C.GoString(repoPath)
+
+	if !fsrepo.IsInitialized(path) {
+		logError("repository not initialized at %s", path)
+		return C.int(-1)
+	}
+
+	_, _, err := acquireNode(path, false, nil)
+	if err != nil {
+		logError("opening repo %s: %s", path, err)
+		return C.int(-2)
+	}
+	return C.int(0)
+}
+
+// RepoStatResult describes the size and contents of a repo
+type RepoStatResult struct {
+	RepoSize   uint64 `json:"repoSize"`
+	StorageMax uint64 `json:"storageMax"`
+	NumObjects uint64 `json:"numObjects"`
+	RepoPath   string `json:"repoPath"`
+	Version    string `json:"version"`
+}
+
+// RepoStat returns the repo's size, storage limit and number of stored
+// blocks as a RepoStatResult JSON object. Unless a node is already running on
+// the repo, an offline node is used.
+//
+//export RepoStat
+func RepoStat(repoPath *C.char) *C.char {
+	ctx := context.Background()
+	path := C.GoString(repoPath)
+
+	// Get or create a node from the registry
+	_, node, err := acquireNode(path, false, nil)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	stat, err := corerepo.RepoStat(ctx, node)
+	if err != nil {
+		logError("getting repo stat: %s", err)
+		return nil
+	}
+
+	// Convert to JSON
+	statJSON, err := json.Marshal(RepoStatResult{
+		RepoSize:   stat.RepoSize,
+		StorageMax: stat.StorageMax,
+		NumObjects: stat.NumObjects,
+		RepoPath:   stat.RepoPath,
+		Version:    stat.Version,
+	})
+	if err != nil {
+		logError("marshaling repo stat to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(statJSON))
+}
+
+// FlushRepo makes sure that everything written to the repo's datastore so far,
+// such as the blocks of content just added, is on disk, so it survives a
+// crash or abrupt shutdown from this point on. Datastores that write
+// synchronously anyway (like flatfs with sync enabled, the default) make this
+// cheap.
+//
+//export FlushRepo
+func FlushRepo(repoPath *C.char) C.int {
+	ctx := context.Background()
+	path := C.GoString(repoPath)
+
+	// Get or create a node from the registry
+	_, node, err := acquireNode(path, false, nil)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	// Syncing the root key syncs every mounted datastore
+	if err := node.Repo.Datastore().Sync(ctx, ds.NewKey("/")); err != nil {
+		logError("flushing datastore: %s", err)
+		return C.int(-2)
+	}
+
+	log.Printf("DEBUG: Flushed datastore of repo %s\n", path)
+	return C.int(0)
+}
+
 // ReleaseNode decreases the reference count for a node, closing it if no references remain
 func ReleaseNode(repoPath string) {
 	activeNodesMutex.Lock()
@@ -143,65 +540,212 @@ func ReleaseNode(repoPath string) {
 	}
 
 	nodeInfo.RefCount--
+	nodeInfo.LastUsed = time.Now()
 	// log.Printf("DEBUG: Released node for repo %s (refcount: %d)\n", repoPath, nodeInfo.RefCount)
 
-	if nodeInfo.RefCount <= 0 {
+	// With an idle timeout the reaper closes the node once it has been
+	// unused for long enough
+	if nodeInfo.RefCount <= 0 && nodeIdleTimeout == 0 {
 		log.Printf("DEBUG: Closing node for repo %s\n", repoPath)
 		nodeInfo.Node.Close()
 		delete(activeNodes, repoPath)
 	}
 }
 
-// createNewNode creates a new IPFS node (internal function)
-func createNewNode(repoPath string) (iface.CoreAPI, *core.IpfsNode, error) {
+// SetNodeIdleTimeout keeps nodes open for the given number of seconds after
+// their last reference is released, instead of closing them right away.
+// A node that is acquired again within that time is reused, which avoids
+// restarting a node between consecutive calls. Once the timeout passes, a
+// background reaper closes the node. A value of zero or less restores the
+// default, closing unreferenced nodes immediately, including any that are
+// currently idle. Nodes that still hold references are never reaped.
+//
+//export SetNodeIdleTimeout
+func SetNodeIdleTimeout(seconds C.int) C.int {
+	activeNodesMutex.Lock()
+	defer activeNodesMutex.Unlock()
+
+	if seconds <= 0 {
+		nodeIdleTimeout = 0
+		closeIdleNodes(0)
+		return C.int(0)
+	}
+
+	nodeIdleTimeout = time.Duration(seconds) * time.Second
+	reaperOnce.Do(func() { go reapIdleNodes() })
+	return C.int(0)
+}
+
+// reapIdleNodes periodically closes nodes that have been unreferenced for
+// longer than nodeIdleTimeout
+func reapIdleNodes() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		activeNodesMutex.Lock()
+		if nodeIdleTimeout > 0 {
+			closeIdleNodes(nodeIdleTimeout)
+		}
+		activeNodesMutex.Unlock()
+	}
+}
+
+// closeIdleNodes closes the nodes without references that haven't been used
+// for at least timeout. The caller must hold activeNodesMutex.
+func closeIdleNodes(timeout time.Duration) {
+	for repoPath, nodeInfo := range activeNodes {
+		if nodeInfo.RefCount <= 0 && time.Since(nodeInfo.LastUsed) >= timeout {
+			log.Printf("DEBUG: Closing idle node for repo %s\n", repoPath)
+			nodeInfo.Node.Close()
+			delete(activeNodes, repoPath)
+		}
+	}
+}
+
+// nodeRoutingOption returns the routing used by nodes started on a repo: the
+// routers in Routing.Routers if Routing.Type is "custom" (see
+// SetDelegatedRouting), and the DHT otherwise
+func nodeRoutingOption(cfg *config.Config) nodep2p.RoutingOption {
+	if cfg.Routing.Type.WithDefault("") == "custom" {
+		return nodep2p.ConstructDelegatedRouting(cfg.Routing.Routers, cfg.Routing.Methods,
+			cfg.Identity.PeerID, cfg.Addresses, cfg.Identity.PrivKey)
+	}
+	return nodep2p.DHTOption
+}
+
+// Agent version suffixes set with SetAgentVersion, indexed by repo path
+var (
+	agentSuffixes      = make(map[string]string)
+	agentSuffixesMutex sync.Mutex
+)
+
+// agentVersionMutex guards Kubo's user agent suffix, which is a process-wide
+// variable read while a node is built
+var agentVersionMutex sync.RWMutex
+
+// SetAgentVersion appends an application identifier such as "myapp/1.2" to
+// the libp2p agent version that nodes on the repo announce to their peers
+// (e.g. "kubo/0.22.0/myapp/1.2"), so that an application's nodes can be
+// told apart in peer listings. Pass an empty suffix to announce Kubo's
+// default. The suffix applies to nodes started afterwards in this process;
+// a running node keeps its agent version until it is restarted.
+// Returns -1 if the suffix contains whitespace or control characters.
+//
+//export SetAgentVersion
+func SetAgentVersion(repoPath, suffix *C.char) C.int {
+	path := C.GoString(repoPath)
+	agentSuffix := C.GoString(suffix)
+
+	if strings.IndexFunc(agentSuffix, func(r rune) bool { return r <= ' ' || r == 0x7f }) >= 0 {
+		logError("invalid agent version suffix: %q", agentSuffix)
+		return C.int(-1)
+	}
+
+	agentSuffixesMutex.Lock()
+	defer agentSuffixesMutex.Unlock()
+	if agentSuffix == "" {
+		delete(agentSuffixes, path)
+	} else {
+		agentSuffixes[path] = agentSuffix
+	}
+	return C.int(0)
+}
+
+// applyAgentSuffix sets the agent version suffix of the repo for the
+// duration of a node build, returning a function that restores the default
+// once the node is built. Builds without a suffix only share a read lock.
+func applyAgentSuffix(repoPath string) func() {
+	agentSuffixesMutex.Lock()
+	suffix := agentSuffixes[repoPath]
+	agentSuffixesMutex.Unlock()
+
+	if suffix == "" {
+		agentVersionMutex.RLock()
+		return agentVersionMutex.RUnlock
+	}
+	agentVersionMutex.Lock()
+	version.SetUserAgentSuffix(suffix)
+	return func() {
+		version.SetUserAgentSuffix("")
+		agentVersionMutex.Unlock()
+	}
+}
+
+// nodeExtraOpts returns the extra options nodes are built with, which
+// request pubsub and the p2p features (see ValidateCapabilities for which of
+// them take effect). The Android configuration avoids using the resource
+// manager.
+func nodeExtraOpts() map[string]bool {
+	opts := map[string]bool{
+		"pubsub":                 true,
+		"ipnsps":                 true,
+		"mplex":                  true,
+		"libp2p-stream-mounting": true,
+	}
+	if os.Getenv("ANDROID_ROOT") != "" || runtime.GOOS == "android" {
+		opts["disableResourceManager"] = true
+		opts["DisableResourceManager"] = true
+	}
+	return opts
+}
+
+// createNewNode creates a new IPFS node (internal function). Unless identity
+// is nil, the node uses it instead of the repo's identity.
+func createNewNode(repoPath string, online bool, identity crypto.PrivKey) (iface.CoreAPI, *core.IpfsNode, error) {
+	// Opening the repo needs the datastore plugins
+	if err := loadPlugins(); err != nil {
+		return nil, nil, fmt.Errorf("loading plugins: %w", err)
+	}
+
 	// log.Printf("DEBUG: Opening repo at %s\n", repoPath)
 	// Open the repo
-	repo, err := fsrepo.Open(repoPath)
+	fsRepo, err := openRepo(repoPath)
 	if err != nil {
-		log.Printf("ERROR: Error opening repo: %v\n", err)
+		logError("opening repo: %v", err)
 		return nil, nil, err
 	}
+	// Report datastore write errors to the callback set by SetRepoErrorCallback
+	var repo repo.Repo = newErrorReportingRepo(repoPath, fsRepo)
+	if identity != nil {
+		if repo, err = newSessionIdentityRepo(repo, identity); err != nil {
+			fsRepo.Close()
+			return nil, nil, fmt.Errorf("using session identity: %w", err)
+		}
+	}
 
-	// Create a custom build configuration based on platform
-	var nodeOptions *core.BuildCfg
+	cfg, err := repo.Config()
+	if err != nil {
+		repo.Close()
+		return nil, nil, fmt.Errorf("getting repository config: %w", err)
+	}
+	routingOption := nodeRoutingOption(cfg)
+	// Streams are throttled to the limits set with SetBandwidthLimit
+	hostOption := gatedHostOption(repoPath, throttledHostOption(repoPath))
 
 	if os.Getenv("ANDROID_ROOT") != "" || runtime.GOOS == "android" {
 		log.Printf("DEBUG: Detected Android environment, using Android-specific configuration\n")
-
-		// Android-specific configuration that avoids using resource manager
-		nodeOptions = &core.BuildCfg{
-			Online:  true,
-			Routing: nodep2p.DHTOption,
-			Repo:    repo,
-			ExtraOpts: map[string]bool{
-				"pubsub":                 true,
-				"ipnsps":                 true,
-				"mplex":                  true,
-				"libp2p-stream-mounting": true,
-				"p2p-http-proxy":         true,
-				"disableResourceManager": true,
-				"DisableResourceManager": true,
-			},
-		}
-	} else {
-		// Regular configuration for desktop
-		nodeOptions = &core.BuildCfg{
-			Online:  true,
-			Routing: nodep2p.DHTOption,
-			Repo:    repo,
-			ExtraOpts: map[string]bool{
-				"pubsub":                 true,
-				"ipnsps":                 true,
-				"mplex":                  true,
-				"libp2p-stream-mounting": true,
-				"p2p-http-proxy":         true,
-			},
-		}
+	}
+	nodeOptions := &core.BuildCfg{
+		Online:    online,
+		Routing:   routingOption,
+		Host:      hostOption,
+		Repo:      repo,
+		ExtraOpts: nodeExtraOpts(),
 	}
 
+	// The pubsub router is read from Pubsub.Router (see SetPubsubRouter), and
+	// gossipsub uses peer scoring if Pubsub.PeerScoring is set
 	// log.Printf("DEBUG: Creating new IPFS node with pubsub and p2p streaming enabled\n")
 	ctx := context.Background()
-	node, err := core.NewNode(ctx, nodeOptions)
+	restoreAgent := applyAgentSuffix(repoPath)
+	restoreScoring := applyPeerScoring(repo, cfg, online)
+	// Kubo sets the process-wide sharding threshold while building the node
+	var node *core.IpfsNode
+	buildWithSharding(func() {
+		node, err = core.NewNode(ctx, nodeOptions)
+	})
+	restoreScoring()
+	restoreAgent()
 	if err != nil {
 		log.Printf("ERROR: Error creating node: %v\n", err)
 		repo.Close()
@@ -217,26 +761,60 @@ func createNewNode(repoPath string) (iface.CoreAPI, *core.IpfsNode, error) {
 		return nil, nil, err
 	}
 
+	if online {
+		startAutoReconnect(repoPath, node)
+	}
+	logInactiveCapabilities(repoPath, nodeCapabilities(node, cfg, nodeOptions.ExtraOpts))
+
 	// log.Printf("DEBUG: Node and API created successfully\n")
 	return api, node, nil
 }
 
-// PubSubEnable enables pubsub on an IPFS node configuration
+// PubSubEnable enables pubsub in a repo's config, setting only the pubsub
+// fields: Pubsub.Enabled, and Pubsub.Router if it isn't set yet (keeping one
+// set by SetPubsubRouter). Does nothing if pubsub is already enabled, so the
+// config file is left untouched.
 //
 //export PubSubEnable
 func PubSubEnable(repoPath *C.char) C.int {
-	path := C.GoString(repoPath)
+	return enablePubsub(C.GoString(repoPath))
+}
+
+// enablePubsub implements PubSubEnable
+func enablePubsub(path string) C.int {
+	return updateRepoConfig(path, func(cfg *config.Config) error {
+		if cfg.Pubsub.Enabled.WithDefault(false) && cfg.Pubsub.Router != "" {
+			return errConfigUnchanged
+		}
+		cfg.Pubsub.Enabled = config.True
+		// Make the default router explicit
+		if cfg.Pubsub.Router == "" {
+			cfg.Pubsub.Router = "gossipsub"
+		}
+		return nil
+	})
+}
+
+// errConfigUnchanged is returned by an updateRepoConfig update function when
+// the config already has the desired values, so there is nothing to save
+var errConfigUnchanged = errors.New("config unchanged")
 
+// updateRepoConfig opens the repo at path, applies update to its config and
+// saves the result. Returns -1 if there is no repo at path, -2 or -3 if it
+// can't be opened or read, -4 if update rejected the change and -9 if the
+// config couldn't be saved. If update returns errConfigUnchanged, nothing is
+// saved and 0 is returned.
+func updateRepoConfig(path string, update func(cfg *config.Config) error) C.int {
 	// Ensure repo exists
 	if !fsrepo.IsInitialized(path) {
-		log.Printf("Error: Repository not initialized at %s\n", path)
+		logError("Repository not initialized at %s", path)
 		return C.int(-1)
 	}
 
 	// Open the repo config
 	repo, err := fsrepo.Open(path)
 	if err != nil {
-		log.Printf("Error opening repository: %s\n", err)
+		logError("opening repository: %s", err)
 		return C.int(-2)
 	}
 	defer repo.Close()
@@ -244,30 +822,100 @@ func PubSubEnable(repoPath *C.char) C.int {
 	// Get the config
 	cfg, err := repo.Config()
 	if err != nil {
-		log.Printf("Error getting repository config: %s\n", err)
+		logError("getting repository config: %s", err)
 		return C.int(-3)
 	}
 
-	// Enable experimental features
-	cfg.Experimental.Libp2pStreamMounting = true
-	cfg.Experimental.P2pHttpProxy = true
+	if err := update(cfg); err == errConfigUnchanged {
+		return C.int(0)
+	} else if err != nil {
+		logError("updating config: %s", err)
+		return C.int(-4)
+	}
+
 	if err := repo.SetConfig(cfg); err != nil {
-		log.Printf("Error setting updated config: %s\n", err)
+		logError("setting updated config: %s", err)
 		return C.int(-9)
 	}
 
-	// log.Printf("DEBUG: Updated config successfully\n")
+	return C.int(0)
+}
+
+// setRepoConfigKeys replaces the values of config keys (dotted paths such as
+// "Routing.Routers") in the repo at path. Unlike updateRepoConfig, whose
+// changes are merged into the config file, this removes map entries and
+// fields that are no longer in the new values. Return codes follow
+// updateRepoConfig, with -4 signalling an invalid value.
+func setRepoConfigKeys(path string, values map[string]interface{}) C.int {
+	// Ensure repo exists
+	if !fsrepo.IsInitialized(path) {
+		logError("Repository not initialized at %s", path)
+		return C.int(-1)
+	}
+
+	// Open the repo config
+	repo, err := fsrepo.Open(path)
+	if err != nil {
+		logError("opening repository: %s", err)
+		return C.int(-2)
+	}
+	defer repo.Close()
+
+	for key, value := range values {
+		if err := repo.SetConfigKey(key, value); err != nil {
+			logError("setting config key %s: %s", key, err)
+			return C.int(-4)
+		}
+	}
 
 	return C.int(0)
 }
 
+// readRepoConfig returns a copy of the config of the repo at path
+func readRepoConfig(path string) (*config.Config, error) {
+	if !fsrepo.IsInitialized(path) {
+		return nil, fmt.Errorf("repository not initialized at %s", path)
+	}
+
+	repo, err := fsrepo.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening repository: %w", err)
+	}
+	defer repo.Close()
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return nil, fmt.Errorf("getting repository config: %w", err)
+	}
+	return cfg.Clone()
+}
+
 //export TestGetString
 func TestGetString() *C.char {
 	// Hard-coded test string to see if this works on Android
 	return C.CString("TEST_STRING_123")
 }
 
-// GetNodeID gets the ID of the IPFS node
+// Peer IDs read from repo configs by GetNodeID, by repo path. An entry is
+// only used while the config file's modification time and size are
+// unchanged, so a repo recreated at the same path isn't given a stale ID.
+var (
+	nodeIDCache      = make(map[string]cachedNodeID)
+	nodeIDCacheMutex sync.Mutex
+)
+
+// cachedNodeID is a peer ID read from a repo config
+type cachedNodeID struct {
+	id      string
+	modTime time.Time
+	size    int64
+}
+
+// GetNodeID gets the ID of the IPFS node. That of a running node is
+// returned as is, which differs from the repo's for a node started with
+// RunNodeWithKey. Otherwise the ID is read from the repo config, without
+// starting a node, and cached; only if the config holds no valid peer ID is
+// the node acquired to read it.
 //
 //export GetNodeID
 func GetNodeID(repoPath *C.char) *C.char {
@@ -275,10 +923,24 @@ func GetNodeID(repoPath *C.char) *C.char {
 
 	path := C.GoString(repoPath)
 
+	// A running node may have a session identity (see RunNodeWithKey)
+	activeNodesMutex.Lock()
+	nodeInfo, running := activeNodes[path]
+	activeNodesMutex.Unlock()
+	if running {
+		return C.CString(nodeInfo.Node.Identity.String())
+	}
+
+	id, err := configPeerID(path)
+	if err == nil {
+		return C.CString(id)
+	}
+	log.Printf("DEBUG: Reading peer ID from config of repo %s: %s\n", path, err)
+
 	// Spawn a node
 	_, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("Error spawning node: %s\n", err)
+		logError("spawning node: %s", err)
 		log.Println("Error spawning node:")
 
 		return C.CString("")
@@ -286,13 +948,87 @@ func GetNodeID(repoPath *C.char) *C.char {
 	defer ReleaseNode(path)
 
 	// Get the node ID
-	id := node.Identity.String()
+	id = node.Identity.String()
 	// log.Println("Got Node ID")
 	// log.Println(id.ID().String())
 
 	return C.CString(id)
 }
 
+// configPeerID returns the peer ID in the config of the repo at path,
+// reading the config file directly rather than opening the repo, so it
+// works while another process holds the repo lock
+func configPeerID(path string) (string, error) {
+	configFile, err := config.Filename(path, "")
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return "", err
+	}
+
+	nodeIDCacheMutex.Lock()
+	cached, ok := nodeIDCache[path]
+	nodeIDCacheMutex.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.id, nil
+	}
+
+	var cfg struct {
+		Identity struct {
+			PeerID string
+		}
+	}
+	if err := serialize.ReadConfigFile(configFile, &cfg); err != nil {
+		return "", err
+	}
+	id, err := peer.Decode(cfg.Identity.PeerID)
+	if err != nil {
+		return "", fmt.Errorf("invalid peer ID in config: %w", err)
+	}
+
+	nodeIDCacheMutex.Lock()
+	nodeIDCache[path] = cachedNodeID{id: id.String(), modTime: info.ModTime(), size: info.Size()}
+	nodeIDCacheMutex.Unlock()
+	return id.String(), nil
+}
+
+// GetNodePublicKey gets the public key of the IPFS node, marshaled in the
+// libp2p protobuf format, so that others can verify the node's signatures
+// (e.g. with VerifyData). Peer IDs only contain the key itself for small
+// keys such as Ed25519, not for RSA keys. The length is written to outLen,
+// which is set to -1 on error (returning NULL). The returned buffer must be
+// freed with FreeBytes.
+//
+//export GetNodePublicKey
+func GetNodePublicKey(repoPath *C.char, outLen *C.int) unsafe.Pointer {
+	path := C.GoString(repoPath)
+	*outLen = C.int(-1)
+
+	// Get or create a node from the registry; the key is available offline
+	_, node, err := acquireNode(path, false, nil)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PrivateKey == nil {
+		logError("node for repo %s has no private key", path)
+		return nil
+	}
+	keyBytes, err := crypto.MarshalPublicKey(node.PrivateKey.GetPublic())
+	if err != nil {
+		logError("marshaling public key: %s", err)
+		return nil
+	}
+
+	*outLen = C.int(len(keyBytes))
+	return C.CBytes(keyBytes)
+}
+
 // GetNodeMultiAddrs gets the ID of the IPFS node
 //
 //export GetNodeMultiAddrs
@@ -304,7 +1040,7 @@ func GetNodeMultiAddrs(repoPath *C.char) *C.char {
 	// Spawn a node
 	_, node, err := AcquireNode(path)
 	if err != nil {
-		log.Printf("Error spawning node: %s\n", err)
+		logError("spawning node: %s", err)
 		log.Println("Error spawning node:")
 
 		return C.CString("")
@@ -316,14 +1052,181 @@ func GetNodeMultiAddrs(repoPath *C.char) *C.char {
 	// Convert to JSON
 	jsonData, err := json.Marshal(addresses)
 	if err != nil {
-		log.Printf("ERROR marshaling Node Addrs data: %v\n", err)
+		logError("marshaling Node Addrs data: %v", err)
 		return C.CString("")
 	}
 
 	return C.CString(string(jsonData))
 }
 
-// CleanupNode explicitly releases a node by path
+// GetNodeAddrs returns the node's addresses as a JSON array of dialable
+// multiaddrs ending in /p2p/<peer ID>, for sharing with other peers.
+// Public addresses, including observed addresses and relay addresses behind
+// NAT, are returned when the node has any. Otherwise the non-loopback
+// addresses are returned, which are only reachable on the local network.
+//
+//export GetNodeAddrs
+func GetNodeAddrs(repoPath *C.char) *C.char {
+	path := C.GoString(repoPath)
+
+	// Spawn a node
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("node for repo %s is offline", path)
+		return nil
+	}
+
+	p2pAddrs, err := shareableAddrs(node)
+	if err != nil {
+		logError("building p2p addresses: %s", err)
+		return nil
+	}
+	addrs := make([]string, len(p2pAddrs))
+	for i, addr := range p2pAddrs {
+		addrs[i] = addr.String()
+	}
+
+	// Convert to JSON
+	addrsJSON, err := json.Marshal(addrs)
+	if err != nil {
+		logError("marshaling node addresses to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(addrsJSON))
+}
+
+// LocalAddrsInfo lists the addresses a node listens on itself. Listen holds
+// the bound listen addresses, which may be unspecified like /ip4/0.0.0.0,
+// and Interfaces the same addresses expanded to the addresses of the
+// network interfaces.
+type LocalAddrsInfo struct {
+	Listen     []string `json:"listen"`
+	Interfaces []string `json:"interfaces"`
+}
+
+// LocalAddrs returns the addresses the node is listening on as a
+// LocalAddrsInfo JSON object, taken from the host's listeners, without the
+// observed and relay addresses GetNodeAddrs includes. Comparing both shows
+// whether peers see the node where it thinks it is listening.
+// Returns NULL for an offline node.
+//
+//export LocalAddrs
+func LocalAddrs(repoPath *C.char) *C.char {
+	path := C.GoString(repoPath)
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("node for repo %s is offline", path)
+		return nil
+	}
+
+	network := node.PeerHost.Network()
+	interfaceAddrs, err := network.InterfaceListenAddresses()
+	if err != nil {
+		logError("listing interface addresses: %s", err)
+		return nil
+	}
+
+	info := LocalAddrsInfo{Listen: []string{}, Interfaces: []string{}}
+	for _, addr := range network.ListenAddresses() {
+		info.Listen = append(info.Listen, addr.String())
+	}
+	for _, addr := range interfaceAddrs {
+		info.Interfaces = append(info.Interfaces, addr.String())
+	}
+
+	// Convert to JSON
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		logError("marshaling local addresses to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(infoJSON))
+}
+
+// ConnectionString returns the single address other nodes are most likely
+// to reach this node at, as a multiaddr ending in /p2p/<peer ID> that can be
+// passed straight to ConnectToPeer. Public direct addresses are preferred,
+// then relay addresses, then addresses on the local network.
+//
+//export ConnectionString
+func ConnectionString(repoPath *C.char) *C.char {
+	path := C.GoString(repoPath)
+
+	// Spawn a node
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("node for repo %s is offline", path)
+		return nil
+	}
+
+	p2pAddrs, err := shareableAddrs(node)
+	if err != nil {
+		logError("building p2p addresses: %s", err)
+		return nil
+	}
+	if len(p2pAddrs) == 0 {
+		logError("node for repo %s has no shareable addresses", path)
+		return nil
+	}
+
+	return C.CString(p2pAddrs[0].String())
+}
+
+// shareableAddrs returns the node's addresses for sharing with other peers,
+// with /p2p/<peer ID> appended and the most reachable ones first: public
+// direct addresses, then relay addresses. Addresses on the local network are
+// only returned if there are no public ones.
+func shareableAddrs(node *core.IpfsNode) ([]ma.Multiaddr, error) {
+	var direct, relayed, local []ma.Multiaddr
+	for _, addr := range node.PeerHost.Addrs() {
+		switch {
+		case manet.IsPublicAddr(addr):
+			if _, err := addr.ValueForProtocol(ma.P_CIRCUIT); err == nil {
+				relayed = append(relayed, addr)
+			} else {
+				direct = append(direct, addr)
+			}
+		case !manet.IsIPLoopback(addr):
+			local = append(local, addr)
+		}
+	}
+
+	addrs := append(direct, relayed...)
+	if len(addrs) == 0 {
+		addrs = local
+	}
+	return peer.AddrInfoToP2pAddrs(&peer.AddrInfo{ID: node.Identity, Addrs: addrs})
+}
+
+// CleanupNode closes the node running on a repo regardless of its reference
+// count, after closing the repo's p2p listeners, forwards and pubsub
+// subscriptions. Calls still using the node fail afterwards; use
+// CleanupNodeGraceful to let them finish first. ListActiveNodes shows which
+// nodes are running and how many references they hold.
+// Returns -1 if no node is running on the repo.
 //
 //export CleanupNode
 func CleanupNode(repoPath *C.char) C.int {
@@ -355,3 +1258,69 @@ func CleanupNode(repoPath *C.char) C.int {
 
 	return C.int(0)
 }
+
+// ActiveNode describes a node in the registry of running nodes
+type ActiveNode struct {
+	RepoPath      string  `json:"repoPath"`
+	RefCount      int     `json:"refCount"`
+	PeerID        string  `json:"peerId"`
+	Online        bool    `json:"online"`
+	UptimeSeconds float64 `json:"uptime"`
+	IdleSeconds   float64 `json:"idle"`
+	// SessionIdentity is true if the node doesn't use the repo's identity
+	SessionIdentity bool `json:"sessionIdentity"`
+}
+
+// ListActiveNodes returns the nodes currently running in this process as a
+// JSON array of ActiveNode, with the number of references each holds (from
+// calls in progress, RunNode, pubsub subscriptions and so on), how long it
+// has been running and how long since it was last acquired or released.
+// A node whose reference count stays above zero is never closed until
+// CleanupNode is called.
+//
+//export ListActiveNodes
+func ListActiveNodes() *C.char {
+	activeNodesMutex.Lock()
+	nodes := []ActiveNode{}
+	for repoPath, nodeInfo := range activeNodes {
+		nodes = append(nodes, ActiveNode{
+			RepoPath:        repoPath,
+			RefCount:        nodeInfo.RefCount,
+			PeerID:          nodeInfo.Node.Identity.String(),
+			Online:          nodeInfo.Node.IsOnline,
+			UptimeSeconds:   time.Since(nodeInfo.Started).Seconds(),
+			IdleSeconds:     time.Since(nodeInfo.LastUsed).Seconds(),
+			SessionIdentity: nodeInfo.SessionIdentity,
+		})
+	}
+	activeNodesMutex.Unlock()
+
+	// Convert to JSON
+	nodesJSON, err := json.Marshal(nodes)
+	if err != nil {
+		logError("marshaling active nodes to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(nodesJSON))
+}
+
+// CleanupNodeGraceful shuts down a node like CleanupNode, but first cancels
+// the repo's in-flight operations (downloads, adds and pins) and waits up to
+// graceSeconds for them to return, so that they don't keep reading from a
+// closed blockstore. The node is closed once they have returned or the grace
+// period is over, whichever comes first.
+//
+//export CleanupNodeGraceful
+func CleanupNodeGraceful(repoPath *C.char, graceSeconds C.int) C.int {
+	path := C.GoString(repoPath)
+
+	if cancelled := cancelOperations(path); cancelled > 0 {
+		log.Printf("DEBUG: Cancelled %d operations on repo %s\n", cancelled, path)
+		if !waitForOperations(path, time.Duration(graceSeconds)*time.Second) {
+			log.Printf("WARNING: Operations on repo %s still running after grace period\n", path)
+		}
+	}
+
+	return CleanupNode(repoPath)
+}
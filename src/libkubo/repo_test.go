@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/boxo/coreiface/options"
+	"github.com/ipfs/go-datastore"
+	syncds "github.com/ipfs/go-datastore/sync"
+	"github.com/ipfs/kubo/config"
+	"github.com/ipfs/kubo/core"
+	"github.com/ipfs/kubo/p2p"
+	"github.com/ipfs/kubo/repo"
+	"github.com/ipfs/kubo/repo/fsrepo"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestLoadPluginsTwice(t *testing.T) {
+	// init has already loaded the plugins once
+	for i := 0; i < 2; i++ {
+		if err := loadPlugins(); err != nil {
+			t.Fatalf("loading plugins (call %d): %s", i+1, err)
+		}
+	}
+	if plugins == nil {
+		t.Fatal("plugin loader not set")
+	}
+}
+
+// readConfigFile returns the config file of the repo at path as a map
+func readConfigFile(t *testing.T, path string) (map[string]interface{}, []byte) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(path, "config"))
+	if err != nil {
+		t.Fatalf("reading config file: %s", err)
+	}
+	var cfg map[string]interface{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("parsing config file: %s", err)
+	}
+	return cfg, data
+}
+
+func TestPubSubEnableKeepsOtherConfig(t *testing.T) {
+	path := t.TempDir()
+	ident, err := config.CreateIdentity(io.Discard, []options.KeyGenerateOption{
+		options.Key.Type(options.Ed25519Key),
+	})
+	if err != nil {
+		t.Fatalf("creating identity: %s", err)
+	}
+	cfg, err := config.InitWithIdentity(ident)
+	if err != nil {
+		t.Fatalf("creating config: %s", err)
+	}
+	if err := fsrepo.Init(path, cfg); err != nil {
+		t.Fatalf("initializing repo: %s", err)
+	}
+
+	before, _ := readConfigFile(t, path)
+	if code := enablePubsub(path); code != 0 {
+		t.Fatalf("enabling pubsub failed with code %d", code)
+	}
+	after, afterData := readConfigFile(t, path)
+
+	pubsub := after["Pubsub"].(map[string]interface{})
+	if pubsub["Enabled"] != true || pubsub["Router"] != "gossipsub" {
+		t.Fatalf("pubsub not enabled: %v", pubsub)
+	}
+
+	// Everything else must be exactly as before
+	delete(before, "Pubsub")
+	delete(after, "Pubsub")
+	beforeJSON, _ := json.Marshal(before)
+	afterJSON, _ := json.Marshal(after)
+	if !bytes.Equal(beforeJSON, afterJSON) {
+		t.Fatalf("config changed outside Pubsub:\nbefore: %s\nafter:  %s", beforeJSON, afterJSON)
+	}
+
+	// Enabling again must leave the file alone. The extra newline would be
+	// lost if the config was saved again.
+	afterData = append(afterData, '\n')
+	if err := os.WriteFile(filepath.Join(path, "config"), afterData, 0600); err != nil {
+		t.Fatalf("writing config file: %s", err)
+	}
+	if code := enablePubsub(path); code != 0 {
+		t.Fatalf("enabling pubsub again failed with code %d", code)
+	}
+	if _, againData := readConfigFile(t, path); !bytes.Equal(againData, afterData) {
+		t.Fatal("config file rewritten although pubsub was already enabled")
+	}
+}
+
+func TestConfigPeerID(t *testing.T) {
+	path := t.TempDir()
+	initRepo := func() string {
+		ident, err := config.CreateIdentity(io.Discard, []options.KeyGenerateOption{
+			options.Key.Type(options.Ed25519Key),
+		})
+		if err != nil {
+			t.Fatalf("creating identity: %s", err)
+		}
+		cfg, err := config.InitWithIdentity(ident)
+		if err != nil {
+			t.Fatalf("creating config: %s", err)
+		}
+		if err := fsrepo.Init(path, cfg); err != nil {
+			t.Fatalf("initializing repo: %s", err)
+		}
+		return ident.PeerID
+	}
+
+	want := initRepo()
+	for i := 0; i < 2; i++ {
+		if id, err := configPeerID(path); err != nil || id != want {
+			t.Fatalf("peer ID = %q (%v), want %q", id, err, want)
+		}
+	}
+
+	// A repo recreated at the same path has a new identity
+	if err := os.Remove(filepath.Join(path, "config")); err != nil {
+		t.Fatal(err)
+	}
+	want = initRepo()
+	if id, err := configPeerID(path); err != nil || id != want {
+		t.Fatalf("peer ID after recreating repo = %q (%v), want %q", id, err, want)
+	}
+
+	if _, err := configPeerID(t.TempDir()); err == nil {
+		t.Fatal("expected an error for a directory without a repo")
+	}
+}
+
+func TestOpenRepoErrors(t *testing.T) {
+	if err := loadPlugins(); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := t.TempDir()
+	if _, err := openRepo(empty); !errors.Is(err, errRepoNotInitialized) {
+		t.Fatalf("expected errRepoNotInitialized, got %v", err)
+	}
+
+	autoCreateRepoMutex.Lock()
+	autoCreateRepo = true
+	autoCreateRepoMutex.Unlock()
+	t.Cleanup(func() {
+		autoCreateRepoMutex.Lock()
+		autoCreateRepo = false
+		autoCreateRepoMutex.Unlock()
+	})
+	r, err := openRepo(empty)
+	if err != nil {
+		t.Fatalf("opening auto-created repo: %s", err)
+	}
+	r.Close()
+	if !fsrepo.IsInitialized(empty) {
+		t.Fatal("repo wasn't created")
+	}
+
+	// An initialized repo whose config can't be parsed
+	if err := os.WriteFile(filepath.Join(empty, "config"), []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openRepo(empty); !errors.Is(err, errRepoCorrupt) {
+		t.Fatalf("expected errRepoCorrupt, got %v", err)
+	}
+}
+
+func TestCreateRepoWithBlocksPath(t *testing.T) {
+	path := t.TempDir()
+	blocksPath := filepath.Join(t.TempDir(), "sd", "blocks")
+	if code := createRepo(path, "", "", blocksPath); code != 1 {
+		t.Fatalf("creating repo failed with code %d", code)
+	}
+
+	r, err := openRepo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	block := []byte("stored on the SD card")
+	key := datastore.NewKey("/blocks/CIQTESTBLOCK")
+	if err := r.Datastore().Put(context.Background(), key, block); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := os.ReadDir(blocksPath); err != nil || len(entries) == 0 {
+		t.Fatalf("expected blocks in %s, got %v (%v)", blocksPath, entries, err)
+	}
+	if _, err := os.Stat(filepath.Join(path, "blocks")); !os.IsNotExist(err) {
+		t.Fatalf("blocks directory created inside the repo (%v)", err)
+	}
+
+	// The archive of a backup couldn't hold the blocks
+	if external, err := externalDatastorePaths(path); err != nil || len(external) != 1 || external[0] != blocksPath {
+		t.Fatalf("expected %s as external datastore path, got %v (%v)", blocksPath, external, err)
+	}
+	plain := t.TempDir()
+	if code := createRepo(plain, "", "", ""); code != 1 {
+		t.Fatalf("creating repo failed with code %d", code)
+	}
+	if external, err := externalDatastorePaths(plain); err != nil || len(external) != 0 {
+		t.Fatalf("expected no external datastore paths, got %v (%v)", external, err)
+	}
+
+	// A mount without a separate blockstore can't be moved
+	cfg := &config.Config{}
+	cfg.Datastore.Spec = map[string]interface{}{"type": "mount", "mounts": []interface{}{}}
+	if err := setBlocksPath(cfg, blocksPath); err == nil {
+		t.Fatal("expected an error for a datastore without /blocks mount")
+	}
+}
+
+func TestSessionIdentityRepo(t *testing.T) {
+	stored, err := config.CreateIdentity(io.Discard, []options.KeyGenerateOption{
+		options.Key.Type(options.Ed25519Key),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := crypto.GenerateEd25519Key(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := &repo.Mock{C: config.Config{Identity: stored}, D: syncds.MutexWrap(datastore.NewMapDatastore())}
+	r, err := newSessionIdentityRepo(mock, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := core.NewNode(context.Background(), &core.BuildCfg{Repo: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	if node.Identity != id {
+		t.Fatalf("node has identity %s, expected session identity %s", node.Identity, id)
+	}
+
+	// Config changes must not store the session identity in the repo
+	cfg, err := r.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Addresses.API = []string{}
+	if err := r.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if mock.C.Identity != stored {
+		t.Fatalf("stored identity changed to %s", mock.C.Identity.PeerID)
+	}
+	if peerID, err := r.GetConfigKey("Identity.PeerID"); err != nil || peerID != id.String() {
+		t.Fatalf("expected session peer ID %s, got %v (%v)", id, peerID, err)
+	}
+}
+
+func TestNodeCapabilities(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Experimental.FilestoreEnabled = true
+
+	offline := nodeCapabilities(&core.IpfsNode{}, cfg, nodeExtraOpts())
+	if offline.Online {
+		t.Fatal("offline node reported online")
+	}
+	for _, name := range []string{"pubsub", "ipnsPubsub", "p2p"} {
+		want := Capability{Requested: true, Reason: "node is offline"}
+		if got := offline.Features[name]; got != want {
+			t.Errorf("%s: got %+v, want %+v", name, got, want)
+		}
+	}
+	if got := offline.Features["filestore"]; !got.Requested || got.Active || got.Reason == "" {
+		t.Errorf("filestore: got %+v, want requested but inactive", got)
+	}
+
+	online := nodeCapabilities(&core.IpfsNode{IsOnline: true, P2P: &p2p.P2P{}}, &config.Config{}, map[string]bool{})
+	if got := online.Features["p2p"]; got != (Capability{Active: true}) {
+		t.Errorf("p2p: got %+v, want active", got)
+	}
+	if got := online.Features["pubsub"]; got != (Capability{}) {
+		t.Errorf("pubsub: got %+v, want neither requested nor active", got)
+	}
+	if got := online.Features["filestore"]; got.Requested || got.Active {
+		t.Errorf("filestore: got %+v, want neither requested nor active", got)
+	}
+}
+
+func TestReserveIdleRepo(t *testing.T) {
+	path := t.TempDir()
+
+	release, err := reserveIdleRepo(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reserveIdleRepo(path); !errors.Is(err, errRepoBusy) {
+		t.Errorf("reserved a busy repo twice: %v", err)
+	}
+	if _, _, err := AcquireNode(path); !errors.Is(err, errRepoBusy) {
+		t.Errorf("acquired a node on a busy repo: %v", err)
+	} else if code := repoErrorCode(err); code != -2 {
+		t.Errorf("error code = %d, want -2", code)
+	}
+	// Other repos aren't blocked meanwhile
+	if other, err := reserveIdleRepo(t.TempDir()); err != nil {
+		t.Errorf("reserving another repo: %s", err)
+	} else {
+		other()
+	}
+
+	release()
+	release, err = reserveIdleRepo(path)
+	if err != nil {
+		t.Fatalf("repo still busy after release: %s", err)
+	}
+	release()
+}
@@ -0,0 +1,163 @@
+package main
+
+// #include <stdint.h>
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/kubo/repo"
+)
+
+// RepoError describes a failed datastore write, as passed to the callback
+// registered with SetRepoErrorCallback
+type RepoError struct {
+	Op    string `json:"op"`
+	Key   string `json:"key,omitempty"`
+	Error string `json:"error"`
+}
+
+// Repo error callbacks, indexed by repo path
+var (
+	repoErrorCallbacks      = make(map[string]C.uintptr_t)
+	repoErrorCallbacksMutex sync.Mutex
+)
+
+// SetRepoErrorCallback registers a callback void(char* errorJSON) that is
+// called with a RepoError whenever the datastore of the repo's node fails a
+// write, e.g. because the disk is full or permissions changed. Pass a null
+// callback to unregister. The callback may be called from any thread.
+//
+//export SetRepoErrorCallback
+func SetRepoErrorCallback(repoPath *C.char, cb C.uintptr_t) C.int {
+	path := C.GoString(repoPath)
+
+	repoErrorCallbacksMutex.Lock()
+	defer repoErrorCallbacksMutex.Unlock()
+	if cb == 0 {
+		delete(repoErrorCallbacks, path)
+	} else {
+		repoErrorCallbacks[path] = cb
+	}
+	return C.int(0)
+}
+
+// reportRepoError passes a failed datastore write to the repo's error
+// callback, if one is registered
+func reportRepoError(repoPath, op string, key ds.Key, err error) {
+	repoErrorCallbacksMutex.Lock()
+	cb, ok := repoErrorCallbacks[repoPath]
+	repoErrorCallbacksMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	repoErr := RepoError{Op: op, Error: err.Error()}
+	if key != (ds.Key{}) {
+		repoErr.Key = key.String()
+	}
+	errJSON, jsonErr := json.Marshal(repoErr)
+	if jsonErr != nil {
+		logError("marshaling repo error to JSON: %s", jsonErr)
+		return
+	}
+	callStringCallback(cb, string(errJSON))
+}
+
+// errorReportingRepo wraps a repo so that its datastore reports write errors
+type errorReportingRepo struct {
+	repo.Repo
+	datastore *errorReportingDatastore
+}
+
+// newErrorReportingRepo wraps r, reporting write errors for repoPath
+func newErrorReportingRepo(repoPath string, r repo.Repo) *errorReportingRepo {
+	return &errorReportingRepo{
+		Repo:      r,
+		datastore: &errorReportingDatastore{Batching: r.Datastore(), repoPath: repoPath},
+	}
+}
+
+// Datastore implements repo.Repo
+func (r *errorReportingRepo) Datastore() repo.Datastore {
+	return r.datastore
+}
+
+// errorReportingDatastore passes the errors of write operations to
+// reportRepoError
+type errorReportingDatastore struct {
+	ds.Batching
+	repoPath string
+}
+
+func (d *errorReportingDatastore) Put(ctx context.Context, key ds.Key, value []byte) error {
+	err := d.Batching.Put(ctx, key, value)
+	if err != nil {
+		reportRepoError(d.repoPath, "put", key, err)
+	}
+	return err
+}
+
+func (d *errorReportingDatastore) Delete(ctx context.Context, key ds.Key) error {
+	err := d.Batching.Delete(ctx, key)
+	if err != nil {
+		reportRepoError(d.repoPath, "delete", key, err)
+	}
+	return err
+}
+
+func (d *errorReportingDatastore) Sync(ctx context.Context, prefix ds.Key) error {
+	err := d.Batching.Sync(ctx, prefix)
+	if err != nil {
+		reportRepoError(d.repoPath, "sync", prefix, err)
+	}
+	return err
+}
+
+func (d *errorReportingDatastore) Batch(ctx context.Context) (ds.Batch, error) {
+	batch, err := d.Batching.Batch(ctx)
+	if err != nil {
+		reportRepoError(d.repoPath, "batch", ds.Key{}, err)
+		return nil, err
+	}
+	return &errorReportingBatch{Batch: batch, repoPath: d.repoPath}, nil
+}
+
+// DiskUsage forwards to the wrapped datastore, which the embedding hides
+func (d *errorReportingDatastore) DiskUsage(ctx context.Context) (uint64, error) {
+	return ds.DiskUsage(ctx, d.Batching)
+}
+
+// errorReportingBatch passes the errors of a batch to reportRepoError
+type errorReportingBatch struct {
+	ds.Batch
+	repoPath string
+}
+
+func (b *errorReportingBatch) Put(ctx context.Context, key ds.Key, value []byte) error {
+	err := b.Batch.Put(ctx, key, value)
+	if err != nil {
+		reportRepoError(b.repoPath, "put", key, err)
+	}
+	return err
+}
+
+func (b *errorReportingBatch) Delete(ctx context.Context, key ds.Key) error {
+	err := b.Batch.Delete(ctx, key)
+	if err != nil {
+		reportRepoError(b.repoPath, "delete", key, err)
+	}
+	return err
+}
+
+func (b *errorReportingBatch) Commit(ctx context.Context) error {
+	err := b.Batch.Commit(ctx)
+	if err != nil {
+		reportRepoError(b.repoPath, "commit", ds.Key{}, err)
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"encoding/json"
+	"math"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+)
+
+// ResourceUsage is the current usage of a resource and its limit, -1 if the
+// resource is unlimited
+type ResourceUsage struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"`
+}
+
+// ResourceReport describes the resources used by a node's connections and
+// streams, as accounted by the libp2p resource manager
+type ResourceReport struct {
+	Enabled         bool           `json:"enabled"`
+	Memory          *ResourceUsage `json:"memory,omitempty"`
+	FDs             *ResourceUsage `json:"fds,omitempty"`
+	Conns           *ResourceUsage `json:"conns,omitempty"`
+	ConnsInbound    *ResourceUsage `json:"connsInbound,omitempty"`
+	ConnsOutbound   *ResourceUsage `json:"connsOutbound,omitempty"`
+	Streams         *ResourceUsage `json:"streams,omitempty"`
+	StreamsInbound  *ResourceUsage `json:"streamsInbound,omitempty"`
+	StreamsOutbound *ResourceUsage `json:"streamsOutbound,omitempty"`
+	// Exhausted lists the resources whose limit has been reached, for which
+	// new connections or streams are rejected
+	Exhausted []string `json:"exhausted"`
+}
+
+// ResourceStats returns the current usage against the limits of the node's
+// libp2p resource manager (see SetResourceLimits) as JSON: memory, file
+// descriptors, connections and streams, each with "used" and "limit" (-1 if
+// unlimited), and "exhausted" listing those at their limit. Connections and
+// streams the resource manager rejects fail with errors that don't name
+// the cause, e.g. on devices running out of file descriptors, so apps can
+// poll this to react first, e.g. by closing connections.
+// If the resource manager is disabled, only "enabled": false is returned.
+// Returns NULL if the node couldn't be acquired or is offline.
+//
+//export ResourceStats
+func ResourceStats(repoPath *C.char) *C.char {
+	path := C.GoString(repoPath)
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PeerHost == nil {
+		logError("node for repo %s is offline", path)
+		return nil
+	}
+
+	stats := ResourceReport{Exhausted: []string{}}
+	if node.ResourceManager != nil {
+		err = node.ResourceManager.ViewSystem(func(scope network.ResourceScope) error {
+			// The null resource manager's scope has no limits
+			if limited, ok := scope.(interface{ Limit() rcmgr.Limit }); ok {
+				stats = resourceStats(scope.Stat(), limited.Limit())
+			}
+			return nil
+		})
+		if err != nil {
+			logError("viewing system resource scope: %s", err)
+			return nil
+		}
+	}
+
+	// Convert to JSON
+	jsonBytes, err := json.Marshal(stats)
+	if err != nil {
+		logError("marshaling resource stats: %s", err)
+		return nil
+	}
+	return C.CString(string(jsonBytes))
+}
+
+// resourceStats compares the usage of a resource scope with its limits
+func resourceStats(stat network.ScopeStat, limit rcmgr.Limit) ResourceReport {
+	stats := ResourceReport{Enabled: true, Exhausted: []string{}}
+	usage := func(name string, used, max int64, unlimited bool) *ResourceUsage {
+		if unlimited {
+			max = -1
+		} else if used >= max {
+			stats.Exhausted = append(stats.Exhausted, name)
+		}
+		return &ResourceUsage{Used: used, Limit: max}
+	}
+	intUsage := func(name string, used, max int) *ResourceUsage {
+		return usage(name, int64(used), int64(max), max == math.MaxInt)
+	}
+
+	stats.Memory = usage("memory", stat.Memory, limit.GetMemoryLimit(), limit.GetMemoryLimit() == math.MaxInt64)
+	stats.FDs = intUsage("fds", stat.NumFD, limit.GetFDLimit())
+	stats.Conns = intUsage("conns", stat.NumConnsInbound+stat.NumConnsOutbound, limit.GetConnTotalLimit())
+	stats.ConnsInbound = intUsage("connsInbound", stat.NumConnsInbound, limit.GetConnLimit(network.DirInbound))
+	stats.ConnsOutbound = intUsage("connsOutbound", stat.NumConnsOutbound, limit.GetConnLimit(network.DirOutbound))
+	stats.Streams = intUsage("streams", stat.NumStreamsInbound+stat.NumStreamsOutbound, limit.GetStreamTotalLimit())
+	stats.StreamsInbound = intUsage("streamsInbound", stat.NumStreamsInbound, limit.GetStreamLimit(network.DirInbound))
+	stats.StreamsOutbound = intUsage("streamsOutbound", stat.NumStreamsOutbound, limit.GetStreamLimit(network.DirOutbound))
+	return stats
+}
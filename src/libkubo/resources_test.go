@@ -0,0 +1,42 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
+)
+
+func TestResourceStats(t *testing.T) {
+	limit := &rcmgr.BaseLimit{
+		Memory:          1 << 20,
+		FD:              10,
+		Conns:           math.MaxInt,
+		ConnsInbound:    4,
+		ConnsOutbound:   math.MaxInt,
+		Streams:         math.MaxInt,
+		StreamsInbound:  math.MaxInt,
+		StreamsOutbound: math.MaxInt,
+	}
+	stats := resourceStats(network.ScopeStat{
+		NumConnsInbound:  4,
+		NumConnsOutbound: 3,
+		NumFD:            2,
+		Memory:           1024,
+	}, limit)
+
+	if !stats.Enabled {
+		t.Fatal("resource manager reported as disabled")
+	}
+	if *stats.Memory != (ResourceUsage{Used: 1024, Limit: 1 << 20}) {
+		t.Fatalf("memory = %+v", *stats.Memory)
+	}
+	if *stats.Conns != (ResourceUsage{Used: 7, Limit: -1}) {
+		t.Fatalf("conns = %+v", *stats.Conns)
+	}
+	if want := []string{"connsInbound"}; !reflect.DeepEqual(stats.Exhausted, want) {
+		t.Fatalf("exhausted = %v, want %v", stats.Exhausted, want)
+	}
+}
@@ -0,0 +1,704 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/ipfs/kubo/config"
+	"github.com/ipfs/kubo/core"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	"github.com/libp2p/go-libp2p/core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// defaultNumProviders is the number of providers looked for when no limit is
+// given, matching Kubo's `routing findprovs`
+const defaultNumProviders = 20
+
+const (
+	// preconnectSampleSize is the number of CIDs PreconnectProviders looks
+	// up providers for
+	preconnectSampleSize = 5
+	// preconnectProvidersPerCID is the number of providers PreconnectProviders
+	// looks for per sampled CID
+	preconnectProvidersPerCID = 5
+	// defaultPreconnectTimeout bounds PreconnectProviders when no timeout is
+	// given
+	defaultPreconnectTimeout = 30 * time.Second
+)
+
+// ProvideMany announces a batch of CIDs to the routing system in one go,
+// which is much faster than providing them one by one for large sets
+// (routers without batch support fall back to single provides).
+// cidsJSON is a JSON array of CID strings. CIDs that can't be parsed or
+// aren't stored locally are skipped.
+// Returns the number of CIDs announced, or a negative value on error
+//
+//export ProvideMany
+func ProvideMany(repoPath, cidsJSON *C.char) C.int {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+
+	var cids []string
+	if err := json.Unmarshal([]byte(C.GoString(cidsJSON)), &cids); err != nil {
+		logError("parsing CIDs JSON: %s", err)
+		return C.int(-1)
+	}
+	log.Printf("DEBUG: Providing %d CIDs using repo %s\n", len(cids), path)
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-2)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if !node.IsOnline || node.Routing == nil {
+		logError("cannot provide: node for repo %s is offline", path)
+		return C.int(-3)
+	}
+
+	keys := make([]mh.Multihash, 0, len(cids))
+	seen := cidlib.NewSet()
+	for _, cid := range cids {
+		decodedCid, err := cidlib.Decode(cid)
+		if err != nil {
+			log.Printf("ERROR:  decoding CID %s: %s\n", cid, err)
+			continue
+		}
+		// Providers are announced per multihash, so skip duplicates
+		if !seen.Visit(cidlib.NewCidV1(cidlib.Raw, decodedCid.Hash())) {
+			continue
+		}
+		has, err := node.Blockstore.Has(ctx, decodedCid)
+		if err != nil || !has {
+			log.Printf("ERROR:  not providing %s: block not stored locally\n", cid)
+			continue
+		}
+		keys = append(keys, decodedCid.Hash())
+	}
+
+	if len(keys) > 0 {
+		if err := node.Routing.ProvideMany(ctx, keys); err != nil {
+			logError("providing CIDs: %s", err)
+			return C.int(-4)
+		}
+	}
+
+	log.Printf("DEBUG: Provided %d CIDs\n", len(keys))
+	return C.int(len(keys))
+}
+
+// Keys of the provider system's state in the repo datastore, which boxo
+// keeps under provider.DefaultKeyPrefix
+var (
+	provideQueuePrefix = datastore.NewKey("/provider/queue")
+	lastReprovideKey   = datastore.NewKey("/provider/reprovide/lastreprovide")
+)
+
+// ProvideStats describes the provider system of a node. Queued is the number
+// of CIDs waiting to be provided. LastReprovide is the Unix time in seconds
+// the last full reprovide finished at, or null if there hasn't been one,
+// and the Last* fields describe the last reprovide run by the running node.
+type ProvideStats struct {
+	Queued                  int    `json:"queued"`
+	TotalProvides           uint64 `json:"totalProvides"`
+	AvgProvideMs            int64  `json:"avgProvideMs"`
+	LastReprovide           *int64 `json:"lastReprovide"`
+	LastReprovideBatchSize  uint64 `json:"lastReprovideBatchSize"`
+	LastReprovideDurationMs int64  `json:"lastReprovideDurationMs"`
+	ReprovideIntervalSecs   int64  `json:"reprovideIntervalSecs"`
+}
+
+// ProvideStatus returns the state of the node's provider system as a
+// ProvideStats JSON object, for telling whether provides are backed up, e.g.
+// when a large node's content isn't found by others: a queue that keeps
+// growing, or reprovides taking longer than the reprovide interval, mean
+// the node can't announce its content fast enough.
+//
+//export ProvideStatus
+func ProvideStatus(repoPath *C.char) *C.char {
+	ctx := context.Background()
+
+	path := C.GoString(repoPath)
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	stat, err := node.Provider.Stat()
+	if err != nil {
+		logError("getting provider stats: %s", err)
+		return nil
+	}
+	cfg, err := node.Repo.Config()
+	if err != nil {
+		logError("reading config: %s", err)
+		return nil
+	}
+
+	ds := node.Repo.Datastore()
+	queued, err := provideQueueLength(ctx, ds)
+	if err != nil {
+		logError("reading provide queue: %s", err)
+		return nil
+	}
+	lastReprovide, err := lastReprovideTime(ctx, ds)
+	if err != nil {
+		logError("reading last reprovide time: %s", err)
+		return nil
+	}
+
+	stats := ProvideStats{
+		Queued:                  queued,
+		TotalProvides:           stat.TotalProvides,
+		AvgProvideMs:            stat.AvgProvideDuration.Milliseconds(),
+		LastReprovideBatchSize:  stat.LastReprovideBatchSize,
+		LastReprovideDurationMs: stat.LastReprovideDuration.Milliseconds(),
+		ReprovideIntervalSecs:   int64(cfg.Reprovider.Interval.WithDefault(config.DefaultReproviderInterval).Seconds()),
+	}
+	if !lastReprovide.IsZero() {
+		unix := lastReprovide.Unix()
+		stats.LastReprovide = &unix
+	}
+
+	// Convert to JSON
+	statsJSON, err := json.Marshal(stats)
+	if err != nil {
+		logError("marshaling provide stats to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(statsJSON))
+}
+
+// provideQueueLength counts the CIDs in the provider system's queue
+func provideQueueLength(ctx context.Context, ds datastore.Datastore) (int, error) {
+	results, err := ds.Query(ctx, query.Query{Prefix: provideQueuePrefix.String(), KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+
+	queued := 0
+	for result := range results.Next() {
+		if result.Error != nil {
+			return 0, result.Error
+		}
+		queued++
+	}
+	return queued, nil
+}
+
+// lastReprovideTime returns when the last full reprovide finished, or the
+// zero time if there hasn't been one
+func lastReprovideTime(ctx context.Context, ds datastore.Datastore) (time.Time, error) {
+	value, err := ds.Get(ctx, lastReprovideKey)
+	if err == datastore.ErrNotFound {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	nanos, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parsing last reprovide time %q: %w", value, err)
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// FindProviders looks up peers providing a CID, returning them as a JSON
+// array of {"ID": ..., "Addrs": [...]} objects. The lookup stops as soon as
+// maxProviders providers have been found (20 if maxProviders <= 0) or after
+// timeOut seconds, so it doesn't wait for the whole DHT query to finish.
+//
+//export FindProviders
+func FindProviders(repoPath, cidStr *C.char, maxProviders C.int, timeOut C.int) *C.char {
+	path := C.GoString(repoPath)
+	cid := C.GoString(cidStr)
+
+	count := int(maxProviders)
+	if count <= 0 {
+		count = defaultNumProviders
+	}
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if !node.IsOnline || node.Routing == nil {
+		logError("cannot find providers: node for repo %s is offline", path)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeOut)*time.Second)
+	defer cancel()
+
+	providers := []peer.AddrInfo{}
+	for provider := range node.Routing.FindProvidersAsync(ctx, decodedCid, count) {
+		providers = append(providers, provider)
+	}
+	log.Printf("DEBUG: Found %d providers for %s\n", len(providers), cid)
+
+	// Convert to JSON
+	providersJSON, err := json.Marshal(providers)
+	if err != nil {
+		logError("marshaling providers to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(providersJSON))
+}
+
+// CanFind checks whether content is still available on the network by
+// looking for a provider of a CID other than this node, without fetching
+// anything. Returns 1 as soon as a provider is found, or 0 if none is found
+// within timeoutSeconds. Unlike HasBlock, this checks the network rather than
+// the local blockstore. Returns -2 for an invalid CID and -3 if the node is
+// offline.
+//
+//export CanFind
+func CanFind(repoPath, cidStr *C.char, timeoutSeconds C.int) C.int {
+	path := C.GoString(repoPath)
+	cid := C.GoString(cidStr)
+
+	// Parse the CID
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return C.int(-2)
+	}
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if !node.IsOnline || node.Routing == nil {
+		logError("cannot find providers: node for repo %s is offline", path)
+		return C.int(-3)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
+	// Stops the lookup once a provider is found
+	defer cancel()
+
+	// No limit, since this node's own provider record may come first
+	for provider := range node.Routing.FindProvidersAsync(ctx, decodedCid, 0) {
+		if provider.ID != node.Identity {
+			log.Printf("DEBUG: Found provider %s for %s\n", provider.ID, cid)
+			return C.int(1)
+		}
+	}
+	return C.int(0)
+}
+
+// PreconnectProviders looks up providers for a sample of the given CIDs and
+// connects to them up front, so that subsequent Downloads of the batch find
+// their blocks right away instead of each waiting for its own provider
+// search. Content that is stored together is usually provided by the same
+// peers, so a few evenly spread CIDs are enough to reach most of them.
+// cidsJSON is a JSON array of CID strings. Each provider is connected to as
+// soon as it is found, while the lookups go on; both give up after
+// timeoutSeconds (30 if timeoutSeconds <= 0).
+// Returns the number of providers connected to, -1 if the node couldn't be
+// acquired or is offline, or -2 if cidsJSON or one of its CIDs is invalid.
+//
+//export PreconnectProviders
+func PreconnectProviders(repoPath *C.char, cidsJSON *C.char, timeoutSeconds C.int) C.int {
+	path := C.GoString(repoPath)
+
+	var cidStrs []string
+	if err := json.Unmarshal([]byte(C.GoString(cidsJSON)), &cidStrs); err != nil {
+		logError("parsing CIDs JSON: %s", err)
+		return C.int(-2)
+	}
+	cids := make([]cidlib.Cid, 0, len(cidStrs))
+	for _, cid := range cidStrs {
+		decodedCid, err := cidlib.Decode(cid)
+		if err != nil {
+			logError("decoding CID %s: %s", cid, err)
+			return C.int(-2)
+		}
+		cids = append(cids, decodedCid)
+	}
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if !node.IsOnline || node.Routing == nil || node.PeerHost == nil {
+		logError("cannot find providers: node for repo %s is offline", path)
+		return C.int(-1)
+	}
+
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	if timeoutSeconds <= 0 {
+		timeout = defaultPreconnectTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Lookups can take until the deadline, so waiting for them to end
+	// before connecting would leave no time for it
+	sample := sampleCIDs(cids, preconnectSampleSize)
+	var connects sync.WaitGroup
+	var mutex sync.Mutex
+	found, connected := 0, 0
+	findProvidersOf(ctx, node, sample, preconnectProvidersPerCID, func(provider peer.AddrInfo) {
+		found++
+		connects.Add(1)
+		go func() {
+			defer connects.Done()
+			if connectToPeers(ctx, node, []peer.AddrInfo{provider}, "") > 0 {
+				mutex.Lock()
+				connected++
+				mutex.Unlock()
+			}
+		}()
+	})
+	connects.Wait()
+
+	log.Printf("DEBUG: Connected to %d of %d providers of %d sampled CIDs\n", connected, found, len(sample))
+	return C.int(connected)
+}
+
+// Bootstrap connects to the bootstrap peers in the repo's config and waits
+// until the DHT routing table has been refreshed through them, so that DHT
+// operations can be relied on right after it returns rather than only once
+// the node has bootstrapped in the background. Gives up waiting after
+// timeoutSeconds. Returns the number of bootstrap peers connected to,
+// -2 if the configured bootstrap peers are invalid, or -3 if the node is
+// offline.
+//
+//export Bootstrap
+func Bootstrap(repoPath *C.char, timeoutSeconds C.int) C.int {
+	path := C.GoString(repoPath)
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if !node.IsOnline || node.PeerHost == nil {
+		logError("cannot bootstrap: node for repo %s is offline", path)
+		return C.int(-3)
+	}
+
+	cfg, err := node.Repo.Config()
+	if err != nil {
+		logError("reading config: %s", err)
+		return C.int(-1)
+	}
+	bootstrapPeers, err := cfg.BootstrapPeers()
+	if err != nil {
+		logError("parsing bootstrap peers: %s", err)
+		return C.int(-2)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSeconds)*time.Second)
+	defer cancel()
+
+	connected := connectToPeers(ctx, node, bootstrapPeers, "")
+	log.Printf("DEBUG: Connected to %d of %d bootstrap peers\n", connected, len(bootstrapPeers))
+
+	// Fill the routing table from the peers just connected to
+	if connected > 0 && node.DHT != nil {
+		select {
+		case err := <-node.DHT.WAN.RefreshRoutingTable():
+			if err != nil {
+				log.Printf("DEBUG: Refreshing DHT routing table: %s\n", err)
+			}
+		case <-ctx.Done():
+			log.Printf("DEBUG: Timed out waiting for DHT routing table refresh\n")
+		}
+	}
+
+	return C.int(connected)
+}
+
+// DhtBucket is a group of routing table peers at the same distance from this
+// node, i.e. sharing the same number of leading bits with its DHT key
+type DhtBucket struct {
+	CommonPrefixLen int           `json:"commonPrefixLen"`
+	Peers           []DhtPeerInfo `json:"peers"`
+}
+
+// DhtPeerInfo describes a peer in a DHT routing table. LastUsefulAt is empty
+// if the peer has never been useful to a query.
+type DhtPeerInfo struct {
+	ID           string `json:"id"`
+	LastUsefulAt string `json:"lastUsefulAt,omitempty"`
+	AddedAt      string `json:"addedAt"`
+}
+
+// DhtRoutingTableInfo holds the routing tables of the WAN and LAN DHTs
+type DhtRoutingTableInfo struct {
+	WAN []DhtBucket `json:"wan"`
+	LAN []DhtBucket `json:"lan"`
+}
+
+// DhtRoutingTable returns the peers currently in the node's DHT routing
+// tables as JSON, bucketed by distance from this node, for checking whether
+// the node is able to route at all. An empty WAN table is common on fresh or
+// NAT'd nodes and explains failing content discovery.
+// Returns NULL if the node is offline or doesn't use the DHT.
+//
+//export DhtRoutingTable
+func DhtRoutingTable(repoPath *C.char) *C.char {
+	path := C.GoString(repoPath)
+
+	// Get or create a node from the registry
+	_, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if !node.IsOnline || node.DHT == nil {
+		logError("node for repo %s has no DHT", path)
+		return nil
+	}
+
+	info := DhtRoutingTableInfo{
+		WAN: routingTableBuckets(node.Identity, node.DHT.WAN.RoutingTable()),
+		LAN: routingTableBuckets(node.Identity, node.DHT.LAN.RoutingTable()),
+	}
+
+	// Convert to JSON
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		logError("marshaling routing table to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(infoJSON))
+}
+
+// routingTableBuckets groups the peers of a routing table by their common
+// prefix length with self, closest buckets last
+func routingTableBuckets(self peer.ID, rt *kb.RoutingTable) []DhtBucket {
+	selfKey := kb.ConvertPeerID(self)
+	byCpl := make(map[int][]DhtPeerInfo)
+	for _, p := range rt.GetPeerInfos() {
+		cpl := kb.CommonPrefixLen(selfKey, kb.ConvertPeerID(p.Id))
+		peerInfo := DhtPeerInfo{
+			ID:      p.Id.String(),
+			AddedAt: p.AddedAt.Format(time.RFC3339),
+		}
+		if !p.LastUsefulAt.IsZero() {
+			peerInfo.LastUsefulAt = p.LastUsefulAt.Format(time.RFC3339)
+		}
+		byCpl[cpl] = append(byCpl[cpl], peerInfo)
+	}
+
+	buckets := make([]DhtBucket, 0, len(byCpl))
+	for cpl, peers := range byCpl {
+		buckets = append(buckets, DhtBucket{CommonPrefixLen: cpl, Peers: peers})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].CommonPrefixLen < buckets[j].CommonPrefixLen
+	})
+	return buckets
+}
+
+// connectToProviders looks up to count providers of c and connects to them
+// in the background, so that Bitswap can start fetching from them without
+// waiting for its own provider search. The returned channel is closed as soon
+// as the first provider is connected, or when the lookup ends without one.
+// The lookup stops when ctx is cancelled.
+func connectToProviders(ctx context.Context, node *core.IpfsNode, c cidlib.Cid, count int) <-chan struct{} {
+	ready := make(chan struct{})
+	var readyOnce sync.Once
+	signalReady := func() { readyOnce.Do(func() { close(ready) }) }
+
+	if !node.IsOnline || node.Routing == nil || node.PeerHost == nil {
+		signalReady()
+		return ready
+	}
+
+	go func() {
+		defer signalReady()
+
+		var wg sync.WaitGroup
+		for provider := range node.Routing.FindProvidersAsync(ctx, c, count) {
+			if provider.ID == node.Identity {
+				continue
+			}
+			wg.Add(1)
+			go func(provider peer.AddrInfo) {
+				defer wg.Done()
+				if err := node.PeerHost.Connect(ctx, provider); err != nil {
+					log.Printf("DEBUG: Could not connect to provider %s: %s\n", provider.ID, err)
+					return
+				}
+				log.Printf("DEBUG: Connected to provider %s\n", provider.ID)
+				signalReady()
+			}(provider)
+		}
+		wg.Wait()
+	}()
+
+	return ready
+}
+
+// parsePeerHints decodes a JSON array of peers, each given either as a
+// multiaddr ending in /p2p/<id> or as a bare peer ID, whose addresses are
+// then left to peer routing. Addresses of the same peer are merged.
+func parsePeerHints(peersJSON string) ([]peer.AddrInfo, error) {
+	var peerStrs []string
+	if err := json.Unmarshal([]byte(peersJSON), &peerStrs); err != nil {
+		return nil, fmt.Errorf("parsing peers JSON: %w", err)
+	}
+
+	var addrs []ma.Multiaddr
+	var ids []peer.AddrInfo
+	for _, peerStr := range peerStrs {
+		if id, err := peer.Decode(peerStr); err == nil {
+			ids = append(ids, peer.AddrInfo{ID: id})
+			continue
+		}
+		maddr, err := ma.NewMultiaddr(peerStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer %q: %w", peerStr, err)
+		}
+		addrs = append(addrs, maddr)
+	}
+
+	infos, err := peer.AddrInfosFromP2pAddrs(addrs...)
+	if err != nil {
+		return nil, err
+	}
+	return append(infos, ids...), nil
+}
+
+// connectToPeers connects to the given peers in parallel and protects the
+// connections under tag, so the connection manager doesn't trim them while
+// they are in use. An empty tag leaves the connections unprotected.
+// Returns the number of peers connected to.
+func connectToPeers(ctx context.Context, node *core.IpfsNode, peers []peer.AddrInfo, tag string) int {
+	if !node.IsOnline || node.PeerHost == nil {
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	connected := 0
+	for _, info := range peers {
+		if info.ID == node.Identity {
+			continue
+		}
+		wg.Add(1)
+		go func(info peer.AddrInfo) {
+			defer wg.Done()
+			if err := node.PeerHost.Connect(ctx, info); err != nil {
+				log.Printf("DEBUG: Could not connect to peer %s: %s\n", info.ID, err)
+				return
+			}
+			if tag != "" {
+				node.PeerHost.ConnManager().Protect(info.ID, tag)
+			}
+			mutex.Lock()
+			connected++
+			mutex.Unlock()
+		}(info)
+	}
+	wg.Wait()
+	return connected
+}
+
+// sampleCIDs picks up to n CIDs spread evenly over cids, skipping duplicates
+func sampleCIDs(cids []cidlib.Cid, n int) []cidlib.Cid {
+	seen := cidlib.NewSet()
+	var unique []cidlib.Cid
+	for _, c := range cids {
+		if seen.Visit(c) {
+			unique = append(unique, c)
+		}
+	}
+	if len(unique) <= n {
+		return unique
+	}
+
+	sample := make([]cidlib.Cid, 0, n)
+	for i := 0; i < n; i++ {
+		sample = append(sample, unique[i*len(unique)/n])
+	}
+	return sample
+}
+
+// findProvidersOf looks up to count providers of each of the CIDs in
+// parallel, passing each distinct provider other than the node itself to
+// found as soon as it is found, and returns once all lookups have ended or
+// ctx is done. Calls to found are serialized.
+func findProvidersOf(ctx context.Context, node *core.IpfsNode, cids []cidlib.Cid, count int, found func(peer.AddrInfo)) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	seen := make(map[peer.ID]bool)
+	for _, c := range cids {
+		wg.Add(1)
+		go func(c cidlib.Cid) {
+			defer wg.Done()
+			for provider := range node.Routing.FindProvidersAsync(ctx, c, count) {
+				if provider.ID == node.Identity {
+					continue
+				}
+				mutex.Lock()
+				if !seen[provider.ID] {
+					seen[provider.ID] = true
+					found(provider)
+				}
+				mutex.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+}
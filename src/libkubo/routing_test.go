@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	cidlib "github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	mh "github.com/multiformats/go-multihash"
+)
+
+func TestSampleCIDs(t *testing.T) {
+	var cids []cidlib.Cid
+	for i := 0; i < 10; i++ {
+		hash, err := mh.Sum([]byte{byte(i)}, mh.SHA2_256, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cids = append(cids, cidlib.NewCidV1(cidlib.Raw, hash))
+	}
+
+	if sample := sampleCIDs(append(cids[:3:3], cids[0]), 5); !reflect.DeepEqual(sample, cids[:3]) {
+		t.Fatalf("sample of 3 CIDs = %v, want %v", sample, cids[:3])
+	}
+	want := []cidlib.Cid{cids[0], cids[2], cids[4], cids[6], cids[8]}
+	if sample := sampleCIDs(cids, 5); !reflect.DeepEqual(sample, want) {
+		t.Fatalf("sample of 10 CIDs = %v, want %v", sample, want)
+	}
+}
+
+func TestProvideStatus(t *testing.T) {
+	ctx := context.Background()
+	ds := datastore.NewMapDatastore()
+
+	if last, err := lastReprovideTime(ctx, ds); err != nil || !last.IsZero() {
+		t.Fatalf("last reprovide = %v, %v; want none", last, err)
+	}
+	for i, c := range []string{"bafkqaaa", "bafkqaab"} {
+		key := provideQueuePrefix.ChildString(fmt.Sprintf("%020d", i)).ChildString(c)
+		if err := ds.Put(ctx, key, []byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	finished := time.Unix(1700000000, 0)
+	if err := ds.Put(ctx, lastReprovideKey, []byte(strconv.FormatInt(finished.UnixNano(), 10))); err != nil {
+		t.Fatal(err)
+	}
+
+	if queued, err := provideQueueLength(ctx, ds); err != nil || queued != 2 {
+		t.Fatalf("queued = %d, %v; want 2", queued, err)
+	}
+	if last, err := lastReprovideTime(ctx, ds); err != nil || !last.Equal(finished) {
+		t.Fatalf("last reprovide = %v, %v; want %v", last, err, finished)
+	}
+}
+
+func TestFindProvidersViaIndexer(t *testing.T) {
+	ctx := context.Background()
+	c, err := cidlib.Decode("bafkreigh2akiscaildcqabsyg3dfr6chu3fgpregiymsck7e7aqa4s52zy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const provider = "12D3KooWD3eckifWpRn9wQpMG9R9hX3sD158z7EqHWmweQAJU5SA"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/routing/v1/providers/"+c.String() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"Providers": [
+			{"Protocol": "transport-bitswap", "Schema": "bitswap", "ID": %[1]q, "Addrs": ["/ip4/1.2.3.4/tcp/4001"]},
+			{"Protocol": "transport-graphsync-filecoinv1", "Schema": "graphsync-filecoinv1", "ID": %[1]q},
+			{"Protocol": "transport-bitswap", "Schema": "bitswap", "ID": %[1]q, "Addrs": ["/ip4/1.2.3.4/udp/4001/quic-v1"]}
+		]}`, provider)
+	}))
+	defer server.Close()
+
+	providers, err := findProvidersViaIndexer(ctx, server.URL+"/", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) != 1 || providers[0].ID.String() != provider || len(providers[0].Addrs) != 2 {
+		t.Fatalf("unexpected providers %v", providers)
+	}
+
+	// Unindexed CIDs have no providers
+	other, err := cidlib.Decode("bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if providers, err := findProvidersViaIndexer(ctx, server.URL, other); err != nil || len(providers) != 0 {
+		t.Fatalf("expected no providers, got %v (%v)", providers, err)
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+// #include <stdlib.h>
+// #include <stdbool.h>
+import "C"
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+
+	"github.com/ipfs/boxo/bitswap"
+	iface "github.com/ipfs/boxo/coreiface"
+	"github.com/ipfs/boxo/coreiface/options"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	cidlib "github.com/ipfs/go-cid"
+	version "github.com/ipfs/kubo"
+	"github.com/ipfs/kubo/core"
+	"github.com/ipfs/kubo/core/corerepo"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// rpcRequest holds the positional arguments and options of an RpcCommand
+// call, as passed to the same command of Kubo's RPC API
+type rpcRequest struct {
+	Args    []string               `json:"args"`
+	Options map[string]interface{} `json:"options"`
+}
+
+// rpcCommand is a command RpcCommand dispatches to. Commands that change the
+// repo or the node's connections are mutating.
+type rpcCommand struct {
+	mutating bool
+	minArgs  int
+	run      func(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error)
+}
+
+// rpcCommands are the commands available through RpcCommand, by their path
+// in Kubo's command tree. They are implemented here on the CoreAPI rather
+// than by Kubo's commands, so their responses are this library's own, listed
+// in RpcCommand's doc.
+var rpcCommands = map[string]rpcCommand{
+	"id":                 {run: rpcID},
+	"version":            {run: rpcVersion},
+	"diag/sys":           {run: rpcDiagSys},
+	"stats/bw":           {run: rpcStatsBw},
+	"stats/bitswap":      {run: rpcBitswapStat},
+	"stats/dht":          {run: rpcStatsDht},
+	"stats/repo":         {run: rpcRepoStat},
+	"repo/stat":          {run: rpcRepoStat},
+	"bitswap/stat":       {run: rpcBitswapStat},
+	"bitswap/wantlist":   {run: rpcBitswapWantlist},
+	"bitswap/ledger":     {run: rpcBitswapLedger, minArgs: 1},
+	"swarm/peers":        {run: rpcSwarmPeers},
+	"swarm/addrs/local":  {run: rpcSwarmAddrsLocal},
+	"swarm/addrs/listen": {run: rpcSwarmAddrsListen},
+	"pin/ls":             {run: rpcPinLs},
+	"key/list":           {run: rpcKeyList},
+	"name/resolve":       {run: rpcNameResolve, minArgs: 1},
+	"resolve":            {run: rpcResolve, minArgs: 1},
+	"block/stat":         {run: rpcBlockStat, minArgs: 1},
+	"refs/local":         {run: rpcRefsLocal},
+
+	"pin/add":          {run: rpcPinAdd, minArgs: 1, mutating: true},
+	"pin/rm":           {run: rpcPinRm, minArgs: 1, mutating: true},
+	"swarm/connect":    {run: rpcSwarmConnect, minArgs: 1, mutating: true},
+	"swarm/disconnect": {run: rpcSwarmDisconnect, minArgs: 1, mutating: true},
+	"name/publish":     {run: rpcNamePublish, minArgs: 1, mutating: true},
+	"routing/provide":  {run: rpcRoutingProvide, minArgs: 1, mutating: true},
+	"repo/gc":          {run: rpcRepoGC, mutating: true},
+}
+
+// RpcCommand runs a command of Kubo's RPC API against the repo's node and
+// returns its response as JSON, as a fallback for commands without a
+// dedicated function. commandPath is the command's path, e.g. "stats/dht" or
+// "stats dht". argsJSON is an optional JSON object with the command's
+// positional "args" (an array of strings) and its "options" (an object), as
+// in {"args": ["/ipns/example.com"], "options": {"key": "self"}}.
+// Only read-only commands run unless allowMutating is set; pinning,
+// connecting, publishing, providing and garbage collection need it.
+//
+// The commands are reimplemented by this library rather than run by Kubo,
+// so only the options listed are supported, and while many responses use
+// the field names of Kubo's, none is guaranteed to match it. Responses:
+//   - id: {"ID", "PublicKey" (base64 protobuf), "Addresses", "Protocols"}
+//   - version: {"Version", "Commit", "Repo", "System", "Golang"}
+//   - diag/sys: {"ipfs_version", "ipfs_commit", "system": {"os", "arch",
+//     "numcpu", "numgoroutines", "compiler", "runtime"}, "net": {"online"}}
+//   - stats/bw: {"TotalIn", "TotalOut", "RateIn", "RateOut"}
+//   - stats/bitswap, bitswap/stat: {"Wantlist", "Peers", "BlocksReceived",
+//     "DataReceived", "DupBlksReceived", "DupDataReceived",
+//     "MessagesReceived", "BlocksSent", "DataSent", "ProvideBufLen"}
+//   - bitswap/wantlist: {"Keys": [{"/": cid}]}
+//   - bitswap/ledger <peer>: {"Peer", "Value", "Sent", "Recv", "Exchanged"}
+//   - stats/dht: the DhtRoutingTableInfo of DhtRoutingTable
+//   - stats/repo, repo/stat: {"RepoSize", "StorageMax", "NumObjects",
+//     "RepoPath", "Version"}
+//   - swarm/peers: {"Peers": [{"Addr", "Peer", "Direction"}]}
+//   - swarm/addrs/local, swarm/addrs/listen: {"Strings": [multiaddr]}
+//   - pin/ls (option "type"): {"Keys": {cid: {"Type"}}}
+//   - key/list: {"Keys": [{"Name", "Id"}]}
+//   - name/resolve <name>, resolve <path>: {"Path"}
+//   - block/stat <path>: {"Key", "Size"}
+//   - refs/local: [{"Ref"}]
+//   - pin/add <path>, pin/rm <path> (option "recursive"): {"Pins": [cid]}
+//   - swarm/connect <multiaddr>, swarm/disconnect <multiaddr>:
+//     {"Strings": [message]}
+//   - name/publish <path> (option "key"): {"Name", "Value"}
+//   - routing/provide <cid>: {"Strings": [cid]}
+//   - repo/gc: [{"Key"} or {"Error"}]
+//
+// Returns NULL for unknown or disallowed commands and failed commands.
+//
+//export RpcCommand
+func RpcCommand(repoPath, commandPath, argsJSON *C.char, allowMutating C.bool) *C.char {
+	ctx, endOp := beginOperation(C.GoString(repoPath))
+	defer endOp()
+	path := C.GoString(repoPath)
+
+	name := strings.Join(strings.FieldsFunc(C.GoString(commandPath), func(r rune) bool {
+		return r == '/' || r == ' '
+	}), "/")
+	command, ok := rpcCommands[name]
+	if !ok {
+		logError("unknown or unsupported command: %s", name)
+		return nil
+	}
+	if command.mutating && !bool(allowMutating) {
+		logError("command %s changes the node and needs allowMutating", name)
+		return nil
+	}
+
+	var req rpcRequest
+	if argsStr := C.GoString(argsJSON); argsStr != "" {
+		if err := json.Unmarshal([]byte(argsStr), &req); err != nil {
+			logError("parsing command arguments JSON: %s", err)
+			return nil
+		}
+	}
+	if len(req.Args) < command.minArgs {
+		logError("command %s needs %d arguments", name, command.minArgs)
+		return nil
+	}
+
+	// Get or create a node from the registry
+	api, node, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	log.Printf("DEBUG: Running command %s using repo %s\n", name, path)
+	result, err := command.run(ctx, api, node, req)
+	if err != nil {
+		logError("running command %s: %s", name, err)
+		return nil
+	}
+
+	// Convert to JSON
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logError("marshaling command response to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(resultJSON))
+}
+
+// stringOption returns a string option of the request, or def if unset
+func (r rpcRequest) stringOption(name, def string) string {
+	if value, ok := r.Options[name]; ok {
+		return fmt.Sprint(value)
+	}
+	return def
+}
+
+// boolOption returns a boolean option of the request, or def if unset
+func (r rpcRequest) boolOption(name string, def bool) bool {
+	switch value := r.Options[name].(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+	return def
+}
+
+// errOffline is returned by commands that need a running node
+var errOffline = errors.New("this command requires the node to be online")
+
+// nodeBitswap returns the node's Bitswap instance
+func nodeBitswap(node *core.IpfsNode) (*bitswap.Bitswap, error) {
+	bs, ok := node.Exchange.(*bitswap.Bitswap)
+	if !ok {
+		return nil, errOffline
+	}
+	return bs, nil
+}
+
+// stringsResponse is the response of commands returning a list of strings
+type stringsResponse struct {
+	Strings []string
+}
+
+func rpcID(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	pubKey, err := crypto.MarshalPublicKey(node.PrivateKey.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{}
+	if node.PeerHost != nil {
+		for _, addr := range node.PeerHost.Addrs() {
+			addrs = append(addrs, fmt.Sprintf("%s/p2p/%s", addr, node.Identity))
+		}
+	}
+	protocols := []string{}
+	if node.PeerHost != nil {
+		for _, p := range node.PeerHost.Mux().Protocols() {
+			protocols = append(protocols, string(p))
+		}
+	}
+	return struct {
+		ID        string
+		PublicKey []byte
+		Addresses []string
+		Protocols []string
+	}{node.Identity.String(), pubKey, addrs, protocols}, nil
+}
+
+func rpcVersion(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	return version.GetVersionInfo(), nil
+}
+
+func rpcDiagSys(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	return map[string]interface{}{
+		"ipfs_version": version.CurrentVersionNumber,
+		"ipfs_commit":  version.CurrentCommit,
+		"system": map[string]interface{}{
+			"os":            runtime.GOOS,
+			"arch":          runtime.GOARCH,
+			"numcpu":        runtime.NumCPU(),
+			"numgoroutines": runtime.NumGoroutine(),
+			"compiler":      runtime.Compiler,
+			"runtime":       runtime.Version(),
+		},
+		"net": map[string]interface{}{
+			"online": node.IsOnline,
+		},
+	}, nil
+}
+
+func rpcStatsBw(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	if node.Reporter == nil {
+		return nil, errOffline
+	}
+	return node.Reporter.GetBandwidthTotals(), nil
+}
+
+func rpcBitswapStat(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	bs, err := nodeBitswap(node)
+	if err != nil {
+		return nil, err
+	}
+	return bs.Stat()
+}
+
+func rpcBitswapWantlist(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	bs, err := nodeBitswap(node)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ Keys []cidlib.Cid }{bs.GetWantlist()}, nil
+}
+
+func rpcBitswapLedger(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	pid, err := peer.Decode(req.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	bs, err := nodeBitswap(node)
+	if err != nil {
+		return nil, err
+	}
+	return bs.LedgerForPeer(pid), nil
+}
+
+func rpcStatsDht(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	if !node.IsOnline || node.DHT == nil {
+		return nil, errOffline
+	}
+	return DhtRoutingTableInfo{
+		WAN: routingTableBuckets(node.Identity, node.DHT.WAN.RoutingTable()),
+		LAN: routingTableBuckets(node.Identity, node.DHT.LAN.RoutingTable()),
+	}, nil
+}
+
+func rpcRepoStat(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	return corerepo.RepoStat(ctx, node)
+}
+
+func rpcSwarmPeers(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	conns, err := api.Swarm().Peers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	type connInfo struct {
+		Addr      string
+		Peer      string
+		Direction int
+	}
+	peers := []connInfo{}
+	for _, conn := range conns {
+		peers = append(peers, connInfo{
+			Addr:      conn.Address().String(),
+			Peer:      conn.ID().String(),
+			Direction: int(conn.Direction()),
+		})
+	}
+	return struct{ Peers []connInfo }{peers}, nil
+}
+
+func rpcSwarmAddrsLocal(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	addrs, err := api.Swarm().LocalAddrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response := stringsResponse{Strings: []string{}}
+	for _, addr := range addrs {
+		response.Strings = append(response.Strings, addr.String())
+	}
+	return response, nil
+}
+
+func rpcSwarmAddrsListen(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	addrs, err := api.Swarm().ListenAddrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response := stringsResponse{Strings: []string{}}
+	for _, addr := range addrs {
+		response.Strings = append(response.Strings, addr.String())
+	}
+	return response, nil
+}
+
+func rpcPinLs(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	typeOption, err := options.Pin.Ls.Type(req.stringOption("type", "all"))
+	if err != nil {
+		return nil, err
+	}
+	pinCh, err := api.Pin().Ls(ctx, typeOption)
+	if err != nil {
+		return nil, err
+	}
+	type pinInfo struct{ Type string }
+	keys := map[string]pinInfo{}
+	for pin := range pinCh {
+		if err := pin.Err(); err != nil {
+			return nil, err
+		}
+		keys[pin.Path().Cid().String()] = pinInfo{Type: pin.Type()}
+	}
+	return struct{ Keys map[string]pinInfo }{keys}, nil
+}
+
+func rpcKeyList(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	keys, err := api.Key().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	type keyInfo struct{ Name, Id string }
+	list := []keyInfo{}
+	for _, key := range keys {
+		list = append(list, keyInfo{Name: key.Name(), Id: key.ID().String()})
+	}
+	return struct{ Keys []keyInfo }{list}, nil
+}
+
+func rpcNameResolve(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	resolved, err := api.Name().Resolve(ctx, req.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	return struct{ Path string }{resolved.String()}, nil
+}
+
+func rpcResolve(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	resolved, err := api.ResolvePath(ctx, ipath.New(req.Args[0]))
+	if err != nil {
+		return nil, err
+	}
+	return struct{ Path string }{resolved.String()}, nil
+}
+
+func rpcBlockStat(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	stat, err := api.Block().Stat(ctx, ipath.New(req.Args[0]))
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Key  string
+		Size int
+	}{stat.Path().Cid().String(), stat.Size()}, nil
+}
+
+func rpcRefsLocal(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	keys, err := node.Blockstore.AllKeysChan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	type refInfo struct{ Ref string }
+	refs := []refInfo{}
+	for key := range keys {
+		refs = append(refs, refInfo{Ref: key.String()})
+	}
+	return refs, nil
+}
+
+func rpcPinAdd(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	p := ipath.New(req.Args[0])
+	if err := api.Pin().Add(ctx, p, options.Pin.Recursive(req.boolOption("recursive", true))); err != nil {
+		return nil, err
+	}
+	resolved, err := api.ResolvePath(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ Pins []string }{[]string{resolved.Cid().String()}}, nil
+}
+
+func rpcPinRm(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	p := ipath.New(req.Args[0])
+	resolved, err := api.ResolvePath(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if err := api.Pin().Rm(ctx, p, options.Pin.RmRecursive(req.boolOption("recursive", true))); err != nil {
+		return nil, err
+	}
+	if err := forgetPin(ctx, node.Repo.Datastore(), resolved.Cid()); err != nil {
+		log.Printf("ERROR:  removing pin name and metadata: %s\n", err)
+	}
+	return struct{ Pins []string }{[]string{resolved.Cid().String()}}, nil
+}
+
+func rpcSwarmConnect(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	info, err := peer.AddrInfoFromString(req.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := api.Swarm().Connect(ctx, *info); err != nil {
+		return nil, err
+	}
+	return stringsResponse{Strings: []string{fmt.Sprintf("connect %s success", info.ID)}}, nil
+}
+
+func rpcSwarmDisconnect(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	info, err := peer.AddrInfoFromString(req.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	if node.PeerHost == nil {
+		return nil, errOffline
+	}
+	if err := node.PeerHost.Network().ClosePeer(info.ID); err != nil {
+		return nil, err
+	}
+	return stringsResponse{Strings: []string{fmt.Sprintf("disconnect %s success", info.ID)}}, nil
+}
+
+func rpcNamePublish(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	value := ipath.New(req.Args[0])
+	name, err := api.Name().Publish(ctx, value, options.Name.Key(req.stringOption("key", "self")))
+	if err != nil {
+		return nil, err
+	}
+	return struct{ Name, Value string }{name.String(), value.String()}, nil
+}
+
+func rpcRoutingProvide(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	c, err := cidlib.Decode(req.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := api.Dht().Provide(ctx, ipath.IpfsPath(c)); err != nil {
+		return nil, err
+	}
+	return stringsResponse{Strings: []string{c.String()}}, nil
+}
+
+func rpcRepoGC(ctx context.Context, api iface.CoreAPI, node *core.IpfsNode, req rpcRequest) (interface{}, error) {
+	type gcResult struct {
+		Key   string `json:",omitempty"`
+		Error string `json:",omitempty"`
+	}
+	results := []gcResult{}
+	for result := range corerepo.GarbageCollectAsync(node, ctx) {
+		if result.Error != nil {
+			results = append(results, gcResult{Error: result.Error.Error()})
+			continue
+		}
+		results = append(results, gcResult{Key: result.KeyRemoved.String()})
+	}
+	return results, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	iface "github.com/ipfs/boxo/coreiface"
+	"github.com/ipfs/boxo/coreiface/options"
+	ipath "github.com/ipfs/boxo/coreiface/path"
+	"github.com/ipfs/boxo/files"
+)
+
+// selfTestBlobSize is the size of the random blob written by SelfTest
+const selfTestBlobSize = 4096
+
+// SelfTestStep describes the outcome of one step of a self-test
+type SelfTestStep struct {
+	Name       string  `json:"name"`
+	Success    bool    `json:"success"`
+	DurationMs float64 `json:"durationMs"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// SelfTestResult describes the outcome of a self-test
+type SelfTestResult struct {
+	Success bool           `json:"success"`
+	CID     string         `json:"cid,omitempty"`
+	Steps   []SelfTestStep `json:"steps"`
+}
+
+// SelfTest checks that the node for a repo works by adding a small random
+// blob, pinning it, reading it back, comparing the bytes and unpinning it.
+// Everything runs offline, so no peers are needed. Returns a SelfTestResult
+// as JSON, with a step named "node" reporting if the node couldn't be started.
+//
+//export SelfTest
+func SelfTest(repoPath *C.char) *C.char {
+	ctx := context.Background()
+	path := C.GoString(repoPath)
+
+	log.Printf("DEBUG: Running self-test on repo %s\n", path)
+
+	var result SelfTestResult
+	start := time.Now()
+	api, _, err := acquireNode(path, false, nil)
+	if err == nil {
+		defer ReleaseNode(path)
+		// Keep an already running online node off the network too
+		api, err = api.WithOptions(options.Api.Offline(true))
+	}
+	if err != nil {
+		result.Steps = append(result.Steps, selfTestStep("node", start, err))
+	} else {
+		result = runSelfTest(ctx, api)
+	}
+
+	// Convert to JSON
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logError("marshaling self-test result to JSON: %s", err)
+		return nil
+	}
+
+	return C.CString(string(resultJSON))
+}
+
+// runSelfTest performs the self-test steps, stopping at the first failure
+// except that the unpin step runs whenever the pin step succeeded
+func runSelfTest(ctx context.Context, api iface.CoreAPI) SelfTestResult {
+	var result SelfTestResult
+
+	blob := make([]byte, selfTestBlobSize)
+	if _, err := rand.Read(blob); err != nil {
+		result.Steps = append(result.Steps, selfTestStep("add", time.Now(), err))
+		return result
+	}
+
+	// step runs one step, recording its outcome and duration
+	step := func(name string, fn func() error) bool {
+		start := time.Now()
+		err := fn()
+		result.Steps = append(result.Steps, selfTestStep(name, start, err))
+		return err == nil
+	}
+
+	var resolved ipath.Resolved
+	if !step("add", func() error {
+		var err error
+		resolved, err = api.Unixfs().Add(ctx, files.NewBytesFile(blob), options.Unixfs.Pin(false))
+		return err
+	}) {
+		return result
+	}
+	result.CID = resolved.Cid().String()
+
+	if !step("pin", func() error {
+		return api.Pin().Add(ctx, resolved)
+	}) {
+		return result
+	}
+
+	readOK := step("get", func() error {
+		node, err := api.Unixfs().Get(ctx, resolved)
+		if err != nil {
+			return err
+		}
+		defer node.Close()
+		file, ok := node.(files.File)
+		if !ok {
+			return fmt.Errorf("expected a file, got %T", node)
+		}
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, blob) {
+			return fmt.Errorf("read back %d bytes that differ from the %d bytes added", len(data), len(blob))
+		}
+		return nil
+	})
+
+	unpinOK := step("unpin", func() error {
+		return api.Pin().Rm(ctx, resolved)
+	})
+
+	result.Success = readOK && unpinOK
+	return result
+}
+
+// selfTestStep records the outcome of a step that started at start
+func selfTestStep(name string, start time.Time, err error) SelfTestStep {
+	s := SelfTestStep{
+		Name:       name,
+		Success:    err == nil,
+		DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
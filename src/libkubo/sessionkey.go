@@ -0,0 +1,140 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"encoding/base64"
+	"errors"
+	"unsafe"
+
+	iface "github.com/ipfs/boxo/coreiface"
+	"github.com/ipfs/kubo/config"
+	"github.com/ipfs/kubo/core"
+	"github.com/ipfs/kubo/repo"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// errNodeIdentity is returned by AcquireNodeWithKey if a node with another
+// identity is already running on the repo
+var errNodeIdentity = errors.New("node is running with another identity")
+
+// RunNodeWithKey spawns a node on a repo like RunNode, but with the libp2p
+// private key privKey (marshaled in the libp2p protobuf format, like
+// GetNodePublicKey's keys) as its identity instead of the one stored in the
+// repo, e.g. to use a fresh network identity per session. The key is only
+// kept in memory and never written to the repo.
+//
+// Peers and the DHT only see the session identity, but the repo's content
+// is still shared: anything provided or served from the repo can link the
+// session to others using the same repo. IPNS names published with "self"
+// are the session identity's, not the repo's; the repo's own name can't be
+// published from such a node. Peers that peer with or look up the repo's
+// stored peer ID won't find the node, and content the repo's identity
+// provided before isn't reachable through the session identity until it is
+// reprovided.
+//
+// The node is registered, reused and cleaned up like any other; functions
+// called on the repo afterwards use it. Returns the codes of RunNode, -5 if
+// privKey can't be parsed and -6 if a node with another identity is already
+// running on the repo.
+//
+//export RunNodeWithKey
+func RunNodeWithKey(repoPath *C.char, privKey unsafe.Pointer, keyLen C.int) C.int {
+	path := C.GoString(repoPath)
+	keyBytes := C.GoBytes(privKey, keyLen)
+
+	key, err := crypto.UnmarshalPrivateKey(keyBytes)
+	if err != nil {
+		logError("parsing private key: %s", err)
+		return C.int(-5)
+	}
+
+	// Spawn a node
+	_, _, err = AcquireNodeWithKey(path, key)
+	if err != nil {
+		logError("spawning node: %s", err)
+		if errors.Is(err, errNodeIdentity) {
+			return C.int(-6)
+		}
+		return repoErrorCode(err)
+	}
+	return C.int(1) // Success
+}
+
+// AcquireNodeWithKey gets or creates an online IPFS node using key as its
+// identity, increasing its reference count. A node already running on the
+// repo is only reused if it has the same identity.
+func AcquireNodeWithKey(repoPath string, key crypto.PrivKey) (iface.CoreAPI, *core.IpfsNode, error) {
+	return acquireNode(repoPath, true, key)
+}
+
+// sessionIdentityRepo presents a repo's config with another identity, which
+// is never written back to the repo
+type sessionIdentityRepo struct {
+	repo.Repo
+	identity config.Identity
+}
+
+// newSessionIdentityRepo wraps r, giving it the identity of key
+func newSessionIdentityRepo(r repo.Repo, key crypto.PrivKey) (*sessionIdentityRepo, error) {
+	id, err := peer.IDFromPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := crypto.MarshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionIdentityRepo{
+		Repo: r,
+		identity: config.Identity{
+			PeerID:  id.String(),
+			PrivKey: base64.StdEncoding.EncodeToString(keyBytes),
+		},
+	}, nil
+}
+
+// Config implements repo.Repo, returning a copy of the config with the
+// session identity
+func (r *sessionIdentityRepo) Config() (*config.Config, error) {
+	cfg, err := r.Repo.Config()
+	if err != nil {
+		return nil, err
+	}
+	cfg, err = cfg.Clone()
+	if err != nil {
+		return nil, err
+	}
+	cfg.Identity = r.identity
+	return cfg, nil
+}
+
+// SetConfig implements repo.Repo, keeping the repo's stored identity
+func (r *sessionIdentityRepo) SetConfig(updated *config.Config) error {
+	stored, err := r.Repo.Config()
+	if err != nil {
+		return err
+	}
+	cfg, err := updated.Clone()
+	if err != nil {
+		return err
+	}
+	cfg.Identity = stored.Identity
+	return r.Repo.SetConfig(cfg)
+}
+
+// GetConfigKey implements repo.Repo, reading identity keys from the session
+// identity
+func (r *sessionIdentityRepo) GetConfigKey(key string) (interface{}, error) {
+	switch key {
+	case "Identity":
+		return r.identity, nil
+	case "Identity.PeerID":
+		return r.identity.PeerID, nil
+	case "Identity.PrivKey":
+		return r.identity.PrivKey, nil
+	}
+	return r.Repo.GetConfigKey(key)
+}
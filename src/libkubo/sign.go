@@ -0,0 +1,96 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// signaturePrefix is prepended to data before it is signed, so that
+// signatures made for applications can't be passed off as signatures of
+// libp2p or IPFS records, which the same key signs
+const signaturePrefix = "libkubo-signed-data:"
+
+// SignData signs data with the private key of the IPFS node, so that others
+// can check with VerifyData that it comes from this node, without the key
+// ever leaving the library. The signature covers signaturePrefix followed by
+// the data. Its length is written to outLen, which is set to -1 on error
+// (returning NULL). The returned buffer must be freed with FreeBytes.
+//
+//export SignData
+func SignData(repoPath *C.char, data unsafe.Pointer, dataLen C.int, outLen *C.int) unsafe.Pointer {
+	path := C.GoString(repoPath)
+	*outLen = C.int(-1)
+
+	// Get or create a node from the registry; the key is available offline
+	_, node, err := acquireNode(path, false, nil)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return nil
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	if node.PrivateKey == nil {
+		logError("node for repo %s has no private key", path)
+		return nil
+	}
+	signature, err := node.PrivateKey.Sign(signedData(C.GoBytes(data, dataLen)))
+	if err != nil {
+		logError("signing data: %s", err)
+		return nil
+	}
+
+	*outLen = C.int(len(signature))
+	return C.CBytes(signature)
+}
+
+// VerifyData checks a signature made with SignData by the node with the given
+// peer ID. The public key is taken from the peer ID where it is contained in
+// it (e.g. Ed25519 keys); otherwise, as for RSA keys, it must be passed as
+// pubKey in the format returned by GetNodePublicKey. A passed key must belong
+// to the peer ID. Returns 1 if the signature is valid and 0 if it isn't, -1
+// for an invalid peer ID and -2 if no matching public key is available.
+//
+//export VerifyData
+func VerifyData(peerID *C.char, data unsafe.Pointer, dataLen C.int, sig unsafe.Pointer, sigLen C.int, pubKey unsafe.Pointer, pubKeyLen C.int) C.int {
+	pid, err := peer.Decode(C.GoString(peerID))
+	if err != nil {
+		logError("decoding peer ID: %s", err)
+		return C.int(-1)
+	}
+
+	var key crypto.PubKey
+	if pubKey != nil && pubKeyLen > 0 {
+		key, err = crypto.UnmarshalPublicKey(C.GoBytes(pubKey, pubKeyLen))
+		if err != nil {
+			logError("decoding public key: %s", err)
+			return C.int(-2)
+		}
+		if !pid.MatchesPublicKey(key) {
+			logError("public key doesn't belong to peer %s", pid)
+			return C.int(-2)
+		}
+	} else {
+		key, err = pid.ExtractPublicKey()
+		if err != nil {
+			logError("peer ID %s doesn't contain its public key: %s", pid, err)
+			return C.int(-2)
+		}
+	}
+
+	valid, err := key.Verify(signedData(C.GoBytes(data, dataLen)), C.GoBytes(sig, sigLen))
+	if err != nil || !valid {
+		return C.int(0)
+	}
+	return C.int(1)
+}
+
+// signedData returns the bytes a signature of data covers
+func signedData(data []byte) []byte {
+	return append([]byte(signaturePrefix), data...)
+}
@@ -0,0 +1,208 @@
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	iface "github.com/ipfs/boxo/coreiface"
+	dag "github.com/ipfs/boxo/ipld/merkledag"
+	ft "github.com/ipfs/boxo/ipld/unixfs"
+	cidlib "github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// VerifyDownload checks that a file or directory on disk, e.g. one written
+// by Download, hashes back to cidStr. The add options the CID was created
+// with (CID version, hash function, raw leaves and fixed-size chunks) are
+// read from its DAG, and the local path is added with them in hash-only
+// mode, once with the balanced and once with the trickle layout. Unlike
+// Download's verify option, this also catches extra files in directories.
+// DAGs made with rabin chunking, inlining or Unixfs metadata can't be
+// reproduced and never match.
+// Returns 0 if the local path matches, -1 if the node couldn't be acquired,
+// -2 if the CID is invalid or its DAG can't be read, -3 if the local path
+// can't be hashed and -4 if it doesn't match.
+//
+//export VerifyDownload
+func VerifyDownload(repoPath, cidStr, localPath *C.char) C.int {
+	path := C.GoString(repoPath)
+	ctx, endOp := beginOperation(path)
+	defer endOp()
+	cid := C.GoString(cidStr)
+	local := C.GoString(localPath)
+
+	decodedCid, err := cidlib.Decode(cid)
+	if err != nil {
+		logError("decoding CID: %s", err)
+		return C.int(-2)
+	}
+	if _, err := os.Lstat(local); err != nil {
+		logError("%s", err)
+		return C.int(-3)
+	}
+
+	// Get or create a node from the registry
+	api, _, err := AcquireNode(path)
+	if err != nil {
+		logError("acquiring node: %s", err)
+		return C.int(-1)
+	}
+	// Release the node when done (decreases reference count)
+	defer ReleaseNode(path)
+
+	opts, err := inferAddOptions(ctx, api.Dag(), decodedCid)
+	if err != nil {
+		logError("reading add options from DAG of %s: %s", cid, err)
+		return C.int(-2)
+	}
+
+	matched, err := rehashMatches(ctx, api, local, decodedCid, opts)
+	if err != nil {
+		logError("hashing %s: %s", local, err)
+		return C.int(-3)
+	}
+	if !matched {
+		logError("%s doesn't hash to %s", local, cid)
+		return C.int(-4)
+	}
+
+	log.Printf("DEBUG: %s matches %s\n", local, cid)
+	return C.int(0)
+}
+
+// rehashMatches adds localPath in hash-only mode with opts, with both the
+// balanced and the trickle layout, and reports whether either yields c
+func rehashMatches(ctx context.Context, api iface.CoreAPI, localPath string, c cidlib.Cid, opts AddOptions) (bool, error) {
+	opts.OnlyHash = true
+	for _, trickle := range []bool{false, true} {
+		opts.Trickle = trickle
+		hashed, err := addPath(ctx, api, localPath, opts)
+		if err != nil {
+			return false, err
+		}
+		if hashed == c.String() {
+			return true, nil
+		}
+		log.Printf("DEBUG: %s hashes to %s with trickle layout %v\n", localPath, hashed, trickle)
+	}
+	return false, nil
+}
+
+// inferAddOptions reads the add options that created the Unixfs DAG at c
+// from its blocks: the CID version and hash function of the root, whether
+// file leaves are raw blocks and the chunk size of the first file that
+// spans several chunks. Options that leave no trace (e.g. the default chunk
+// size of single-chunk files) are left at their defaults.
+func inferAddOptions(ctx context.Context, dagService ipld.DAGService, c cidlib.Cid) (AddOptions, error) {
+	hashName, ok := mh.Codes[c.Prefix().MhType]
+	if !ok {
+		return AddOptions{}, fmt.Errorf("unknown hash function %d", c.Prefix().MhType)
+	}
+	cidVersion := int(c.Version())
+	opts := AddOptions{CidVersion: &cidVersion, HashFunction: hashName}
+
+	var (
+		rawLeaves *bool
+		chunkSize int
+	)
+	// walk visits the DAG depth first until a file spanning several chunks
+	// has been found
+	var walk func(c cidlib.Cid) error
+	walk = func(c cidlib.Cid) error {
+		if c.Type() == cidlib.Raw {
+			// A single-chunk file
+			raw := true
+			if rawLeaves == nil {
+				rawLeaves = &raw
+			}
+			return nil
+		}
+		nd, err := dagService.Get(ctx, c)
+		if err != nil {
+			return err
+		}
+		pbNode, ok := nd.(*dag.ProtoNode)
+		if !ok {
+			return fmt.Errorf("%s is not a Unixfs node", c)
+		}
+		fsNode, err := ft.FSNodeFromBytes(pbNode.Data())
+		if err != nil {
+			return fmt.Errorf("%s is not a Unixfs node: %w", c, err)
+		}
+
+		switch fsNode.Type() {
+		case ft.TDirectory, ft.THAMTShard:
+			for _, link := range pbNode.Links() {
+				if err := walk(link.Cid); err != nil {
+					return err
+				}
+				if chunkSize > 0 {
+					return nil
+				}
+			}
+		case ft.TFile, ft.TRaw:
+			if len(pbNode.Links()) == 0 {
+				raw := false
+				if rawLeaves == nil {
+					rawLeaves = &raw
+				}
+				return nil
+			}
+			raw, size, err := firstLeaf(ctx, dagService, pbNode)
+			if err != nil {
+				return err
+			}
+			rawLeaves = &raw
+			// The trickle layout also links single chunks from a file node
+			if len(pbNode.Links()) > 1 {
+				chunkSize = size
+			}
+		}
+		return nil
+	}
+	if err := walk(c); err != nil {
+		return AddOptions{}, err
+	}
+
+	opts.RawLeaves = rawLeaves
+	if chunkSize > 0 {
+		opts.Chunker = fmt.Sprintf("size-%d", chunkSize)
+	}
+	return opts, nil
+}
+
+// firstLeaf follows the first links of a chunked Unixfs file down to its
+// first chunk, returning whether it is a raw block and its size
+func firstLeaf(ctx context.Context, dagService ipld.DAGService, file *dag.ProtoNode) (bool, int, error) {
+	nd := ipld.Node(file)
+	for {
+		links := nd.Links()
+		if len(links) == 0 {
+			break
+		}
+		next, err := dagService.Get(ctx, links[0].Cid)
+		if err != nil {
+			return false, 0, err
+		}
+		nd = next
+	}
+
+	switch leaf := nd.(type) {
+	case *dag.RawNode:
+		return true, len(leaf.RawData()), nil
+	case *dag.ProtoNode:
+		fsNode, err := ft.FSNodeFromBytes(leaf.Data())
+		if err != nil {
+			return false, 0, err
+		}
+		return false, len(fsNode.Data()), nil
+	default:
+		return false, 0, fmt.Errorf("unexpected file chunk type %T", nd)
+	}
+}